@@ -0,0 +1,151 @@
+package csvdir
+
+// general stuff:
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/yql"
+)
+
+// Reads the (Date, value) rows of a symbol's optional `SYMBOL.<kind>.csv` file ordered by descending date.
+// The value is taken from the first column that is not "Date".
+func (p *Provider) readActions(symbol, kind string) (rows [][2]string, err error) {
+	path := filepath.Join(p.Dir, strings.ToUpper(symbol)+"."+kind+".csv")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return [][2]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return [][2]string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	dateIdx, valueIdx := -1, -1
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), "Date") {
+			dateIdx = i
+		} else if valueIdx < 0 {
+			valueIdx = i
+		}
+	}
+	if dateIdx < 0 || valueIdx < 0 {
+		return nil, fmt.Errorf("%s: expected a 'Date' column and a value column", path)
+	}
+
+	rows = make([][2]string, 0, 16)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		if _, err := time.Parse(dateFmt, rec[dateIdx]); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		rows = append(rows, [2]string{rec[dateIdx], strings.TrimSpace(rec[valueIdx])})
+	}
+
+	sort.Sort(actionsByDateDesc(rows))
+	return rows, nil
+}
+
+// Sortable list of (Date, value) rows:
+type actionsByDateDesc [][2]string
+
+func (l actionsByDateDesc) Len() int           { return len(l) }
+func (l actionsByDateDesc) Less(i, j int) bool { return l[i][0] > l[j][0] }
+func (l actionsByDateDesc) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Gets all cash dividends for a symbol with ex-dates between startDate and endDate (inclusive), ordered by descending date.
+func (p *Provider) GetDividends(symbol string, startDate, endDate time.Time) (dividends []yql.Dividend, err error) {
+	rows, err := p.readActions(symbol, "dividends")
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := startDate.Format(dateFmt), endDate.Format(dateFmt)
+	dividends = make([]yql.Dividend, 0, len(rows))
+	for _, row := range rows {
+		if row[0] < start || row[0] > end {
+			continue
+		}
+
+		amount, err := yql.ParsePrice(strings.ToUpper(symbol), "Dividends", row[1])
+		if err != nil {
+			return nil, err
+		}
+		dividends = append(dividends, yql.Dividend{
+			Symbol: strings.ToUpper(symbol),
+			Date:   row[0],
+			Amount: amount.FloatString(6),
+		})
+	}
+
+	return dividends, nil
+}
+
+// Gets all stock splits for a symbol between startDate and endDate (inclusive), ordered by descending date.
+func (p *Provider) GetSplits(symbol string, startDate, endDate time.Time) (splits []yql.Split, err error) {
+	rows, err := p.readActions(symbol, "splits")
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := startDate.Format(dateFmt), endDate.Format(dateFmt)
+	splits = make([]yql.Split, 0, len(rows))
+	for _, row := range rows {
+		if row[0] < start || row[0] > end {
+			continue
+		}
+
+		num, den, err := yql.ParseSplitRatio(row[1])
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, yql.Split{
+			Symbol:      strings.ToUpper(symbol),
+			Date:        row[0],
+			Numerator:   num,
+			Denominator: den,
+		})
+	}
+
+	return splits, nil
+}
+
+// Gets all cash dividends for a symbol between startDate and endDate unless `ctx` is already done.
+func (p *Provider) GetDividendsContext(ctx context.Context, symbol string, startDate, endDate time.Time) (dividends []yql.Dividend, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return p.GetDividends(symbol, startDate, endDate)
+}
+
+// Gets all stock splits for a symbol between startDate and endDate unless `ctx` is already done.
+func (p *Provider) GetSplitsContext(ctx context.Context, symbol string, startDate, endDate time.Time) (splits []yql.Split, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return p.GetSplits(symbol, startDate, endDate)
+}
@@ -0,0 +1,216 @@
+// Offline quote provider backed by a directory of per-symbol CSV files.
+package csvdir
+
+// general stuff:
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/yql"
+)
+
+const dateFmt = "2006-01-02"
+
+// Columns required in each CSV file's header row (any order, case-insensitive; extra columns are ignored):
+var requiredColumns = []string{"Date", "Open", "High", "Low", "Close", "Volume"}
+
+// Provider reads daily trading history and current quotes from a directory of CSV files
+// named after their symbol, e.g. `MSFT.csv`, in the same layout as Yahoo's historical
+// prices download:
+//
+//	Date,Open,High,Low,Close,Volume
+//	2013-12-20,36.20,36.93,36.19,36.80,62649100
+//
+// Rows may appear in any order. The "current" quote for a symbol is the closing price of its latest row;
+// its day range and volume come from that row too and its previous close from the row before it.
+//
+// Dividends and splits are read from optional `MSFT.dividends.csv` and `MSFT.splits.csv` files:
+//
+//	Date,Dividends
+//	2013-11-19,0.28
+//
+//	Date,Stock Splits
+//	2003-02-18,2:1
+type Provider struct {
+	Dir string
+}
+
+// Creates a provider reading CSV files from `dir`.
+func New(dir string) *Provider {
+	return &Provider{Dir: dir}
+}
+
+// Reads all rows of a symbol's CSV file ordered by descending date.
+// A missing file yields no rows rather than an error, same as YQL does for unknown symbols.
+func (p *Provider) readSymbol(symbol string) (rows []yql.History, err error) {
+	path := filepath.Join(p.Dir, strings.ToUpper(symbol)+".csv")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []yql.History{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+
+	// Map column names to their positions:
+	header, err := r.Read()
+	if err == io.EOF {
+		return []yql.History{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	idx := make([]int, 0, len(requiredColumns))
+	for _, name := range requiredColumns {
+		i, ok := cols[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("%s: missing required column '%s'", path, name)
+		}
+		idx = append(idx, i)
+	}
+
+	rows = make([]yql.History, 0, 260)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		h := yql.History{
+			Symbol: strings.ToUpper(symbol),
+			Date:   rec[idx[0]],
+			Open:   rec[idx[1]],
+			High:   rec[idx[2]],
+			Low:    rec[idx[3]],
+			Close:  rec[idx[4]],
+			Volume: rec[idx[5]],
+		}
+		if _, err := time.Parse(dateFmt, h.Date); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		rows = append(rows, h)
+	}
+
+	// YQL reports dates in descending order; dates in `dateFmt` sort lexically:
+	sort.Sort(byDateDesc(rows))
+	return rows, nil
+}
+
+// Parses an optional price column; non-numbers yield nil.
+func parseOptional(value string) *big.Rat {
+	r, err := yql.ParsePrice("", "", value)
+	if err != nil {
+		return nil
+	}
+	return r
+}
+
+// Sortable list of history rows:
+type byDateDesc []yql.History
+
+func (l byDateDesc) Len() int           { return len(l) }
+func (l byDateDesc) Less(i, j int) bool { return l[i].Date > l[j].Date }
+func (l byDateDesc) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Gets the current trading prices for a set of symbols.
+// Symbols without a CSV file are left out of the results; symbols whose latest close is not a number
+// are left out and reported in a `yql.PriceErrors` error.
+func (p *Provider) GetQuotes(symbols ...string) (quotes []yql.Quote, err error) {
+	quotes = make([]yql.Quote, 0, len(symbols))
+	rejected := yql.PriceErrors(nil)
+	for _, symbol := range symbols {
+		rows, err := p.readSymbol(symbol)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		price, err := yql.ParsePrice(rows[0].Symbol, "Close", rows[0].Close)
+		if err != nil {
+			rejected = append(rejected, err.(*yql.PriceError))
+			continue
+		}
+		quote := yql.Quote{
+			Symbol:  rows[0].Symbol,
+			Price:   price,
+			DayHigh: parseOptional(rows[0].High),
+			DayLow:  parseOptional(rows[0].Low),
+		}
+		if v, ok := new(big.Int).SetString(rows[0].Volume, 10); ok {
+			quote.Volume = v
+		}
+		if len(rows) > 1 {
+			quote.PreviousClose = parseOptional(rows[1].Close)
+		}
+		if quote.PreviousClose != nil && quote.PreviousClose.Sign() != 0 {
+			// chg% = ((price / prevClose) - 1) * 100
+			chg := new(big.Rat).Quo(price, quote.PreviousClose)
+			chg.Sub(chg, big.NewRat(1, 1))
+			quote.ChangePercent = chg.Mul(chg, big.NewRat(100, 1))
+		}
+		quotes = append(quotes, quote)
+	}
+
+	if len(rejected) > 0 {
+		return quotes, rejected
+	}
+	return quotes, nil
+}
+
+// Gets all historical data for a symbol between startDate and endDate (inclusive), ordered by descending date.
+func (p *Provider) GetHistory(symbol string, startDate, endDate time.Time) (results []yql.History, err error) {
+	rows, err := p.readSymbol(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := startDate.Format(dateFmt), endDate.Format(dateFmt)
+	results = make([]yql.History, 0, len(rows))
+	for _, h := range rows {
+		if h.Date < start || h.Date > end {
+			continue
+		}
+		results = append(results, h)
+	}
+
+	return results, nil
+}
+
+// Reading local files is quick, so the context variants only check `ctx` before starting:
+
+// Gets the current trading prices for a set of symbols unless `ctx` is already done.
+func (p *Provider) GetQuotesContext(ctx context.Context, symbols ...string) (quotes []yql.Quote, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return p.GetQuotes(symbols...)
+}
+
+// Gets all historical data for a symbol between startDate and endDate unless `ctx` is already done.
+func (p *Provider) GetHistoryContext(ctx context.Context, symbol string, startDate, endDate time.Time) (results []yql.History, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return p.GetHistory(symbol, startDate, endDate)
+}
@@ -0,0 +1,145 @@
+package csvdir
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const testDir = "./testdata"
+
+func TestGetHistory(t *testing.T) {
+	p := New(testDir)
+
+	startDate, _ := time.Parse(dateFmt, "2013-12-17")
+	endDate, _ := time.Parse(dateFmt, "2013-12-19")
+	hist, err := p.GetHistory("MSFT", startDate, endDate)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	// Expect inclusive range in descending date order:
+	expected := []string{"2013-12-19", "2013-12-18", "2013-12-17"}
+	if len(hist) != len(expected) {
+		t.Fatalf("expected %d rows; got %d", len(expected), len(hist))
+		return
+	}
+	for i, h := range hist {
+		if h.Date != expected[i] {
+			t.Fatalf("row %d: expected date %s; got %s", i, expected[i], h.Date)
+		}
+		if h.Symbol != "MSFT" {
+			t.Fatalf("row %d: expected symbol MSFT; got %s", i, h.Symbol)
+		}
+	}
+	if hist[0].Close != "36.25" || hist[0].Volume != "42773200" {
+		t.Fatalf("unexpected values: %+v", hist[0])
+	}
+
+	fmt.Println(hist)
+}
+
+func TestGetHistoryMissingSymbol(t *testing.T) {
+	p := New(testDir)
+
+	hist, err := p.GetHistory("NOPE", time.Now().AddDate(-1, 0, 0), time.Now())
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(hist) != 0 {
+		t.Fatalf("expected no rows; got %d", len(hist))
+	}
+}
+
+func TestGetHistoryMissingColumn(t *testing.T) {
+	p := New(testDir)
+
+	_, err := p.GetHistory("BAD", time.Now().AddDate(-1, 0, 0), time.Now())
+	if err == nil {
+		t.Fatal("expected error for missing Close column")
+	}
+}
+
+func TestGetQuotes(t *testing.T) {
+	p := New(testDir)
+
+	quotes, err := p.GetQuotes("MSFT", "NOPE")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(quotes) != 1 {
+		t.Fatalf("expected 1 quote; got %d", len(quotes))
+		return
+	}
+
+	// Latest row's close is the current price:
+	q := quotes[0]
+	if q.Symbol != "MSFT" || q.Price.FloatString(2) != "36.80" {
+		t.Fatalf("unexpected quote: %+v", q)
+	}
+
+	// Day range and volume from the latest row; previous close from the row before:
+	if q.DayHigh.FloatString(2) != "36.93" || q.DayLow.FloatString(2) != "36.19" || q.Volume.String() != "62649100" {
+		t.Fatalf("unexpected day range or volume: %+v", q)
+	}
+	if q.PreviousClose.FloatString(2) != "36.25" || q.ChangePercent.FloatString(2) != "1.52" {
+		t.Fatalf("unexpected change: %+v", q)
+	}
+	if q.Bid != nil || q.Ask != nil {
+		t.Fatalf("expected no bid/ask: %+v", q)
+	}
+
+	fmt.Printf("quotes: %+v\n", quotes)
+}
+
+func TestGetDividends(t *testing.T) {
+	p := New(testDir)
+
+	startDate, _ := time.Parse(dateFmt, "2013-09-01")
+	endDate, _ := time.Parse(dateFmt, "2013-12-31")
+	dividends, err := p.GetDividends("MSFT", startDate, endDate)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(dividends) != 1 {
+		t.Fatalf("expected 1 dividend; got %d", len(dividends))
+		return
+	}
+	if d := dividends[0]; d.Symbol != "MSFT" || d.Date != "2013-11-19" || d.Amount != "0.280000" {
+		t.Fatalf("unexpected dividend: %+v", d)
+	}
+
+	// No file means no dividends:
+	dividends, err = p.GetDividends("NOPE", startDate, endDate)
+	if err != nil || len(dividends) != 0 {
+		t.Fatalf("expected no dividends; got %+v, %v", dividends, err)
+	}
+}
+
+func TestGetSplits(t *testing.T) {
+	p := New(testDir)
+
+	startDate, _ := time.Parse(dateFmt, "1990-01-01")
+	endDate, _ := time.Parse(dateFmt, "2013-12-31")
+	splits, err := p.GetSplits("MSFT", startDate, endDate)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	// Both "2:1" and "2/1" ratios are accepted; latest first:
+	if len(splits) != 2 {
+		t.Fatalf("expected 2 splits; got %d", len(splits))
+		return
+	}
+	if s := splits[0]; s.Date != "2003-02-18" || s.Numerator != 2 || s.Denominator != 1 {
+		t.Fatalf("unexpected split: %+v", s)
+	}
+	if s := splits[1]; s.Date != "1999-03-29" || s.Numerator != 2 || s.Denominator != 1 {
+		t.Fatalf("unexpected split: %+v", s)
+	}
+}
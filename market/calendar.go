@@ -0,0 +1,292 @@
+// Exchange trading calendars: holidays, early closes and session times.
+package market
+
+// general stuff:
+import (
+	"time"
+)
+
+// Get the New York location for stock timezone:
+var LocNY, _ = time.LoadLocation("America/New_York")
+
+// A calendar date as (year, month, day):
+type date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+// Returns the holidays (date -> name) observed in a year.
+type holidayRule func(year int) map[date]string
+
+// TradingCalendar knows which dates an exchange is open and its session open and close times on those dates.
+// A date argument means the calendar date of the `time.Time` in its own location, so convert the current time
+// with `t.In(c.Loc)` first. Dates returned are midnight in `Loc` and session times are constructed in that
+// location so they are correct on either side of DST changes.
+type TradingCalendar struct {
+	Name string
+	Loc  *time.Location
+
+	// Regular session open and close as offsets from midnight:
+	Open       time.Duration
+	Close      time.Duration
+	EarlyClose time.Duration
+
+	// Extended-hours trading windows as offsets from midnight:
+	PreMarketOpen   time.Duration
+	AfterHoursClose time.Duration
+
+	holidays    holidayRule
+	earlyCloses holidayRule
+	// One-off closures, e.g. for weather or national days of mourning:
+	closures map[date]string
+}
+
+// The New York Stock Exchange calendar.
+var NYSE = &TradingCalendar{
+	Name:       "NYSE",
+	Loc:        LocNY,
+	Open:       time.Duration(9)*time.Hour + time.Duration(30)*time.Minute,
+	Close:      time.Duration(16) * time.Hour,
+	EarlyClose: time.Duration(13) * time.Hour,
+
+	PreMarketOpen:   time.Duration(4) * time.Hour,
+	AfterHoursClose: time.Duration(20) * time.Hour,
+
+	holidays:    nyseHolidays,
+	earlyCloses: nyseEarlyCloses,
+	closures: map[date]string{
+		{2001, time.September, 11}: "September 11",
+		{2001, time.September, 12}: "September 11",
+		{2001, time.September, 13}: "September 11",
+		{2001, time.September, 14}: "September 11",
+		{2004, time.June, 11}:      "President Reagan's funeral",
+		{2007, time.January, 2}:    "President Ford's funeral",
+		{2012, time.October, 29}:   "Hurricane Sandy",
+		{2012, time.October, 30}:   "Hurricane Sandy",
+		{2018, time.December, 5}:   "President Bush's funeral",
+		{2025, time.January, 9}:    "President Carter's funeral",
+	},
+}
+
+func toDate(t time.Time) date {
+	y, m, d := t.Date()
+	return date{y, m, d}
+}
+
+// Midnight of the date in the calendar's location:
+func (c *TradingCalendar) midnight(d date) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, c.Loc)
+}
+
+// Gets the date truncated to midnight in the calendar's location.
+func (c *TradingCalendar) Date(t time.Time) time.Time {
+	return c.midnight(toDate(t))
+}
+
+// Adds a number of calendar days to a date; DST-safe unlike adding multiples of 24 hours.
+func (c *TradingCalendar) AddDays(t time.Time, days int) time.Time {
+	d := toDate(t)
+	return time.Date(d.Year, d.Month, d.Day+days, 0, 0, 0, 0, c.Loc)
+}
+
+// Gets the name of the holiday or closure the exchange observes on the date, if any. Weekends are not holidays.
+func (c *TradingCalendar) Holiday(t time.Time) (name string, ok bool) {
+	d := toDate(t)
+	if name, ok = c.closures[d]; ok {
+		return
+	}
+	name, ok = c.holidays(d.Year)[d]
+	return
+}
+
+// Checks if the exchange is open at all on the date.
+func (c *TradingCalendar) IsTradingDay(t time.Time) bool {
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	_, holiday := c.Holiday(t)
+	return !holiday
+}
+
+// Checks if the exchange closes early on the date.
+func (c *TradingCalendar) IsEarlyClose(t time.Time) bool {
+	if !c.IsTradingDay(t) {
+		return false
+	}
+	_, ok := c.earlyCloses(t.Year())[toDate(t)]
+	return ok
+}
+
+// Gets the regular session's open and close times on the date; `ok` is false if the exchange is closed.
+func (c *TradingCalendar) Session(t time.Time) (opens, closes time.Time, ok bool) {
+	if !c.IsTradingDay(t) {
+		return time.Time{}, time.Time{}, false
+	}
+
+	d := toDate(t)
+	closeAt := c.Close
+	if c.IsEarlyClose(t) {
+		closeAt = c.EarlyClose
+	}
+
+	return c.clock(d, c.Open), c.clock(d, closeAt), true
+}
+
+// Gets the wall-clock time `offset` past midnight on the date; not affected by a DST change earlier that day.
+func (c *TradingCalendar) clock(d date, offset time.Duration) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, int(offset/time.Hour), int((offset%time.Hour)/time.Minute), 0, 0, c.Loc)
+}
+
+// Checks if the regular session is open at time `t`.
+func (c *TradingCalendar) IsOpen(t time.Time) bool {
+	t = t.In(c.Loc)
+	opens, closes, ok := c.Session(t)
+	if !ok {
+		return false
+	}
+	return !t.Before(opens) && t.Before(closes)
+}
+
+// Gets the latest trading date strictly before the date.
+func (c *TradingCalendar) PrevTradingDay(t time.Time) time.Time {
+	t = c.AddDays(t, -1)
+	for !c.IsTradingDay(t) {
+		t = c.AddDays(t, -1)
+	}
+	return t
+}
+
+// Gets the earliest trading date strictly after the date.
+func (c *TradingCalendar) NextTradingDay(t time.Time) time.Time {
+	t = c.AddDays(t, 1)
+	for !c.IsTradingDay(t) {
+		t = c.AddDays(t, 1)
+	}
+	return t
+}
+
+// Moves a date by `n` trading days, backwards for negative `n`. Non-trading dates count as the next trading day
+// when moving backwards and the previous one when moving forwards.
+func (c *TradingCalendar) AddTradingDays(t time.Time, n int) time.Time {
+	t = c.Date(t)
+	for ; n < 0; n++ {
+		t = c.PrevTradingDay(t)
+	}
+	for ; n > 0; n-- {
+		t = c.NextTradingDay(t)
+	}
+	return t
+}
+
+// Counts the trading days between startDate and endDate, inclusive.
+func (c *TradingCalendar) TradingDays(startDate, endDate time.Time) (count int) {
+	end := c.Date(endDate)
+	for t := c.Date(startDate); !t.After(end); t = c.AddDays(t, 1) {
+		if c.IsTradingDay(t) {
+			count++
+		}
+	}
+	return
+}
+
+// ------------------------------- NYSE rules:
+
+// Gets the n-th (1-based) weekday of a month; n = -1 gets the last one.
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) date {
+	if n < 0 {
+		// Find the last weekday by counting back from the end of the month:
+		t := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+		for t.Weekday() != weekday {
+			t = t.AddDate(0, 0, -1)
+		}
+		return date{year, month, t.Day()}
+	}
+
+	t := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	for t.Weekday() != weekday {
+		t = t.AddDate(0, 0, 1)
+	}
+	t = t.AddDate(0, 0, 7*(n-1))
+	return date{year, month, t.Day()}
+}
+
+// Moves a fixed-date holiday falling on a weekend to the Friday before or Monday after:
+func observed(year int, month time.Month, day int) date {
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	switch t.Weekday() {
+	case time.Saturday:
+		t = t.AddDate(0, 0, -1)
+	case time.Sunday:
+		t = t.AddDate(0, 0, 1)
+	}
+	y, m, d := t.Date()
+	return date{y, m, d}
+}
+
+// Gets the date of Easter Sunday (anonymous Gregorian algorithm):
+func easter(year int) date {
+	a := year % 19
+	b := year / 100
+	c := year % 100
+	d := b / 4
+	e := b % 4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i := c / 4
+	k := c % 4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := ((h + l - 7*m + 114) % 31) + 1
+	return date{year, time.Month(month), day}
+}
+
+func nyseHolidays(year int) map[date]string {
+	h := make(map[date]string)
+
+	// NOTE: New Year's Day on a Saturday is not observed on the Friday before since that closes the year.
+	if ny := observed(year, time.January, 1); ny.Year == year {
+		h[ny] = "New Year's Day"
+	}
+	if year >= 1998 {
+		h[nthWeekday(year, time.January, time.Monday, 3)] = "Martin Luther King, Jr. Day"
+	}
+	h[nthWeekday(year, time.February, time.Monday, 3)] = "Washington's Birthday"
+
+	e := easter(year)
+	gf := time.Date(e.Year, e.Month, e.Day-2, 0, 0, 0, 0, time.UTC)
+	h[date{gf.Year(), gf.Month(), gf.Day()}] = "Good Friday"
+
+	h[nthWeekday(year, time.May, time.Monday, -1)] = "Memorial Day"
+	if year >= 2022 {
+		h[observed(year, time.June, 19)] = "Juneteenth"
+	}
+	h[observed(year, time.July, 4)] = "Independence Day"
+	h[nthWeekday(year, time.September, time.Monday, 1)] = "Labor Day"
+	h[nthWeekday(year, time.November, time.Thursday, 4)] = "Thanksgiving Day"
+	h[observed(year, time.December, 25)] = "Christmas Day"
+
+	return h
+}
+
+func nyseEarlyCloses(year int) map[date]string {
+	h := make(map[date]string)
+
+	// The day before Independence Day when it falls Monday through Thursday:
+	if wd := time.Date(year, time.July, 3, 0, 0, 0, 0, time.UTC).Weekday(); wd >= time.Monday && wd <= time.Thursday {
+		h[date{year, time.July, 3}] = "Independence Day eve"
+	}
+
+	// The day after Thanksgiving:
+	tg := nthWeekday(year, time.November, time.Thursday, 4)
+	h[date{year, time.November, tg.Day + 1}] = "Black Friday"
+
+	// Christmas Eve when it falls Monday through Thursday:
+	if wd := time.Date(year, time.December, 24, 0, 0, 0, 0, time.UTC).Weekday(); wd >= time.Monday && wd <= time.Thursday {
+		h[date{year, time.December, 24}] = "Christmas Eve"
+	}
+
+	return h
+}
@@ -0,0 +1,178 @@
+package market
+
+import (
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02", s, LocNY)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestIsTradingDay(t *testing.T) {
+	tests := []struct {
+		Date    string
+		Trading bool
+	}{
+		{"2013-12-20", true},  // Friday
+		{"2013-12-21", false}, // Saturday
+		{"2013-12-25", false}, // Christmas
+		{"2013-01-01", false}, // New Year's Day
+		{"2013-01-21", false}, // MLK day
+		{"2013-02-18", false}, // Washington's Birthday
+		{"2013-03-29", false}, // Good Friday
+		{"2013-05-27", false}, // Memorial Day
+		{"2013-07-04", false}, // Independence Day
+		{"2013-09-02", false}, // Labor Day
+		{"2013-11-28", false}, // Thanksgiving
+		{"2015-07-03", false}, // Independence Day observed on Friday
+		{"2016-12-26", false}, // Christmas observed on Monday
+		{"2010-12-31", true},  // New Year's Day on Saturday is not observed
+		{"2012-10-29", false}, // Hurricane Sandy
+		{"2022-06-20", false}, // Juneteenth observed on Monday
+		{"2021-06-18", true},  // Juneteenth not yet a holiday
+	}
+
+	for _, test := range tests {
+		if actual := NYSE.IsTradingDay(day(test.Date)); actual != test.Trading {
+			t.Errorf("%s: expected trading day = %v; got %v", test.Date, test.Trading, actual)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	tests := []struct {
+		Date  string
+		Open  string
+		Close string
+	}{
+		{"2013-12-20", "2013-12-20T09:30:00-05:00", "2013-12-20T16:00:00-05:00"},
+		// DST:
+		{"2013-07-02", "2013-07-02T09:30:00-04:00", "2013-07-02T16:00:00-04:00"},
+		// Early closes:
+		{"2013-07-03", "2013-07-03T09:30:00-04:00", "2013-07-03T13:00:00-04:00"},
+		{"2013-11-29", "2013-11-29T09:30:00-05:00", "2013-11-29T13:00:00-05:00"},
+		{"2013-12-24", "2013-12-24T09:30:00-05:00", "2013-12-24T13:00:00-05:00"},
+		// First trading day after the DST change:
+		{"2013-03-11", "2013-03-11T09:30:00-04:00", "2013-03-11T16:00:00-04:00"},
+	}
+
+	for _, test := range tests {
+		open, close, ok := NYSE.Session(day(test.Date))
+		if !ok {
+			t.Errorf("%s: expected a session", test.Date)
+			continue
+		}
+		if open.Format(time.RFC3339) != test.Open || close.Format(time.RFC3339) != test.Close {
+			t.Errorf("%s: expected %s - %s; got %s - %s", test.Date, test.Open, test.Close, open.Format(time.RFC3339), close.Format(time.RFC3339))
+		}
+	}
+
+	if _, _, ok := NYSE.Session(day("2013-12-25")); ok {
+		t.Errorf("expected no session on Christmas")
+	}
+}
+
+func TestPrevTradingDay(t *testing.T) {
+	tests := []struct {
+		Date string
+		Prev string
+	}{
+		{"2013-12-26", "2013-12-24"}, // skips Christmas
+		{"2013-12-23", "2013-12-20"}, // skips the weekend
+		{"2013-09-03", "2013-08-30"}, // skips Labor Day weekend
+		{"2013-11-04", "2013-11-01"}, // across the DST change
+	}
+
+	for _, test := range tests {
+		if actual := NYSE.PrevTradingDay(day(test.Date)).Format("2006-01-02"); actual != test.Prev {
+			t.Errorf("%s: expected %s; got %s", test.Date, test.Prev, actual)
+		}
+	}
+}
+
+func TestTradingDays(t *testing.T) {
+	// 252 trading days in 2013:
+	if n := NYSE.TradingDays(day("2013-01-01"), day("2013-12-31")); n != 252 {
+		t.Errorf("expected 252 trading days; got %d", n)
+	}
+	if d := NYSE.AddTradingDays(day("2013-12-26"), -2).Format("2006-01-02"); d != "2013-12-23" {
+		t.Errorf("expected 2013-12-23; got %s", d)
+	}
+}
+
+func TestIsOpen(t *testing.T) {
+	tests := []struct {
+		Time string
+		Open bool
+	}{
+		{"2013-12-20T14:30:00Z", true},  // 9:30 EST
+		{"2013-12-20T14:29:00Z", false}, // 9:29 EST
+		{"2013-07-02T13:30:00Z", true},  // 9:30 EDT
+		{"2013-07-03T17:30:00Z", false}, // 13:30 EDT on an early close
+		{"2013-12-25T15:00:00Z", false}, // Christmas
+	}
+
+	for _, test := range tests {
+		at, _ := time.Parse(time.RFC3339, test.Time)
+		if actual := NYSE.IsOpen(at); actual != test.Open {
+			t.Errorf("%s: expected open = %v; got %v", test.Time, test.Open, actual)
+		}
+	}
+}
+
+func TestSessionAt(t *testing.T) {
+	tests := []struct {
+		Time    string
+		Session Session
+	}{
+		{"2013-12-20T08:59:00Z", Closed},     // 3:59 EST
+		{"2013-12-20T09:00:00Z", PreMarket},  // 4:00 EST
+		{"2013-12-20T14:30:00Z", Regular},    // 9:30 EST
+		{"2013-12-20T21:00:00Z", AfterHours}, // 16:00 EST
+		{"2013-12-21T01:00:00Z", Closed},     // 20:00 EST
+		{"2013-12-24T18:30:00Z", AfterHours}, // 13:30 EST on an early close
+		{"2013-12-21T15:00:00Z", Closed},     // Saturday
+	}
+
+	for _, test := range tests {
+		at, _ := time.Parse(time.RFC3339, test.Time)
+		if actual := NYSE.SessionAt(at); actual != test.Session {
+			t.Errorf("%s: expected %s; got %s", test.Time, test.Session, actual)
+		}
+	}
+}
+
+func TestParseSessions(t *testing.T) {
+	tests := []struct {
+		Text    string
+		Session Session
+	}{
+		{"regular", Regular},
+		{"pre, after", PreMarket | AfterHours},
+		{"all", AllSessions},
+		{"", Closed},
+	}
+
+	for _, test := range tests {
+		s, err := ParseSessions(test.Text)
+		if err != nil {
+			t.Errorf("%q: %s", test.Text, err)
+			continue
+		}
+		if s != test.Session {
+			t.Errorf("%q: expected %s; got %s", test.Text, test.Session, s)
+		}
+	}
+
+	if _, err := ParseSessions("lunch"); err == nil {
+		t.Errorf("expected error for unknown session")
+	}
+	if !AllSessions.Has(Regular) || Regular.Has(AfterHours) || AllSessions.Has(Closed) {
+		t.Errorf("unexpected Has results")
+	}
+}
@@ -0,0 +1,114 @@
+package market
+
+// general stuff:
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Trading sessions of a day as bit flags so a set of sessions can be stored as one value.
+type Session uint
+
+const Closed Session = 0
+
+const (
+	PreMarket Session = 1 << iota
+	Regular
+	AfterHours
+)
+
+const AllSessions = PreMarket | Regular | AfterHours
+
+var sessionNames = []struct {
+	Session Session
+	Name    string
+}{
+	{PreMarket, "pre"},
+	{Regular, "regular"},
+	{AfterHours, "after"},
+}
+
+// Checks if the set includes session `o`; never true for `Closed`.
+func (s Session) Has(o Session) bool {
+	return o != Closed && s&o == o
+}
+
+// Formats a set of sessions as e.g. "pre,regular":
+func (s Session) String() string {
+	if s == Closed {
+		return "closed"
+	}
+
+	names := make([]string, 0, len(sessionNames))
+	for _, n := range sessionNames {
+		if s.Has(n.Session) {
+			names = append(names, n.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Parses a comma-delimited set of session names ("pre", "regular", "after" or "all").
+func ParseSessions(v string) (s Session, err error) {
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			s |= AllSessions
+			continue
+		}
+
+		found := false
+		for _, n := range sessionNames {
+			if n.Name == name {
+				s |= n.Session
+				found = true
+				break
+			}
+		}
+		if !found {
+			return Closed, fmt.Errorf("unknown trading session '%s'", name)
+		}
+	}
+	return s, nil
+}
+
+func (s Session) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Session) UnmarshalText(text []byte) (err error) {
+	if string(text) == "closed" {
+		*s = Closed
+		return nil
+	}
+	*s, err = ParseSessions(string(text))
+	return
+}
+
+// Gets the trading session in progress at time `t`, or `Closed`.
+// Pre-market runs from `PreMarketOpen` until the open and after-hours from the (possibly early) close until `AfterHoursClose`.
+func (c *TradingCalendar) SessionAt(t time.Time) Session {
+	t = t.In(c.Loc)
+	opens, closes, ok := c.Session(t)
+	if !ok {
+		return Closed
+	}
+
+	d := toDate(t)
+	switch {
+	case t.Before(c.clock(d, c.PreMarketOpen)):
+		return Closed
+	case t.Before(opens):
+		return PreMarket
+	case t.Before(closes):
+		return Regular
+	case t.Before(c.clock(d, c.AfterHoursClose)):
+		return AfterHours
+	default:
+		return Closed
+	}
+}
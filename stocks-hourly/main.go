@@ -11,22 +11,56 @@ package main
 // general stuff:
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	//"fmt"
 	"html/template"
 	"log"
 	"net/mail"
+	"os"
 	"time"
 )
 
 // Our own packages:
 import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
 	"github.com/JamesDunne/StockWatcher/mailutil"
+	"github.com/JamesDunne/StockWatcher/market"
 	"github.com/JamesDunne/StockWatcher/stocks"
+	"github.com/JamesDunne/StockWatcher/yql"
 )
 
 var emailTemplate *template.Template
 
+// Portfolios of the stocks notified on by ID, looked up once per run:
+var portfolios = make(map[stocks.PortfolioID]*stocks.Portfolio)
+
+func getPortfolio(ctx context.Context, api *stocks.API, portfolioID stocks.PortfolioID) *stocks.Portfolio {
+	if portfolioID == 0 {
+		return nil
+	}
+	if p, ok := portfolios[portfolioID]; ok {
+		return p
+	}
+
+	p, err := api.GetPortfolioContext(ctx, portfolioID)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	portfolios[portfolioID] = p
+	return p
+}
+
+// What notification email templates are executed with:
+type notification struct {
+	*stocks.StockDetail
+
+	// The stock's portfolio; nil if it is in none:
+	Portfolio *stocks.Portfolio
+}
+
 func textTemplateString(tmpl *template.Template, name string, obj interface{}) string {
 	w := new(bytes.Buffer)
 	err := tmpl.ExecuteTemplate(w, name, obj)
@@ -36,7 +70,7 @@ func textTemplateString(tmpl *template.Template, name string, obj interface{}) s
 	return w.String()
 }
 
-func attemptEmailUser(api *stocks.API, user *stocks.User, sd *stocks.StockDetail, lastDeliveryTime *stocks.NullDateTime, templateName string) bool {
+func attemptEmailUser(ctx context.Context, api *stocks.API, user *stocks.User, sd *stocks.StockDetail, lastDeliveryTime *stocks.NullDateTime, templateName string) bool {
 	// Determine next available delivery time:
 	nextDeliveryTime := time.Now()
 	if (*lastDeliveryTime).Valid {
@@ -56,8 +90,9 @@ func attemptEmailUser(api *stocks.API, user *stocks.User, sd *stocks.StockDetail
 	to := mail.Address{user.Name, user.PrimaryEmail()}
 
 	// Execute email template to get subject and body:
-	subject := textTemplateString(emailTemplate, templateName+"/subject", sd)
-	body := textTemplateString(emailTemplate, templateName+"/body", sd)
+	n := notification{StockDetail: sd, Portfolio: getPortfolio(ctx, api, sd.Stock.PortfolioID)}
+	subject := textTemplateString(emailTemplate, templateName+"/subject", n)
+	body := textTemplateString(emailTemplate, templateName+"/body", n)
 
 	// Deliver email:
 	if err := mailutil.SendHtmlMessage(from, to, subject, body); err != nil {
@@ -69,21 +104,35 @@ func attemptEmailUser(api *stocks.API, user *stocks.User, sd *stocks.StockDetail
 
 		// Successfully delivered email as far as we know; record last delivery date/time:
 		*lastDeliveryTime = stocks.NullDateTime{Value: time.Now(), Valid: true}
-		api.UpdateNotifyTimes(&sd.Stock)
+		if err := api.UpdateNotifyTimesContext(ctx, &sd.Stock); err != nil {
+			log.Println(err)
+		}
 		return true
 	}
 }
 
 // Notifications:
 
+// Checks if a notification may fire in the trading session the current price was fetched in:
+func inSessions(sessions market.Session, sd *stocks.StockDetail) bool {
+	if !sessions.Has(sd.Detail.CurrSession) {
+		log.Printf("    current price is from %s session; only notifying in %s\n", sd.Detail.CurrSession, sessions)
+		return false
+	}
+	return true
+}
+
 // Trailing Stop
-func checkTStop(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
+func checkTStop(ctx context.Context, api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	if !sd.Stock.NotifyTStop || !sd.Stock.TStopPercent.Valid {
 		return
 	}
 	if !sd.Detail.CurrPrice.Valid || !sd.Detail.TStopPrice.Valid {
 		return
 	}
+	if !inSessions(sd.Stock.TStopSessions, sd) {
+		return
+	}
 
 	// Check if (price < t-stop):
 	log.Println("  Checking trailing stop...")
@@ -93,17 +142,20 @@ func checkTStop(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	}
 	log.Printf("    current %v is less than trailing stop %v!\n", sd.Detail.CurrPrice, sd.Detail.TStopPrice)
 
-	attemptEmailUser(api, user, sd, &sd.Stock.LastTimeTStop, "tstop")
+	attemptEmailUser(ctx, api, user, sd, &sd.Stock.LastTimeTStop, "tstop")
 }
 
 // Buy Stop
-func checkBuyStop(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
+func checkBuyStop(ctx context.Context, api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	if !sd.Stock.NotifyBuyStop || !sd.Stock.BuyStopPrice.Valid {
 		return
 	}
 	if !sd.Detail.CurrPrice.Valid {
 		return
 	}
+	if !inSessions(sd.Stock.BuyStopSessions, sd) {
+		return
+	}
 
 	// Check if (price < buy-stop):
 	log.Println("  Checking buy stop...")
@@ -113,17 +165,20 @@ func checkBuyStop(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	}
 	log.Printf("    current %v is less than buy stop %v!\n", sd.Detail.CurrPrice, sd.Stock.BuyStopPrice)
 
-	attemptEmailUser(api, user, sd, &sd.Stock.LastTimeBuyStop, "buystop")
+	attemptEmailUser(ctx, api, user, sd, &sd.Stock.LastTimeBuyStop, "buystop")
 }
 
 // Sell Stop
-func checkSellStop(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
+func checkSellStop(ctx context.Context, api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	if !sd.Stock.NotifySellStop || !sd.Stock.SellStopPrice.Valid {
 		return
 	}
 	if !sd.Detail.CurrPrice.Valid {
 		return
 	}
+	if !inSessions(sd.Stock.SellStopSessions, sd) {
+		return
+	}
 
 	// Check if (price > sell-stop):
 	log.Println("  Checking sell stop...")
@@ -133,16 +188,19 @@ func checkSellStop(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	}
 	log.Printf("    current %v is greater than sell stop %v!\n", sd.Detail.CurrPrice, sd.Stock.SellStopPrice)
 
-	attemptEmailUser(api, user, sd, &sd.Stock.LastTimeSellStop, "sellstop")
+	attemptEmailUser(ctx, api, user, sd, &sd.Stock.LastTimeSellStop, "sellstop")
 }
 
-func checkRise(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
+func checkRise(ctx context.Context, api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	if !sd.Stock.NotifyRise || !sd.Stock.RisePercent.Valid {
 		return
 	}
 	if !sd.Detail.CurrPrice.Valid || !sd.Detail.N1ClosePrice.Valid {
 		return
 	}
+	if !inSessions(sd.Stock.RiseSessions, sd) {
+		return
+	}
 
 	// chg% = ((CurrPrice / N1ClosePrice) - 1) * 100
 	log.Println("  Checking rise by %...")
@@ -154,16 +212,19 @@ func checkRise(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	}
 	log.Printf("    change %.2f%% is greater than rise %.2f%%!\n", chg, rise)
 
-	attemptEmailUser(api, user, sd, &sd.Stock.LastTimeRise, "rise")
+	attemptEmailUser(ctx, api, user, sd, &sd.Stock.LastTimeRise, "rise")
 }
 
-func checkFall(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
+func checkFall(ctx context.Context, api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	if !sd.Stock.NotifyFall || !sd.Stock.FallPercent.Valid {
 		return
 	}
 	if !sd.Detail.CurrPrice.Valid || !sd.Detail.N1ClosePrice.Valid {
 		return
 	}
+	if !inSessions(sd.Stock.FallSessions, sd) {
+		return
+	}
 
 	// chg% = ((CurrPrice / N1ClosePrice) - 1) * 100
 	log.Println("  Checking fall by %...")
@@ -175,25 +236,28 @@ func checkFall(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	}
 	log.Printf("    change %.2f%% is less than fall %.2f%%!\n", chg, fall)
 
-	attemptEmailUser(api, user, sd, &sd.Stock.LastTimeFall, "fall")
+	attemptEmailUser(ctx, api, user, sd, &sd.Stock.LastTimeFall, "fall")
 }
 
-func checkBullBear(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
+func checkBullBear(ctx context.Context, api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 	if !sd.Stock.NotifyBullBear {
 		return
 	}
-	if !sd.Detail.N1SMAPercent.Valid || !sd.Detail.N2SMAPercent.Valid {
+	if !sd.Detail.N1CrossoverPercent.Valid || !sd.Detail.N2CrossoverPercent.Valid {
+		return
+	}
+	if !inSessions(sd.Stock.BullBearSessions, sd) {
 		return
 	}
 
-	// TODO: verify this logic.
-	log.Println("  Checking SMA for bullish/bearish...")
-	if sd.Detail.N2SMAPercent.Value < 0.0 && sd.Detail.N1SMAPercent.Value >= 0.0 {
+	// The fast average crossing above the slow one is bullish; crossing below is bearish:
+	log.Printf("  Checking %s crossover for bullish/bearish...\n", sd.Detail.Crossover)
+	if sd.Detail.N2CrossoverPercent.Value < 0.0 && sd.Detail.N1CrossoverPercent.Value >= 0.0 {
 		log.Println("  stock turned bullish!")
-		attemptEmailUser(api, user, sd, &sd.Stock.LastTimeBullBear, "bull")
-	} else if sd.Detail.N2SMAPercent.Value >= 0.0 && sd.Detail.N1SMAPercent.Value < 0.0 {
+		attemptEmailUser(ctx, api, user, sd, &sd.Stock.LastTimeBullBear, "bull")
+	} else if sd.Detail.N2CrossoverPercent.Value >= 0.0 && sd.Detail.N1CrossoverPercent.Value < 0.0 {
 		log.Println("  stock turned bearish!")
-		attemptEmailUser(api, user, sd, &sd.Stock.LastTimeBullBear, "bear")
+		attemptEmailUser(ctx, api, user, sd, &sd.Stock.LastTimeBullBear, "bear")
 	} else {
 		log.Println("  no change")
 	}
@@ -201,6 +265,15 @@ func checkBullBear(api *stocks.API, user *stocks.User, sd *stocks.StockDetail) {
 
 // ------------- main:
 
+// Parses a "15:04" time of day as an offset from midnight:
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
 func main() {
 	const dateFmt = "2006-01-02"
 
@@ -209,6 +282,11 @@ func main() {
 	mailServerArg := flag.String("mail-server", "localhost:25", "Address of SMTP server to use for sending email")
 	testArg := flag.Bool("test", false, "Add test data")
 	tmplPathArg := flag.String("template", "./emails.tmpl", "Path to email template file")
+	csvDirArg := flag.String("csv-dir", "", "Read quotes and history from a directory of per-symbol CSV files instead of YQL")
+	sessionsArg := flag.String("sessions", "pre,regular,after", "Trading sessions to fetch quotes and check notifications in (pre, regular, after or all)")
+	preMarketArg := flag.String("pre-market-open", "04:00", "Time pre-market trading opens, New York time")
+	afterHoursArg := flag.String("after-hours-close", "20:00", "Time after-hours trading closes, New York time")
+	timeoutArg := flag.Duration("timeout", 50*time.Minute, "Give up fetching and notifying after this long; 0 for no limit")
 
 	// Parse the flags and set values:
 	flag.Parse()
@@ -216,11 +294,39 @@ func main() {
 	mailutil.Server = *mailServerArg
 	tmplPath := *tmplPathArg
 
+	// Parse trading session windows:
+	fetchSessions, err := market.ParseSessions(*sessionsArg)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+	if market.NYSE.PreMarketOpen, err = parseClock(*preMarketArg); err != nil {
+		log.Fatalln(err)
+		return
+	}
+	if market.NYSE.AfterHoursClose, err = parseClock(*afterHoursArg); err != nil {
+		log.Fatalln(err)
+		return
+	}
+
 	// Parse email template file:
 	emailTemplate = template.Must(template.New("email").ParseFiles(tmplPath))
 
-	// Create the API context which initializes the database:
-	api, err := stocks.NewAPI(dbPath)
+	// Select the quote provider:
+	var provider stocks.QuoteProvider = yql.NewProvider()
+	if *csvDirArg != "" {
+		provider = csvdir.New(*csvDirArg)
+	}
+
+	// Open the database:
+	store, err := stocks.NewSQLiteStore(dbPath)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	// Create the API context over the store:
+	api, err := stocks.NewAPI(store, provider)
 	if err != nil {
 		log.Fatalln(err)
 		return
@@ -229,6 +335,12 @@ func main() {
 
 	// Testing data:
 	if *testArg {
+		buyDate, err := stocks.ToDateTime(dateFmt, "2013-09-03")
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
 		testUser := &stocks.User{
 			Name:                "Test User",
 			NotificationTimeout: time.Minute,
@@ -236,14 +348,14 @@ func main() {
 				stocks.UserEmail{Email: "test@example.org", IsPrimary: true},
 			},
 		}
-		err := api.AddUser(testUser)
+		err = api.AddUser(testUser)
 
 		if err == nil {
 			// Real data from market:
 			s := &stocks.Stock{
 				UserID:       testUser.UserID,
 				Symbol:       "MSFT",
-				BuyDate:      stocks.ToDateTime(dateFmt, "2013-09-03"),
+				BuyDate:      buyDate,
 				BuyPrice:     stocks.ToDecimal("31.88"),
 				Shares:       10,
 				TStopPercent: stocks.ToNullDecimal("2.50"),
@@ -252,7 +364,7 @@ func main() {
 			s = &stocks.Stock{
 				UserID:       testUser.UserID,
 				Symbol:       "MSFT",
-				BuyDate:      stocks.ToDateTime(dateFmt, "2013-09-03"),
+				BuyDate:      buyDate,
 				BuyPrice:     stocks.ToDecimal("31.88"),
 				Shares:       -5,
 				TStopPercent: stocks.ToNullDecimal("2.50"),
@@ -262,7 +374,7 @@ func main() {
 			s = &stocks.Stock{
 				UserID:       testUser.UserID,
 				Symbol:       "AAPL",
-				BuyDate:      stocks.ToDateTime(dateFmt, "2013-09-03"),
+				BuyDate:      buyDate,
 				BuyPrice:     stocks.ToDecimal("488.58"),
 				Shares:       10,
 				TStopPercent: stocks.ToNullDecimal("2.50"),
@@ -271,7 +383,7 @@ func main() {
 			s = &stocks.Stock{
 				UserID:       testUser.UserID,
 				Symbol:       "AAPL",
-				BuyDate:      stocks.ToDateTime(dateFmt, "2013-09-03"),
+				BuyDate:      buyDate,
 				BuyPrice:     stocks.ToDecimal("488.58"),
 				Shares:       -5,
 				TStopPercent: stocks.ToNullDecimal("2.50"),
@@ -281,7 +393,7 @@ func main() {
 			s = &stocks.Stock{
 				UserID:       testUser.UserID,
 				Symbol:       "YHOO",
-				BuyDate:      stocks.ToDateTime(dateFmt, "2013-09-03"),
+				BuyDate:      buyDate,
 				BuyPrice:     stocks.ToDecimal("31.88"),
 				Shares:       0,
 				IsWatched:    true,
@@ -291,8 +403,36 @@ func main() {
 		}
 	}
 
+	// Bound the whole run so a slow quote provider can't pile up hourly jobs:
+	ctx := context.Background()
+	if *timeoutArg > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutArg)
+		defer cancel()
+	}
+
+	// Only one run evaluates alerts at a time; overlapping runs would send the same notifications twice.
+	// The lock expires shortly after the run's timeout in case the run dies without unlocking it:
+	lockTTL := 24 * time.Hour
+	if *timeoutArg > 0 {
+		lockTTL = *timeoutArg + time.Minute
+	}
+	runLock, err := api.LockRunContext(ctx, "stocks-hourly", lockTTL)
+	if errors.Is(err, stocks.ErrLocked) {
+		log.Println("Another run is in progress; skipping")
+		return
+	} else if err != nil {
+		log.Fatalln(err)
+		return
+	}
+	defer func() {
+		if err := runLock.Unlock(); err != nil {
+			log.Println(err)
+		}
+	}()
+
 	// Query stocks:
-	symbols, err := api.GetAllTrackedSymbols()
+	symbols, err := api.GetAllTrackedSymbolsContext(ctx)
 	if err != nil {
 		log.Fatalln(err)
 		return
@@ -301,21 +441,92 @@ func main() {
 	// Run through each actively tracked stock and calculate stopping prices, notify next of kin, what have you...
 	log.Printf("%d stocks tracked.\n", len(symbols))
 
+	// One bad symbol shouldn't stop the others; failures are reported at the end:
+	failed := make([]error, 0)
+	defer func() {
+		if len(failed) == 0 {
+			return
+		}
+		log.Printf("%d failures:\n", len(failed))
+		for _, err := range failed {
+			log.Printf("  %s\n", err)
+		}
+		runLock.Unlock()
+		api.Close()
+		os.Exit(1)
+	}()
+
 	for _, symbol := range symbols {
+		if err := ctx.Err(); err != nil {
+			log.Printf("  %s\n", err)
+			failed = append(failed, err)
+			log.Println("Job stopped")
+			return
+		}
+
 		// Record trading history:
 		log.Printf("  %s: recording historical data and calculating statistics...\n", symbol)
-		api.RecordHistory(symbol)
+		if err := api.RecordHistoryContext(ctx, symbol); err != nil {
+			log.Printf("  %s\n", err)
+			failed = append(failed, err)
+		}
+	}
+
+	// Value each user's portfolios at the last close once a night; users holding nothing are never due:
+	userIDs, err := api.GetUserIDsToSnapshotContext(ctx)
+	if err != nil {
+		log.Printf("  %s\n", err)
+		failed = append(failed, err)
+	}
+	for _, userID := range userIDs {
+		log.Printf("  user %d: recording portfolio snapshots...\n", userID)
+		if err := api.RecordSnapshotsContext(ctx, userID); err != nil {
+			log.Printf("  %s\n", err)
+			failed = append(failed, err)
+		}
+	}
+
+	// Don't fetch stale prices or send notifications based on them outside of trading sessions:
+	session := api.Calendar().SessionAt(time.Now())
+	if !fetchSessions.Has(session) {
+		log.Printf("Market session is %s; only fetching prices in %s.\n", session, fetchSessions)
+		log.Println("Job complete")
+		return
 	}
 
 	// Fetch current prices from Yahoo into the database:
-	log.Printf("Fetching current prices...\n")
-	api.GetCurrentHourlyPrices(true, symbols...)
+	log.Printf("Fetching current prices in %s session...\n", session)
+	prices, err := api.GetCurrentHourlyPricesContext(ctx, true, symbols...)
+	if err != nil {
+		log.Printf("  %s\n", err)
+		failed = append(failed, err)
+		if !errors.Is(err, stocks.ErrBadData) {
+			// No current prices to notify on:
+			log.Println("Job complete")
+			return
+		}
+	}
 
 	for _, symbol := range symbols {
+		if err := ctx.Err(); err != nil {
+			log.Printf("  %s\n", err)
+			failed = append(failed, err)
+			log.Println("Job stopped")
+			return
+		}
+
+		// Don't notify on a stale price:
+		if _, ok := prices[symbol]; !ok {
+			log.Printf("  %s: no current price; skipping notifications\n", symbol)
+			continue
+		}
+
 		// Calculate details of owned stocks and their owners for this symbol:
-		details, err := api.GetStockDetailsForSymbol(symbol)
+		details, err := api.GetStockDetailsForSymbolContext(ctx, symbol)
 		if err != nil {
-			panic(err)
+			log.Printf("  %s\n", err)
+			failed = append(failed, err)
+			continue
 		}
 
 		for _, sd := range details {
@@ -323,19 +534,31 @@ func main() {
 			d := &sd.Detail
 
 			// Get the owner:
-			user, err := api.GetUser(s.UserID)
+			user, err := api.GetUserContext(ctx, s.UserID)
 			if err != nil {
-				panic(err)
+				log.Printf("  %s\n", err)
+				failed = append(failed, err)
+				continue
+			}
+			if user == nil {
+				log.Printf("  %s: owner %d of stock %d not found\n", symbol, s.UserID, s.StockID)
+				continue
 			}
 
 			log.Printf("  %s\n", symbol)
+			if p := getPortfolio(ctx, api, s.PortfolioID); p != nil {
+				log.Printf("    in portfolio %s:\n", p.Name)
+			}
 			if !sd.Stock.IsWatched {
 				log.Printf("    %s bought %d shares at %s on %s:\n", user.Name, s.Shares, s.BuyPrice, s.BuyDate.DateString())
 			} else {
 				log.Printf("    %s watching from %s on %s:\n", user.Name, s.BuyPrice, s.BuyDate.DateString())
 			}
 			if sd.Detail.CurrPrice.Valid {
-				log.Printf("    current: %v\n", sd.Detail.CurrPrice)
+				log.Printf("    current: %v (%s)\n", sd.Detail.CurrPrice, d.CurrSession)
+			}
+			if d.ChangePercent.Valid {
+				log.Printf("    chg(%%):  %v\n", d.ChangePercent)
 			}
 			if d.TStopPrice.Valid {
 				log.Printf("    t-stop:  %v\n", d.TStopPrice)
@@ -346,15 +569,27 @@ func main() {
 			if d.GainLossPercent.Valid {
 				log.Printf("    gain(%%): %v\n", d.GainLossPercent)
 			}
+			if d.N1MACD.Valid {
+				log.Printf("    macd:    %v (signal %v)\n", d.N1MACD, d.N1MACDSignal)
+			}
+			if d.N1RSI14.Valid {
+				log.Printf("    rsi:     %v\n", d.N1RSI14)
+			}
+			if d.N1BollingerLower.Valid {
+				log.Printf("    bands:   %v - %v\n", d.N1BollingerLower, d.N1BollingerUpper)
+			}
+			if d.N1ATR14.Valid {
+				log.Printf("    atr:     %v\n", d.N1ATR14)
+			}
 
 			// Check notifications:
 			log.Println()
-			checkTStop(api, user, &sd)
-			checkBuyStop(api, user, &sd)
-			checkSellStop(api, user, &sd)
-			checkRise(api, user, &sd)
-			checkFall(api, user, &sd)
-			checkBullBear(api, user, &sd)
+			checkTStop(ctx, api, user, &sd)
+			checkBuyStop(ctx, api, user, &sd)
+			checkSellStop(ctx, api, user, &sd)
+			checkRise(ctx, api, user, &sd)
+			checkFall(ctx, api, user, &sd)
+			checkBullBear(ctx, api, user, &sd)
 		}
 	}
 
@@ -3,13 +3,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	//"net/url"
-	//"time"
 	"strings"
+	"time"
 )
 
 // sqlite related imports:
@@ -23,6 +24,7 @@ import (
 import (
 	//"github.com/JamesDunne/StockWatcher/dbutil"
 	//"github.com/JamesDunne/StockWatcher/mailutil"
+	"github.com/JamesDunne/StockWatcher/market"
 	"github.com/JamesDunne/StockWatcher/stocks"
 )
 
@@ -56,7 +58,7 @@ func validate(test bool, msg string) {
 }
 
 // Handles /api/* requests for JSON API:
-func apiHandler(w http.ResponseWriter, r *http.Request) {
+func (srv *server) apiHandler(w http.ResponseWriter, r *http.Request) {
 	// Get authenticated user data:
 	webuser := getUserData(r)
 
@@ -129,17 +131,11 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write(bytes)
 	}()
 
-	// Open API database:
-	api, err := stocks.NewAPI(dbPath)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, "Could not open stocks database!", http.StatusInternalServerError)
-		return
-	}
-	defer api.Close()
+	api := srv.api
 
 	// Get API user:
-	apiuser, err := api.GetUserByEmail(webuser.Email)
+	ctx := r.Context()
+	apiuser, err := api.GetUserByEmailContext(ctx, webuser.Email)
 	if err != nil {
 		log.Println(err)
 	}
@@ -154,14 +150,72 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 
 		case "/owned/list":
 			// Get list of owned stocks w/ details.
-			owned, _ := getDetailsSplit(api, apiuser.UserID)
+			owned, _ := getDetailsSplit(ctx, api, apiuser.UserID, portfolioFilter(r))
 			rsp = owned
 
 		case "/watched/list":
 			// Get list of watched stocks w/ details.
-			_, watched := getDetailsSplit(api, apiuser.UserID)
+			_, watched := getDetailsSplit(ctx, api, apiuser.UserID, portfolioFilter(r))
 			rsp = watched
 
+		case "/portfolio/list":
+			// Get the user's portfolios with their stocks and positions rolled up:
+			matching, err := stocks.ParseLotMatching(r.URL.Query().Get("matching"))
+			if err != nil {
+				rspcode = 400
+				rsperr = err
+				return
+			}
+			portfolios, err := api.GetPortfolioDetailsContext(ctx, apiuser.UserID, matching)
+			if err != nil {
+				rspcode, rsperr = errorResponse(err)
+				return
+			}
+			rsp = portfolios
+
+		case "/portfolio/performance":
+			// Get the returns of one portfolio, or all of them, from the nightly snapshots between two optional
+			// dates:
+			from, to := time.Time{}, api.LastTradingDate()
+			if s := r.URL.Query().Get("from"); s != "" {
+				d, err := stocks.ToDateTime(dateFmt, s)
+				validate(err == nil, "from must be YYYY-MM-DD")
+				from = d.Value
+			}
+			if s := r.URL.Query().Get("to"); s != "" {
+				d, err := stocks.ToDateTime(dateFmt, s)
+				validate(err == nil, "to must be YYYY-MM-DD")
+				to = d.Value
+			}
+			performance, err := api.GetPerformanceContext(ctx, apiuser.UserID, portfolioFilter(r), from, to)
+			if err != nil {
+				rspcode, rsperr = errorResponse(err)
+				return
+			}
+			rsp = performance
+
+		case "/transaction/list":
+			// Get the user's transactions, optionally of only one symbol:
+			symbol := strings.Trim(strings.ToUpper(r.URL.Query().Get("symbol")), " ")
+			txns, err := api.GetTransactionsContext(ctx, apiuser.UserID, symbol)
+			panicIf(err)
+			rsp = txns
+
+		case "/position/list":
+			// Get the user's positions with lots closed by the chosen matching method:
+			matching, err := stocks.ParseLotMatching(r.URL.Query().Get("matching"))
+			if err != nil {
+				rspcode = 400
+				rsperr = err
+				return
+			}
+			positions, err := api.GetPositionsContext(ctx, apiuser.UserID, matching)
+			if err != nil {
+				rspcode, rsperr = errorResponse(err)
+				return
+			}
+			rsp = positions
+
 		case "/stock/price":
 			// Get current price of stock:
 			symbol := r.URL.Query().Get("symbol")
@@ -173,7 +227,18 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 			symbol = strings.Trim(strings.ToUpper(symbol), " ")
 
 			// Get the last hourly price for the symbol:
-			prices := api.GetCurrentHourlyPrices(true, symbol)
+			prices, err := api.GetCurrentHourlyPricesContext(ctx, true, symbol)
+			if err != nil && !errors.Is(err, stocks.ErrBadData) {
+				rspcode, rsperr = errorResponse(err)
+				return
+			}
+			price, ok := prices[symbol]
+			if !ok {
+				// Unknown symbols have no usable price:
+				rspcode = 404
+				rsperr = fmt.Errorf("No price for symbol %s", symbol)
+				return
+			}
 
 			// Return the price value:
 			rsp = struct {
@@ -181,7 +246,7 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				Price  stocks.Decimal
 			}{
 				Symbol: symbol,
-				Price:  prices[symbol],
+				Price:  price,
 			}
 
 		default:
@@ -200,6 +265,62 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 			// Join to existing user with secondary email.
 			rsperr = fmt.Errorf("TODO")
 
+		case "/user/crossover":
+			// Set the moving-average crossover used for bull/bear notifications on stocks without their own.
+			tmp := stocks.Crossover{}
+			parsePostJson(r, &tmp)
+
+			err := tmp.Validate()
+			validate(err == nil, fmt.Sprint(err))
+
+			err = api.UpdateUserCrossover(apiuser.UserID, tmp)
+			panicIf(err)
+
+			// Compute the series for the newly chosen crossover:
+			details, err := api.GetStockDetailsForUserContext(ctx, apiuser.UserID)
+			panicIf(err)
+			recorded := make(map[string]bool)
+			for _, sd := range details {
+				if !recorded[sd.Stock.Symbol] {
+					if err = api.RecordHistoryContext(ctx, sd.Stock.Symbol); err != nil {
+						rspcode, rsperr = errorResponse(err)
+						return
+					}
+					recorded[sd.Stock.Symbol] = true
+				}
+			}
+
+			rsp = "ok"
+
+		case "/user/benchmark":
+			// Set the index symbol holdings are compared against; empty for none.
+			tmp := struct {
+				Symbol string
+			}{}
+			parsePostJson(r, &tmp)
+
+			err := api.UpdateUserBenchmarkContext(ctx, apiuser.UserID, tmp.Symbol)
+			if errors.Is(err, stocks.ErrBadData) {
+				validate(false, err.Error())
+			}
+			panicIf(err)
+
+			user, err := api.GetUserContext(ctx, apiuser.UserID)
+			panicIf(err)
+			if user.Benchmark != "" {
+				// Nobody may hold the benchmark yet; fetch its history back to the user's earliest holding:
+				if failed := fetchLatest(ctx, api, user.Benchmark); len(failed) > 0 {
+					if errors.Is(failed[0], stocks.ErrNotFound) {
+						// Don't keep tracking a symbol the quote provider doesn't know:
+						panicIf(api.UpdateUserBenchmarkContext(ctx, apiuser.UserID, apiuser.Benchmark))
+					}
+					rspcode, rsperr = errorResponse(failed[0])
+					return
+				}
+			}
+
+			rsp = "ok"
+
 		case "/stock/add":
 			// Add stock.
 
@@ -210,6 +331,8 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				BuyPrice  string
 				Shares    int64
 				IsWatched bool
+				// 0 for no portfolio:
+				PortfolioID int64
 
 				TStopPercent   string
 				BuyStopPrice   string
@@ -217,6 +340,17 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				RisePercent    string
 				FallPercent    string
 				NotifyBullBear bool
+
+				// Trading sessions notifications may fire in, e.g. "regular,after"; defaults to "regular":
+				TStopSessions    market.Session
+				BuyStopSessions  market.Session
+				SellStopSessions market.Session
+				RiseSessions     market.Session
+				FallSessions     market.Session
+				BullBearSessions market.Session
+
+				// Moving-average crossover for bull/bear notifications, e.g. {"Fast": 20, "Slow": 50, "Kind": "EMA"}; null for the user's:
+				Crossover *stocks.Crossover
 			}{}
 			parsePostJson(r, &tmp)
 
@@ -224,15 +358,23 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 			validate(tmp.Symbol != "", "Symbol required")
 			validate(tmp.BuyDate != "", "BuyDate required")
 			validate(tmp.BuyPrice != "", "BuyPrice required")
+			if tmp.Crossover != nil {
+				err := tmp.Crossover.Validate()
+				validate(err == nil, fmt.Sprint(err))
+			}
+
+			buyDate, err := stocks.ToDateTime(dateFmt, strings.Trim(tmp.BuyDate, " "))
+			validate(err == nil, "BuyDate must be YYYY-MM-DD")
 
 			// Convert JSON input into stock struct:
 			s := &stocks.Stock{
-				UserID:    apiuser.UserID,
-				Symbol:    strings.Trim(strings.ToUpper(tmp.Symbol), " "),
-				BuyDate:   stocks.ToDateTime(dateFmt, strings.Trim(tmp.BuyDate, " ")),
-				BuyPrice:  stocks.ToDecimal(strings.Trim(tmp.BuyPrice, " ")),
-				Shares:    tmp.Shares,
-				IsWatched: tmp.IsWatched,
+				UserID:      apiuser.UserID,
+				PortfolioID: stocks.PortfolioID(tmp.PortfolioID),
+				Symbol:      strings.Trim(strings.ToUpper(tmp.Symbol), " "),
+				BuyDate:     buyDate,
+				BuyPrice:    stocks.ToDecimal(strings.Trim(tmp.BuyPrice, " ")),
+				Shares:      tmp.Shares,
+				IsWatched:   tmp.IsWatched,
 
 				TStopPercent:   stocks.ToNullDecimal(tmp.TStopPercent),
 				BuyStopPrice:   stocks.ToNullDecimal(tmp.BuyStopPrice),
@@ -240,6 +382,15 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				RisePercent:    stocks.ToNullDecimal(tmp.RisePercent),
 				FallPercent:    stocks.ToNullDecimal(tmp.FallPercent),
 				NotifyBullBear: tmp.NotifyBullBear,
+
+				TStopSessions:    tmp.TStopSessions,
+				BuyStopSessions:  tmp.BuyStopSessions,
+				SellStopSessions: tmp.SellStopSessions,
+				RiseSessions:     tmp.RiseSessions,
+				FallSessions:     tmp.FallSessions,
+				BullBearSessions: tmp.BullBearSessions,
+
+				Crossover: tmp.Crossover,
 			}
 
 			// Enable/disable notifications based on what's filled out:
@@ -259,21 +410,23 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				s.NotifyFall = true
 			}
 
-			// Add the stock record:
+			// Add the stock record; an unknown portfolio is the caller's fault:
 			err = api.AddStock(s)
+			if errors.Is(err, stocks.ErrBadData) {
+				validate(false, err.Error())
+			}
 			panicIf(err)
 
-			// Check if we have to recreate history:
-			minBuyDate := api.GetMinBuyDate(s.Symbol)
-			if minBuyDate.Valid && s.BuyDate.Value.Before(minBuyDate.Value) {
-				// Introducing earlier BuyDates screws up the TradeDayIndex values.
-				// TODO(jsd): We could probably fix this better by simply reindexing the TradeDayIndex values and filling in the holes.
-				api.DeleteHistory(s.Symbol)
+			// Fetch latest data for new symbol; this backfills history for an earlier BuyDate:
+			if failed := fetchLatest(ctx, api, s.Symbol); len(failed) > 0 {
+				if errors.Is(failed[0], stocks.ErrNotFound) {
+					// Don't keep tracking a symbol the quote provider doesn't know:
+					panicIf(api.RemoveStock(s.StockID))
+				}
+				rspcode, rsperr = errorResponse(failed[0])
+				return
 			}
 
-			// Fetch latest data for new symbol:
-			fetchLatest(api, s.Symbol)
-
 			rsp = "ok"
 
 		case "/stock/update":
@@ -287,6 +440,8 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				BuyPrice  string
 				Shares    int64
 				IsWatched bool
+				// Unchanged if not given; 0 for no portfolio:
+				PortfolioID *int64
 
 				TStopPercent string
 				NotifyTStop  bool
@@ -304,15 +459,33 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				NotifyFall  bool
 
 				NotifyBullBear bool
+
+				// Trading sessions notifications may fire in; unchanged if not given:
+				TStopSessions    market.Session
+				BuyStopSessions  market.Session
+				SellStopSessions market.Session
+				RiseSessions     market.Session
+				FallSessions     market.Session
+				BullBearSessions market.Session
+
+				// Moving-average crossover for bull/bear notifications; null for the user's:
+				Crossover *stocks.Crossover
 			}{}
 			parsePostJson(r, &tmp)
 
 			// Validate settings and respond 400 if failed:
 			validate(tmp.BuyPrice != "", "BuyPrice required")
+			if tmp.Crossover != nil {
+				err := tmp.Crossover.Validate()
+				validate(err == nil, fmt.Sprint(err))
+			}
 
-			// Get stock from the database:
-			s, err := api.GetStock(stocks.StockID(tmp.StockID))
-			panicIf(err)
+			// Get stock from the database; 404 if there is none:
+			s, err := api.GetStockContext(ctx, stocks.StockID(tmp.StockID))
+			if err != nil {
+				rspcode, rsperr = errorResponse(err)
+				return
+			}
 
 			// 404 if wrong user attempts to update:
 			if s.UserID != apiuser.UserID {
@@ -343,10 +516,44 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 
 			s.NotifyBullBear = tmp.NotifyBullBear
 
+			if tmp.TStopSessions != market.Closed {
+				s.TStopSessions = tmp.TStopSessions
+			}
+			if tmp.BuyStopSessions != market.Closed {
+				s.BuyStopSessions = tmp.BuyStopSessions
+			}
+			if tmp.SellStopSessions != market.Closed {
+				s.SellStopSessions = tmp.SellStopSessions
+			}
+			if tmp.RiseSessions != market.Closed {
+				s.RiseSessions = tmp.RiseSessions
+			}
+			if tmp.FallSessions != market.Closed {
+				s.FallSessions = tmp.FallSessions
+			}
+			if tmp.BullBearSessions != market.Closed {
+				s.BullBearSessions = tmp.BullBearSessions
+			}
+
+			s.Crossover = tmp.Crossover
+
+			if tmp.PortfolioID != nil {
+				s.PortfolioID = stocks.PortfolioID(*tmp.PortfolioID)
+			}
+
 			// Add the stock record:
 			err = api.UpdateStock(s)
+			if errors.Is(err, stocks.ErrBadData) {
+				validate(false, err.Error())
+			}
 			panicIf(err)
 
+			// Compute the series for a newly chosen crossover:
+			if err = api.RecordHistoryContext(ctx, s.Symbol); err != nil {
+				rspcode, rsperr = errorResponse(err)
+				return
+			}
+
 			rsp = "ok"
 
 		case "/stock/remove":
@@ -357,11 +564,13 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 
 			stockID := stocks.StockID(tmp.ID)
 
-			st, err := api.GetStock(stockID)
-			if st == nil {
+			st, err := api.GetStockContext(ctx, stockID)
+			if errors.Is(err, stocks.ErrNotFound) {
+				// Already gone:
 				rsp = "ok"
 				return
 			}
+			panicIf(err)
 
 			// Security check.
 			if st.UserID != apiuser.UserID {
@@ -374,6 +583,147 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 
 			rsp = "ok"
 
+		case "/transaction/add":
+			// Record a buy, sell, short or cover, or a deposit or withdrawal of cash.
+
+			// Parse body as JSON:
+			tmp := struct {
+				Symbol string
+				Kind   stocks.TransactionKind
+				Date   string
+				// Per share, or the amount of cash:
+				Price  string
+				Shares int64
+				// The buy or short a sell or cover closes with specific lot matching; 0 for none:
+				LotID int64
+				// 0 for no portfolio:
+				PortfolioID int64
+			}{}
+			parsePostJson(r, &tmp)
+
+			kind := stocks.TransactionKind(strings.ToLower(string(tmp.Kind)))
+
+			// Validate and respond 400 if failed:
+			validate(kind.IsCash() || tmp.Symbol != "", "Symbol required")
+			validate(tmp.Date != "", "Date required")
+			validate(tmp.Price != "", "Price required")
+
+			date, err := stocks.ToDateTime(dateFmt, strings.Trim(tmp.Date, " "))
+			validate(err == nil, "Date must be YYYY-MM-DD")
+
+			t := &stocks.Transaction{
+				UserID:      apiuser.UserID,
+				PortfolioID: stocks.PortfolioID(tmp.PortfolioID),
+				Symbol:      strings.Trim(strings.ToUpper(tmp.Symbol), " "),
+				Kind:        kind,
+				Date:        date,
+				Price:       stocks.ToDecimal(strings.Trim(tmp.Price, " ")),
+				Shares:      tmp.Shares,
+				LotID:       stocks.TransactionID(tmp.LotID),
+			}
+
+			// Invalid transactions and sells of shares not held are the caller's fault:
+			err = api.AddTransaction(t)
+			if errors.Is(err, stocks.ErrBadData) {
+				validate(false, err.Error())
+			}
+			panicIf(err)
+			if kind.IsCash() {
+				rsp = t
+				return
+			}
+
+			// Fetch latest data for the symbol so its position can be valued:
+			if failed := fetchLatest(ctx, api, t.Symbol); len(failed) > 0 {
+				if errors.Is(failed[0], stocks.ErrNotFound) {
+					// Don't keep a transaction in a symbol the quote provider doesn't know:
+					panicIf(api.RemoveTransaction(t.TransactionID))
+				}
+				rspcode, rsperr = errorResponse(failed[0])
+				return
+			}
+
+			rsp = t
+
+		case "/transaction/remove":
+			tmp := struct {
+				ID int64 `json:"id"`
+			}{}
+			parsePostJson(r, &tmp)
+
+			transactionID := stocks.TransactionID(tmp.ID)
+
+			t, err := api.GetTransactionContext(ctx, transactionID)
+			panicIf(err)
+			if t == nil {
+				rsp = "ok"
+				return
+			}
+
+			// Security check.
+			if t.UserID != apiuser.UserID {
+				rspcode = 404
+				rsperr = fmt.Errorf("Not Found")
+				return
+			}
+
+			// Refuse to orphan a later sell or cover:
+			err = api.RemoveTransaction(transactionID)
+			if errors.Is(err, stocks.ErrBadData) {
+				validate(false, err.Error())
+			}
+			panicIf(err)
+
+			rsp = "ok"
+
+		case "/portfolio/add":
+			tmp := struct {
+				Name string
+			}{}
+			parsePostJson(r, &tmp)
+
+			// Empty and duplicate names are the caller's fault:
+			p := &stocks.Portfolio{UserID: apiuser.UserID, Name: tmp.Name}
+			err := api.AddPortfolio(p)
+			if errors.Is(err, stocks.ErrBadData) {
+				validate(false, err.Error())
+			}
+			panicIf(err)
+
+			rsp = p
+
+		case "/portfolio/rename", "/portfolio/remove":
+			tmp := struct {
+				ID   int64 `json:"id"`
+				Name string
+			}{}
+			parsePostJson(r, &tmp)
+
+			portfolioID := stocks.PortfolioID(tmp.ID)
+
+			p, err := api.GetPortfolioContext(ctx, portfolioID)
+			panicIf(err)
+
+			// Security check.
+			if p == nil || p.UserID != apiuser.UserID {
+				rspcode = 404
+				rsperr = fmt.Errorf("Not Found")
+				return
+			}
+
+			// Removing a portfolio with transactions would merge their lots with others':
+			if r.URL.Path == "/portfolio/rename" {
+				err = api.RenamePortfolio(portfolioID, tmp.Name)
+			} else {
+				err = api.RemovePortfolio(portfolioID)
+			}
+			if errors.Is(err, stocks.ErrBadData) {
+				validate(false, err.Error())
+			}
+			panicIf(err)
+
+			rsp = "ok"
+
 		default:
 			rspcode = 404
 			rsperr = fmt.Errorf("Invalid API url")
@@ -24,14 +24,34 @@ import (
 
 // Our own packages:
 import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
 	"github.com/JamesDunne/StockWatcher/mailutil"
-	//"github.com/JamesDunne/StockWatcher/stocks"
+	"github.com/JamesDunne/StockWatcher/stocks"
+	"github.com/JamesDunne/StockWatcher/yql"
 	"github.com/JamesDunne/go-fsnotify"
 )
 
 // Where to serve static files from:
 var fsRoot = "./root/"
-var dbPath string
+
+// Dependencies shared by all requests; the secured handlers are its methods:
+type server struct {
+	// Opened once at startup and safe for concurrent requests:
+	api *stocks.API
+}
+
+// Opens the API over the database at `dbPath`:
+func openAPI(dbPath string, provider stocks.QuoteProvider) (api *stocks.API, err error) {
+	store, err := stocks.NewSQLiteStore(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if api, err = stocks.NewAPI(store, provider); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return api, nil
+}
 
 // Override this with the production host name, e.g. stocks.bittwiddlers.org (port optional):
 var webHost = "localhost:8080"
@@ -68,14 +88,29 @@ func main() {
 	dbPathArg := flag.String("db", "./stocks.db", "Path to stocks.db database")
 	webHostArg := flag.String("host", "localhost:8080", "Host name of server; used for HTTP redirects")
 	mailServerArg := flag.String("mail-server", "localhost:25", "Address of SMTP server to use for sending email")
+	csvDirArg := flag.String("csv-dir", "", "Read quotes and history from a directory of per-symbol CSV files instead of YQL")
 
 	// Parse the flags and set values:
 	flag.Parse()
 	fsRoot = *fs
-	dbPath = *dbPathArg
 	webHost = *webHostArg
 	mailutil.Server = *mailServerArg
 
+	// Select the quote provider:
+	var provider stocks.QuoteProvider = yql.NewProvider()
+	if *csvDirArg != "" {
+		provider = csvdir.New(*csvDirArg)
+	}
+
+	// Open the database once; all requests share the API:
+	api, err := openAPI(*dbPathArg, provider)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	defer api.Close()
+	srv := &server{api: api}
+
 	// Parse template files:
 	tmplPath := path.Join(fsRoot, "templates")
 	ui, err := template.New("ui").ParseGlob(path.Join(tmplPath, "*.tmpl"))
@@ -148,6 +183,9 @@ func main() {
 			os.Remove(*socketAddr)
 		}
 
+		// Close the database:
+		api.Close()
+
 		// And we're done:
 		os.Exit(0)
 	}(sigc)
@@ -158,8 +196,8 @@ func main() {
 	http.Handle("/auth/", http.StripPrefix("/auth", http.HandlerFunc(authHandler)))
 
 	// Secured section:
-	http.Handle("/ui/", RequireAuth(http.StripPrefix("/ui", http.HandlerFunc(uiHandler))))
-	http.Handle("/api/", RequireAuth(http.StripPrefix("/api", http.HandlerFunc(apiHandler))))
+	http.Handle("/ui/", RequireAuth(http.StripPrefix("/ui", http.HandlerFunc(srv.uiHandler))))
+	http.Handle("/api/", RequireAuth(http.StripPrefix("/api", http.HandlerFunc(srv.apiHandler))))
 
 	// Unsecured section:
 	// For serving static files:
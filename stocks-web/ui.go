@@ -2,7 +2,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -29,20 +31,23 @@ import (
 
 // utilities:
 
-func getDetails(api *stocks.API, userID stocks.UserID) []stocks.StockDetail {
-	details, err := api.GetStockDetailsForUser(userID)
+func getDetails(ctx context.Context, api *stocks.API, userID stocks.UserID) []stocks.StockDetail {
+	details, err := api.GetStockDetailsForUserContext(ctx, userID)
 	if err != nil {
 		panic(err)
 	}
 	return details
 }
 
-func getDetailsSplit(api *stocks.API, userID stocks.UserID) (owned []stocks.StockDetail, watched []stocks.StockDetail) {
-	details := getDetails(api, userID)
+func getDetailsSplit(ctx context.Context, api *stocks.API, userID stocks.UserID, portfolioID stocks.PortfolioID) (owned []stocks.StockDetail, watched []stocks.StockDetail) {
+	details := getDetails(ctx, api, userID)
 	owned = make([]stocks.StockDetail, 0, len(details))
 	watched = make([]stocks.StockDetail, 0, len(details))
 
 	for _, s := range details {
+		if portfolioID != stocks.AllPortfolios && s.Stock.PortfolioID != portfolioID {
+			continue
+		}
 		if s.Stock.IsWatched {
 			watched = append(watched, s)
 		} else {
@@ -53,19 +58,33 @@ func getDetailsSplit(api *stocks.API, userID stocks.UserID) (owned []stocks.Stoc
 	return
 }
 
-func fetchLatest(api *stocks.API, symbols ...string) {
+// Carries on past symbols that fail and returns their errors; stops once `ctx` is done, e.g. when the client
+// goes away:
+func fetchLatest(ctx context.Context, api *stocks.API, symbols ...string) (failed []error) {
 	// Run through each actively tracked stock and calculate stopping prices, notify next of kin, what have you...
 	log.Printf("%d stocks tracked.\n", len(symbols))
 
 	for _, symbol := range symbols {
+		if err := ctx.Err(); err != nil {
+			log.Println(err)
+			return append(failed, err)
+		}
+
 		// Record trading history:
 		log.Printf("%s: recording historical data and calculating statistics...\n", symbol)
-		api.RecordHistory(symbol)
+		if err := api.RecordHistoryContext(ctx, symbol); err != nil {
+			log.Println(err)
+			failed = append(failed, err)
+		}
 	}
 
 	// Fetch current prices from Yahoo into the database:
 	log.Printf("Fetching current prices...\n")
-	api.GetCurrentHourlyPrices(true, symbols...)
+	if _, err := api.GetCurrentHourlyPricesContext(ctx, true, symbols...); err != nil {
+		log.Println(err)
+		failed = append(failed, err)
+	}
+	return
 }
 
 func notEmpty(s string, err string) string {
@@ -83,6 +102,22 @@ func (err BadRequestError) Error() string {
 	return err.Message
 }
 
+// Gets the HTTP status code and error to respond with for an API error; internal errors are logged and hidden:
+func errorResponse(err error) (code int, rsperr error) {
+	switch {
+	case errors.Is(err, stocks.ErrNotFound):
+		return http.StatusNotFound, err
+	case errors.Is(err, stocks.ErrBadData):
+		return http.StatusBadGateway, err
+	case errors.Is(err, stocks.ErrProviderUnavailable):
+		return http.StatusServiceUnavailable, err
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, err
+	}
+	log.Println(err)
+	return http.StatusInternalServerError, fmt.Errorf("Internal server error")
+}
+
 func badRequest(err error, msg string) {
 	if err != nil {
 		log.Println(err)
@@ -97,6 +132,16 @@ func tryParseInt(s string, msg string) int64 {
 	return v
 }
 
+// Gets the portfolio to filter by from the `portfolio` query string parameter; all of them if not given and
+// none of them for 0:
+func portfolioFilter(r *http.Request) stocks.PortfolioID {
+	s := r.URL.Query().Get("portfolio")
+	if s == "" {
+		return stocks.AllPortfolios
+	}
+	return stocks.PortfolioID(tryParseInt(s, "portfolio must be a portfolio ID"))
+}
+
 func toJSON(data interface{}) string {
 	bytes, err := json.Marshal(data)
 	panicIf(err)
@@ -110,15 +155,8 @@ const dateFmt = "2006-01-02"
 var uiTmpl *template.Template
 
 // Handles /ui/* requests to present HTML UI to the user:
-func uiHandler(w http.ResponseWriter, r *http.Request) {
-	// Get API ready:
-	api, err := stocks.NewAPI(dbPath)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, "Could not open stocks database!", http.StatusInternalServerError)
-		return
-	}
-	defer api.Close()
+func (srv *server) uiHandler(w http.ResponseWriter, r *http.Request) {
+	api := srv.api
 
 	// Handle panic()s as '500' responses:
 	defer func() {
@@ -136,8 +174,9 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// Find user:
+	ctx := r.Context()
 	webuser := getUserData(r)
-	apiuser, err := api.GetUserByEmail(webuser.Email)
+	apiuser, err := api.GetUserByEmailContext(ctx, webuser.Email)
 	if apiuser == nil || err != nil {
 		if r.URL.Path != "/register" {
 			http.Redirect(w, r, "/ui/register", http.StatusFound)
@@ -186,20 +225,68 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 		// -------------------------------------------------
 
 	case "/dash":
-		// Fetch data to be used by the template:
-		owned, watched := getDetailsSplit(api, apiuser.UserID)
+		// Fetch data to be used by the template, of only one portfolio if asked:
+		portfolioID := portfolioFilter(r)
+		owned, watched := getDetailsSplit(ctx, api, apiuser.UserID, portfolioID)
+
+		// Positions from the transaction ledger; sells and covers close lots FIFO unless asked otherwise:
+		matching, err := stocks.ParseLotMatching(r.URL.Query().Get("matching"))
+		badRequest(err, "matching must be FIFO, LIFO or SpecificID")
+		portfolios, err := api.GetPortfolioDetailsContext(ctx, apiuser.UserID, matching)
+		panicIf(err)
+		positions := make([]stocks.Position, 0, 8)
+		for _, pd := range portfolios {
+			if portfolioID == stocks.AllPortfolios || pd.Portfolio.PortfolioID == portfolioID {
+				positions = append(positions, pd.Positions...)
+			}
+		}
+		realized, unrealized := stocks.TotalGains(positions)
+
+		allTransactions, err := api.GetTransactionsContext(ctx, apiuser.UserID, "")
+		panicIf(err)
+		transactions := make([]stocks.Transaction, 0, len(allTransactions))
+		for _, t := range allTransactions {
+			if portfolioID == stocks.AllPortfolios || t.PortfolioID == portfolioID {
+				transactions = append(transactions, t)
+			}
+		}
 
 		model := struct {
 			User    *stocks.User
 			Owned   []stocks.StockDetail
 			Watched []stocks.StockDetail
+
+			// Roll-ups of every portfolio, their total and the one shown, if `Filtered`:
+			Portfolios []stocks.PortfolioDetail
+			Total      stocks.PortfolioSummary
+			Portfolio  stocks.PortfolioID
+			Filtered   bool
+
+			Matching       stocks.LotMatching
+			Positions      []stocks.Position
+			RealizedGain   stocks.Decimal
+			UnrealizedGain stocks.NullDecimal
+			Transactions   []stocks.Transaction
+			Today          time.Time
 		}{
 			User:    apiuser,
 			Owned:   owned,
 			Watched: watched,
+
+			Portfolios: portfolios,
+			Total:      stocks.TotalSummary(portfolios),
+			Portfolio:  portfolioID,
+			Filtered:   portfolioID != stocks.AllPortfolios,
+
+			Matching:       matching,
+			Positions:      positions,
+			RealizedGain:   realized,
+			UnrealizedGain: unrealized,
+			Transactions:   transactions,
+			Today:          time.Now(),
 		}
 
-		err := uiTmpl.ExecuteTemplate(w, "dash", model)
+		err = uiTmpl.ExecuteTemplate(w, "dash", model)
 		panicIf(err)
 		return
 
@@ -207,10 +294,11 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 		// Fetch latest data:
 
 		// Query stocks:
-		symbols, err := api.GetAllTrackedSymbols()
+		symbols, err := api.GetAllTrackedSymbolsContext(ctx)
 		panicIf(err)
 
-		fetchLatest(api, symbols...)
+		// Failures are logged; show what we have:
+		fetchLatest(ctx, api, symbols...)
 
 		// Redirect to dashboard with updated data:
 		http.Redirect(w, r, "/ui/dash", http.StatusFound)
@@ -220,36 +308,48 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 
 	case "/owned/add":
 		if r.Method == "GET" {
-			// Data to be used by the template:
+			// Data to be used by the template; the stock goes in the portfolio the dashboard was showing:
+			portfolios, err := api.GetPortfoliosContext(ctx, apiuser.UserID)
+			panicIf(err)
 			model := struct {
-				User      *stocks.User
-				Today     time.Time
-				IsWatched bool
+				User        *stocks.User
+				Today       time.Time
+				IsWatched   bool
+				Portfolios  []stocks.Portfolio
+				PortfolioID stocks.PortfolioID
 			}{
-				User:      apiuser,
-				Today:     time.Now(),
-				IsWatched: false,
+				User:        apiuser,
+				Today:       time.Now(),
+				IsWatched:   false,
+				Portfolios:  portfolios,
+				PortfolioID: portfolioFilter(r),
 			}
 
-			err := uiTmpl.ExecuteTemplate(w, "add", model)
+			err = uiTmpl.ExecuteTemplate(w, "add", model)
 			panicIf(err)
 			return
 		}
 
 	case "/watched/add":
 		if r.Method == "GET" {
-			// Data to be used by the template:
+			// Data to be used by the template; the stock goes in the portfolio the dashboard was showing:
+			portfolios, err := api.GetPortfoliosContext(ctx, apiuser.UserID)
+			panicIf(err)
 			model := struct {
-				User      *stocks.User
-				Today     time.Time
-				IsWatched bool
+				User        *stocks.User
+				Today       time.Time
+				IsWatched   bool
+				Portfolios  []stocks.Portfolio
+				PortfolioID stocks.PortfolioID
 			}{
-				User:      apiuser,
-				Today:     time.Now(),
-				IsWatched: true,
+				User:        apiuser,
+				Today:       time.Now(),
+				IsWatched:   true,
+				Portfolios:  portfolios,
+				PortfolioID: portfolioFilter(r),
 			}
 
-			err := uiTmpl.ExecuteTemplate(w, "add", model)
+			err = uiTmpl.ExecuteTemplate(w, "add", model)
 			panicIf(err)
 			return
 		}
@@ -260,26 +360,33 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			// Data to be used by the template:
 			id := r.URL.Query().Get("id")
-			st, err := api.GetStock(stocks.StockID(tryParseInt(id, "id query string parameter is required")))
-			panicIf(err)
-			if st == nil {
+			st, err := api.GetStockContext(ctx, stocks.StockID(tryParseInt(id, "id query string parameter is required")))
+			if errors.Is(err, stocks.ErrNotFound) {
 				http.Error(w, "404 Not Found", http.StatusNotFound)
 				return
 			}
+			panicIf(err)
 			// Security check.
 			if st.UserID != apiuser.UserID {
 				http.Error(w, "404 Not Found", http.StatusNotFound)
 				return
 			}
 
+			portfolios, err := api.GetPortfoliosContext(ctx, apiuser.UserID)
+			panicIf(err)
+
 			model := struct {
-				User      *stocks.User
-				StockJSON string
-				IsWatched bool
+				User        *stocks.User
+				StockJSON   string
+				IsWatched   bool
+				Portfolios  []stocks.Portfolio
+				PortfolioID stocks.PortfolioID
 			}{
-				User:      apiuser,
-				StockJSON: toJSON(st),
-				IsWatched: st.IsWatched,
+				User:        apiuser,
+				StockJSON:   toJSON(st),
+				IsWatched:   st.IsWatched,
+				Portfolios:  portfolios,
+				PortfolioID: st.PortfolioID,
 			}
 
 			// Render the appropriate html template:
@@ -0,0 +1,219 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"time"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/yql"
+)
+
+// A cash dividend paid per share as of its ex-dividend date.
+type Dividend struct {
+	Symbol string
+	Date   DateTime
+	Amount Decimal
+}
+
+// A stock split of `Numerator` new shares for every `Denominator` old shares effective on `Date`.
+type Split struct {
+	Symbol      string
+	Date        DateTime
+	Numerator   int64
+	Denominator int64
+}
+
+// Gets the split ratio as new shares per old share.
+func (s Split) Ratio() *big.Rat {
+	return big.NewRat(s.Numerator, s.Denominator)
+}
+
+// Gets all recorded dividends for a symbol in ascending date order.
+func (api *API) GetDividends(symbol string) (dividends []Dividend, err error) {
+	return api.store.GetDividends(context.Background(), symbol)
+}
+
+// Gets all recorded splits for a symbol in ascending date order.
+func (api *API) GetSplits(symbol string) (splits []Split, err error) {
+	return api.store.GetSplits(context.Background(), symbol)
+}
+
+// Fetches dividends and splits from the quote provider into the store.
+func (api *API) recordActions(ctx context.Context, symbol string, startDate time.Time) (err error) {
+	endDate := api.LastTradingDate()
+	dividends, err := api.provider.GetDividendsContext(ctx, symbol, startDate, endDate)
+	if err != nil {
+		return providerError("GetDividends", symbol, err)
+	}
+	splits, err := api.provider.GetSplitsContext(ctx, symbol, startDate, endDate)
+	if err != nil {
+		return providerError("GetSplits", symbol, err)
+	}
+
+	// Dates are in the NYC timezone:
+	divs := make([]Dividend, 0, len(dividends))
+	for _, d := range dividends {
+		date, err := time.ParseInLocation(dateFmt, d.Date, LocNY)
+		if err != nil {
+			return badData("GetDividends", symbol, err)
+		}
+		amount, err := yql.ParsePrice(symbol, "Dividends", d.Amount)
+		if err != nil {
+			return badData("GetDividends", symbol, err)
+		}
+		divs = append(divs, Dividend{Symbol: symbol, Date: DateTime{Value: date}, Amount: Decimal{Value: amount}})
+	}
+	if err = api.store.AddDividends(ctx, divs); err != nil {
+		return
+	}
+
+	spls := make([]Split, 0, len(splits))
+	for _, s := range splits {
+		date, err := time.ParseInLocation(dateFmt, s.Date, LocNY)
+		if err != nil {
+			return badData("GetSplits", symbol, err)
+		}
+		spls = append(spls, Split{Symbol: symbol, Date: DateTime{Value: date}, Numerator: s.Numerator, Denominator: s.Denominator})
+	}
+	return api.store.AddSplits(ctx, spls)
+}
+
+// Recomputes the split- and dividend-adjusted closing prices of a symbol's history.
+// Closes are adjusted into today's share basis: each split divides all earlier closes by its ratio and
+// each dividend multiplies all earlier closes by (1 - dividend / close on the trading day before its ex-date).
+// Returns the lowest and highest TradeDayIndex whose adjusted close changed, or zeroes if none did.
+func (api *API) adjustHistory(ctx context.Context, symbol string) (minChanged, maxChanged int64, err error) {
+	_, lastTradeDay, err := api.store.GetLastTradeDay(ctx, symbol)
+	if err != nil {
+		return
+	}
+	hist, err := api.store.GetHistory(ctx, symbol, 1, lastTradeDay)
+	if err != nil {
+		return
+	}
+
+	dividends, err := api.GetDividends(symbol)
+	if err != nil {
+		return
+	}
+	splits, err := api.GetSplits(symbol)
+	if err != nil {
+		return
+	}
+
+	// Walk back in time from the latest close, applying each action to all closes before it:
+	changed := make([]HistoryDay, 0, len(hist))
+	factor := big.NewRat(1, 1)
+	d, s := len(dividends)-1, len(splits)-1
+	for i := len(hist) - 1; i >= 0; i-- {
+		h := hist[i]
+		date := h.Date.Value
+		closing := h.Close.Value
+
+		for ; s >= 0 && splits[s].Date.Value.After(date); s-- {
+			factor.Quo(factor, splits[s].Ratio())
+		}
+		for ; d >= 0 && dividends[d].Date.Value.After(date); d-- {
+			if closing.Sign() == 0 {
+				continue
+			}
+			// factor *= 1 - (dividend / close)
+			f := new(big.Rat).Quo(dividends[d].Amount.Value, closing)
+			f.Sub(big.NewRat(1, 1), f)
+			factor.Mul(factor, f)
+		}
+
+		// Adjusted closes are kept to 4 decimal places:
+		adj := ToRat(new(big.Rat).Mul(closing, factor).FloatString(4))
+		if h.AdjClose.Valid && h.AdjClose.Value.Cmp(adj) == 0 {
+			continue
+		}
+		h.AdjClose = NullDecimal{Value: adj, Valid: true}
+		changed = append(changed, h)
+
+		if h.TradeDayIndex > maxChanged {
+			maxChanged = h.TradeDayIndex
+		}
+		if minChanged == 0 || h.TradeDayIndex < minChanged {
+			minChanged = h.TradeDayIndex
+		}
+	}
+
+	if len(changed) > 0 {
+		err = api.store.SetAdjustedCloses(ctx, symbol, changed)
+	}
+	return
+}
+
+// Adjusts the Shares, BuyPrice, BuyStopPrice and SellStopPrice of every Stock bought before a recorded split
+// of its symbol into the post-split share basis. Each (Stock, split) pair is adjusted only once and recorded
+// as a SplitAdjustment.
+func (api *API) applySplits(ctx context.Context, symbol string) (err error) {
+	splits, err := api.store.GetUnappliedSplits(ctx, symbol)
+	if err != nil {
+		return
+	}
+
+	// Divides a price by the split ratio:
+	adjustPrice := func(v NullDecimal, ratio *big.Rat) NullDecimal {
+		if !v.Valid {
+			return v
+		}
+		return NullDecimal{Value: new(big.Rat).Quo(v.Value, ratio), Valid: true}
+	}
+
+	now := DateTime{Value: time.Now().In(LocNY)}
+
+	// Multiple splits for the same stock apply on top of each other since each adjustment is stored before the next:
+	for _, sp := range splits {
+		s, err := api.store.GetStock(ctx, sp.StockID)
+		if errors.Is(err, ErrNotFound) {
+			// Removed since the split was found:
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		ratio := sp.Split.Ratio()
+
+		// Fractional shares are paid out as cash-in-lieu so round toward zero:
+		shares := new(big.Rat).Mul(big.NewRat(s.Shares, 1), ratio)
+		newShares := new(big.Int).Quo(shares.Num(), shares.Denom()).Int64()
+		if !shares.IsInt() {
+			log.Printf("%s: stock %d: %s shares after %d:%d split rounded to %d\n", symbol, s.StockID, shares.FloatString(4), sp.Split.Numerator, sp.Split.Denominator, newShares)
+		}
+
+		adj := SplitAdjustment{
+			StockID:          s.StockID,
+			Split:            sp.Split,
+			AdjustedDateTime: now,
+
+			OldShares:        s.Shares,
+			NewShares:        newShares,
+			OldBuyPrice:      s.BuyPrice,
+			NewBuyPrice:      Decimal{Value: new(big.Rat).Quo(s.BuyPrice.Value, ratio)},
+			OldBuyStopPrice:  s.BuyStopPrice,
+			NewBuyStopPrice:  adjustPrice(s.BuyStopPrice, ratio),
+			OldSellStopPrice: s.SellStopPrice,
+			NewSellStopPrice: adjustPrice(s.SellStopPrice, ratio),
+		}
+		if err = api.store.ApplySplitAdjustment(ctx, adj); err != nil {
+			return err
+		}
+
+		log.Printf("%s: stock %d adjusted for %d:%d split on %s: shares %d -> %d, buy price %s -> %s, buy stop %s -> %s, sell stop %s -> %s\n",
+			symbol, s.StockID, sp.Split.Numerator, sp.Split.Denominator, sp.Split.Date.DateString(),
+			adj.OldShares, adj.NewShares,
+			adj.OldBuyPrice, adj.NewBuyPrice,
+			adj.OldBuyStopPrice, adj.NewBuyStopPrice,
+			adj.OldSellStopPrice, adj.NewSellStopPrice,
+		)
+	}
+	return
+}
@@ -2,36 +2,66 @@ package stocks
 
 // general stuff:
 import (
-	//"math/big"
+	"context"
+	"fmt"
+	"sync"
 	"time"
 )
 
-// sqlite related imports:
-import (
-	//"database/sql"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
-)
-
 // Our own packages:
 import (
-//"github.com/JamesDunne/StockWatcher/yql"
+	"github.com/JamesDunne/StockWatcher/market"
 )
 
 // Get the New York location for stock timezone:
-var LocNY, _ = time.LoadLocation("America/New_York")
+var LocNY = market.LocNY
 
 // ------------- public structures:
 
-// Our API context struct:
+// Our API context struct; safe for concurrent use, e.g. by all requests of a web server:
 type API struct {
-	db              *sqlx.DB
+	store    Store
+	provider QuoteProvider
+	calendar *market.TradingCalendar
+
+	// Guards the fields below:
+	lock sync.Mutex
+	// Rolled over by `dates()` after midnight NY time:
 	today           time.Time
 	lastTradingDate time.Time
+	// Serializes recording history per symbol:
+	recording map[string]*sync.Mutex
 }
 
-func (api *API) Today() time.Time           { return api.today }
-func (api *API) LastTradingDate() time.Time { return api.lastTradingDate }
+func (api *API) Today() time.Time                  { today, _ := api.dates(); return today }
+func (api *API) LastTradingDate() time.Time        { _, last := api.dates(); return last }
+func (api *API) Calendar() *market.TradingCalendar { return api.calendar }
+
+// Gets today's date in NY time and the last trading date before it, recomputing both when the day rolls over:
+func (api *API) dates() (today, lastTradingDate time.Time) {
+	today = api.calendar.Date(time.Now().In(LocNY))
+
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if !today.Equal(api.today) {
+		api.today = today
+		// Find the last trading date before today, skipping weekends and exchange holidays:
+		api.lastTradingDate = api.calendar.PrevTradingDay(today)
+	}
+	return api.today, api.lastTradingDate
+}
+
+// Gets the lock held while recording history for `symbol`:
+func (api *API) recordingLock(symbol string) *sync.Mutex {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	l, ok := api.recording[symbol]
+	if !ok {
+		l = new(sync.Mutex)
+		api.recording[symbol] = l
+	}
+	return l
+}
 
 type UserID int64
 type StockID int64
@@ -41,45 +71,42 @@ type StockID int64
 const dateFmt = "2006-01-02"
 const sqliteFmt = "2006-01-02 15:04:05"
 
-// Releases all API resources:
-func (api *API) Close() {
-	api.db.Close()
-	api.db = nil
-}
+// Creates an API over `store`, e.g. `NewSQLiteStore(dbPath)` or `NewMemoryStore()`.
+// `provider` is the source of quotes and trading history, e.g. `yql.NewProvider()`.
+func NewAPI(store Store, provider QuoteProvider) (api *API, err error) {
+	if store == nil {
+		return nil, fmt.Errorf("store cannot be nil for NewAPI")
+	}
+	if provider == nil {
+		return nil, fmt.Errorf("provider cannot be nil for NewAPI")
+	}
 
-// Gets all actively tracked stock symbols (owned or watching):
-func (api *API) GetAllTrackedSymbols() (symbols []string, err error) {
-	rows := make([]struct {
-		Symbol string `db:"Symbol"`
-	}, 0, 4)
+	api = &API{store: store, provider: provider, calendar: market.NYSE, recording: make(map[string]*sync.Mutex)}
 
-	err = api.db.Select(&rows, `select distinct Symbol from Stock`)
-	if err != nil {
-		return
-	}
+	// Get today's date and the last trading date in NY time:
+	api.dates()
 
-	symbols = make([]string, 0, len(rows))
-	for _, v := range rows {
-		symbols = append(symbols, v.Symbol)
-	}
+	// Success!
+	return api, nil
+}
 
-	return
+// Releases all API resources, including the store. The store stays set so calls still in flight fail with
+// its errors instead of racing on the field:
+func (api *API) Close() {
+	api.store.Close()
 }
 
-// Gets the last date trading occurred for a stock symbol.
-func (api *API) GetLastTradeDay(symbol string) (date DateTime, tradeDay int64, err error) {
-	row := struct {
-		Date          string `db:"Date"`
-		TradeDayIndex int64  `db:"TradeDayIndex"`
-	}{}
+// Gets all actively tracked stock symbols (owned or watching):
+func (api *API) GetAllTrackedSymbols() (symbols []string, err error) {
+	return api.GetAllTrackedSymbolsContext(context.Background())
+}
 
-	err = api.db.Get(&row, `select h.Date, h.TradeDayIndex from StockHistory h where (h.Symbol = ?1) and (h.TradeDayIndex = (select max(TradeDayIndex) from StockHistory where Symbol = h.Symbol))`, symbol)
-	if err != nil {
-		return
-	}
+// Like `GetAllTrackedSymbols`; `ctx` cancels the store query.
+func (api *API) GetAllTrackedSymbolsContext(ctx context.Context) (symbols []string, err error) {
+	return api.store.GetAllTrackedSymbols(ctx)
+}
 
-	date = fromDbDateTime(dateFmt, row.Date)
-	tradeDay = row.TradeDayIndex
-	err = nil
-	return
+// Gets the last date trading occurred for a stock symbol; `date` is not valid if no history is recorded.
+func (api *API) GetLastTradeDay(symbol string) (date NullDateTime, tradeDay int64, err error) {
+	return api.store.GetLastTradeDay(context.Background(), symbol)
 }
@@ -1,20 +1,42 @@
 package stocks
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
 	"os"
 	"testing"
 	"time"
 )
 
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+	"github.com/JamesDunne/StockWatcher/yql"
+)
+
 const tmpdb = "./tmp.db"
 
+// Offline quote and history data:
+const testdata = "./testdata"
+
 var api *API
 var symbols []string
 var err error
 
 // These test functions run in sequential order as defined here:
 
+// Removes a SQLite DB along with its write-ahead log:
+func removeDB(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
+
+// Gets the SQLite store under test for raw queries:
+func sqlite() *sqliteStore { return api.store.(*sqliteStore) }
+
 func TestTruncDate(t *testing.T) {
 	// Get the New York location for stock timezone:
 	nyLoc, _ := time.LoadLocation("America/New_York")
@@ -27,9 +49,13 @@ func TestTruncDate(t *testing.T) {
 }
 
 func TestNewAPI(t *testing.T) {
-	os.Remove(tmpdb)
-	var err error
-	api, err = NewAPI(tmpdb)
+	removeDB(tmpdb)
+	store, err := NewSQLiteStore(tmpdb)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	api, err = NewAPI(store, csvdir.New(testdata))
 	if err != nil {
 		t.Fatal(err)
 		return
@@ -74,11 +100,22 @@ func TestGetUserBySecondaryEmail(t *testing.T) {
 	fmt.Printf("user1: %+v\n", user)
 }
 
+func TestGetUserByEmailCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := api.GetUserByEmailContext(ctx, "test@example.org")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled; got %v", err)
+		return
+	}
+}
+
 func TestAddStock(t *testing.T) {
 	s := Stock{
 		UserID:    UserID(1),
 		Symbol:    "MSFT",
-		BuyDate:   ToDateTime(dateFmt, "2012-09-03"),
+		BuyDate:   testDateTime(dateFmt, "2012-09-03"),
 		BuyPrice:  ToDecimal("40.00"),
 		Shares:    int64(-10),
 		IsWatched: false,
@@ -98,7 +135,7 @@ func TestAddStock2(t *testing.T) {
 	s := Stock{
 		UserID:    UserID(1),
 		Symbol:    "AAPL",
-		BuyDate:   ToDateTime(dateFmt, "2012-09-03"),
+		BuyDate:   testDateTime(dateFmt, "2012-09-03"),
 		BuyPrice:  ToDecimal("400.00"),
 		Shares:    int64(+10),
 		IsWatched: false,
@@ -118,7 +155,7 @@ func TestAddWatchedStock(t *testing.T) {
 	s := Stock{
 		UserID:    UserID(1),
 		Symbol:    "MSFT",
-		BuyDate:   ToDateTime(dateFmt, "2012-09-03"),
+		BuyDate:   testDateTime(dateFmt, "2012-09-03"),
 		BuyPrice:  ToDecimal("40.00"),
 		Shares:    int64(0),
 		IsWatched: true,
@@ -138,7 +175,7 @@ func TestAddWatchedStock2(t *testing.T) {
 	s := Stock{
 		UserID:    UserID(1),
 		Symbol:    "AAPL",
-		BuyDate:   ToDateTime(dateFmt, "2012-09-03"),
+		BuyDate:   testDateTime(dateFmt, "2012-09-03"),
 		BuyPrice:  ToDecimal("400.00"),
 		Shares:    int64(0),
 		IsWatched: true,
@@ -154,6 +191,13 @@ func TestAddWatchedStock2(t *testing.T) {
 	}
 }
 
+func TestGetStockNotFound(t *testing.T) {
+	s, err := api.GetStock(StockID(999))
+	if !errors.Is(err, ErrNotFound) || s != nil {
+		t.Fatalf("expected not found; got %+v, %v", s, err)
+	}
+}
+
 func TestGetAllTrackedSymbols(t *testing.T) {
 	symbols, err = api.GetAllTrackedSymbols()
 	if err != nil {
@@ -167,21 +211,198 @@ func TestGetAllTrackedSymbols(t *testing.T) {
 func TestRecordHistory(t *testing.T) {
 	for _, symbol := range symbols {
 		fmt.Printf("recording history for %s...\n", symbol)
-		api.RecordHistory(symbol)
+		if err := api.RecordHistory(symbol); err != nil {
+			t.Fatal(err)
+		}
 	}
 }
 
 func TestRecordHistory2(t *testing.T) {
 	for _, symbol := range symbols {
 		fmt.Printf("recording history for %s...\n", symbol)
-		api.RecordHistory(symbol)
+		if err := api.RecordHistory(symbol); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackfillHistory(t *testing.T) {
+	count := func(q string) int64 {
+		n, err := sqlite().getScalar(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n.(int64)
+	}
+
+	histCount := count(`select count(*) from StockHistory where Symbol = 'AAPL'`)
+	statsCount := count(`select count(*) from StockStats where Symbol = 'AAPL'`)
+
+	// Pretend history was first fetched from 2012 so the earlier buy date's history is missing:
+	cutoff, _ := time.ParseInLocation(dateFmt, "2012-01-03", LocNY)
+	if _, err := sqlite().db.Exec(`delete from StockHistory where Symbol = 'AAPL' and Date < ?1`, cutoff.Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.store.SetHistoryStartDate(context.Background(), "AAPL", cutoff); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := api.RecordHistory("AAPL"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count(`select count(*) from StockHistory where Symbol = 'AAPL'`); n != histCount {
+		t.Fatalf("expected %d history rows after backfill; got %d", histCount, n)
+	}
+	if n := count(`select count(*) from StockStats where Symbol = 'AAPL'`); n != statsCount {
+		t.Fatalf("expected %d stats rows after backfill; got %d", statsCount, n)
+	}
+
+	// TradeDayIndex must be contiguous in date order:
+	gaps := count(`select count(*) from StockHistory h where (h.Symbol = 'AAPL') and (h.TradeDayIndex != (select count(*) from StockHistory h0 where (h0.Symbol = h.Symbol) and (h0.Date <= h.Date)))`)
+	if gaps != 0 {
+		t.Fatalf("expected contiguous TradeDayIndex; %d rows out of order", gaps)
+	}
+	mismatched := count(`select count(*) from StockStats s join StockHistory h on (h.Symbol = s.Symbol) and (h.Date = s.Date) where (s.Symbol = 'AAPL') and (s.TradeDayIndex != h.TradeDayIndex)`)
+	if mismatched != 0 {
+		t.Fatalf("expected StockStats TradeDayIndex to match history; %d rows differ", mismatched)
+	}
+}
+
+func TestAdjustedHistory(t *testing.T) {
+	getAdj := func(symbol, date string) (closing, adj string) {
+		row := struct {
+			Closing    string `db:"Closing"`
+			AdjClosing string `db:"AdjClosing"`
+		}{}
+		d, _ := time.ParseInLocation(dateFmt, date, LocNY)
+		err := sqlite().db.Get(&row, `select Closing, AdjClosing from StockHistory where Symbol = ?1 and Date = ?2`, symbol, d.Format(time.RFC3339))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return row.Closing, row.AdjClosing
+	}
+
+	// No dividends after the ex-date so no adjustment:
+	closing, adj := getAdj("MSFT", "2013-11-19")
+	if ToRat(closing).Cmp(ToRat(adj)) != 0 {
+		t.Fatalf("expected unadjusted close %s; got %s", closing, adj)
+	}
+
+	// Trading day before the ex-date is adjusted by exactly the dividend amount:
+	closing, adj = getAdj("MSFT", "2013-11-18")
+	if expected := new(big.Rat).Sub(ToRat(closing), ToRat("0.28")); expected.Cmp(ToRat(adj)) != 0 {
+		t.Fatalf("expected adjusted close %s; got %s", expected.FloatString(4), adj)
+	}
+
+	// A 2:1 split halves all earlier closes:
+	splitDate, _ := time.ParseInLocation(dateFmt, "2013-12-02", LocNY)
+	_, err := sqlite().db.Exec(`insert into StockSplit (Symbol, Date, Numerator, Denominator) values ('AAPL', ?1, 2, 1)`, splitDate.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = api.adjustHistory(context.Background(), "AAPL"); err != nil {
+		t.Fatal(err)
+	}
+	closing, adj = getAdj("AAPL", "2013-11-29")
+	if expected := new(big.Rat).Quo(ToRat(closing), big.NewRat(2, 1)); expected.Cmp(ToRat(adj)) != 0 {
+		t.Fatalf("expected split-adjusted close %s; got %s", expected.FloatString(4), adj)
+	}
+	closing, adj = getAdj("AAPL", "2013-12-02")
+	if ToRat(closing).Cmp(ToRat(adj)) != 0 {
+		t.Fatalf("expected unadjusted close %s; got %s", closing, adj)
+	}
+
+	// Undo the split for the following tests:
+	if _, err = sqlite().db.Exec(`delete from StockSplit where Symbol = 'AAPL'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = api.adjustHistory(context.Background(), "AAPL"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplySplits(t *testing.T) {
+	// Stock 1 is MSFT bought 2012-09-03:
+	before, err := api.GetStock(StockID(1))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	before.SellStopPrice = ToNullDecimal("30.00")
+	if err = api.UpdateStock(before); err != nil {
+		t.Fatal(err)
+		return
+	}
+	// Stock 3 is the watched MSFT:
+	watched, err := api.GetStock(StockID(3))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	splitDate, _ := time.ParseInLocation(dateFmt, "2013-06-03", LocNY)
+	_, err = sqlite().db.Exec(`insert into StockSplit (Symbol, Date, Numerator, Denominator) values ('MSFT', ?1, 4, 1)`, splitDate.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying twice must only adjust once:
+	for i := 0; i < 2; i++ {
+		if err = api.applySplits(context.Background(), "MSFT"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := api.GetStock(StockID(1))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if after.Shares != before.Shares*4 {
+		t.Fatalf("expected %d shares; got %d", before.Shares*4, after.Shares)
+	}
+	if after.BuyPrice.Value.Cmp(ToRat("10.00")) != 0 {
+		t.Fatalf("expected buy price 10.00; got %s", after.BuyPrice)
+	}
+	if !after.SellStopPrice.Valid || after.SellStopPrice.Value.Cmp(ToRat("7.50")) != 0 {
+		t.Fatalf("expected sell stop 7.50; got %s", after.SellStopPrice)
+	}
+	if after.BuyStopPrice.Valid {
+		t.Fatalf("expected no buy stop; got %s", after.BuyStopPrice)
+	}
+
+	n, err := sqlite().getScalar(context.Background(), `select count(*) from StockSplitAdjustment where StockID = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.(int64) != 1 {
+		t.Fatalf("expected 1 adjustment record; got %d", n)
+	}
+
+	// Undo the split for the following tests:
+	before.SellStopPrice = DecimalNull
+	if err = api.UpdateStock(before); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.UpdateStock(watched); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sqlite().db.Exec(`delete from StockSplit where Symbol = 'MSFT' and Numerator = 4`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sqlite().db.Exec(`delete from StockSplitAdjustment`); err != nil {
+		t.Fatal(err)
 	}
 }
 
 func TestGetCurrentHourlyPrices(t *testing.T) {
 	// Fetch multiple times in a row to test fetch from DB vs. fetch from Yahoo (and store to DB):
 	for i := 1; i <= 10; i++ {
-		prices := api.GetCurrentHourlyPrices(false, "MSFT", "AAPL")
+		prices, err := api.GetCurrentHourlyPrices(false, "MSFT", "AAPL")
+		if err != nil {
+			t.Fatal(err)
+		}
 		fmt.Printf("prices [%d]: %+v\n", i, prices)
 	}
 }
@@ -193,6 +414,13 @@ func TestGetStockDetailsForUser(t *testing.T) {
 		return
 	}
 
+	// Quote details recorded from the provider:
+	for _, sd := range stocks {
+		if !sd.Detail.DayHigh.Valid || !sd.Detail.DayLow.Valid || !sd.Detail.PrevClose.Valid || !sd.Detail.Volume.Valid || !sd.Detail.ChangePercent.Valid {
+			t.Fatalf("%s: missing quote details: %+v", sd.Stock.Symbol, sd.Detail)
+		}
+	}
+
 	fmt.Printf("detail stocks: %+v\n", stocks)
 }
 
@@ -204,4 +432,191 @@ func TestGetStockDetailsForSymbol(t *testing.T) {
 	}
 
 	fmt.Printf("detail stocks: %+v\n", stocks)
+
+	// Indicators are recorded along with the moving averages:
+	for _, sd := range stocks {
+		d := sd.Detail
+		if !d.N1EMA12.Valid || !d.N1MACD.Valid || !d.N1RSI14.Valid || !d.N1BollingerUpper.Valid || !d.N1ATR14.Valid {
+			t.Fatalf("expected indicators for %s; got %+v", sd.Stock.Symbol, d)
+		}
+		if d.N1RSI14.Value < 0 || d.N1RSI14.Value > 100 {
+			t.Fatalf("expected RSI between 0 and 100; got %v", d.N1RSI14)
+		}
+		if d.N1BollingerLower.Value > d.N1BollingerUpper.Value {
+			t.Fatalf("expected lower Bollinger band %v below upper %v", d.N1BollingerLower, d.N1BollingerUpper)
+		}
+	}
+}
+
+func TestCrossoverDetails(t *testing.T) {
+	// The default crossover matches the recorded 50/200-day SMA percent:
+	details, err := api.GetStockDetailsForUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sd := range details {
+		d := sd.Detail
+		if d.Crossover != DefaultCrossover {
+			t.Fatalf("expected default crossover; got %s", d.Crossover)
+		}
+		if !d.N1CrossoverPercent.Valid || !d.N2CrossoverPercent.Valid {
+			t.Fatalf("expected crossover percents for %s; got %+v", sd.Stock.Symbol, d)
+		}
+		if math.Abs(d.N1CrossoverPercent.Value-d.N1SMAPercent.Value) > 1e-6 {
+			t.Fatalf("expected crossover percent %v to match SMA percent %v", d.N1CrossoverPercent.Value, d.N1SMAPercent.Value)
+		}
+	}
+
+	// Stock 4 is the watched AAPL; give it its own crossover:
+	s, err := api.GetStock(StockID(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Crossover = &Crossover{Fast: 20, Slow: 50, Kind: EMA}
+	if err = api.UpdateStock(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.RecordHistory("AAPL"); err != nil {
+		t.Fatal(err)
+	}
+
+	details, err = api.GetStockDetailsForSymbol("AAPL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sd := range details {
+		d := sd.Detail
+		if sd.Stock.StockID != StockID(4) {
+			if d.Crossover != DefaultCrossover {
+				t.Fatalf("expected default crossover for stock %d; got %s", sd.Stock.StockID, d.Crossover)
+			}
+			continue
+		}
+		if d.Crossover != *s.Crossover {
+			t.Fatalf("expected crossover %s; got %s", s.Crossover, d.Crossover)
+		}
+		if !d.N1CrossoverPercent.Valid || !d.N2CrossoverPercent.Valid {
+			t.Fatalf("expected crossover percents; got %+v", d)
+		}
+		if math.Abs(d.N1CrossoverPercent.Value-d.N1SMAPercent.Value) < 1e-6 {
+			t.Fatalf("expected 20/50 EMA percent to differ from the SMA percent %v", d.N1SMAPercent.Value)
+		}
+	}
+
+	// Invalid crossovers are refused:
+	s.Crossover = &Crossover{Fast: 50, Slow: 20, Kind: EMA}
+	if err = api.UpdateStock(s); err == nil {
+		t.Fatal("expected error for fast window longer than slow")
+	}
+
+	s.Crossover = nil
+	if err = api.UpdateStock(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Offline history that ends at `until`, when set, as if fetched on an earlier day:
+type untilProvider struct {
+	*csvdir.Provider
+	until time.Time
+}
+
+func (p *untilProvider) GetHistoryContext(ctx context.Context, symbol string, startDate, endDate time.Time) (results []yql.History, err error) {
+	if !p.until.IsZero() && endDate.After(p.until) {
+		endDate = p.until
+	}
+	return p.Provider.GetHistoryContext(ctx, symbol, startDate, endDate)
+}
+
+// Remembers which stats lookups found a recorded day:
+type seedStore struct {
+	Store
+	found map[int64]bool
+}
+
+func (s *seedStore) GetStats(ctx context.Context, symbol string, tradeDayIndex int64) (*DayStats, error) {
+	d, err := s.Store.GetStats(ctx, symbol, tradeDayIndex)
+	s.found[tradeDayIndex] = d != nil
+	return d, err
+}
+
+const incrementaldb = "./tmp-incremental.db"
+
+func TestIncrementalHistory(t *testing.T) {
+	t.Run("memory", func(t *testing.T) { testIncrementalHistory(t, NewMemoryStore()) })
+	t.Run("sqlite", func(t *testing.T) {
+		removeDB(incrementaldb)
+		defer removeDB(incrementaldb)
+
+		store, err := NewSQLiteStore(incrementaldb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testIncrementalHistory(t, store)
+	})
+}
+
+func testIncrementalHistory(t *testing.T, store Store) {
+	ctx := context.Background()
+	p := &untilProvider{Provider: csvdir.New(testdata)}
+	p.until, _ = time.ParseInLocation(dateFmt, "2013-06-28", LocNY)
+	s := &seedStore{Store: store, found: make(map[int64]bool)}
+	a, err := NewAPI(s, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	user := &User{Name: "Test User", Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddStock(&Stock{UserID: user.UserID, Symbol: "AAPL", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("450.00"), Shares: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.RecordHistory("AAPL"); err != nil {
+		t.Fatal(err)
+	}
+	_, first, err := store.GetLastTradeDay(ctx, "AAPL")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next fetch starts at the last recorded day again; it must not be counted twice:
+	p.until = time.Time{}
+	s.found = make(map[int64]bool)
+	if err = a.RecordHistory("AAPL"); err != nil {
+		t.Fatal(err)
+	}
+	_, last, err := store.GetLastTradeDay(ctx, "AAPL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	days, err := store.GetHistory(ctx, "AAPL", 1, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(days)) != last || last <= first {
+		t.Fatalf("expected %d days numbered 1 to %d after day %d; got %d", last, last, first, len(days))
+	}
+	for i, d := range days {
+		if d.TradeDayIndex != int64(i+1) {
+			t.Fatalf("expected contiguous TradeDayIndex; day %s is %d, not %d", d.Date.Value.Format(dateFmt), d.TradeDayIndex, i+1)
+		}
+	}
+
+	// The stats of the new days continue from the last day already recorded:
+	if !s.found[first] {
+		t.Fatalf("expected the stats of day %d to seed the second pass; looked up %v", first, s.found)
+	}
+	if _, err = a.GetCurrentHourlyPrices(false, "AAPL"); err != nil {
+		t.Fatal(err)
+	}
+	details, err := a.GetStockDetailsForUser(user.UserID)
+	if err != nil || len(details) != 1 {
+		t.Fatalf("expected AAPL; got %+v, %v", details, err)
+	}
+	if d := details[0].Detail; !d.N2ClosePrice.Valid || !d.N2SMAPercent.Valid {
+		t.Fatalf("expected the day before the last close; got %+v", d)
+	}
 }
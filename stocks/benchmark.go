@@ -0,0 +1,170 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Sets the index symbol, e.g. "SPY", that a user's holdings are compared against; empty for none. The symbol
+// is tracked from then on even if nobody holds it, so `RecordHistory` should be run for it. Fails with
+// `ErrBadData` if the symbol has spaces or commas in it.
+func (api *API) UpdateUserBenchmark(userID UserID, symbol string) (err error) {
+	return api.UpdateUserBenchmarkContext(context.Background(), userID, symbol)
+}
+
+// Like `UpdateUserBenchmark`; `ctx` cancels the store update.
+func (api *API) UpdateUserBenchmarkContext(ctx context.Context, userID UserID, symbol string) (err error) {
+	symbol = strings.ToUpper(strings.TrimSpace(symbol))
+	if strings.ContainsAny(symbol, " \t\r\n,") {
+		return badData("UpdateUserBenchmark", symbol, fmt.Errorf("invalid benchmark symbol %q", symbol))
+	}
+	return storeError("UpdateUserBenchmark", symbol, api.store.UpdateUserBenchmark(ctx, userID, symbol))
+}
+
+// A benchmark symbol's last recorded trading day and its current price:
+type benchmark struct {
+	symbol string
+	last   *HistoryDay // nil without history
+	curr   *big.Rat
+}
+
+// Reads a user's benchmark; nil if the user has none:
+func (api *API) benchmark(ctx context.Context, userID UserID) (b *benchmark, err error) {
+	user, err := api.store.GetUser(ctx, userID)
+	if err != nil || user == nil || user.Benchmark == "" {
+		return nil, err
+	}
+
+	b = &benchmark{symbol: user.Benchmark}
+	date, _, err := api.store.GetLastTradeDay(ctx, b.symbol)
+	if err != nil || !date.Valid {
+		return b, err
+	}
+	if b.last, err = api.store.GetLastHistoryDay(ctx, b.symbol, date.Value); err != nil || b.last == nil {
+		return b, err
+	}
+
+	// Prefer an hourly price newer than the last close:
+	b.curr = b.last.Close.Value
+	hour, err := api.store.GetLastHourlyTime(ctx, b.symbol)
+	if err != nil || !hour.Valid || !hour.Value.After(b.last.Date.Value) {
+		return b, err
+	}
+	price, err := api.store.GetHourlyPrice(ctx, b.symbol, hour.Value)
+	if err != nil {
+		return nil, err
+	}
+	if price != nil {
+		b.curr = price.Current.Value
+	}
+	return b, nil
+}
+
+// What one dollar put in the benchmark at the last close on or before `date` is worth now, counting the
+// dividends paid since; false if there is no close by then.
+func (api *API) growth(ctx context.Context, b *benchmark, date time.Time) (g *big.Rat, ok bool, err error) {
+	if b.last == nil {
+		return nil, false, nil
+	}
+	h, err := api.store.GetLastHistoryDay(ctx, b.symbol, date)
+	if err != nil || h == nil {
+		return nil, false, err
+	}
+
+	// Adjusted closes carry the dividends and splits since; the current price moves on from the last close:
+	first, last := adjustedClose(*h), b.last
+	if first.Sign() == 0 || last.Close.Value.Sign() == 0 {
+		return nil, false, nil
+	}
+	g = new(big.Rat).Quo(adjustedClose(*last), first)
+	return g.Mul(g, new(big.Rat).Quo(b.curr, last.Close.Value)), true, nil
+}
+
+// The close adjusted for later dividends and splits, or the plain close until it is adjusted:
+func adjustedClose(h HistoryDay) *big.Rat {
+	if h.AdjClose.Valid {
+		return h.AdjClose.Value
+	}
+	return h.Close.Value
+}
+
+// Compares stocks against their owners' benchmarks since their BuyDates:
+func (api *API) compareDetails(ctx context.Context, details []StockDetail) (err error) {
+	benchmarks := make(map[UserID]*benchmark)
+	for i := range details {
+		s, d := &details[i].Stock, &details[i].Detail
+
+		b, ok := benchmarks[s.UserID]
+		if !ok {
+			if b, err = api.benchmark(ctx, s.UserID); err != nil {
+				return
+			}
+			benchmarks[s.UserID] = b
+		}
+		if b == nil {
+			continue
+		}
+
+		d.BenchmarkSymbol = b.symbol
+		g, ok, err := api.growth(ctx, b, api.calendar.Date(s.BuyDate.Value))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		value := new(big.Rat).Abs(new(big.Rat).Mul(s.BuyPrice.Value, IntToRat(s.Shares)))
+		d.BenchmarkValue = NullDecimal{Value: value.Mul(value, g), Valid: true}
+		d.BenchmarkPercent = NullFloat64{Value: (RatToFloat(g) - 1.0) * 100.0, Valid: true}
+		d.AlphaPercent = alphaPercent(d.GainLossPercent, d.BenchmarkPercent)
+	}
+	return nil
+}
+
+// Compares the open lots of a user's positions against the user's benchmark since each was opened:
+func (api *API) comparePositions(ctx context.Context, userID UserID, positions []Position) (err error) {
+	b, err := api.benchmark(ctx, userID)
+	if err != nil || b == nil {
+		return
+	}
+
+	for i := range positions {
+		p := &positions[i]
+		if len(p.Lots) == 0 {
+			continue
+		}
+
+		value, valid := new(big.Rat), true
+		for _, l := range p.Lots {
+			g, ok, err := api.growth(ctx, b, api.calendar.Date(l.Date.Value))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				valid = false
+				break
+			}
+			value.Add(value, new(big.Rat).Mul(new(big.Rat).Abs(l.Cost()), g))
+		}
+		if !valid {
+			continue
+		}
+		invested := p.invested()
+		p.BenchmarkValue = NullDecimal{Value: value, Valid: true}
+		p.BenchmarkPercent = percentOf(NullDecimal{Value: new(big.Rat).Sub(value, invested), Valid: true}, NullDecimal{Value: invested, Valid: true})
+		p.AlphaPercent = alphaPercent(p.UnrealizedPercent, p.BenchmarkPercent)
+	}
+	return nil
+}
+
+// A return less the benchmark's over the same window; not valid unless both are:
+func alphaPercent(ret, benchmark NullFloat64) NullFloat64 {
+	if !ret.Valid || !benchmark.Valid {
+		return NullFloat64{}
+	}
+	return NullFloat64{Value: ret.Value - benchmark.Value, Valid: true}
+}
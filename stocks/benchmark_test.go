@@ -0,0 +1,126 @@
+package stocks
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+)
+
+const benchmarkdb = "./tmp-benchmark.db"
+
+func TestBenchmark(t *testing.T) {
+	t.Run("memory", func(t *testing.T) { testBenchmark(t, NewMemoryStore()) })
+	t.Run("sqlite", func(t *testing.T) {
+		removeDB(benchmarkdb)
+		defer removeDB(benchmarkdb)
+
+		store, err := NewSQLiteStore(benchmarkdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testBenchmark(t, store)
+	})
+}
+
+func testBenchmark(t *testing.T, store Store) {
+	a, err := NewAPI(store, csvdir.New(testdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	user := &User{Name: "Test User", Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	// MSFT owned and bought in the ledger on the same day, compared against AAPL which nobody holds:
+	if err = a.AddStock(&Stock{UserID: user.UserID, Symbol: "MSFT", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("30.00"), Shares: 10}); err != nil {
+		t.Fatal(err)
+	}
+	buy := testTransaction(0, Buy, "2013-06-03", 10, "30.00")
+	buy.UserID = user.UserID
+	if err = a.AddTransaction(&buy); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.UpdateUserBenchmark(user.UserID, "S P Y"); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data for a symbol with spaces; got %v", err)
+	}
+	if err = a.UpdateUserBenchmark(user.UserID, " aapl "); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := a.GetUser(user.UserID); err != nil || u.Benchmark != "AAPL" {
+		t.Fatalf("expected AAPL as the benchmark; got %+v, %v", u, err)
+	}
+
+	// The benchmark is tracked with history back to the user's earliest holding:
+	symbols, err := a.GetAllTrackedSymbols()
+	if err != nil || !reflect.DeepEqual(symbols, []string{"AAPL", "MSFT"}) {
+		t.Fatalf("expected AAPL and MSFT tracked; got %v, %v", symbols, err)
+	}
+	minDate, err := a.GetMinBuyDate("AAPL")
+	if err != nil || !minDate.Valid || minDate.Value.Format(dateFmt) != "2013-06-03" {
+		t.Fatalf("expected AAPL history needed from 2013-06-03; got %v, %v", minDate, err)
+	}
+	for _, symbol := range symbols {
+		if err = a.RecordHistory(symbol); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prices, err := a.GetCurrentHourlyPrices(false, symbols...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AAPL closed at 571.13 on 2013-06-03:
+	growth := new(big.Rat).Quo(prices["AAPL"].Value, ToRat("571.13"))
+	benchmark := (RatToFloat(growth) - 1.0) * 100.0
+	near := func(x NullFloat64, want float64) bool { return x.Valid && math.Abs(x.Value-want) < 1e-9 }
+
+	details, err := a.GetStockDetailsForUser(user.UserID)
+	if err != nil || len(details) != 1 {
+		t.Fatalf("expected MSFT; got %+v, %v", details, err)
+	}
+	d := details[0].Detail
+	if d.BenchmarkSymbol != "AAPL" || !near(d.BenchmarkPercent, benchmark) || !near(d.AlphaPercent, d.GainLossPercent.Value-benchmark) {
+		t.Fatalf("expected AAPL returning %f since 2013-06-03; got %+v", benchmark, d)
+	}
+	value := new(big.Rat).Mul(big.NewRat(300, 1), growth)
+	if !d.BenchmarkValue.Valid || d.BenchmarkValue.Value.Cmp(value) != 0 {
+		t.Fatalf("expected 300.00 to be worth %s in AAPL; got %v", value.FloatString(2), d.BenchmarkValue)
+	}
+
+	// The ledger lot fares the same, and so does the portfolio holding both:
+	positions, err := a.GetPositions(user.UserID, FIFO)
+	if err != nil || len(positions) != 1 {
+		t.Fatalf("expected a MSFT position; got %+v, %v", positions, err)
+	}
+	p := positions[0]
+	if !near(p.UnrealizedPercent, d.GainLossPercent.Value) || !near(p.BenchmarkPercent, benchmark) || !near(p.AlphaPercent, d.AlphaPercent.Value) {
+		t.Fatalf("expected the position to match the stock; got %+v", p)
+	}
+	portfolios, err := a.GetPortfolioDetails(user.UserID, FIFO)
+	if err != nil || len(portfolios) != 1 {
+		t.Fatalf("expected holdings in no portfolio; got %+v, %v", portfolios, err)
+	}
+	if summary := portfolios[0].Summary; !near(summary.BenchmarkPercent, benchmark) || !near(summary.AlphaPercent, d.AlphaPercent.Value) {
+		t.Fatalf("expected the portfolio to match the stock; got %+v", summary)
+	}
+
+	// Nothing to compare against without a benchmark:
+	if err = a.UpdateUserBenchmark(user.UserID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if details, err = a.GetStockDetailsForUser(user.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if d = details[0].Detail; d.BenchmarkSymbol != "" || d.BenchmarkPercent.Valid || d.AlphaPercent.Valid {
+		t.Fatalf("expected no benchmark; got %+v", d)
+	}
+}
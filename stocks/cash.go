@@ -0,0 +1,142 @@
+package stocks
+
+// general stuff:
+import (
+	"math/big"
+)
+
+// A portfolio's value, cost and returns, totalled exactly:
+type PortfolioSummary struct {
+	// Of owned stocks and open positions at current prices; not valid if any of them has no current price:
+	MarketValue NullDecimal
+	// What owned stocks and open positions cost; shorts count negative as what they were sold for:
+	CostBasis Decimal
+	// Deposits less withdrawals, adjusted by the ledger's trades and dividends:
+	Cash Decimal
+	// MarketValue plus Cash:
+	TotalValue NullDecimal
+
+	// MarketValue less CostBasis:
+	UnrealizedGain NullDecimal
+	// Of shares closed in the ledger:
+	RealizedGain Decimal
+	// Received on ledger positions:
+	Dividends Decimal
+	// Unrealized and realized gains plus dividends:
+	TotalReturn NullDecimal
+
+	// UnrealizedGain as a percentage of what the holdings cost, with shorts counting as what they brought in:
+	UnrealizedPercent NullFloat64
+	// What the same money would have made in the owner's benchmark since each holding was bought, and
+	// UnrealizedPercent less that; not valid unless every holding has a `BenchmarkValue`:
+	BenchmarkPercent NullFloat64
+	AlphaPercent     NullFloat64
+
+	// Share of the TotalValue of all of the user's portfolios; only set by `GetPortfolioDetails`:
+	AllocationPercent NullFloat64
+}
+
+// Summarizes owned stocks and ledger positions valued at their current prices, with a cash balance.
+func Summarize(owned []StockDetail, positions []Position, cash Decimal) (s PortfolioSummary) {
+	value, cost := new(big.Rat), new(big.Rat)
+	realized, dividends := new(big.Rat), new(big.Rat)
+	invested, benchmark := new(big.Rat), new(big.Rat)
+	valid, compared := true, true
+
+	for _, sd := range owned {
+		shares := IntToRat(sd.Stock.Shares)
+		held := new(big.Rat).Mul(sd.Stock.BuyPrice.Value, shares)
+		cost.Add(cost, held)
+		invested.Add(invested, held.Abs(held))
+		if sd.Detail.BenchmarkValue.Valid {
+			benchmark.Add(benchmark, sd.Detail.BenchmarkValue.Value)
+		} else {
+			compared = false
+		}
+		if !sd.Detail.CurrPrice.Valid {
+			valid = false
+			continue
+		}
+		value.Add(value, new(big.Rat).Mul(sd.Detail.CurrPrice.Value, shares))
+	}
+	for _, p := range positions {
+		cost.Add(cost, p.CostBasis.Value)
+		realized.Add(realized, p.RealizedGain.Value)
+		dividends.Add(dividends, p.Dividends.Value)
+		if len(p.Lots) > 0 {
+			invested.Add(invested, p.invested())
+			if p.BenchmarkValue.Valid {
+				benchmark.Add(benchmark, p.BenchmarkValue.Value)
+			} else {
+				compared = false
+			}
+		}
+		if p.MarketValue.Valid {
+			value.Add(value, p.MarketValue.Value)
+		} else if p.Shares != 0 {
+			valid = false
+		}
+	}
+
+	unrealized := new(big.Rat).Sub(value, cost)
+	s.MarketValue = NullDecimal{Value: value, Valid: valid}
+	s.CostBasis = Decimal{Value: cost}
+	s.Cash = Decimal{Value: new(big.Rat).Set(cash.Value)}
+	s.TotalValue = NullDecimal{Value: new(big.Rat).Add(value, cash.Value), Valid: valid}
+	s.UnrealizedGain = NullDecimal{Value: unrealized, Valid: valid}
+	s.RealizedGain = Decimal{Value: realized}
+	s.Dividends = Decimal{Value: dividends}
+	s.TotalReturn = NullDecimal{Value: new(big.Rat).Add(unrealized, new(big.Rat).Add(realized, dividends)), Valid: valid}
+
+	basis := NullDecimal{Value: invested, Valid: true}
+	s.UnrealizedPercent = percentOf(s.UnrealizedGain, basis)
+	if compared {
+		s.BenchmarkPercent = percentOf(NullDecimal{Value: benchmark.Sub(benchmark, invested), Valid: true}, basis)
+		s.AlphaPercent = alphaPercent(s.UnrealizedPercent, s.BenchmarkPercent)
+	}
+	return
+}
+
+// Summarizes the holdings and cash of several portfolios together.
+func TotalSummary(portfolios []PortfolioDetail) PortfolioSummary {
+	owned := make([]StockDetail, 0, 16)
+	positions := make([]Position, 0, 16)
+	cash := new(big.Rat)
+	for _, pd := range portfolios {
+		owned = append(owned, pd.Owned...)
+		positions = append(positions, pd.Positions...)
+		cash.Add(cash, pd.Summary.Cash.Value)
+	}
+	return Summarize(owned, positions, Decimal{Value: cash})
+}
+
+// The cash left by one portfolio's ledger: deposits less withdrawals, plus what sells and shorts brought in
+// less what buys and covers cost, plus the dividends of its positions.
+func cashBalance(txns []Transaction, positions []Position) Decimal {
+	cash := new(big.Rat)
+	for _, t := range txns {
+		amount := t.Price.Value
+		if !t.Kind.IsCash() {
+			amount = new(big.Rat).Mul(t.Price.Value, IntToRat(t.Shares))
+		}
+		switch t.Kind {
+		case Deposit, Sell, Short:
+			cash.Add(cash, amount)
+		case Withdrawal, Buy, Cover:
+			cash.Sub(cash, amount)
+		}
+	}
+	for _, p := range positions {
+		cash.Add(cash, p.Dividends.Value)
+	}
+	return Decimal{Value: cash}
+}
+
+// Gets `part` as a percentage of `whole`; not valid if either is unknown or `whole` is zero:
+func percentOf(part, whole NullDecimal) NullFloat64 {
+	if !part.Valid || !whole.Valid || whole.Value.Sign() == 0 {
+		return NullFloat64{}
+	}
+	pct := new(big.Rat).Quo(new(big.Rat).Mul(part.Value, big.NewRat(100, 1)), whole.Value)
+	return NullFloat64{Value: RatToFloat(pct), Valid: true}
+}
@@ -0,0 +1,155 @@
+package stocks
+
+import (
+	"errors"
+	"testing"
+)
+
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+)
+
+func testDividend(date string, amount string) Dividend {
+	return Dividend{Symbol: "MSFT", Date: testDateTime(dateFmt, date), Amount: ToDecimal(amount)}
+}
+
+func TestDividendsReceived(t *testing.T) {
+	txns := []Transaction{
+		testTransaction(1, Buy, "2013-06-03", 10, "30.00"),
+		testTransaction(2, Buy, "2013-06-17", 5, "30.00"),
+		testTransaction(3, Sell, "2013-06-24", 10, "16.00"),
+	}
+	splits := []Split{
+		Split{Symbol: "MSFT", Date: testDateTime(dateFmt, "2013-06-20"), Numerator: 2, Denominator: 1},
+	}
+	dividends := []Dividend{
+		// Before anything was bought:
+		testDividend("2013-05-15", "1.00"),
+		// On 10 shares; the buy on the ex-dividend date doesn't get it:
+		testDividend("2013-06-10", "0.23"),
+		testDividend("2013-06-17", "0.23"),
+		// On the 20 shares left of 30 after the split:
+		testDividend("2013-06-28", "0.12"),
+	}
+
+	paid, err := dividendsReceived(txns, splits, dividends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paid.FloatString(2); got != "7.00" {
+		t.Fatalf("expected 7.00 in dividends; got %s", got)
+	}
+
+	// Shorts pay dividends:
+	txns = []Transaction{testTransaction(1, Short, "2013-06-03", 10, "30.00")}
+	if paid, err = dividendsReceived(txns, nil, dividends); err != nil {
+		t.Fatal(err)
+	}
+	if got := paid.FloatString(2); got != "-5.80" {
+		t.Fatalf("expected -5.80 in dividends; got %s", got)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	deposit := Transaction{Kind: Deposit, Date: testDateTime(dateFmt, "2013-06-01"), Price: ToDecimal("1000.00")}
+	withdrawal := Transaction{Kind: Withdrawal, Date: testDateTime(dateFmt, "2013-06-05"), Price: ToDecimal("100.00")}
+	txns := []Transaction{
+		deposit,
+		testTransaction(1, Buy, "2013-06-03", 10, "30.00"),
+		testTransaction(2, Sell, "2013-06-04", 4, "35.00"),
+		withdrawal,
+	}
+	positions := []Position{
+		Position{
+			Symbol:       "MSFT",
+			Shares:       6,
+			CostBasis:    ToDecimal("180.00"),
+			RealizedGain: ToDecimal("20.00"),
+			Dividends:    ToDecimal("2.30"),
+			MarketValue:  ToNullDecimal("240.00"),
+		},
+	}
+
+	cash := cashBalance(txns, positions)
+	if cash.String() != "742.30" {
+		t.Fatalf("expected 742.30 cash; got %s", cash)
+	}
+
+	owned := []StockDetail{
+		StockDetail{
+			Stock:  Stock{Symbol: "AAPL", BuyPrice: ToDecimal("30.00"), Shares: 10},
+			Detail: Detail{CurrPrice: ToNullDecimal("33.00")},
+		},
+	}
+	s := Summarize(owned, positions, cash)
+	for _, c := range []struct{ what, got, expected string }{
+		{"market value", s.MarketValue.String(), "570.00"},
+		{"cost basis", s.CostBasis.String(), "480.00"},
+		{"total value", s.TotalValue.String(), "1312.30"},
+		{"unrealized gain", s.UnrealizedGain.String(), "90.00"},
+		{"total return", s.TotalReturn.String(), "112.30"},
+	} {
+		if c.got != c.expected {
+			t.Fatalf("expected %s of %s; got %s", c.what, c.expected, c.got)
+		}
+	}
+
+	// Value is unknown without a current price:
+	owned[0].Detail.CurrPrice = NullDecimal{}
+	if s = Summarize(owned, positions, cash); s.MarketValue.Valid || s.TotalValue.Valid || s.TotalReturn.Valid {
+		t.Fatalf("expected no market value; got %+v", s)
+	}
+	if s.CostBasis.String() != "480.00" || s.Cash.String() != "742.30" {
+		t.Fatalf("expected cost and cash to be known; got %+v", s)
+	}
+}
+
+func TestCashLedger(t *testing.T) {
+	a, err := NewAPI(NewMemoryStore(), csvdir.New(testdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	user := &User{Name: "Test User", Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	deposit := Transaction{UserID: user.UserID, Kind: Deposit, Symbol: "MSFT", Date: testDateTime(dateFmt, "2013-06-01"), Price: ToDecimal("1000.00")}
+	if err = a.AddTransaction(&deposit); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data depositing with a symbol; got %v", err)
+	}
+	deposit.Symbol = ""
+	if err = a.AddTransaction(&deposit); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cash is not a symbol to track:
+	symbols, err := a.GetAllTrackedSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(symbols) != 0 {
+		t.Fatalf("expected no tracked symbols; got %v", symbols)
+	}
+
+	details, err := a.GetPortfolioDetails(user.UserID, FIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(details) != 1 || len(details[0].Positions) != 0 {
+		t.Fatalf("expected only cash in no portfolio; got %+v", details)
+	}
+	s := details[0].Summary
+	if s.Cash.String() != "1000.00" || s.TotalValue.String() != "1000.00" || s.AllocationPercent.String() != "100.00" {
+		t.Fatalf("expected 1000.00 cash making up all of the value; got %+v", s)
+	}
+
+	if err = a.RemoveTransaction(deposit.TransactionID); err != nil {
+		t.Fatal(err)
+	}
+	if details, err = a.GetPortfolioDetails(user.UserID, FIFO); err != nil || len(details) != 0 {
+		t.Fatalf("expected nothing left; got %+v, %v", details, err)
+	}
+}
@@ -0,0 +1,98 @@
+package stocks
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+)
+
+func TestDayRollover(t *testing.T) {
+	a, err := NewAPI(NewMemoryStore(), csvdir.New(testdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// Pretend the API was created a few days ago:
+	a.today = a.today.AddDate(0, 0, -3)
+	a.lastTradingDate = a.today.AddDate(0, 0, -1)
+
+	today := a.calendar.Date(time.Now().In(LocNY))
+	if got := a.Today(); !got.Equal(today) {
+		t.Fatalf("expected today %v; got %v", today, got)
+	}
+	if got, expected := a.LastTradingDate(), a.calendar.PrevTradingDay(today); !got.Equal(expected) {
+		t.Fatalf("expected last trading date %v; got %v", expected, got)
+	}
+}
+
+// Adds a user owning MSFT to a new API over an in-memory store:
+func newMSFTAPI(t *testing.T) (a *API, userID UserID) {
+	a, err := NewAPI(NewMemoryStore(), csvdir.New(testdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Name: "Test User", Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+	s := &Stock{UserID: user.UserID, Symbol: "MSFT", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("30.00"), Shares: 10}
+	if err = a.AddStock(s); err != nil {
+		t.Fatal(err)
+	}
+	return a, user.UserID
+}
+
+func TestRecordHistoryConcurrently(t *testing.T) {
+	a, userID := newMSFTAPI(t)
+	defer a.Close()
+
+	// Requests sharing the API record and read the same symbol at once:
+	const n = 8
+	errs := make(chan error, 3*n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- a.RecordHistory("MSFT")
+			_, err := a.GetCurrentHourlyPrices(true, "MSFT")
+			errs <- err
+			_, err = a.GetStockDetailsForUser(userID)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same history is recorded as by a single call:
+	b, _ := newMSFTAPI(t)
+	defer b.Close()
+	if err := b.RecordHistory("MSFT"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	_, got, err := a.store.GetLastTradeDay(ctx, "MSFT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, expected, err := b.store.GetLastTradeDay(ctx, "MSFT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != expected {
+		t.Fatalf("expected %d trading days; got %d", expected, got)
+	}
+}
@@ -0,0 +1,178 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"fmt"
+)
+
+// Kind of moving average compared by a crossover:
+type AverageKind string
+
+const (
+	SMA AverageKind = "SMA" // simple moving average
+	EMA AverageKind = "EMA" // exponential moving average
+)
+
+// Fast and slow moving averages whose crossover signals a stock turning bullish or bearish.
+type Crossover struct {
+	Fast int
+	Slow int
+	Kind AverageKind
+}
+
+// The classic 50/200-day SMA crossover:
+var DefaultCrossover = Crossover{Fast: shortWindow, Slow: longWindow, Kind: SMA}
+
+// e.g. "50/200-day SMA"
+func (c Crossover) String() string {
+	return fmt.Sprintf("%d/%d-day %s", c.Fast, c.Slow, c.Kind)
+}
+
+// Checks the windows fit within the history recorded for each stock.
+func (c Crossover) Validate() error {
+	if c.Kind != SMA && c.Kind != EMA {
+		return fmt.Errorf("crossover kind must be SMA or EMA; got %q", c.Kind)
+	}
+	if c.Fast < 1 || c.Fast >= c.Slow {
+		return fmt.Errorf("crossover fast window must be at least 1 day and shorter than the slow window; got %d/%d", c.Fast, c.Slow)
+	}
+	if c.Slow > longWindow {
+		return fmt.Errorf("crossover slow window must be at most %d days; got %d", longWindow, c.Slow)
+	}
+	return nil
+}
+
+// A moving average fed one close at a time:
+type rollingAverage interface {
+	Push(v float64)
+	Value() float64
+	Ready() bool
+}
+
+func (c Crossover) averages() (fast, slow rollingAverage) {
+	if c.Kind == EMA {
+		return newEMA(c.Fast), newEMA(c.Slow)
+	}
+	return newMovingAverage(c.Fast), newMovingAverage(c.Slow)
+}
+
+// A trading day's fast and slow averages for a crossover:
+type CrossoverDay struct {
+	Date          DateTime
+	TradeDayIndex int64
+	Fast          float64
+	Slow          float64
+	// ((Fast / Slow) - 1) * 100; positive when bullish:
+	Percent float64
+}
+
+// Computes a crossover's averages over `closes`, which must be consecutive trading days in ascending order.
+// Days are produced only at or after TradeDayIndex `from` once both averages are full.
+//
+// SMA crossovers refill their windows from `closes`, which must include the `Slow` - 1 days before `from`.
+// EMA crossovers continue from `seed`, the recorded averages of a day in `closes` before `from`; if `seed`
+// is nil, `closes` must start at the first trading day.
+func crossoverSeries(closes []dayClose, c Crossover, from int64, seed *CrossoverDay) (days []CrossoverDay) {
+	fast, slow := c.averages()
+
+	skipTo := int64(0)
+	if seed != nil && c.Kind == EMA {
+		fast.(*expAverage).Resume(seed.Fast)
+		slow.(*expAverage).Resume(seed.Slow)
+		skipTo = seed.TradeDayIndex
+	}
+
+	days = make([]CrossoverDay, 0, len(closes))
+	for _, cl := range closes {
+		if cl.TradeDayIndex <= skipTo {
+			continue
+		}
+		fast.Push(cl.Close)
+		slow.Push(cl.Close)
+
+		if cl.TradeDayIndex < from || !fast.Ready() || !slow.Ready() {
+			continue
+		}
+
+		f, s := fast.Value(), slow.Value()
+		days = append(days, CrossoverDay{
+			Date:          cl.Date,
+			TradeDayIndex: cl.TradeDayIndex,
+			Fast:          f,
+			Slow:          s,
+			Percent:       ((f / s) - 1) * 100,
+		})
+	}
+
+	return
+}
+
+// Sets the crossover used for all of a user's stocks that don't choose their own.
+func (api *API) UpdateUserCrossover(userID UserID, c Crossover) (err error) {
+	if err = c.Validate(); err != nil {
+		return badData("UpdateUserCrossover", "", err)
+	}
+	return api.store.UpdateUserCrossover(context.Background(), userID, c)
+}
+
+// Brings the cached series of every crossover in use for a symbol up to date. Each series continues after
+// its last cached day, or from TradeDayIndex `changedFrom` if earlier adjusted closes changed.
+func (api *API) recordCrossovers(ctx context.Context, symbol string, changedFrom int64) (err error) {
+	crossovers, err := api.store.GetCrossoversInUse(ctx, symbol)
+	if err != nil || len(crossovers) == 0 {
+		return
+	}
+
+	lastDate, lastTradeDay, err := api.GetLastTradeDay(symbol)
+	if err != nil || !lastDate.Valid {
+		// No history yet:
+		return
+	}
+
+	for _, c := range crossovers {
+		var last int64
+		if last, err = api.store.GetLastCrossoverDay(ctx, symbol, c); err != nil {
+			return
+		}
+
+		from := last + 1
+		if changedFrom > 0 && changedFrom < from {
+			from = changedFrom
+		}
+		if from > lastTradeDay {
+			continue
+		}
+
+		// Find where the averages can start from:
+		var seed *CrossoverDay
+		start := int64(1)
+		if c.Kind == EMA {
+			if seed, err = api.store.GetCrossoverDay(ctx, symbol, c, from-1); err != nil {
+				return
+			}
+			if seed != nil {
+				start = seed.TradeDayIndex
+			}
+		} else if from > int64(c.Slow) {
+			start = from - int64(c.Slow) + 1
+		}
+
+		var closes []dayClose
+		if closes, err = api.getCloses(ctx, symbol, start, lastTradeDay); err != nil {
+			return
+		}
+
+		days := crossoverSeries(closes, c, from, seed)
+		if len(days) == 0 {
+			continue
+		}
+
+		err = api.store.SetCrossoverDays(ctx, symbol, c, days)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,107 @@
+package stocks
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCrossoverValidate(t *testing.T) {
+	tests := []struct {
+		c     Crossover
+		valid bool
+	}{
+		{DefaultCrossover, true},
+		{Crossover{Fast: 20, Slow: 50, Kind: EMA}, true},
+		{Crossover{Fast: 1, Slow: 200, Kind: SMA}, true},
+		{Crossover{Fast: 50, Slow: 20, Kind: SMA}, false},
+		{Crossover{Fast: 20, Slow: 20, Kind: SMA}, false},
+		{Crossover{Fast: 0, Slow: 20, Kind: SMA}, false},
+		{Crossover{Fast: 50, Slow: 250, Kind: SMA}, false},
+		{Crossover{Fast: 20, Slow: 50, Kind: "WMA"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.c.Validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid %v; got %v", test.c, test.valid, err)
+		}
+	}
+}
+
+func TestCrossoverSeries(t *testing.T) {
+	linear := series(100, func(i int64) float64 { return float64(i) })
+	// Flat at 1 for the first 70 days then jumps to 101:
+	step := series(100, func(i int64) float64 {
+		if i <= 70 {
+			return 1
+		}
+		return 101
+	})
+
+	tests := []struct {
+		name   string
+		closes []dayClose
+		c      Crossover
+		// Expected number of days and the expected averages of the last day:
+		count int
+		fast  float64
+		slow  float64
+	}{
+		// Windows of consecutive integers average to their middle:
+		{"sma linear", linear, Crossover{Fast: 5, Slow: 20, Kind: SMA}, 81, 98, 90.5},
+		// Each EMA lags the latest close by (period - 1) / 2:
+		{"ema linear", linear, Crossover{Fast: 5, Slow: 20, Kind: EMA}, 81, 98, 90.5},
+		// Fast window already full of the new price; slow window holds 10 old and 30 new days:
+		{"sma step", step, Crossover{Fast: 10, Slow: 40, Kind: SMA}, 61, 101, 76},
+		{"too short", linear[:19], Crossover{Fast: 5, Slow: 20, Kind: SMA}, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		days := crossoverSeries(test.closes, test.c, 1, nil)
+		if len(days) != test.count {
+			t.Errorf("%s: expected %d days; got %d", test.name, test.count, len(days))
+			continue
+		}
+		if test.count == 0 {
+			continue
+		}
+
+		last := days[len(days)-1]
+		if math.Abs(last.Fast-test.fast) > 1e-9 || math.Abs(last.Slow-test.slow) > 1e-9 {
+			t.Errorf("%s: expected %v/%v; got %v/%v", test.name, test.fast, test.slow, last.Fast, last.Slow)
+		}
+		if expected := ((test.fast / test.slow) - 1) * 100; math.Abs(last.Percent-expected) > 1e-9 {
+			t.Errorf("%s: expected percent %v; got %v", test.name, expected, last.Percent)
+		}
+	}
+}
+
+func TestCrossoverSeriesResume(t *testing.T) {
+	closes := series(150, func(i int64) float64 { return 30 + 5*math.Sin(float64(i)/9) })
+
+	for _, c := range []Crossover{{Fast: 12, Slow: 26, Kind: EMA}, {Fast: 10, Slow: 30, Kind: SMA}} {
+		full := crossoverSeries(closes, c, 1, nil)
+		byDay := make(map[int64]CrossoverDay, len(full))
+		for _, d := range full {
+			byDay[d.TradeDayIndex] = d
+		}
+
+		// Continue from day 120 as recordCrossovers would:
+		var resumed []CrossoverDay
+		if c.Kind == EMA {
+			seed := byDay[120]
+			resumed = crossoverSeries(closes[119:], c, 121, &seed)
+		} else {
+			resumed = crossoverSeries(closes[121-c.Slow:], c, 121, nil)
+		}
+
+		if len(resumed) != 30 {
+			t.Fatalf("%s: expected 30 resumed days; got %d", c, len(resumed))
+		}
+		for _, r := range resumed {
+			d := byDay[r.TradeDayIndex]
+			if math.Abs(d.Fast-r.Fast) > 1e-9 || math.Abs(d.Slow-r.Slow) > 1e-9 {
+				t.Fatalf("%s day %d: resumed %+v differs from full %+v", c, r.TradeDayIndex, r, d)
+			}
+		}
+	}
+}
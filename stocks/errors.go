@@ -0,0 +1,105 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/yql"
+)
+
+// Kinds of API errors; test for them with `errors.Is`, e.g. `errors.Is(err, stocks.ErrNotFound)`:
+var (
+	// The quote provider or the store has nothing for a symbol, user or stock:
+	ErrNotFound = errors.New("not found")
+	// The quote provider could not be reached or failed to answer:
+	ErrProviderUnavailable = errors.New("quote provider unavailable")
+	// A value from the quote provider, the store or the caller could not be parsed:
+	ErrBadData = errors.New("bad data")
+	// Another run holds an advisory run lock:
+	ErrLocked = errors.New("locked by another run")
+)
+
+// An error from an API operation, wrapping its underlying cause.
+type Error struct {
+	Op     string // the API operation, e.g. "RecordHistory"
+	Symbol string // the symbol operated on, if any
+	Kind   error  // one of the `Err*` kinds above; nil for store failures and cancellation
+	Err    error
+}
+
+func (e *Error) Error() string {
+	msg := e.Op
+	if e.Symbol != "" {
+		msg += " " + e.Symbol
+	}
+	if e.Kind != nil {
+		if msg != "" {
+			msg += ": "
+		}
+		msg += e.Kind.Error()
+	}
+	if msg == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Matches the error's kind:
+func (e *Error) Is(target error) bool { return e.Kind != nil && target == e.Kind }
+
+// Wraps `err` as an API error of the given kind. Already wrapped errors keep their kind and original
+// operation; only a missing operation or symbol is filled in.
+func wrapError(op, symbol string, kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		if e.Op != "" && e.Symbol != "" {
+			return e
+		}
+		w := *e
+		if w.Op == "" {
+			w.Op = op
+		}
+		if w.Symbol == "" {
+			w.Symbol = symbol
+		}
+		return &w
+	}
+	return &Error{Op: op, Symbol: symbol, Kind: kind, Err: err}
+}
+
+// Wraps an error from the quote provider; undecodable responses and unusable prices are bad data, a
+// cancelled or expired context is left without a kind and everything else means the provider is unavailable.
+func providerError(op, symbol string, err error) error {
+	switch err.(type) {
+	case *yql.ResponseError, *yql.PriceError, yql.PriceErrors:
+		return wrapError(op, symbol, ErrBadData, err)
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return wrapError(op, symbol, nil, err)
+	}
+	return wrapError(op, symbol, ErrProviderUnavailable, err)
+}
+
+// Wraps a parse error of a value as bad data:
+func badData(op, symbol string, err error) error {
+	return wrapError(op, symbol, ErrBadData, err)
+}
+
+// The error stores return for a stock ID they have no record of:
+func stockNotFound(stockID StockID) error {
+	return wrapError("GetStock", "", ErrNotFound, fmt.Errorf("stock %d does not exist", stockID))
+}
+
+// Wraps a store error from an API operation:
+func storeError(op, symbol string, err error) error {
+	return wrapError(op, symbol, nil, err)
+}
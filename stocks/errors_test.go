@@ -0,0 +1,166 @@
+package stocks
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+	"github.com/JamesDunne/StockWatcher/yql"
+)
+
+// The offline provider, unreachable or with unparseable prices for one symbol:
+type faultyProvider struct {
+	*csvdir.Provider
+	down bool
+	bad  string
+}
+
+var errDown = errors.New("connection refused")
+
+func (p *faultyProvider) GetQuotesContext(ctx context.Context, symbols ...string) (quotes []yql.Quote, err error) {
+	if p.down {
+		return nil, errDown
+	}
+	quotes, err = p.Provider.GetQuotesContext(ctx, symbols...)
+	if err != nil {
+		return
+	}
+
+	kept := make([]yql.Quote, 0, len(quotes))
+	rejected := yql.PriceErrors(nil)
+	for _, q := range quotes {
+		if q.Symbol == p.bad {
+			rejected = append(rejected, &yql.PriceError{Symbol: q.Symbol, Field: "LastTradePriceOnly", Value: "N/A"})
+			continue
+		}
+		kept = append(kept, q)
+	}
+	if len(rejected) > 0 {
+		return kept, rejected
+	}
+	return kept, nil
+}
+
+func (p *faultyProvider) GetHistoryContext(ctx context.Context, symbol string, startDate, endDate time.Time) (results []yql.History, err error) {
+	if p.down {
+		return nil, errDown
+	}
+	results, err = p.Provider.GetHistoryContext(ctx, symbol, startDate, endDate)
+	if symbol == p.bad {
+		for i := range results {
+			results[i].Close = "N/A"
+		}
+	}
+	return
+}
+
+func TestRecordHistoryErrors(t *testing.T) {
+	p := &faultyProvider{Provider: csvdir.New(testdata)}
+	a, err := NewAPI(NewMemoryStore(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	user := &User{Name: "Test User", Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range []string{"MSFT", "AAPL", "NOPE"} {
+		s := &Stock{UserID: user.UserID, Symbol: symbol, BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("30.00"), Shares: 10}
+		if err = a.AddStock(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The provider has no history for an unknown symbol:
+	err = a.RecordHistory("NOPE")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found; got %v", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Symbol != "NOPE" || !strings.Contains(err.Error(), "NOPE") {
+		t.Fatalf("expected error about NOPE; got %v", err)
+	}
+
+	// An unreachable provider fails every symbol:
+	p.down = true
+	if err = a.RecordHistory("MSFT"); !errors.Is(err, ErrProviderUnavailable) || !errors.Is(err, errDown) {
+		t.Fatalf("expected provider unavailable; got %v", err)
+	}
+	if _, err = a.GetCurrentHourlyPrices(true, "MSFT", "AAPL"); !errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("expected provider unavailable; got %v", err)
+	}
+
+	// Unparseable prices fail only their symbol:
+	p.down, p.bad = false, "MSFT"
+	if err = a.RecordHistory("MSFT"); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data; got %v", err)
+	}
+	if err = a.RecordHistory("AAPL"); err != nil {
+		t.Fatal(err)
+	}
+
+	prices, err := a.GetCurrentHourlyPrices(true, "MSFT", "AAPL")
+	if !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data; got %v", err)
+	}
+	if _, ok := prices["MSFT"]; ok {
+		t.Fatalf("expected no price for MSFT; got %v", prices)
+	}
+	if _, ok := prices["AAPL"]; !ok {
+		t.Fatalf("expected a price for AAPL; got %v", prices)
+	}
+}
+
+// A quote provider that never answers before its context is done:
+type slowProvider struct {
+	*csvdir.Provider
+}
+
+func (p *slowProvider) GetQuotesContext(ctx context.Context, symbols ...string) (quotes []yql.Quote, err error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (p *slowProvider) GetHistoryContext(ctx context.Context, symbol string, startDate, endDate time.Time) (results []yql.History, err error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRecordHistoryCancellation(t *testing.T) {
+	a, err := NewAPI(NewMemoryStore(), &slowProvider{Provider: csvdir.New(testdata)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	user := &User{Name: "Test User", Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+	s := &Stock{UserID: user.UserID, Symbol: "MSFT", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("30.00"), Shares: 10}
+	if err = a.AddStock(s); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = a.RecordHistoryContext(ctx, "MSFT")
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("expected deadline exceeded; got %v", err)
+	}
+	if _, err = a.GetCurrentHourlyPricesContext(ctx, true, "MSFT"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected to stop at the deadline; took %v", elapsed)
+	}
+}
@@ -0,0 +1,131 @@
+package stocks
+
+// general stuff:
+import (
+	"math"
+)
+
+// Indicator periods, in trading days:
+const (
+	emaFastPeriod    = 12
+	emaSlowPeriod    = 26
+	macdSignalPeriod = 9
+	rsiPeriod        = 14
+	atrPeriod        = 14
+	bollingerPeriod  = 20
+	// Bollinger band width in standard deviations:
+	bollingerWidth = 2.0
+)
+
+// Exponential moving average seeded with the simple average of its first `period` values.
+// After that each value v moves the average by alpha * (v - average).
+type expAverage struct {
+	period int
+	alpha  float64
+	count  int
+	value  float64
+}
+
+// EMA with the usual alpha = 2 / (period + 1):
+func newEMA(period int) *expAverage {
+	return &expAverage{period: period, alpha: 2 / float64(period+1)}
+}
+
+// Wilder's smoothing as used by RSI and ATR; alpha = 1 / period:
+func newWilder(period int) *expAverage {
+	return &expAverage{period: period, alpha: 1 / float64(period)}
+}
+
+// Continues the average from a previously computed value.
+func (e *expAverage) Resume(value float64) {
+	e.count = e.period
+	e.value = value
+}
+
+func (e *expAverage) Push(v float64) {
+	if e.count < e.period {
+		// Running simple average until the first `period` values are in:
+		e.count++
+		e.value += (v - e.value) / float64(e.count)
+		return
+	}
+	e.value += e.alpha * (v - e.value)
+}
+
+// Reports whether `period` values have been pushed.
+func (e *expAverage) Ready() bool { return e.count >= e.period }
+
+func (e *expAverage) Value() float64 { return e.value }
+
+// Indicators that carry state from every earlier day rather than a fixed window:
+type indicators struct {
+	emaFast, emaSlow, signal *expAverage
+	gain, loss, atr          *expAverage
+
+	prevClose float64
+	hasPrev   bool
+}
+
+func newIndicators() *indicators {
+	return &indicators{
+		emaFast: newEMA(emaFastPeriod),
+		emaSlow: newEMA(emaSlowPeriod),
+		signal:  newEMA(macdSignalPeriod),
+		gain:    newWilder(rsiPeriod),
+		loss:    newWilder(rsiPeriod),
+		atr:     newWilder(atrPeriod),
+	}
+}
+
+// Continues the indicators from the recorded stats of the day `prev`:
+func resumeIndicators(s *DayStats, prev dayClose) *indicators {
+	ind := newIndicators()
+	ind.emaFast.Resume(s.EMA12)
+	ind.emaSlow.Resume(s.EMA26)
+	ind.signal.Resume(s.MACDSignal)
+	ind.gain.Resume(s.AvgGain14)
+	ind.loss.Resume(s.AvgLoss14)
+	ind.atr.Resume(s.ATR14)
+	ind.prevClose, ind.hasPrev = prev.Close, true
+	return ind
+}
+
+// Adds the next trading day.
+func (ind *indicators) Push(c dayClose) {
+	ind.emaFast.Push(c.Close)
+	ind.emaSlow.Push(c.Close)
+	if ind.emaSlow.Ready() {
+		ind.signal.Push(ind.MACD())
+	}
+
+	if ind.hasPrev {
+		chg := c.Close - ind.prevClose
+		ind.gain.Push(math.Max(chg, 0))
+		ind.loss.Push(math.Max(-chg, 0))
+
+		// True range includes any gap from the previous close:
+		tr := math.Max(c.High-c.Low, math.Max(math.Abs(c.High-ind.prevClose), math.Abs(c.Low-ind.prevClose)))
+		ind.atr.Push(tr)
+	}
+	ind.prevClose, ind.hasPrev = c.Close, true
+}
+
+// Reports whether every indicator has seen enough days.
+func (ind *indicators) Ready() bool {
+	return ind.signal.Ready() && ind.gain.Ready() && ind.atr.Ready()
+}
+
+// MACD = EMA(12) - EMA(26)
+func (ind *indicators) MACD() float64 { return ind.emaFast.Value() - ind.emaSlow.Value() }
+
+// RSI = 100 - 100 / (1 + avg gain / avg loss)
+func (ind *indicators) RSI() float64 {
+	gain, loss := ind.gain.Value(), ind.loss.Value()
+	if loss == 0 {
+		if gain == 0 {
+			return 50
+		}
+		return 100
+	}
+	return 100 - 100/(1+gain/loss)
+}
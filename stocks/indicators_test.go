@@ -0,0 +1,134 @@
+package stocks
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExpAverage(t *testing.T) {
+	tests := []struct {
+		name     string
+		avg      *expAverage
+		values   []float64
+		expected []float64
+		ready    []bool
+	}{
+		// Seeded with the simple average of the first 3, then alpha = 2/4:
+		{"ema", newEMA(3), []float64{1, 2, 3, 5, 1}, []float64{1, 1.5, 2, 3.5, 2.25}, []bool{false, false, true, true, true}},
+		// Seeded with the simple average of the first 2, then alpha = 1/2:
+		{"wilder", newWilder(2), []float64{4, 2, 7, 1}, []float64{4, 3, 5, 3}, []bool{false, true, true, true}},
+	}
+
+	for _, test := range tests {
+		for i, v := range test.values {
+			test.avg.Push(v)
+			if got := test.avg.Value(); math.Abs(got-test.expected[i]) > 1e-9 {
+				t.Errorf("%s after %v: expected %v; got %v", test.name, test.values[:i+1], test.expected[i], got)
+			}
+			if got := test.avg.Ready(); got != test.ready[i] {
+				t.Errorf("%s after %v: expected ready %v; got %v", test.name, test.values[:i+1], test.ready[i], got)
+			}
+		}
+	}
+}
+
+func TestIndicators(t *testing.T) {
+	// Flat closes trading in a range of 2:
+	flat := series(250, func(i int64) float64 { return 10 })
+	for i := range flat {
+		flat[i].High, flat[i].Low = 11, 9
+	}
+	// Closes equal to the index; each EMA lags the latest close by (period - 1) / 2:
+	rising := series(250, func(i int64) float64 { return float64(i) })
+	falling := series(250, func(i int64) float64 { return float64(1000 - i) })
+	// Standard deviation of 20 consecutive integers:
+	dev20 := math.Sqrt(399.0 / 12.0)
+
+	tests := []struct {
+		name     string
+		closes   []dayClose
+		expected DayStats
+	}{
+		{"flat", flat, DayStats{
+			EMA12: 10, EMA26: 10, MACD: 0, MACDSignal: 0, RSI14: 50,
+			BollingerUpper: 10, BollingerLower: 10, ATR14: 2,
+		}},
+		{"rising", rising, DayStats{
+			EMA12: 244.5, EMA26: 237.5, MACD: 7, MACDSignal: 7, RSI14: 100, AvgGain14: 1,
+			BollingerUpper: 240.5 + 2*dev20, BollingerLower: 240.5 - 2*dev20, ATR14: 1,
+		}},
+		{"falling", falling, DayStats{
+			EMA12: 755.5, EMA26: 762.5, MACD: -7, MACDSignal: -7, RSI14: 0, AvgLoss14: 1,
+			BollingerUpper: 759.5 + 2*dev20, BollingerLower: 759.5 - 2*dev20, ATR14: 1,
+		}},
+	}
+
+	for _, test := range tests {
+		stats := trailingStats(test.closes, 1, nil)
+		if len(stats) == 0 {
+			t.Errorf("%s: no stats", test.name)
+			continue
+		}
+
+		// Check the last day:
+		got, exp := stats[len(stats)-1], test.expected
+		for _, f := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"EMA12", got.EMA12, exp.EMA12},
+			{"EMA26", got.EMA26, exp.EMA26},
+			{"MACD", got.MACD, exp.MACD},
+			{"MACDSignal", got.MACDSignal, exp.MACDSignal},
+			{"RSI14", got.RSI14, exp.RSI14},
+			{"AvgGain14", got.AvgGain14, exp.AvgGain14},
+			{"AvgLoss14", got.AvgLoss14, exp.AvgLoss14},
+			{"BollingerUpper", got.BollingerUpper, exp.BollingerUpper},
+			{"BollingerLower", got.BollingerLower, exp.BollingerLower},
+			{"ATR14", got.ATR14, exp.ATR14},
+		} {
+			if math.Abs(f.got-f.want) > 1e-9 {
+				t.Errorf("%s: expected %s %v; got %v", test.name, f.name, f.want, f.got)
+			}
+		}
+	}
+}
+
+func TestIndicatorsResume(t *testing.T) {
+	// An irregular series with gaps between closes:
+	closes := series(300, func(i int64) float64 { return 50 + 10*math.Sin(float64(i)/7) + float64(i%5) })
+	for i := range closes {
+		closes[i].High, closes[i].Low = closes[i].Close+1, closes[i].Close-1.5
+	}
+
+	full := trailingStats(closes, 1, nil)
+
+	// Continue from the recorded stats of day 260 with only the last 200 days' closes:
+	var seed DayStats
+	for _, s := range full {
+		if s.TradeDayIndex == 260 {
+			seed = s
+		}
+	}
+	resumed := trailingStats(closes[261-longWindow:], 261, &seed)
+	if len(resumed) != 40 {
+		t.Fatalf("expected 40 resumed stats; got %d", len(resumed))
+	}
+
+	for _, r := range resumed {
+		s := full[r.TradeDayIndex-int64(full[0].TradeDayIndex)]
+		if s.TradeDayIndex != r.TradeDayIndex {
+			t.Fatalf("expected day %d; got %d", r.TradeDayIndex, s.TradeDayIndex)
+		}
+		diffs := []float64{
+			s.Avg200Day - r.Avg200Day, s.Avg50Day - r.Avg50Day,
+			s.EMA12 - r.EMA12, s.EMA26 - r.EMA26, s.MACDSignal - r.MACDSignal,
+			s.RSI14 - r.RSI14, s.BollingerUpper - r.BollingerUpper, s.ATR14 - r.ATR14,
+		}
+		for _, d := range diffs {
+			if math.Abs(d) > 1e-9 {
+				t.Fatalf("day %d: resumed stats %+v differ from full %+v", r.TradeDayIndex, r, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+type TransactionID int64
+
+// What a ledger transaction does to a user's position in a symbol:
+type TransactionKind string
+
+const (
+	Buy   TransactionKind = "buy"   // opens a long lot
+	Sell  TransactionKind = "sell"  // closes shares of long lots
+	Short TransactionKind = "short" // opens a short lot
+	Cover TransactionKind = "cover" // closes shares of short lots
+
+	Deposit    TransactionKind = "deposit"    // adds cash
+	Withdrawal TransactionKind = "withdrawal" // takes cash out
+)
+
+// Buys and shorts open lots; sells and covers close them:
+func (k TransactionKind) Opens() bool { return k == Buy || k == Short }
+
+// Deposits and withdrawals only move cash and have no symbol or shares:
+func (k TransactionKind) IsCash() bool { return k == Deposit || k == Withdrawal }
+
+// A user's trade of a symbol, or movement of cash, recorded in the ledger:
+type Transaction struct {
+	TransactionID TransactionID
+	UserID        UserID
+	PortfolioID   PortfolioID // 0 for none; lots only close within their portfolio
+	Symbol        string
+	Kind          TransactionKind
+	Date          DateTime
+	Price         Decimal // per share; the amount of a deposit or withdrawal
+	Shares        int64   // always positive; `Kind` gives the direction
+
+	// The buy or short whose lot a sell or cover closes under `SpecificID` matching; 0 to close the oldest:
+	LotID TransactionID
+}
+
+func (t *Transaction) Validate() error {
+	switch t.Kind {
+	case Buy, Short:
+		if t.LotID != 0 {
+			return fmt.Errorf("only a sell or cover closes a specific lot")
+		}
+	case Sell, Cover:
+	case Deposit, Withdrawal:
+		if t.Symbol != "" || t.Shares != 0 || t.LotID != 0 {
+			return fmt.Errorf("a %s has only an amount and no symbol, shares or lot", t.Kind)
+		}
+		if t.Price.Value == nil || t.Price.Value.Sign() <= 0 {
+			return fmt.Errorf("%s amount must be positive", t.Kind)
+		}
+		return nil
+	default:
+		return fmt.Errorf("transaction kind must be buy, sell, short, cover, deposit or withdrawal; got %q", t.Kind)
+	}
+	if t.Symbol == "" {
+		return fmt.Errorf("transaction symbol is required")
+	}
+	if t.Shares <= 0 {
+		return fmt.Errorf("transaction shares must be positive; got %d", t.Shares)
+	}
+	if t.Price.Value == nil || t.Price.Value.Sign() < 0 {
+		return fmt.Errorf("transaction price must not be negative")
+	}
+	return nil
+}
+
+// How sells and covers choose the lots they close:
+type LotMatching string
+
+const (
+	FIFO       LotMatching = "FIFO"       // oldest lot first
+	LIFO       LotMatching = "LIFO"       // newest lot first
+	SpecificID LotMatching = "SpecificID" // the lot of the transaction's LotID, else oldest first
+)
+
+// Parses a lot matching method case-insensitively; empty means FIFO.
+func ParseLotMatching(s string) (m LotMatching, err error) {
+	if s == "" {
+		return FIFO, nil
+	}
+	for _, m := range []LotMatching{FIFO, LIFO, SpecificID} {
+		if strings.EqualFold(s, string(m)) {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("lot matching must be FIFO, LIFO or SpecificID; got %q", s)
+}
+
+// Shares of an opening buy or short that are still open, adjusted for later splits:
+type Lot struct {
+	TransactionID TransactionID // the opening buy or short
+	Symbol        string
+	Date          DateTime
+	Price         Decimal // per share
+	Shares        int64   // negative for shorts
+}
+
+// What the lot's shares cost; negative for shorts, which were sold for that much.
+func (l Lot) Cost() *big.Rat {
+	return new(big.Rat).Mul(l.Price.Value, IntToRat(l.Shares))
+}
+
+// Shares of a lot closed by a sell or cover:
+type ClosedLot struct {
+	Lot // the closed shares only
+
+	CloseID    TransactionID // the sell or cover
+	CloseDate  DateTime
+	ClosePrice Decimal
+	// (ClosePrice - Price) * Shares:
+	Gain Decimal
+}
+
+// Sorts transactions by date; transactions of the same date keep their order:
+func sortTransactions(txns []Transaction) {
+	sort.SliceStable(txns, func(i, j int) bool { return txns[i].Date.Value.Before(txns[j].Date.Value) })
+}
+
+// Applies a split to lots opened before it; fractional shares are paid out as cash-in-lieu so round
+// toward zero:
+func splitLots(lots []Lot, sp Split) []Lot {
+	ratio := sp.Ratio()
+	kept := lots[:0]
+	for _, l := range lots {
+		shares := new(big.Rat).Mul(IntToRat(l.Shares), ratio)
+		l.Shares = new(big.Int).Quo(shares.Num(), shares.Denom()).Int64()
+		l.Price = Decimal{Value: new(big.Rat).Quo(l.Price.Value, ratio)}
+		if l.Shares != 0 {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// Finds the open lot a sell or cover closes shares of next; -1 if none is left.
+func pickLot(open []Lot, t Transaction, m LotMatching) (i int, err error) {
+	// Sells close buys and covers close shorts:
+	long, opener := t.Kind == Sell, Buy
+	if !long {
+		opener = Short
+	}
+	closes := func(l Lot) bool { return (l.Shares > 0) == long }
+
+	switch {
+	case m == SpecificID && t.LotID != 0:
+		for i, l := range open {
+			if l.TransactionID == t.LotID {
+				if !closes(l) {
+					return -1, fmt.Errorf("%s of %d %s on %s: lot %d is not a %s", t.Kind, t.Shares, t.Symbol, t.Date.DateString(), t.LotID, opener)
+				}
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("%s of %d %s on %s: lot %d has no shares left open", t.Kind, t.Shares, t.Symbol, t.Date.DateString(), t.LotID)
+	case m == LIFO:
+		for i := len(open) - 1; i >= 0; i-- {
+			if closes(open[i]) {
+				return i, nil
+			}
+		}
+	default:
+		for i, l := range open {
+			if closes(l) {
+				return i, nil
+			}
+		}
+	}
+	return -1, nil
+}
+
+// Matches the sells and covers among one symbol's transactions, in ascending date order, against the lots
+// opened before them and applies the symbol's splits, in ascending date order, as of their dates.
+// Fails if a sell or cover closes more shares than are open.
+func matchLots(txns []Transaction, splits []Split, m LotMatching) (open []Lot, closed []ClosedLot, err error) {
+	open = make([]Lot, 0, len(txns))
+	closed = make([]ClosedLot, 0, len(txns))
+
+	s := 0
+	for _, t := range txns {
+		// A split takes effect before the trades on its date:
+		for ; s < len(splits) && !splits[s].Date.Value.After(t.Date.Value); s++ {
+			open = splitLots(open, splits[s])
+		}
+
+		if t.Kind.Opens() {
+			shares := t.Shares
+			if t.Kind == Short {
+				shares = -shares
+			}
+			open = append(open, Lot{TransactionID: t.TransactionID, Symbol: t.Symbol, Date: t.Date, Price: t.Price, Shares: shares})
+			continue
+		}
+
+		for remaining := t.Shares; remaining > 0; {
+			i, err := pickLot(open, t, m)
+			if err != nil {
+				return nil, nil, err
+			}
+			if i < 0 {
+				return nil, nil, fmt.Errorf("%s of %d %s on %s closes more shares than are open", t.Kind, t.Shares, t.Symbol, t.Date.DateString())
+			}
+
+			// Close as many of the lot's shares as are left to close:
+			l := &open[i]
+			n := remaining
+			if l.Shares < 0 {
+				n = -n
+				if n < l.Shares {
+					n = l.Shares
+				}
+			} else if n > l.Shares {
+				n = l.Shares
+			}
+
+			c := ClosedLot{Lot: *l, CloseID: t.TransactionID, CloseDate: t.Date, ClosePrice: t.Price}
+			c.Shares = n
+			c.Gain = Decimal{Value: new(big.Rat).Mul(new(big.Rat).Sub(t.Price.Value, l.Price.Value), IntToRat(n))}
+			closed = append(closed, c)
+
+			l.Shares -= n
+			if n < 0 {
+				remaining += n
+			} else {
+				remaining -= n
+			}
+			if l.Shares == 0 {
+				open = append(open[:i], open[i+1:]...)
+			}
+		}
+	}
+
+	// Splits since the last trade still apply to the open lots:
+	for ; s < len(splits); s++ {
+		open = splitLots(open, splits[s])
+	}
+	return open, closed, nil
+}
+
+// Totals the dividends, in ascending date order, paid on the shares one symbol's transactions held going into
+// each ex-dividend date; short shares pay them instead.
+func dividendsReceived(txns []Transaction, splits []Split, dividends []Dividend) (paid *big.Rat, err error) {
+	paid = new(big.Rat)
+	n, s := 0, 0
+	for _, d := range dividends {
+		// Shares traded on the ex-dividend date don't get it:
+		for ; n < len(txns) && txns[n].Date.Value.Before(d.Date.Value); n++ {
+		}
+		if n == 0 {
+			continue
+		}
+		for ; s < len(splits) && !splits[s].Date.Value.After(d.Date.Value); s++ {
+		}
+
+		open, _, err := matchLots(txns[:n], splits[:s], FIFO)
+		if err != nil {
+			return nil, err
+		}
+		shares := int64(0)
+		for _, l := range open {
+			shares += l.Shares
+		}
+		paid.Add(paid, new(big.Rat).Mul(d.Amount.Value, IntToRat(shares)))
+	}
+	return paid, nil
+}
+
+// A user's position in a symbol within a portfolio derived from the ledger:
+type Position struct {
+	PortfolioID PortfolioID
+	Symbol      string
+	Shares      int64 // net open shares; negative if short
+
+	Lots   []Lot       // open lots in date order
+	Closed []ClosedLot // closed shares in the order they were closed
+
+	CostBasis    Decimal // of the open lots
+	RealizedGain Decimal // of the closed shares
+	Dividends    Decimal // received on shares held on ex-dividend dates; paid out if short
+
+	// Valued at the latest hourly price:
+	CurrPrice      NullDecimal
+	MarketValue    NullDecimal
+	UnrealizedGain NullDecimal
+	// UnrealizedGain as a percentage of what the open lots cost, or brought in if short:
+	UnrealizedPercent NullFloat64
+
+	// The owner's benchmark over the same windows since each open lot's date: what the lots' cost would be
+	// worth had it bought the benchmark instead, the benchmark's return and UnrealizedPercent less it; not
+	// valid without a benchmark or its history back to the first lot:
+	BenchmarkValue   NullDecimal
+	BenchmarkPercent NullFloat64
+	AlphaPercent     NullFloat64
+}
+
+// What the open lots cost, with shorts counting as what they brought in:
+func (p Position) invested() *big.Rat {
+	invested := new(big.Rat)
+	for _, l := range p.Lots {
+		invested.Add(invested, new(big.Rat).Abs(l.Cost()))
+	}
+	return invested
+}
+
+// Adds a transaction to a user's ledger and sets `t.TransactionID`. Fails with `ErrBadData` if the
+// transaction is invalid or its sell or cover closes more shares than are open.
+func (api *API) AddTransaction(t *Transaction) (err error) {
+	if t == nil {
+		return fmt.Errorf("t cannot be nil for AddTransaction")
+	}
+	if err = t.Validate(); err != nil {
+		return badData("AddTransaction", t.Symbol, err)
+	}
+
+	ctx := context.Background()
+	if err = api.checkPortfolio(ctx, t.UserID, t.PortfolioID); err != nil {
+		return wrapError("AddTransaction", t.Symbol, ErrBadData, err)
+	}
+	if t.Kind.IsCash() {
+		return storeError("AddTransaction", "", api.store.AddTransaction(ctx, t))
+	}
+	txns, err := api.store.GetTransactions(ctx, t.UserID, t.Symbol)
+	if err != nil {
+		return storeError("AddTransaction", t.Symbol, err)
+	}
+	if err = api.checkLedger(ctx, t.Symbol, append(inPortfolio(txns, t.PortfolioID), *t)); err != nil {
+		return wrapError("AddTransaction", t.Symbol, ErrBadData, err)
+	}
+
+	return storeError("AddTransaction", t.Symbol, api.store.AddTransaction(ctx, t))
+}
+
+// Gets a transaction by ID; nil if it does not exist.
+func (api *API) GetTransaction(transactionID TransactionID) (t *Transaction, err error) {
+	return api.GetTransactionContext(context.Background(), transactionID)
+}
+
+// Like `GetTransaction`; `ctx` cancels the store query.
+func (api *API) GetTransactionContext(ctx context.Context, transactionID TransactionID) (t *Transaction, err error) {
+	t, err = api.store.GetTransaction(ctx, transactionID)
+	return t, storeError("GetTransaction", "", err)
+}
+
+// Removes a transaction from the ledger. Fails with `ErrBadData` if a later sell or cover would close more
+// shares than are open without it.
+func (api *API) RemoveTransaction(transactionID TransactionID) (err error) {
+	ctx := context.Background()
+	t, err := api.store.GetTransaction(ctx, transactionID)
+	if err != nil || t == nil {
+		return storeError("RemoveTransaction", "", err)
+	}
+	if t.Kind.IsCash() {
+		return storeError("RemoveTransaction", "", api.store.RemoveTransaction(ctx, transactionID))
+	}
+
+	txns, err := api.store.GetTransactions(ctx, t.UserID, t.Symbol)
+	if err != nil {
+		return storeError("RemoveTransaction", t.Symbol, err)
+	}
+	kept := make([]Transaction, 0, len(txns))
+	for _, o := range inPortfolio(txns, t.PortfolioID) {
+		if o.TransactionID != transactionID {
+			kept = append(kept, o)
+		}
+	}
+	if err = api.checkLedger(ctx, t.Symbol, kept); err != nil {
+		return wrapError("RemoveTransaction", t.Symbol, ErrBadData, err)
+	}
+
+	return storeError("RemoveTransaction", t.Symbol, api.store.RemoveTransaction(ctx, transactionID))
+}
+
+// Checks that every sell and cover of a symbol's transactions closes shares that are open:
+func (api *API) checkLedger(ctx context.Context, symbol string, txns []Transaction) (err error) {
+	splits, err := api.store.GetSplits(ctx, symbol)
+	if err != nil {
+		return
+	}
+	sortTransactions(txns)
+	_, _, err = matchLots(txns, splits, SpecificID)
+	return
+}
+
+// Gets a user's transactions, of only `symbol` if it is not empty, in ascending date order.
+func (api *API) GetTransactions(userID UserID, symbol string) (txns []Transaction, err error) {
+	return api.GetTransactionsContext(context.Background(), userID, symbol)
+}
+
+// Like `GetTransactions`; `ctx` cancels the store query.
+func (api *API) GetTransactionsContext(ctx context.Context, userID UserID, symbol string) (txns []Transaction, err error) {
+	txns, err = api.store.GetTransactions(ctx, userID, symbol)
+	return txns, storeError("GetTransactions", symbol, err)
+}
+
+// Gets a user's positions by symbol and portfolio, matching sells and covers to lots with `m`.
+func (api *API) GetPositions(userID UserID, m LotMatching) (positions []Position, err error) {
+	return api.GetPositionsContext(context.Background(), userID, m)
+}
+
+// Like `GetPositions`; `ctx` cancels the store queries.
+func (api *API) GetPositionsContext(ctx context.Context, userID UserID, m LotMatching) (positions []Position, err error) {
+	txns, err := api.store.GetTransactions(ctx, userID, "")
+	if err != nil {
+		return nil, storeError("GetPositions", "", err)
+	}
+
+	// Group by symbol and portfolio in that order:
+	type holding struct {
+		Symbol      string
+		PortfolioID PortfolioID
+	}
+	byHolding := make(map[holding][]Transaction)
+	holdings := make([]holding, 0, 8)
+	for _, t := range txns {
+		if t.Kind.IsCash() {
+			continue
+		}
+		h := holding{t.Symbol, t.PortfolioID}
+		if _, ok := byHolding[h]; !ok {
+			holdings = append(holdings, h)
+		}
+		byHolding[h] = append(byHolding[h], t)
+	}
+	sort.Slice(holdings, func(i, j int) bool {
+		if holdings[i].Symbol != holdings[j].Symbol {
+			return holdings[i].Symbol < holdings[j].Symbol
+		}
+		return holdings[i].PortfolioID < holdings[j].PortfolioID
+	})
+
+	positions = make([]Position, 0, len(holdings))
+	for _, h := range holdings {
+		p, err := api.position(ctx, h.Symbol, byHolding[h], m)
+		if err != nil {
+			return nil, err
+		}
+		p.PortfolioID = h.PortfolioID
+		positions = append(positions, p)
+	}
+
+	if err = api.comparePositions(ctx, userID, positions); err != nil {
+		return nil, storeError("GetPositions", "", err)
+	}
+	return positions, nil
+}
+
+// Derives the position in a symbol from its transactions within one portfolio:
+func (api *API) position(ctx context.Context, symbol string, txns []Transaction, m LotMatching) (p Position, err error) {
+	splits, err := api.store.GetSplits(ctx, symbol)
+	if err != nil {
+		return p, storeError("GetPositions", symbol, err)
+	}
+	open, closed, err := matchLots(txns, splits, m)
+	if err != nil {
+		return p, wrapError("GetPositions", symbol, ErrBadData, err)
+	}
+
+	p = Position{Symbol: symbol, Lots: open, Closed: closed}
+	cost, realized := new(big.Rat), new(big.Rat)
+	for _, l := range open {
+		p.Shares += l.Shares
+		cost.Add(cost, l.Cost())
+	}
+	for _, c := range closed {
+		realized.Add(realized, c.Gain.Value)
+	}
+	p.CostBasis = Decimal{Value: cost}
+	p.RealizedGain = Decimal{Value: realized}
+
+	dividends, err := api.store.GetDividends(ctx, symbol)
+	if err != nil {
+		return p, storeError("GetPositions", symbol, err)
+	}
+	paid, err := dividendsReceived(txns, splits, dividends)
+	if err != nil {
+		return p, wrapError("GetPositions", symbol, ErrBadData, err)
+	}
+	p.Dividends = Decimal{Value: paid}
+
+	// Value the open shares at the latest hourly price:
+	last, err := api.store.GetLastHourlyTime(ctx, symbol)
+	if err != nil || !last.Valid {
+		return p, storeError("GetPositions", symbol, err)
+	}
+	price, err := api.store.GetHourlyPrice(ctx, symbol, last.Value)
+	if err != nil || price == nil {
+		return p, storeError("GetPositions", symbol, err)
+	}
+	value := new(big.Rat).Mul(price.Current.Value, IntToRat(p.Shares))
+	p.CurrPrice = NullDecimal{Value: price.Current.Value, Valid: true}
+	p.MarketValue = NullDecimal{Value: value, Valid: true}
+	p.UnrealizedGain = NullDecimal{Value: new(big.Rat).Sub(value, cost), Valid: true}
+	p.UnrealizedPercent = percentOf(p.UnrealizedGain, NullDecimal{Value: p.invested(), Valid: true})
+	return p, nil
+}
+
+// Totals the realized and unrealized gains of positions; unrealized is not valid if a position with open
+// shares has no price.
+func TotalGains(positions []Position) (realized Decimal, unrealized NullDecimal) {
+	realized = Decimal{Value: new(big.Rat)}
+	unrealized = NullDecimal{Value: new(big.Rat), Valid: true}
+	for _, p := range positions {
+		realized.Value.Add(realized.Value, p.RealizedGain.Value)
+		if p.UnrealizedGain.Valid {
+			unrealized.Value.Add(unrealized.Value, p.UnrealizedGain.Value)
+		} else if p.Shares != 0 {
+			unrealized.Valid = false
+		}
+	}
+	return
+}
@@ -0,0 +1,187 @@
+package stocks
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+)
+
+func testTransaction(id TransactionID, kind TransactionKind, date string, shares int64, price string) Transaction {
+	return Transaction{TransactionID: id, Symbol: "MSFT", Kind: kind, Date: testDateTime(dateFmt, date), Price: ToDecimal(price), Shares: shares}
+}
+
+// Checks lots as "id:shares@price" pairs:
+func expectLots(t *testing.T, what string, lots []Lot, expected ...string) {
+	if len(lots) != len(expected) {
+		t.Fatalf("%s: expected %d lots; got %+v", what, len(expected), lots)
+	}
+	for i, l := range lots {
+		got := fmt.Sprintf("%d:%d@%s", l.TransactionID, l.Shares, l.Price)
+		if got != expected[i] {
+			t.Fatalf("%s: expected lot %d to be %s; got %s", what, i, expected[i], got)
+		}
+	}
+}
+
+func expectGains(t *testing.T, what string, closed []ClosedLot, expected ...string) {
+	if len(closed) != len(expected) {
+		t.Fatalf("%s: expected %d closed lots; got %+v", what, len(expected), closed)
+	}
+	for i, c := range closed {
+		if got := c.Gain.String(); got != expected[i] {
+			t.Fatalf("%s: expected closed lot %d to gain %s; got %s", what, i, expected[i], got)
+		}
+	}
+}
+
+func TestMatchLots(t *testing.T) {
+	txns := []Transaction{
+		testTransaction(1, Buy, "2013-06-03", 10, "10.00"),
+		testTransaction(2, Buy, "2013-06-04", 10, "20.00"),
+		testTransaction(3, Sell, "2013-06-05", 15, "30.00"),
+	}
+
+	open, closed, err := matchLots(txns, nil, FIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLots(t, "FIFO", open, "2:5@20.00")
+	expectGains(t, "FIFO", closed, "200.00", "50.00")
+
+	open, closed, err = matchLots(txns, nil, LIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLots(t, "LIFO", open, "1:5@10.00")
+	expectGains(t, "LIFO", closed, "100.00", "100.00")
+
+	// A specific lot, and FIFO for a sell without one:
+	txns[2].Shares, txns[2].LotID = 10, 2
+	txns = append(txns, testTransaction(4, Sell, "2013-06-06", 5, "5.00"))
+	open, closed, err = matchLots(txns, nil, SpecificID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLots(t, "SpecificID", open, "1:5@10.00")
+	expectGains(t, "SpecificID", closed, "100.00", "-25.00")
+
+	// Closing more than the specific lot has open:
+	txns[3].LotID = 2
+	if _, _, err = matchLots(txns, nil, SpecificID); err == nil {
+		t.Fatal("expected an error closing a closed lot")
+	}
+}
+
+func TestMatchShortLots(t *testing.T) {
+	txns := []Transaction{
+		testTransaction(1, Short, "2013-06-03", 10, "50.00"),
+		testTransaction(2, Buy, "2013-06-03", 5, "50.00"),
+		testTransaction(3, Cover, "2013-06-04", 4, "40.00"),
+	}
+
+	open, closed, err := matchLots(txns, nil, FIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLots(t, "cover", open, "1:-6@50.00", "2:5@50.00")
+	expectGains(t, "cover", closed, "40.00")
+
+	// Covers don't close long lots:
+	txns[2].Shares = 11
+	if _, _, err = matchLots(txns, nil, FIFO); err == nil {
+		t.Fatal("expected an error covering more than was shorted")
+	}
+}
+
+func TestMatchLotsAcrossSplits(t *testing.T) {
+	txns := []Transaction{
+		testTransaction(1, Buy, "2013-06-03", 10, "100.00"),
+		testTransaction(2, Buy, "2013-06-10", 3, "60.00"),
+		testTransaction(3, Sell, "2013-06-10", 15, "60.00"),
+	}
+	splits := []Split{
+		Split{Symbol: "MSFT", Date: testDateTime(dateFmt, "2013-06-10"), Numerator: 2, Denominator: 1},
+		Split{Symbol: "MSFT", Date: testDateTime(dateFmt, "2013-06-20"), Numerator: 1, Denominator: 2},
+	}
+
+	// The first lot is sold at its post-split price; the rest is reverse split with a share paid out:
+	open, closed, err := matchLots(txns, splits, FIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGains(t, "split", closed, "150.00")
+	expectLots(t, "split", open, "1:2@100.00", "2:1@120.00")
+}
+
+func TestLedger(t *testing.T) {
+	a, err := NewAPI(NewMemoryStore(), csvdir.New(testdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	user := &User{Name: "Test User", Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	buy := testTransaction(0, Buy, "2013-06-03", 10, "30.00")
+	buy.UserID = user.UserID
+	if err = a.AddTransaction(&buy); err != nil {
+		t.Fatal(err)
+	}
+	sell := testTransaction(0, Sell, "2013-06-04", 11, "35.00")
+	sell.UserID = user.UserID
+	if err = a.AddTransaction(&sell); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data selling more than was bought; got %v", err)
+	}
+	sell.Shares = 4
+	if err = a.AddTransaction(&sell); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.RemoveTransaction(buy.TransactionID); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data removing a sold buy; got %v", err)
+	}
+
+	// Ledger symbols are tracked:
+	symbols, err := a.GetAllTrackedSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(symbols) != 1 || symbols[0] != "MSFT" {
+		t.Fatalf("expected MSFT to be tracked; got %v", symbols)
+	}
+	if err = a.RecordHistory("MSFT"); err != nil {
+		t.Fatal(err)
+	}
+	prices, err := a.GetCurrentHourlyPrices(false, "MSFT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions, err := a.GetPositions(user.UserID, FIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 1 {
+		t.Fatalf("expected one position; got %+v", positions)
+	}
+	p := positions[0]
+	if p.Shares != 6 || p.CostBasis.String() != "180.00" || p.RealizedGain.String() != "20.00" {
+		t.Fatalf("expected 6 shares costing 180.00 with 20.00 realized; got %+v", p)
+	}
+	unrealized := new(big.Rat).Sub(new(big.Rat).Mul(prices["MSFT"].Value, big.NewRat(6, 1)), big.NewRat(180, 1))
+	if !p.UnrealizedGain.Valid || p.UnrealizedGain.Value.Cmp(unrealized) != 0 {
+		t.Fatalf("expected %s unrealized; got %v", unrealized.FloatString(2), p.UnrealizedGain)
+	}
+
+	realized, total := TotalGains(positions)
+	if realized.String() != "20.00" || total.Value.Cmp(unrealized) != 0 {
+		t.Fatalf("expected totals 20.00 and %s; got %v and %v", unrealized.FloatString(2), realized, total)
+	}
+}
@@ -0,0 +1,1082 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/market"
+)
+
+// In-memory implementation of Store; nothing is persisted.
+type memoryStore struct {
+	lock sync.Mutex
+
+	users       map[UserID]*User
+	nextUserID  UserID
+	stocks      map[StockID]*Stock
+	nextStockID StockID
+
+	portfolios      map[PortfolioID]Portfolio
+	nextPortfolioID PortfolioID
+
+	transactions      map[TransactionID]Transaction
+	nextTransactionID TransactionID
+
+	// Snapshots per user ordered by date and PortfolioID:
+	snapshots map[UserID][]Snapshot
+
+	// History per symbol in ascending date order:
+	history      map[string][]HistoryDay
+	historyStart map[string]time.Time
+	dividends    map[string][]Dividend
+	splits       map[string][]Split
+	adjustments  map[stockSplitKey]SplitAdjustment
+
+	// Stats and crossover averages per symbol keyed by date:
+	stats      map[string]map[time.Time]DayStats
+	crossovers map[crossoverKey]map[time.Time]CrossoverDay
+
+	// Hourly prices per symbol keyed by hour:
+	hourly map[string]map[time.Time]HourlyPrice
+
+	// Advisory run locks by name:
+	runLocks map[string]runLock
+}
+
+type runLock struct {
+	Owner   string
+	Expires time.Time
+}
+
+type stockSplitKey struct {
+	StockID StockID
+	Date    time.Time
+}
+
+type crossoverKey struct {
+	Symbol string
+	Crossover
+}
+
+// Creates an empty in-memory store, e.g. for unit tests.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		users:        make(map[UserID]*User),
+		stocks:       make(map[StockID]*Stock),
+		portfolios:   make(map[PortfolioID]Portfolio),
+		transactions: make(map[TransactionID]Transaction),
+		snapshots:    make(map[UserID][]Snapshot),
+		history:      make(map[string][]HistoryDay),
+		historyStart: make(map[string]time.Time),
+		dividends:    make(map[string][]Dividend),
+		splits:       make(map[string][]Split),
+		adjustments:  make(map[stockSplitKey]SplitAdjustment),
+		stats:        make(map[string]map[time.Time]DayStats),
+		crossovers:   make(map[crossoverKey]map[time.Time]CrossoverDay),
+		hourly:       make(map[string]map[time.Time]HourlyPrice),
+		runLocks:     make(map[string]runLock),
+	}
+}
+
+func (m *memoryStore) Close() error { return nil }
+
+// Dates are compared as instants so keys must not depend on the time zone:
+func dateKey(d DateTime) time.Time { return d.Value.UTC() }
+
+// ------------------------- users:
+
+func copyUser(u *User) *User {
+	c := *u
+	c.Emails = append([]UserEmail(nil), u.Emails...)
+	return &c
+}
+
+func (m *memoryStore) AddUser(ctx context.Context, user *User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nextUserID++
+	user.UserID = m.nextUserID
+
+	u := copyUser(user)
+	for i := range u.Emails {
+		u.Emails[i].UserID = u.UserID
+	}
+	m.users[u.UserID] = u
+	return nil
+}
+
+func (m *memoryStore) GetUser(ctx context.Context, userID UserID) (*User, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	return copyUser(u), nil
+}
+
+func (m *memoryStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, u := range m.users {
+		for _, e := range u.Emails {
+			if e.Email == email {
+				return copyUser(u), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) GetUserIDs(ctx context.Context) ([]UserID, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ids := make([]UserID, 0, len(m.users))
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (m *memoryStore) UpdateUserCrossover(ctx context.Context, userID UserID, c Crossover) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.Crossover = c
+	}
+	return nil
+}
+
+func (m *memoryStore) UpdateUserBenchmark(ctx context.Context, userID UserID, symbol string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.Benchmark = symbol
+	}
+	return nil
+}
+
+// ------------------------- portfolios:
+
+func (m *memoryStore) AddPortfolio(ctx context.Context, p *Portfolio) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nextPortfolioID++
+	p.PortfolioID = m.nextPortfolioID
+	m.portfolios[p.PortfolioID] = *p
+	return nil
+}
+
+func (m *memoryStore) GetPortfolio(ctx context.Context, portfolioID PortfolioID) (*Portfolio, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.portfolios[portfolioID]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (m *memoryStore) GetPortfolios(ctx context.Context, userID UserID) ([]Portfolio, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	portfolios := make([]Portfolio, 0, 4)
+	for _, p := range m.portfolios {
+		if p.UserID == userID {
+			portfolios = append(portfolios, p)
+		}
+	}
+	sortPortfolios(portfolios)
+	return portfolios, nil
+}
+
+func (m *memoryStore) RenamePortfolio(ctx context.Context, portfolioID PortfolioID, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.portfolios[portfolioID]; ok {
+		p.Name = name
+		m.portfolios[portfolioID] = p
+	}
+	return nil
+}
+
+func (m *memoryStore) RemovePortfolio(ctx context.Context, portfolioID PortfolioID) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.portfolios[portfolioID]; !ok {
+		return false, nil
+	}
+	for _, t := range m.transactions {
+		if t.PortfolioID == portfolioID {
+			return false, nil
+		}
+	}
+
+	for _, s := range m.stocks {
+		if s.PortfolioID == portfolioID {
+			s.PortfolioID = 0
+		}
+	}
+	delete(m.portfolios, portfolioID)
+	return true, nil
+}
+
+// ------------------------- stocks:
+
+func copyStock(s *Stock) *Stock {
+	c := *s
+	if s.Crossover != nil {
+		x := *s.Crossover
+		c.Crossover = &x
+	}
+	return &c
+}
+
+func (m *memoryStore) AddStock(ctx context.Context, s *Stock) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nextStockID++
+	s.StockID = m.nextStockID
+
+	c := copyStock(s)
+	// Notifications fire in the regular session unless told otherwise:
+	for _, sessions := range []*market.Session{&c.TStopSessions, &c.BuyStopSessions, &c.SellStopSessions, &c.RiseSessions, &c.FallSessions, &c.BullBearSessions} {
+		*sessions = market.Session(toDbSessions(*sessions))
+	}
+	m.stocks[c.StockID] = c
+	return nil
+}
+
+func (m *memoryStore) GetStock(ctx context.Context, stockID StockID) (*Stock, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.stocks[stockID]
+	if !ok {
+		return nil, stockNotFound(stockID)
+	}
+	return copyStock(s), nil
+}
+
+func (m *memoryStore) GetStocksForUser(ctx context.Context, userID UserID) ([]Stock, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list := make([]Stock, 0, 16)
+	for _, s := range m.stocks {
+		if s.UserID == userID {
+			list = append(list, *copyStock(s))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Symbol != list[j].Symbol {
+			return list[i].Symbol < list[j].Symbol
+		}
+		if !list[i].BuyDate.Value.Equal(list[j].BuyDate.Value) {
+			return list[i].BuyDate.Value.Before(list[j].BuyDate.Value)
+		}
+		return list[i].StockID < list[j].StockID
+	})
+	return list, nil
+}
+
+func (m *memoryStore) UpdateStock(ctx context.Context, n *Stock) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.stocks[n.StockID]
+	if !ok {
+		return nil
+	}
+
+	c := copyStock(n)
+	c.UserID, c.Symbol, c.IsWatched = s.UserID, s.Symbol, s.IsWatched
+	c.LastTimeTStop, c.LastTimeBuyStop, c.LastTimeSellStop = s.LastTimeTStop, s.LastTimeBuyStop, s.LastTimeSellStop
+	c.LastTimeRise, c.LastTimeFall, c.LastTimeBullBear = s.LastTimeRise, s.LastTimeFall, s.LastTimeBullBear
+	for _, sessions := range []*market.Session{&c.TStopSessions, &c.BuyStopSessions, &c.SellStopSessions, &c.RiseSessions, &c.FallSessions, &c.BullBearSessions} {
+		*sessions = market.Session(toDbSessions(*sessions))
+	}
+	m.stocks[c.StockID] = c
+	return nil
+}
+
+func (m *memoryStore) UpdateNotifyTimes(ctx context.Context, n *Stock) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.stocks[n.StockID]
+	if !ok {
+		return nil
+	}
+
+	s.LastTimeTStop, s.LastTimeBuyStop, s.LastTimeSellStop = n.LastTimeTStop, n.LastTimeBuyStop, n.LastTimeSellStop
+	s.LastTimeRise, s.LastTimeFall, s.LastTimeBullBear = n.LastTimeRise, n.LastTimeFall, n.LastTimeBullBear
+	return nil
+}
+
+func (m *memoryStore) RemoveStock(ctx context.Context, stockID StockID) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.stocks, stockID)
+	return nil
+}
+
+func (m *memoryStore) GetAllTrackedSymbols(ctx context.Context) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	seen := make(map[string]bool)
+	symbols := make([]string, 0, 4)
+	for _, s := range m.stocks {
+		if !seen[s.Symbol] {
+			seen[s.Symbol] = true
+			symbols = append(symbols, s.Symbol)
+		}
+	}
+	for _, t := range m.transactions {
+		// Deposits and withdrawals have no symbol:
+		if t.Symbol != "" && !seen[t.Symbol] {
+			seen[t.Symbol] = true
+			symbols = append(symbols, t.Symbol)
+		}
+	}
+	for _, u := range m.users {
+		if u.Benchmark != "" && !seen[u.Benchmark] {
+			seen[u.Benchmark] = true
+			symbols = append(symbols, u.Benchmark)
+		}
+	}
+	sort.Strings(symbols)
+	return symbols, nil
+}
+
+func (m *memoryStore) GetMinBuyDate(ctx context.Context, symbol string) (NullDateTime, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Holdings of users comparing against the symbol need its history as far back as theirs:
+	benchmarked := func(userID UserID) bool {
+		u, ok := m.users[userID]
+		return ok && u.Benchmark == symbol
+	}
+
+	minDate := NullDateTime{Valid: false}
+	for _, s := range m.stocks {
+		if s.Symbol == symbol || benchmarked(s.UserID) {
+			minDate = minNullTime(minDate, NullDateTime{Value: s.BuyDate.Value, Valid: true})
+		}
+	}
+	for _, t := range m.transactions {
+		if t.Symbol == symbol || benchmarked(t.UserID) {
+			minDate = minNullTime(minDate, NullDateTime{Value: t.Date.Value, Valid: true})
+		}
+	}
+	return minDate, nil
+}
+
+// Gets the stock's own crossover or else its owner's; false if neither is known:
+func (m *memoryStore) activeCrossover(s *Stock) (Crossover, bool) {
+	if s.Crossover != nil {
+		return *s.Crossover, true
+	}
+	if u, ok := m.users[s.UserID]; ok {
+		return u.Crossover, true
+	}
+	return Crossover{}, false
+}
+
+func (m *memoryStore) GetCrossoversInUse(ctx context.Context, symbol string) ([]Crossover, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	seen := make(map[Crossover]bool)
+	crossovers := make([]Crossover, 0, 2)
+	for _, s := range m.stocks {
+		if s.Symbol != symbol {
+			continue
+		}
+		if c, ok := m.activeCrossover(s); ok && !seen[c] {
+			seen[c] = true
+			crossovers = append(crossovers, c)
+		}
+	}
+	return crossovers, nil
+}
+
+// Gets the stocks matching `include` that have hourly prices, ordered by symbol, buy date and shares:
+func (m *memoryStore) getStockDetails(include func(s *Stock) bool) []StoredDetail {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stocks := make([]*Stock, 0, 6)
+	for _, s := range m.stocks {
+		if include(s) {
+			stocks = append(stocks, s)
+		}
+	}
+	sort.Slice(stocks, func(i, j int) bool {
+		a, b := stocks[i], stocks[j]
+		if a.Symbol != b.Symbol {
+			return a.Symbol < b.Symbol
+		}
+		if !a.BuyDate.Value.Equal(b.BuyDate.Value) {
+			return a.BuyDate.Value.Before(b.BuyDate.Value)
+		}
+		return a.Shares < b.Shares
+	})
+
+	details := make([]StoredDetail, 0, len(stocks))
+	for _, s := range stocks {
+		hour, ok := m.lastHourly(s.Symbol)
+		if !ok {
+			continue
+		}
+		h := m.hourly[s.Symbol][hour]
+
+		d := Detail{
+			CurrPrice:       NullDecimal{Value: h.Current.Value, Valid: true},
+			CurrHour:        NullDateTime{Value: h.DateTime.Value, Valid: true},
+			FetchedDateTime: NullDateTime{Value: h.FetchedDateTime.Value, Valid: true},
+			CurrSession:     h.Session,
+
+			Bid:           h.Bid,
+			Ask:           h.Ask,
+			DayHigh:       h.DayHigh,
+			DayLow:        h.DayLow,
+			PrevClose:     h.PrevClose,
+			Volume:        h.Volume,
+			ChangePercent: h.ChangePercent,
+
+			Crossover: DefaultCrossover,
+		}
+
+		// Last two trading days with stats:
+		hist := m.history[s.Symbol]
+		if n := len(hist); n > 0 {
+			if day, st, ok := m.dayStats(s.Symbol, hist[n-1]); ok {
+				d.N1CloseDate = NullDateTime{Value: day.Date.Value, Valid: true}
+				d.N1ClosePrice = NullDecimal{Value: day.Close.Value, Valid: true}
+				d.N1SMAPercent = NullFloat64{Value: st.SMAPercent, Valid: true}
+				d.N1Avg200Day = NullFloat64{Value: st.Avg200Day, Valid: true}
+				d.N1Avg50Day = NullFloat64{Value: st.Avg50Day, Valid: true}
+
+				d.N1EMA12 = NullFloat64{Value: st.EMA12, Valid: true}
+				d.N1EMA26 = NullFloat64{Value: st.EMA26, Valid: true}
+				d.N1MACD = NullFloat64{Value: st.MACD, Valid: true}
+				d.N1MACDSignal = NullFloat64{Value: st.MACDSignal, Valid: true}
+				d.N1RSI14 = NullFloat64{Value: st.RSI14, Valid: true}
+				d.N1BollingerUpper = NullFloat64{Value: st.BollingerUpper, Valid: true}
+				d.N1BollingerLower = NullFloat64{Value: st.BollingerLower, Valid: true}
+				d.N1ATR14 = NullFloat64{Value: st.ATR14, Valid: true}
+			}
+			if n > 1 {
+				if day, st, ok := m.dayStats(s.Symbol, hist[n-2]); ok {
+					d.N2CloseDate = NullDateTime{Value: day.Date.Value, Valid: true}
+					d.N2ClosePrice = NullDecimal{Value: day.Close.Value, Valid: true}
+					d.N2SMAPercent = NullFloat64{Value: st.SMAPercent, Valid: true}
+				}
+			}
+
+			if c, ok := m.activeCrossover(s); ok {
+				d.Crossover = c
+				days := m.crossovers[crossoverKey{Symbol: s.Symbol, Crossover: c}]
+				if x, ok := days[dateKey(hist[n-1].Date)]; ok {
+					d.N1CrossoverPercent = NullFloat64{Value: x.Percent, Valid: true}
+				}
+				if n > 1 {
+					if x, ok := days[dateKey(hist[n-2].Date)]; ok {
+						d.N2CrossoverPercent = NullFloat64{Value: x.Percent, Valid: true}
+					}
+				}
+			}
+		}
+
+		// Find lowest and highest closing price since buy date:
+		sd := StoredDetail{StockDetail: StockDetail{Stock: *copyStock(s), Detail: d}}
+		for _, day := range hist {
+			if day.Date.Value.Before(s.BuyDate.Value) {
+				continue
+			}
+			closing := day.Close.Value
+			if day.AdjClose.Valid {
+				closing = day.AdjClose.Value
+			}
+			c := RatToFloat(closing)
+			if !sd.LowestClose.Valid || c < sd.LowestClose.Value {
+				sd.LowestClose = NullFloat64{Value: c, Valid: true}
+			}
+			if !sd.HighestClose.Valid || c > sd.HighestClose.Value {
+				sd.HighestClose = NullFloat64{Value: c, Valid: true}
+			}
+		}
+
+		details = append(details, sd)
+	}
+	return details
+}
+
+// Gets a trading day with its stats; false if it has none:
+func (m *memoryStore) dayStats(symbol string, day HistoryDay) (HistoryDay, DayStats, bool) {
+	st, ok := m.stats[symbol][dateKey(day.Date)]
+	return day, st, ok
+}
+
+func (m *memoryStore) GetStockDetailsForUser(ctx context.Context, userID UserID) ([]StoredDetail, error) {
+	return m.getStockDetails(func(s *Stock) bool { return s.UserID == userID }), nil
+}
+
+func (m *memoryStore) GetStockDetailsForSymbol(ctx context.Context, symbol string) ([]StoredDetail, error) {
+	return m.getStockDetails(func(s *Stock) bool { return s.Symbol == symbol }), nil
+}
+
+// ------------------------- transactions:
+
+func (m *memoryStore) AddTransaction(ctx context.Context, t *Transaction) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nextTransactionID++
+	t.TransactionID = m.nextTransactionID
+	m.transactions[t.TransactionID] = *t
+	return nil
+}
+
+func (m *memoryStore) GetTransaction(ctx context.Context, transactionID TransactionID) (*Transaction, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t, ok := m.transactions[transactionID]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (m *memoryStore) RemoveTransaction(ctx context.Context, transactionID TransactionID) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.transactions, transactionID)
+	return nil
+}
+
+func (m *memoryStore) GetTransactions(ctx context.Context, userID UserID, symbol string) ([]Transaction, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	txns := make([]Transaction, 0, 16)
+	for _, t := range m.transactions {
+		if t.UserID == userID && (symbol == "" || t.Symbol == symbol) {
+			txns = append(txns, t)
+		}
+	}
+	sort.Slice(txns, func(i, j int) bool {
+		if !txns[i].Date.Value.Equal(txns[j].Date.Value) {
+			return txns[i].Date.Value.Before(txns[j].Date.Value)
+		}
+		return txns[i].TransactionID < txns[j].TransactionID
+	})
+	return txns, nil
+}
+
+// ------------------------- portfolio snapshots:
+
+func (m *memoryStore) AddSnapshots(ctx context.Context, snapshots []Snapshot) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, s := range snapshots {
+		kept := m.snapshots[s.UserID]
+		i := sort.Search(len(kept), func(i int) bool {
+			if !kept[i].Date.Value.Equal(s.Date.Value) {
+				return kept[i].Date.Value.After(s.Date.Value)
+			}
+			return kept[i].PortfolioID >= s.PortfolioID
+		})
+		if i < len(kept) && kept[i].Date.Value.Equal(s.Date.Value) && kept[i].PortfolioID == s.PortfolioID {
+			continue
+		}
+		m.snapshots[s.UserID] = append(kept[:i], append([]Snapshot{s}, kept[i:]...)...)
+	}
+	return nil
+}
+
+func (m *memoryStore) GetSnapshots(ctx context.Context, userID UserID, from, to time.Time) ([]Snapshot, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snapshots := make([]Snapshot, 0, len(m.snapshots[userID]))
+	for _, s := range m.snapshots[userID] {
+		if !s.Date.Value.Before(from) && !s.Date.Value.After(to) {
+			snapshots = append(snapshots, s)
+		}
+	}
+	return snapshots, nil
+}
+
+func (m *memoryStore) GetLastSnapshotDate(ctx context.Context, userID UserID) (NullDateTime, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snapshots := m.snapshots[userID]
+	if len(snapshots) == 0 {
+		return NullDateTime{Valid: false}, nil
+	}
+	return NullDateTime{Value: snapshots[len(snapshots)-1].Date.Value, Valid: true}, nil
+}
+
+func (m *memoryStore) GetUserIDsToSnapshot(ctx context.Context, date time.Time) ([]UserID, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	due := make(map[UserID]bool)
+	for _, s := range m.stocks {
+		if !s.IsWatched {
+			due[s.UserID] = true
+		}
+	}
+	for _, t := range m.transactions {
+		due[t.UserID] = true
+	}
+	for id, snapshots := range m.snapshots {
+		if len(snapshots) > 0 {
+			due[id] = snapshots[len(snapshots)-1].Date.Value.Before(date)
+		}
+	}
+
+	ids := make([]UserID, 0, len(due))
+	for id, ok := range due {
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// ------------------------- corporate actions:
+
+func (m *memoryStore) AddDividends(ctx context.Context, dividends []Dividend) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, d := range dividends {
+		exists := false
+		for _, e := range m.dividends[d.Symbol] {
+			if e.Date.Value.Equal(d.Date.Value) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			m.dividends[d.Symbol] = append(m.dividends[d.Symbol], d)
+		}
+	}
+	for symbol, divs := range m.dividends {
+		sort.Slice(divs, func(i, j int) bool { return divs[i].Date.Value.Before(divs[j].Date.Value) })
+		m.dividends[symbol] = divs
+	}
+	return nil
+}
+
+func (m *memoryStore) AddSplits(ctx context.Context, splits []Split) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, s := range splits {
+		exists := false
+		for _, e := range m.splits[s.Symbol] {
+			if e.Date.Value.Equal(s.Date.Value) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			m.splits[s.Symbol] = append(m.splits[s.Symbol], s)
+		}
+	}
+	for symbol, spls := range m.splits {
+		sort.Slice(spls, func(i, j int) bool { return spls[i].Date.Value.Before(spls[j].Date.Value) })
+		m.splits[symbol] = spls
+	}
+	return nil
+}
+
+func (m *memoryStore) GetDividends(ctx context.Context, symbol string) ([]Dividend, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]Dividend(nil), m.dividends[symbol]...), nil
+}
+
+func (m *memoryStore) GetSplits(ctx context.Context, symbol string) ([]Split, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]Split(nil), m.splits[symbol]...), nil
+}
+
+func (m *memoryStore) GetUnappliedSplits(ctx context.Context, symbol string) ([]StockSplit, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	splits := make([]StockSplit, 0, 4)
+	for _, s := range m.stocks {
+		if s.Symbol != symbol {
+			continue
+		}
+		for _, sp := range m.splits[symbol] {
+			if !s.BuyDate.Value.Before(sp.Date.Value) {
+				continue
+			}
+			if _, ok := m.adjustments[stockSplitKey{StockID: s.StockID, Date: dateKey(sp.Date)}]; ok {
+				continue
+			}
+			splits = append(splits, StockSplit{StockID: s.StockID, Split: sp})
+		}
+	}
+	sort.SliceStable(splits, func(i, j int) bool { return splits[i].StockID < splits[j].StockID })
+	return splits, nil
+}
+
+func (m *memoryStore) ApplySplitAdjustment(ctx context.Context, adj SplitAdjustment) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.stocks[adj.StockID]
+	if !ok {
+		return nil
+	}
+	s.Shares = adj.NewShares
+	s.BuyPrice = adj.NewBuyPrice
+	s.BuyStopPrice = adj.NewBuyStopPrice
+	s.SellStopPrice = adj.NewSellStopPrice
+
+	m.adjustments[stockSplitKey{StockID: adj.StockID, Date: dateKey(adj.Split.Date)}] = adj
+	return nil
+}
+
+// ------------------------- history:
+
+func (m *memoryStore) GetLastTradeDay(ctx context.Context, symbol string) (date NullDateTime, tradeDay int64, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hist := m.history[symbol]
+	if len(hist) == 0 {
+		return NullDateTime{Valid: false}, 0, nil
+	}
+	last := hist[len(hist)-1]
+	return NullDateTime{Value: last.Date.Value, Valid: true}, last.TradeDayIndex, nil
+}
+
+func (m *memoryStore) GetHistory(ctx context.Context, symbol string, from, to int64) ([]HistoryDay, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	days := make([]HistoryDay, 0, 260)
+	for _, h := range m.history[symbol] {
+		if h.TradeDayIndex >= from && h.TradeDayIndex <= to {
+			days = append(days, h)
+		}
+	}
+	return days, nil
+}
+
+func (m *memoryStore) GetLastHistoryDay(ctx context.Context, symbol string, date time.Time) (*HistoryDay, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// History is kept in date order:
+	var last *HistoryDay
+	for _, h := range m.history[symbol] {
+		if h.Date.Value.After(date) {
+			break
+		}
+		h := h
+		last = &h
+	}
+	return last, nil
+}
+
+// Inserts days whose dates are not yet recorded and keeps history in date order; returns the number added:
+func (m *memoryStore) addHistory(symbol string, days []HistoryDay) (added int64) {
+	hist := m.history[symbol]
+	dates := make(map[time.Time]bool, len(hist))
+	for _, h := range hist {
+		dates[dateKey(h.Date)] = true
+	}
+
+	for _, h := range days {
+		if dates[dateKey(h.Date)] {
+			continue
+		}
+		dates[dateKey(h.Date)] = true
+		h.AdjClose = NullDecimal{Valid: false}
+		hist = append(hist, h)
+		added++
+	}
+
+	sort.Slice(hist, func(i, j int) bool { return hist[i].Date.Value.Before(hist[j].Date.Value) })
+	m.history[symbol] = hist
+	return
+}
+
+func (m *memoryStore) AddHistory(ctx context.Context, symbol string, days []HistoryDay) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.addHistory(symbol, days)
+	return nil
+}
+
+func (m *memoryStore) BackfillHistory(ctx context.Context, symbol string, days []HistoryDay, startDate time.Time) (added int64, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	added = m.addHistory(symbol, days)
+	m.historyStart[symbol] = startDate
+	if added == 0 {
+		return
+	}
+
+	// Renumber trading days in date order:
+	indexes := make(map[time.Time]int64)
+	for i := range m.history[symbol] {
+		h := &m.history[symbol][i]
+		h.TradeDayIndex = int64(i + 1)
+		indexes[dateKey(h.Date)] = h.TradeDayIndex
+	}
+	for date, st := range m.stats[symbol] {
+		st.TradeDayIndex = indexes[date]
+		m.stats[symbol][date] = st
+	}
+	for key, xdays := range m.crossovers {
+		if key.Symbol != symbol {
+			continue
+		}
+		for date, x := range xdays {
+			x.TradeDayIndex = indexes[date]
+			xdays[date] = x
+		}
+	}
+	return
+}
+
+func (m *memoryStore) GetHistoryStartDate(ctx context.Context, symbol string) (NullDateTime, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if startDate, ok := m.historyStart[symbol]; ok {
+		return NullDateTime{Value: startDate, Valid: true}, nil
+	}
+
+	// Assume the earliest recorded date:
+	if hist := m.history[symbol]; len(hist) > 0 {
+		return NullDateTime{Value: hist[0].Date.Value, Valid: true}, nil
+	}
+	return NullDateTime{Valid: false}, nil
+}
+
+func (m *memoryStore) SetHistoryStartDate(ctx context.Context, symbol string, startDate time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.historyStart[symbol] = startDate
+	return nil
+}
+
+func (m *memoryStore) GetFirstUnadjustedDate(ctx context.Context, symbol string) (NullDateTime, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, h := range m.history[symbol] {
+		if !h.AdjClose.Valid {
+			return NullDateTime{Value: h.Date.Value, Valid: true}, nil
+		}
+	}
+	return NullDateTime{Valid: false}, nil
+}
+
+func (m *memoryStore) SetAdjustedCloses(ctx context.Context, symbol string, days []HistoryDay) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	adjusted := make(map[time.Time]NullDecimal, len(days))
+	for _, h := range days {
+		adjusted[dateKey(h.Date)] = h.AdjClose
+	}
+	for i := range m.history[symbol] {
+		h := &m.history[symbol][i]
+		if adj, ok := adjusted[dateKey(h.Date)]; ok {
+			h.AdjClose = adj
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteHistory(ctx context.Context, symbol string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.history, symbol)
+	delete(m.stats, symbol)
+	delete(m.historyStart, symbol)
+	for key := range m.crossovers {
+		if key.Symbol == symbol {
+			delete(m.crossovers, key)
+		}
+	}
+	return nil
+}
+
+// ------------------------- stats:
+
+func (m *memoryStore) SetStats(ctx context.Context, symbol string, stats []DayStats) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stats[symbol] == nil {
+		m.stats[symbol] = make(map[time.Time]DayStats)
+	}
+	for _, st := range stats {
+		m.stats[symbol][dateKey(st.Date)] = st
+	}
+	return nil
+}
+
+func (m *memoryStore) GetStats(ctx context.Context, symbol string, tradeDayIndex int64) (*DayStats, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, st := range m.stats[symbol] {
+		if st.TradeDayIndex == tradeDayIndex {
+			return &st, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) SetCrossoverDays(ctx context.Context, symbol string, c Crossover, days []CrossoverDay) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := crossoverKey{Symbol: symbol, Crossover: c}
+	if m.crossovers[key] == nil {
+		m.crossovers[key] = make(map[time.Time]CrossoverDay)
+	}
+	for _, d := range days {
+		m.crossovers[key][dateKey(d.Date)] = d
+	}
+	return nil
+}
+
+func (m *memoryStore) GetCrossoverDay(ctx context.Context, symbol string, c Crossover, tradeDayIndex int64) (*CrossoverDay, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, d := range m.crossovers[crossoverKey{Symbol: symbol, Crossover: c}] {
+		if d.TradeDayIndex == tradeDayIndex {
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) GetLastCrossoverDay(ctx context.Context, symbol string, c Crossover) (tradeDay int64, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, d := range m.crossovers[crossoverKey{Symbol: symbol, Crossover: c}] {
+		if d.TradeDayIndex > tradeDay {
+			tradeDay = d.TradeDayIndex
+		}
+	}
+	return
+}
+
+// ------------------------- hourly prices:
+
+func (m *memoryStore) SetHourlyPrice(ctx context.Context, p HourlyPrice) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.hourly[p.Symbol] == nil {
+		m.hourly[p.Symbol] = make(map[time.Time]HourlyPrice)
+	}
+	m.hourly[p.Symbol][dateKey(p.DateTime)] = p
+	return nil
+}
+
+func (m *memoryStore) GetHourlyPrice(ctx context.Context, symbol string, hour time.Time) (*HourlyPrice, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.hourly[symbol][hour.UTC()]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (m *memoryStore) lastHourly(symbol string) (hour time.Time, ok bool) {
+	for h := range m.hourly[symbol] {
+		if !ok || h.After(hour) {
+			hour, ok = h, true
+		}
+	}
+	return
+}
+
+func (m *memoryStore) GetLastHourlyTime(ctx context.Context, symbol string) (NullDateTime, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if hour, ok := m.lastHourly(symbol); ok {
+		return NullDateTime{Value: hour, Valid: true}, nil
+	}
+	return NullDateTime{Valid: false}, nil
+}
+
+// ------------------------- run locks:
+
+func (m *memoryStore) AcquireRunLock(ctx context.Context, name, owner string, expires time.Time) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if l, ok := m.runLocks[name]; ok && l.Owner != owner && time.Now().Before(l.Expires) {
+		return false, nil
+	}
+	m.runLocks[name] = runLock{Owner: owner, Expires: expires}
+	return true, nil
+}
+
+func (m *memoryStore) ReleaseRunLock(ctx context.Context, name, owner string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if l, ok := m.runLocks[name]; ok && l.Owner == owner {
+		delete(m.runLocks, name)
+	}
+	return nil
+}
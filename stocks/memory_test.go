@@ -0,0 +1,151 @@
+package stocks
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+)
+
+const comparedb = "./tmp-compare.db"
+
+// Adds a user with an owned, a shorted and a watched stock and records their history and prices:
+func setupStore(t *testing.T, store Store) *API {
+	a, err := NewAPI(store, csvdir.New(testdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{
+		Name:                "Test User",
+		NotificationTimeout: time.Duration(24) * time.Hour,
+		Emails:              []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}},
+	}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Stock{
+		&Stock{UserID: user.UserID, Symbol: "MSFT", BuyDate: testDateTime(dateFmt, "2012-09-04"), BuyPrice: ToDecimal("30.00"), Shares: 10, TStopPercent: ToNullDecimal("20.00")},
+		&Stock{UserID: user.UserID, Symbol: "AAPL", BuyDate: testDateTime(dateFmt, "2013-01-02"), BuyPrice: ToDecimal("500.00"), Shares: -5, TStopPercent: ToNullDecimal("10.00")},
+		&Stock{UserID: user.UserID, Symbol: "AAPL", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("450.00"), IsWatched: true, Crossover: &Crossover{Fast: 20, Slow: 50, Kind: EMA}},
+	} {
+		if err = a.AddStock(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	symbols, err := a.GetAllTrackedSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range symbols {
+		if err = a.RecordHistory(symbol); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = a.GetCurrentHourlyPrices(false, symbols...); err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func TestMemoryStore(t *testing.T) {
+	a := setupStore(t, NewMemoryStore())
+	defer a.Close()
+
+	user, err := a.GetUserByEmail("test@example.org")
+	if err != nil || user == nil {
+		t.Fatalf("expected user; got %+v, %v", user, err)
+	}
+	if user.Crossover != DefaultCrossover {
+		t.Fatalf("expected default crossover; got %s", user.Crossover)
+	}
+
+	details, err := a.GetStockDetailsForUser(user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(details) != 3 {
+		t.Fatalf("expected 3 stocks; got %d", len(details))
+	}
+	for _, sd := range details {
+		d := sd.Detail
+		if !d.CurrPrice.Valid || !d.N1SMAPercent.Valid || !d.N2SMAPercent.Valid || !d.N1RSI14.Valid || !d.N1CrossoverPercent.Valid || d.TStopPrice.Valid != sd.Stock.TStopPercent.Valid {
+			t.Fatalf("%s: missing details: %+v", sd.Stock.Symbol, d)
+		}
+	}
+
+	// Removed stocks are no longer tracked:
+	if err = a.RemoveStock(details[2].Stock.StockID); err != nil {
+		t.Fatal(err)
+	}
+	symbols, err := a.GetAllTrackedSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(symbols) != 1 || symbols[0] != "AAPL" {
+		t.Fatalf("expected only AAPL to be tracked; got %v", symbols)
+	}
+}
+
+// Both stores must give the same details for the same data:
+func TestMemoryStoreMatchesSQLite(t *testing.T) {
+	removeDB(comparedb)
+	defer removeDB(comparedb)
+
+	store, err := NewSQLiteStore(comparedb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteAPI := setupStore(t, store)
+	defer sqliteAPI.Close()
+	memoryAPI := setupStore(t, NewMemoryStore())
+	defer memoryAPI.Close()
+
+	expected, err := sqliteAPI.GetStockDetailsForUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := memoryAPI.GetStockDetailsForUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d stocks; got %d", len(expected), len(actual))
+	}
+
+	sameFloat := func(a, b NullFloat64) bool {
+		return a.Valid == b.Valid && math.Abs(a.Value-b.Value) < 1e-9
+	}
+	sameDecimal := func(a, b NullDecimal) bool {
+		return a.Valid == b.Valid && (!a.Valid || a.Value.Cmp(b.Value) == 0)
+	}
+	for i := range expected {
+		e, a := expected[i], actual[i]
+		if e.Stock.StockID != a.Stock.StockID || e.Stock.Shares != a.Stock.Shares || e.Detail.Crossover != a.Detail.Crossover {
+			t.Fatalf("stock %d: expected %+v; got %+v", i, e.Stock, a.Stock)
+		}
+		if !e.Detail.N1CloseDate.Value.Equal(a.Detail.N1CloseDate.Value) || !sameDecimal(e.Detail.N1ClosePrice, a.Detail.N1ClosePrice) || !sameDecimal(e.Detail.TStopPrice, a.Detail.TStopPrice) {
+			t.Fatalf("%s: expected %+v; got %+v", e.Stock.Symbol, e.Detail, a.Detail)
+		}
+		for _, pair := range [][2]NullFloat64{
+			{e.Detail.N1SMAPercent, a.Detail.N1SMAPercent},
+			{e.Detail.N2SMAPercent, a.Detail.N2SMAPercent},
+			{e.Detail.N1MACD, a.Detail.N1MACD},
+			{e.Detail.N1RSI14, a.Detail.N1RSI14},
+			{e.Detail.N1ATR14, a.Detail.N1ATR14},
+			{e.Detail.N1CrossoverPercent, a.Detail.N1CrossoverPercent},
+			{e.Detail.N2CrossoverPercent, a.Detail.N2CrossoverPercent},
+			{e.Detail.GainLossPercent, a.Detail.GainLossPercent},
+		} {
+			if !sameFloat(pair[0], pair[1]) {
+				t.Fatalf("%s: expected %v; got %v", e.Stock.Symbol, pair[0], pair[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package stocks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// sqlite related imports:
+import (
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+)
+
+// A forward-only schema change taking the database to `Version`.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sqlx.Tx) error
+}
+
+// All schema migrations in version order. Never change a released migration; append a new one instead.
+// Migrations must be idempotent since databases created before versioning (version 0) may already have
+// some of their changes applied.
+var migrations = []migration{
+	{1, "initial schema", func(tx *sqlx.Tx) error {
+		return execAll(tx, `
+create table if not exists StockHistory (
+	Symbol TEXT NOT NULL,
+	Date TEXT NOT NULL,
+	TradeDayIndex INTEGER NOT NULL,
+	Closing TEXT NOT NULL,
+	Opening TEXT NOT NULL,
+	Low TEXT NOT NULL,
+	High TEXT NOT NULL,
+	Volume INTEGER NOT NULL,
+	CONSTRAINT PK_StockHistory PRIMARY KEY (Symbol, Date)
+)`,
+			// Index for historical data:
+			`
+create index if not exists IX_StockHistory on StockHistory (
+	Symbol ASC,
+	TradeDayIndex ASC
+)`,
+			// StockStats to store stats per stock per date:
+			`
+create table if not exists StockStats (
+	Symbol TEXT NOT NULL,
+	Date TEXT NOT NULL,
+	TradeDayIndex INTEGER NOT NULL,
+	Avg200Day TEXT NOT NULL,
+	Avg50Day TEXT NOT NULL,
+	SMAPercent TEXT NOT NULL,	-- simple moving average
+	CONSTRAINT PK_StockStats PRIMARY KEY (Symbol, Date)
+)`,
+			// Index for stats:
+			`
+create index if not exists IX_StockStats on StockStats (
+	Symbol ASC,
+	TradeDayIndex ASC
+)`,
+			// Track hourly stock price:
+			`
+create table if not exists StockHourly (
+	Symbol TEXT NOT NULL,
+	DateTime TEXT NOT NULL,
+	Current TEXT NOT NULL,
+	FetchedDateTime TEXT NOT NULL,
+	CONSTRAINT PK_StockHourly PRIMARY KEY (Symbol, DateTime)
+)`,
+			// Index for hourly data:
+			`
+create index if not exists IX_StockHourly on StockHourly (
+	Symbol ASC,
+	DateTime ASC,
+	Current
+)`,
+			// Create user tables:
+			`
+create table if not exists User (
+	UserID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	Name TEXT NOT NULL,
+	NotificationTimeout INTEGER NOT NULL
+)`, `
+create table if not exists UserEmail (
+	Email TEXT NOT NULL,
+	UserID INTEGER NOT NULL,
+	IsPrimary INTEGER NOT NULL,
+	CONSTRAINT PK_UserEmail PRIMARY KEY (Email, UserID)
+)`,
+			// Index for user emails:
+			`
+create unique index if not exists IX_UserEmail on UserEmail (
+	Email ASC,
+	UserID,
+	IsPrimary
+)`,
+			// Per-user tracked stocks:
+			`
+create table if not exists Stock (
+	StockID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+
+	UserID INTEGER NOT NULL,
+	Symbol TEXT NOT NULL,
+	BuyDate TEXT NOT NULL,
+	BuyPrice TEXT NOT NULL,
+	Shares INTEGER NOT NULL,
+	IsWatched INTEGER NOT NULL,  -- 0 for owned, 1 for watched
+
+	-- Notifications:
+	TStopPercent TEXT,
+	BuyStopPrice TEXT,
+	SellStopPrice TEXT,
+	RisePercent TEXT,
+	FallPercent TEXT,
+	NotifyTStop INTEGER NOT NULL,
+	NotifyBuyStop INTEGER NOT NULL,
+	NotifySellStop INTEGER NOT NULL,
+	NotifyRise INTEGER NOT NULL,
+	NotifyFall INTEGER NOT NULL,
+	NotifyBullBear INTEGER NOT NULL,
+	LastTimeTStop TEXT,
+	LastTimeBuyStop TEXT,
+	LastTimeSellStop TEXT,
+	LastTimeRise TEXT,
+	LastTimeFall TEXT,
+	LastTimeBullBear TEXT
+)`, `
+create index if not exists IX_Stock on Stock (
+	UserID ASC,
+	Symbol ASC
+)`)
+	}},
+
+	{2, "quote details on StockHourly", func(tx *sqlx.Tx) error {
+		return addColumns(tx, "StockHourly", "Bid TEXT", "Ask TEXT", "DayHigh TEXT", "DayLow TEXT", "PrevClose TEXT", "Volume INTEGER", "ChangePercent TEXT")
+	}},
+
+	{3, "dividends, splits and adjusted closes", func(tx *sqlx.Tx) error {
+		err := execAll(tx,
+			// Cash dividends per share by ex-dividend date:
+			`
+create table if not exists StockDividend (
+	Symbol TEXT NOT NULL,
+	Date TEXT NOT NULL,
+	Amount TEXT NOT NULL,
+	CONSTRAINT PK_StockDividend PRIMARY KEY (Symbol, Date)
+)`,
+			// Stock splits, e.g. 2:1 is Numerator = 2, Denominator = 1:
+			`
+create table if not exists StockSplit (
+	Symbol TEXT NOT NULL,
+	Date TEXT NOT NULL,
+	Numerator INTEGER NOT NULL,
+	Denominator INTEGER NOT NULL,
+	CONSTRAINT PK_StockSplit PRIMARY KEY (Symbol, Date)
+)`)
+		if err != nil {
+			return err
+		}
+
+		// Split- and dividend-adjusted closing price:
+		return addColumns(tx, "StockHistory", "AdjClosing TEXT")
+	}},
+
+	{4, "split adjustments of Stock positions", func(tx *sqlx.Tx) error {
+		return execAll(tx, `
+create table if not exists StockSplitAdjustment (
+	StockID INTEGER NOT NULL,
+	SplitDate TEXT NOT NULL,
+	Numerator INTEGER NOT NULL,
+	Denominator INTEGER NOT NULL,
+	AdjustedDateTime TEXT NOT NULL,
+	OldShares INTEGER NOT NULL,
+	NewShares INTEGER NOT NULL,
+	OldBuyPrice TEXT NOT NULL,
+	NewBuyPrice TEXT NOT NULL,
+	OldBuyStopPrice TEXT,
+	NewBuyStopPrice TEXT,
+	OldSellStopPrice TEXT,
+	NewSellStopPrice TEXT,
+	CONSTRAINT PK_StockSplitAdjustment PRIMARY KEY (StockID, SplitDate)
+)`)
+	}},
+
+	{5, "trading sessions", func(tx *sqlx.Tx) error {
+		// market.Session the price was fetched in:
+		err := addColumns(tx, "StockHourly", "Session INTEGER")
+		if err != nil {
+			return err
+		}
+
+		// Trading sessions each notification may fire in; 2 is market.Regular:
+		return addColumns(tx, "Stock",
+			"TStopSessions INTEGER NOT NULL DEFAULT 2",
+			"BuyStopSessions INTEGER NOT NULL DEFAULT 2",
+			"SellStopSessions INTEGER NOT NULL DEFAULT 2",
+			"RiseSessions INTEGER NOT NULL DEFAULT 2",
+			"FallSessions INTEGER NOT NULL DEFAULT 2",
+			"BullBearSessions INTEGER NOT NULL DEFAULT 2",
+		)
+	}},
+
+	{6, "history fetch ranges", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			// Earliest date history was requested from the quote provider for, so earlier buy dates can be backfilled:
+			`
+create table if not exists StockHistoryFetch (
+	Symbol TEXT NOT NULL PRIMARY KEY,
+	StartDate TEXT NOT NULL
+)`,
+			`insert or ignore into StockHistoryFetch (Symbol, StartDate) select Symbol, min(Date) from StockHistory group by Symbol`,
+		)
+	}},
+
+	{7, "trailing moving averages", func(tx *sqlx.Tx) error {
+		// Stats used to be averaged over untrimmed windows; clearing the adjusted closes makes the next
+		// RecordHistory recompute them and all stats from scratch:
+		return execAll(tx,
+			`delete from StockStats`,
+			`update StockHistory set AdjClosing = null`,
+		)
+	}},
+
+	{8, "technical indicators", func(tx *sqlx.Tx) (err error) {
+		err = addColumns(tx, "StockStats",
+			"EMA12 TEXT",
+			"EMA26 TEXT",
+			"MACD TEXT",
+			"MACDSignal TEXT",
+			"RSI14 TEXT",
+			// Wilder-smoothed average gain and loss that RSI continues from:
+			"AvgGain14 TEXT",
+			"AvgLoss14 TEXT",
+			"BollingerUpper TEXT",
+			"BollingerLower TEXT",
+			"ATR14 TEXT",
+		)
+		if err != nil {
+			return
+		}
+
+		// Recompute all stats with indicators on the next RecordHistory:
+		_, err = tx.Exec(`update StockHistory set AdjClosing = null`)
+		return
+	}},
+
+	{9, "configurable crossovers", func(tx *sqlx.Tx) (err error) {
+		// Each user's crossover for bull/bear detection:
+		err = addColumns(tx, "User",
+			"CrossoverFast INTEGER NOT NULL DEFAULT 50",
+			"CrossoverSlow INTEGER NOT NULL DEFAULT 200",
+			"CrossoverKind TEXT NOT NULL DEFAULT 'SMA'",
+		)
+		if err != nil {
+			return
+		}
+		// Per-stock overrides; NULL to use the owner's:
+		err = addColumns(tx, "Stock",
+			"CrossoverFast INTEGER",
+			"CrossoverSlow INTEGER",
+			"CrossoverKind TEXT",
+		)
+		if err != nil {
+			return
+		}
+
+		return execAll(tx,
+			// Cached fast and slow averages per symbol per crossover per date:
+			`
+create table if not exists StockCrossover (
+	Symbol TEXT NOT NULL,
+	Kind TEXT NOT NULL,
+	Fast INTEGER NOT NULL,
+	Slow INTEGER NOT NULL,
+	Date TEXT NOT NULL,
+	TradeDayIndex INTEGER NOT NULL,
+	FastAvg TEXT NOT NULL,
+	SlowAvg TEXT NOT NULL,
+	Percent TEXT NOT NULL,
+	CONSTRAINT PK_StockCrossover PRIMARY KEY (Symbol, Kind, Fast, Slow, Date)
+)`,
+			`
+create index if not exists IX_StockCrossover on StockCrossover (
+	Symbol ASC,
+	Kind ASC,
+	Fast ASC,
+	Slow ASC,
+	TradeDayIndex ASC
+)`,
+		)
+	}},
+
+	{10, "run locks", func(tx *sqlx.Tx) error {
+		// Advisory locks held by a process until released or expired, e.g. by stocks-hourly:
+		return execAll(tx, `
+create table if not exists RunLock (
+	Name TEXT NOT NULL,
+	Owner TEXT NOT NULL,
+	ExpiresDateTime TEXT NOT NULL,
+	CONSTRAINT PK_RunLock PRIMARY KEY (Name)
+)`)
+	}},
+
+	{11, "transaction ledger", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			// Buys, sells, shorts and covers per user; open lots are derived from them:
+			`
+create table if not exists StockTransaction (
+	TransactionID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+
+	UserID INTEGER NOT NULL,
+	Symbol TEXT NOT NULL,
+	Kind TEXT NOT NULL,  -- 'buy', 'sell', 'short' or 'cover'
+	Date TEXT NOT NULL,
+	Price TEXT NOT NULL,
+	Shares INTEGER NOT NULL,
+	LotID INTEGER  -- the buy or short a sell or cover closes under specific-ID matching
+)`,
+			`
+create index if not exists IX_StockTransaction on StockTransaction (
+	UserID ASC,
+	Symbol ASC,
+	Date ASC
+)`,
+		)
+	}},
+
+	{12, "portfolios", func(tx *sqlx.Tx) (err error) {
+		// Named brokerage accounts per user, e.g. 'IRA' or 'Taxable':
+		err = execAll(tx, `
+create table if not exists Portfolio (
+	PortfolioID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	UserID INTEGER NOT NULL,
+	Name TEXT NOT NULL COLLATE NOCASE,
+	CONSTRAINT UQ_Portfolio UNIQUE (UserID, Name)
+)`)
+		if err != nil {
+			return
+		}
+
+		// NULL for stocks and transactions in no portfolio:
+		if err = addColumns(tx, "Stock", "PortfolioID INTEGER"); err != nil {
+			return
+		}
+		return addColumns(tx, "StockTransaction", "PortfolioID INTEGER")
+	}},
+
+	{13, "portfolio snapshots", func(tx *sqlx.Tx) error {
+		// Each portfolio's holdings valued at a trading day's close, appended once per day; earlier rows are never rewritten:
+		return execAll(tx, `
+create table if not exists PortfolioSnapshot (
+	UserID INTEGER NOT NULL,
+	PortfolioID INTEGER NOT NULL,  -- 0 for holdings in no portfolio
+	Date TEXT NOT NULL,
+	MarketValue TEXT NOT NULL,
+	Cash TEXT NOT NULL,
+	NetFlow TEXT NOT NULL,  -- money put in less taken out since the portfolio's previous snapshot
+	Invested TEXT NOT NULL,  -- money put in less taken out through the day
+	CONSTRAINT PK_PortfolioSnapshot PRIMARY KEY (UserID, PortfolioID, Date)
+)`)
+	}},
+
+	{14, "benchmarks", func(tx *sqlx.Tx) error {
+		// Each user's index symbol to compare returns against; empty for none:
+		return addColumns(tx, "User", "Benchmark TEXT NOT NULL DEFAULT ''")
+	}},
+}
+
+// The schema version this binary expects:
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Gets the schema version recorded in the database; 0 for a new or unversioned database.
+func (st *sqliteStore) schemaVersion() (version int, err error) {
+	err = st.db.Get(&version, `pragma user_version`)
+	return
+}
+
+// Applies all migrations newer than the database's schema version, each in its own transaction along with
+// the version bump. Refuses to touch a database with a newer schema than this binary knows.
+func (st *sqliteStore) migrate() (err error) {
+	version, err := st.schemaVersion()
+	if err != nil {
+		return
+	}
+	if version > SchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this program's version %d; upgrade the program", version, SchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		log.Printf("Migrating database schema to version %d: %s\n", m.Version, m.Name)
+		err = st.tx(context.Background(), func(tx *sqlx.Tx) (err error) {
+			if err = m.Up(tx); err != nil {
+				return
+			}
+
+			// NOTE: pragmas do not accept parameters.
+			_, err = tx.Exec(fmt.Sprintf(`pragma user_version = %d`, m.Version))
+			return
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Executes each DDL command in order:
+func execAll(tx *sqlx.Tx, cmds ...string) error {
+	for _, cmd := range cmds {
+		if _, err := tx.Exec(cmd); err != nil {
+			return fmt.Errorf("%s\n%s", cmd, err)
+		}
+	}
+	return nil
+}
+
+// Adds columns to an existing table if they are missing; `create table if not exists` won't add them.
+// Each column definition is of the form "Name TYPE".
+func addColumns(tx *sqlx.Tx, tableName string, defs ...string) (err error) {
+	cols := make([]struct {
+		CID       int64          `db:"cid"`
+		Name      string         `db:"name"`
+		Type      string         `db:"type"`
+		NotNull   int64          `db:"notnull"`
+		DfltValue sql.NullString `db:"dflt_value"`
+		PK        int64          `db:"pk"`
+	}, 0, 16)
+	if err = tx.Select(&cols, `pragma table_info(`+tableName+`)`); err != nil {
+		return
+	}
+
+	for _, def := range defs {
+		name := strings.Fields(def)[0]
+
+		exists := false
+		for _, c := range cols {
+			if strings.EqualFold(c.Name, name) {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+
+		if err = execAll(tx, `alter table `+tableName+` add column `+def); err != nil {
+			return
+		}
+	}
+	return
+}
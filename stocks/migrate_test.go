@@ -0,0 +1,101 @@
+package stocks
+
+import (
+	"context"
+	"testing"
+)
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+const migratedb = "./tmp-migrate.db"
+
+func TestMigrateNewDatabase(t *testing.T) {
+	removeDB(migratedb)
+	defer removeDB(migratedb)
+
+	store, err := NewSQLiteStore(migratedb)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer store.Close()
+
+	version, err := store.(*sqliteStore).schemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion() {
+		t.Fatalf("expected schema version %d; got %d", SchemaVersion(), version)
+	}
+}
+
+func TestMigrateUnversionedDatabase(t *testing.T) {
+	removeDB(migratedb)
+	defer removeDB(migratedb)
+
+	// Create a database the way binaries did before schema versioning:
+	db, err := sqlx.Connect("sqlite3", migratedb)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrations[0].Up(tx); err != nil {
+		t.Fatal(err)
+	}
+	// Some later columns were already added by hand:
+	if err = addColumns(tx, "StockHourly", "Bid TEXT"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into Stock (UserID,Symbol,BuyDate,BuyPrice,Shares,IsWatched,NotifyTStop,NotifyBuyStop,NotifySellStop,NotifyRise,NotifyFall,NotifyBullBear) values (1, 'MSFT', '2013-09-03T00:00:00Z', '31.88', 10, 0, 0, 0, 0, 0, 0, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := NewSQLiteStore(migratedb)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer store.Close()
+
+	// Existing rows get defaults for new columns:
+	s, err := store.GetStock(context.Background(), StockID(1))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if s == nil || s.TStopSessions.String() != "regular" {
+		t.Fatalf("unexpected migrated stock: %+v", s)
+	}
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	removeDB(migratedb)
+	defer removeDB(migratedb)
+
+	db, err := sqlx.Connect("sqlite3", migratedb)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if _, err = db.Exec(`pragma user_version = 9999`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := NewSQLiteStore(migratedb)
+	if err == nil {
+		store.Close()
+		t.Fatal("expected error opening a newer database")
+	}
+}
@@ -0,0 +1,449 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"math"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// A portfolio's holdings valued at a trading day's close:
+type Snapshot struct {
+	UserID      UserID
+	PortfolioID PortfolioID // 0 for holdings in no portfolio
+	Date        DateTime
+
+	// Of owned stocks and open ledger positions at the day's close, or the last one before it:
+	MarketValue Decimal
+	// Like `PortfolioSummary.Cash` but never negative; what trades cost beyond the cash on hand is counted as
+	// put in, and paying it back as taken out:
+	Cash Decimal
+	// Money put in less money taken out since the portfolio's previous snapshot; the change in Invested:
+	NetFlow Decimal
+	// Money put in less money taken out through the day: deposits less withdrawals, what the owned stocks
+	// cost and what trades still owe beyond the cash on hand:
+	Invested Decimal
+}
+
+// Gets the market value plus cash.
+func (s Snapshot) Value() *big.Rat {
+	return new(big.Rat).Add(s.MarketValue.Value, s.Cash.Value)
+}
+
+// A portfolio's, or all of a user's portfolios', returns between two trading days:
+type Performance struct {
+	PortfolioID PortfolioID // `AllPortfolios` for all of them together
+	StartDate   DateTime
+	EndDate     DateTime
+
+	StartValue Decimal
+	EndValue   Decimal
+	// Put in less taken out after the start date through the end date:
+	NetFlow Decimal
+	// EndValue less StartValue and NetFlow:
+	Gain Decimal
+
+	// Percent return compounded daily, unaffected by when money was put in or taken out; days starting with
+	// nothing invested are left out:
+	TimeWeightedReturn NullFloat64
+	// Annualized percent rate of return of the money put in when it was put in (IRR); not valid for a single
+	// day or if there is no such rate:
+	MoneyWeightedReturn NullFloat64
+
+	// The recorded snapshots, summed across portfolios for `AllPortfolios`:
+	Snapshots []Snapshot
+}
+
+// Values a user's holdings in each portfolio at the last trading date's close and adds them to the user's
+// snapshots. Earlier snapshots are left as they were recorded, so editing holdings later shows up as money put
+// in or taken out rather than rewriting past returns. Does nothing if the date is already recorded.
+func (api *API) RecordSnapshots(userID UserID) (err error) {
+	return api.RecordSnapshotsContext(context.Background(), userID)
+}
+
+// Like `RecordSnapshots`; `ctx` cancels the store queries.
+func (api *API) RecordSnapshotsContext(ctx context.Context, userID UserID) (err error) {
+	return api.recordSnapshots(ctx, userID, api.LastTradingDate())
+}
+
+func (api *API) recordSnapshots(ctx context.Context, userID UserID, date time.Time) (err error) {
+	last, err := api.store.GetLastSnapshotDate(ctx, userID)
+	if err != nil {
+		return storeError("RecordSnapshots", "", err)
+	}
+	if last.Valid && !last.Value.Before(date) {
+		return nil
+	}
+
+	// Flows are measured against the previous snapshot of each portfolio:
+	var prev []Snapshot
+	if last.Valid {
+		if prev, err = api.store.GetSnapshots(ctx, userID, last.Value, last.Value); err != nil {
+			return storeError("RecordSnapshots", "", err)
+		}
+	}
+	snapshots, err := api.snapshots(ctx, userID, date, prev)
+	if err != nil || len(snapshots) == 0 {
+		return
+	}
+	return storeError("RecordSnapshots", "", api.store.AddSnapshots(ctx, snapshots))
+}
+
+// Gets the IDs of users with holdings or snapshots but none for the last trading date, in ascending order;
+// the users `RecordSnapshots` has something to do for.
+func (api *API) GetUserIDsToSnapshotContext(ctx context.Context) (ids []UserID, err error) {
+	ids, err = api.store.GetUserIDsToSnapshot(ctx, api.LastTradingDate())
+	return ids, storeError("GetUserIDsToSnapshot", "", err)
+}
+
+// Measures the performance of one of a user's portfolios, or of all of them for `AllPortfolios`, over the
+// recorded snapshots from the date of `from` through the date of `to`. Returns nil if there are none.
+func (api *API) GetPerformance(userID UserID, portfolioID PortfolioID, from, to time.Time) (p *Performance, err error) {
+	return api.GetPerformanceContext(context.Background(), userID, portfolioID, from, to)
+}
+
+// Like `GetPerformance`; `ctx` cancels the store query.
+func (api *API) GetPerformanceContext(ctx context.Context, userID UserID, portfolioID PortfolioID, from, to time.Time) (p *Performance, err error) {
+	snapshots, err := api.store.GetSnapshots(ctx, userID, api.calendar.Date(from), api.calendar.Date(to))
+	if err != nil {
+		return nil, storeError("GetPerformance", "", err)
+	}
+
+	// Sum the portfolios by date:
+	days := make([]Snapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		if portfolioID != AllPortfolios && s.PortfolioID != portfolioID {
+			continue
+		}
+		if n := len(days); n > 0 && days[n-1].Date.Value.Equal(s.Date.Value) {
+			d := &days[n-1]
+			d.MarketValue.Value.Add(d.MarketValue.Value, s.MarketValue.Value)
+			d.Cash.Value.Add(d.Cash.Value, s.Cash.Value)
+			d.NetFlow.Value.Add(d.NetFlow.Value, s.NetFlow.Value)
+			d.Invested.Value.Add(d.Invested.Value, s.Invested.Value)
+			continue
+		}
+		days = append(days, Snapshot{
+			UserID:      s.UserID,
+			PortfolioID: portfolioID,
+			Date:        s.Date,
+			MarketValue: Decimal{Value: new(big.Rat).Set(s.MarketValue.Value)},
+			Cash:        Decimal{Value: new(big.Rat).Set(s.Cash.Value)},
+			NetFlow:     Decimal{Value: new(big.Rat).Set(s.NetFlow.Value)},
+			Invested:    Decimal{Value: new(big.Rat).Set(s.Invested.Value)},
+		})
+	}
+	if len(days) == 0 {
+		return nil, nil
+	}
+	return measure(portfolioID, days), nil
+}
+
+// Computes returns over consecutive snapshots of one portfolio:
+func measure(portfolioID PortfolioID, days []Snapshot) *Performance {
+	first, last := days[0], days[len(days)-1]
+	p := &Performance{
+		PortfolioID: portfolioID,
+		StartDate:   first.Date,
+		EndDate:     last.Date,
+		StartValue:  Decimal{Value: first.Value()},
+		EndValue:    Decimal{Value: last.Value()},
+		Snapshots:   days,
+	}
+
+	flow := new(big.Rat)
+	growth := 1.0
+	flows := []cashFlow{{Amount: -RatToFloat(p.StartValue.Value)}}
+	for i := 1; i < len(days); i++ {
+		f := days[i].NetFlow.Value
+		flow.Add(flow, f)
+
+		// Money put in during a day is taken to be put in at its start:
+		base := new(big.Rat).Add(days[i-1].Value(), f)
+		if base.Sign() > 0 {
+			growth *= RatToFloat(new(big.Rat).Quo(days[i].Value(), base))
+		}
+		if f.Sign() != 0 {
+			flows = append(flows, cashFlow{Years: yearsBetween(first.Date, days[i].Date), Amount: -RatToFloat(f)})
+		}
+	}
+	flows = append(flows, cashFlow{Years: yearsBetween(first.Date, last.Date), Amount: RatToFloat(p.EndValue.Value)})
+
+	p.NetFlow = Decimal{Value: flow}
+	p.Gain = Decimal{Value: new(big.Rat).Sub(new(big.Rat).Sub(p.EndValue.Value, p.StartValue.Value), flow)}
+	if len(days) > 1 {
+		p.TimeWeightedReturn = NullFloat64{Value: (growth - 1) * 100, Valid: true}
+	}
+	if rate, ok := irr(flows); ok {
+		p.MoneyWeightedReturn = NullFloat64{Value: rate * 100, Valid: true}
+	}
+	return p
+}
+
+// An amount of money taken out of a portfolio, negative if put in, some years after its first snapshot:
+type cashFlow struct {
+	Years  float64
+	Amount float64
+}
+
+func yearsBetween(from, to DateTime) float64 {
+	return math.Round(to.Value.Sub(from.Value).Hours()/24) / 365
+}
+
+// Finds the annual rate that discounts cash flows to a net present value of zero by bisection; false if the
+// flows span no time or no rate between -100% and 1,000,000% does.
+func irr(flows []cashFlow) (rate float64, ok bool) {
+	if flows[len(flows)-1].Years <= 0 {
+		return 0, false
+	}
+	npv := func(r float64) (v float64) {
+		for _, f := range flows {
+			v += f.Amount / math.Pow(1+r, f.Years)
+		}
+		return
+	}
+
+	lo, hi := -0.999999, 10000.0
+	vlo, vhi := npv(lo), npv(hi)
+	if math.IsNaN(vlo) || math.IsNaN(vhi) || (vlo > 0) == (vhi > 0) {
+		return 0, false
+	}
+	for i := 0; i < 200; i++ {
+		mid := (lo + hi) / 2
+		if v := npv(mid); (v > 0) == (vlo > 0) {
+			lo, vlo = mid, v
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2, true
+}
+
+// ------------------------- snapshots:
+
+// One portfolio's holdings as of a snapshot date:
+type snapshotBook struct {
+	portfolioID PortfolioID
+
+	owned  []Stock                  // bought by the date
+	txns   []Transaction            // dated by the date
+	trades map[string][]Transaction // of `txns` by symbol
+
+	// What was invested as of the portfolio's previous snapshot; nil if it has none:
+	prev *big.Rat
+}
+
+// Values the book's holdings at the close of `date`; nil if it holds nothing and was never snapshotted:
+func (b *snapshotBook) snapshot(date time.Time, closes map[string]*big.Rat, splits map[string][]Split, dividends map[string][]Dividend) (s *Snapshot, err error) {
+	if len(b.owned) == 0 && len(b.txns) == 0 && b.prev == nil {
+		return nil, nil
+	}
+
+	cash, invested := new(big.Rat), new(big.Rat)
+	for _, t := range b.txns {
+		amount := t.Price.Value
+		if !t.Kind.IsCash() {
+			amount = new(big.Rat).Mul(t.Price.Value, IntToRat(t.Shares))
+		}
+		switch t.Kind {
+		case Deposit:
+			invested.Add(invested, amount)
+			cash.Add(cash, amount)
+		case Withdrawal:
+			invested.Sub(invested, amount)
+			cash.Sub(cash, amount)
+		case Sell, Short:
+			cash.Add(cash, amount)
+		case Buy, Cover:
+			cash.Sub(cash, amount)
+		}
+	}
+
+	value := new(big.Rat)
+	for symbol, trades := range b.trades {
+		split := splitsBy(splits[symbol], date)
+		open, _, err := matchLots(trades, split, FIFO)
+		if err != nil {
+			return nil, wrapError("RecordSnapshots", symbol, ErrBadData, err)
+		}
+		paid, err := dividendsReceived(trades, split, dividends[symbol])
+		if err != nil {
+			return nil, wrapError("RecordSnapshots", symbol, ErrBadData, err)
+		}
+		cash.Add(cash, paid)
+
+		shares := int64(0)
+		for _, l := range open {
+			shares += l.Shares
+		}
+		if shares == 0 {
+			continue
+		}
+		price := closes[symbol]
+		if price == nil {
+			// Without history, value shares at the last price they traded at:
+			price = trades[len(trades)-1].Price.Value
+		}
+		value.Add(value, new(big.Rat).Mul(price, IntToRat(shares)))
+	}
+	for _, o := range b.owned {
+		cost := new(big.Rat).Mul(o.BuyPrice.Value, IntToRat(o.Shares))
+		invested.Add(invested, cost)
+
+		// Stocks hold their post-split shares; undo the splits still to come:
+		ratio := big.NewRat(1, 1)
+		for _, sp := range splits[o.Symbol] {
+			if sp.Date.Value.After(date) && sp.Date.Value.After(o.BuyDate.Value) {
+				ratio.Mul(ratio, sp.Ratio())
+			}
+		}
+		if price := closes[o.Symbol]; price != nil {
+			value.Add(value, new(big.Rat).Mul(price, new(big.Rat).Quo(IntToRat(o.Shares), ratio)))
+		} else {
+			value.Add(value, cost)
+		}
+	}
+
+	// What trades cost beyond the cash on hand is counted as put in:
+	if cash.Sign() < 0 {
+		invested.Sub(invested, cash)
+		cash.SetInt64(0)
+	}
+	flow := new(big.Rat).Set(invested)
+	if b.prev != nil {
+		flow.Sub(flow, b.prev)
+	}
+
+	return &Snapshot{
+		PortfolioID: b.portfolioID,
+		Date:        DateTime{Value: date},
+		MarketValue: Decimal{Value: value},
+		Cash:        Decimal{Value: cash},
+		NetFlow:     Decimal{Value: flow},
+		Invested:    Decimal{Value: invested},
+	}, nil
+}
+
+// Values a user's portfolios at `date`'s close, following on from the snapshots of their previous date:
+func (api *API) snapshots(ctx context.Context, userID UserID, date time.Time, prev []Snapshot) (snapshots []Snapshot, err error) {
+	ps, err := api.store.GetPortfolios(ctx, userID)
+	if err != nil {
+		return nil, storeError("RecordSnapshots", "", err)
+	}
+	owned, err := api.store.GetStocksForUser(ctx, userID)
+	if err != nil {
+		return nil, storeError("RecordSnapshots", "", err)
+	}
+	txns, err := api.store.GetTransactions(ctx, userID, "")
+	if err != nil {
+		return nil, storeError("RecordSnapshots", "", err)
+	}
+
+	// Holdings of portfolios removed from under them are counted with those in none:
+	books := make(map[PortfolioID]*snapshotBook, len(ps)+1)
+	books[0] = nil
+	for _, p := range ps {
+		books[p.PortfolioID] = nil
+	}
+	book := func(id PortfolioID) *snapshotBook {
+		if _, ok := books[id]; !ok {
+			id = 0
+		}
+		if books[id] == nil {
+			books[id] = &snapshotBook{portfolioID: id, trades: make(map[string][]Transaction)}
+		}
+		return books[id]
+	}
+
+	for _, s := range prev {
+		b := book(s.PortfolioID)
+		if b.prev == nil {
+			b.prev = new(big.Rat)
+		}
+		b.prev.Add(b.prev, s.Invested.Value)
+	}
+
+	// Trades and buys are dated at UTC midnight but closes and corporate actions at New York midnight:
+	symbols := make(map[string]bool)
+	for _, s := range owned {
+		if s.IsWatched || api.calendar.Date(s.BuyDate.Value).After(date) {
+			continue
+		}
+		s.BuyDate = DateTime{Value: api.calendar.Date(s.BuyDate.Value)}
+		b := book(s.PortfolioID)
+		b.owned = append(b.owned, s)
+		symbols[s.Symbol] = true
+	}
+	for _, t := range txns {
+		t.Date = DateTime{Value: api.calendar.Date(t.Date.Value)}
+		if t.Date.Value.After(date) {
+			continue
+		}
+		b := book(t.PortfolioID)
+		b.txns = append(b.txns, t)
+		if !t.Kind.IsCash() {
+			b.trades[t.Symbol] = append(b.trades[t.Symbol], t)
+			symbols[t.Symbol] = true
+		}
+	}
+
+	closes := make(map[string]*big.Rat, len(symbols))
+	splits := make(map[string][]Split, len(symbols))
+	dividends := make(map[string][]Dividend, len(symbols))
+	for symbol := range symbols {
+		if closes[symbol], err = api.closeOn(ctx, symbol, date); err != nil {
+			return
+		}
+		if splits[symbol], err = api.store.GetSplits(ctx, symbol); err != nil {
+			return nil, storeError("RecordSnapshots", symbol, err)
+		}
+		if dividends[symbol], err = api.store.GetDividends(ctx, symbol); err != nil {
+			return nil, storeError("RecordSnapshots", symbol, err)
+		}
+		dividends[symbol] = dividendsBy(dividends[symbol], date)
+	}
+
+	ordered := make([]*snapshotBook, 0, len(books))
+	for _, b := range books {
+		if b != nil {
+			ordered = append(ordered, b)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].portfolioID < ordered[j].portfolioID })
+
+	snapshots = make([]Snapshot, 0, len(ordered))
+	for _, b := range ordered {
+		s, err := b.snapshot(date, closes, splits, dividends)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			s.UserID = userID
+			snapshots = append(snapshots, *s)
+		}
+	}
+	return snapshots, nil
+}
+
+// Gets a symbol's last recorded close on or before `date`; nil if there is none:
+func (api *API) closeOn(ctx context.Context, symbol string, date time.Time) (price *big.Rat, err error) {
+	h, err := api.store.GetLastHistoryDay(ctx, symbol, date)
+	if err != nil || h == nil {
+		return nil, storeError("RecordSnapshots", symbol, err)
+	}
+	return h.Close.Value, nil
+}
+
+// The splits, in ascending date order, taking effect by `date`:
+func splitsBy(splits []Split, date time.Time) []Split {
+	i := sort.Search(len(splits), func(i int) bool { return splits[i].Date.Value.After(date) })
+	return splits[:i]
+}
+
+// The dividends, in ascending date order, going ex by `date`:
+func dividendsBy(dividends []Dividend, date time.Time) []Dividend {
+	i := sort.Search(len(dividends), func(i int) bool { return dividends[i].Date.Value.After(date) })
+	return dividends[:i]
+}
@@ -0,0 +1,178 @@
+package stocks
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+)
+
+const performancedb = "./tmp-performance.db"
+
+func testSnapshot(date string, value, flow string) Snapshot {
+	return Snapshot{Date: testDateTime(dateFmt, date), MarketValue: ToDecimal(value), Cash: ToDecimal("0"), NetFlow: ToDecimal(flow), Invested: ToDecimal(flow)}
+}
+
+func TestMeasure(t *testing.T) {
+	// Up 10% in each half year with as much again put in halfway:
+	p := measure(AllPortfolios, []Snapshot{
+		testSnapshot("2013-01-02", "1000.00", "1000.00"),
+		testSnapshot("2013-07-02", "1100.00", "0.00"),
+		testSnapshot("2014-01-02", "2420.00", "1100.00"),
+	})
+	if p.NetFlow.String() != "1100.00" || p.Gain.String() != "320.00" {
+		t.Fatalf("expected 1100.00 put in and 320.00 gained; got %+v", p)
+	}
+	if !p.TimeWeightedReturn.Valid || math.Abs(p.TimeWeightedReturn.Value-21) > 1e-9 {
+		t.Fatalf("expected a 21%% time-weighted return; got %v", p.TimeWeightedReturn)
+	}
+	// -1000*(1+r) - 1100 + 2420 = 0 a year apart:
+	if !p.MoneyWeightedReturn.Valid || math.Abs(p.MoneyWeightedReturn.Value-32) > 1e-6 {
+		t.Fatalf("expected a 32%% money-weighted return; got %v", p.MoneyWeightedReturn)
+	}
+
+	// A single day has no returns:
+	p = measure(AllPortfolios, []Snapshot{testSnapshot("2013-01-02", "1000.00", "1000.00")})
+	if p.TimeWeightedReturn.Valid || p.MoneyWeightedReturn.Valid {
+		t.Fatalf("expected no returns for a single day; got %+v", p)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	t.Run("memory", func(t *testing.T) { testSnapshots(t, NewMemoryStore()) })
+	t.Run("sqlite", func(t *testing.T) {
+		removeDB(performancedb)
+		defer removeDB(performancedb)
+
+		store, err := NewSQLiteStore(performancedb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testSnapshots(t, store)
+	})
+}
+
+func testSnapshots(t *testing.T, store Store) {
+	a, err := NewAPI(store, csvdir.New(testdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	user := &User{Name: "Test User", Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err = a.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	deposit := Transaction{UserID: user.UserID, Kind: Deposit, Date: testDateTime(dateFmt, "2013-06-03"), Price: ToDecimal("1000.00")}
+	buy := testTransaction(0, Buy, "2013-06-04", 10, "35.00")
+	buy.UserID = user.UserID
+	// More than the cash left pays for:
+	more := testTransaction(0, Buy, "2013-06-05", 100, "35.00")
+	more.UserID = user.UserID
+	for _, txn := range []*Transaction{&deposit, &buy, &more} {
+		if err = a.AddTransaction(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.RecordHistory("MSFT"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	day := func(date string) time.Time { return a.calendar.Date(testDateTime(dateFmt, date).Value) }
+	for _, date := range []string{"2013-06-03", "2013-06-04", "2013-06-05", "2013-06-05"} {
+		if err = a.recordSnapshots(ctx, user.UserID, day(date)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorded, err := store.GetSnapshots(ctx, user.UserID, day("2013-01-01"), day("2013-12-31"))
+	if err != nil || len(recorded) != 3 {
+		t.Fatalf("expected one snapshot a day; got %+v, %v", recorded, err)
+	}
+
+	first, second, third := recorded[0], recorded[1], recorded[2]
+	if first.MarketValue.String() != "0.00" || first.Cash.String() != "1000.00" || first.NetFlow.String() != "1000.00" {
+		t.Fatalf("expected 1000.00 deposited on 2013-06-03; got %+v", first)
+	}
+	price, err := a.closeOn(ctx, "MSFT", second.Date.Value)
+	if err != nil || price == nil {
+		t.Fatalf("expected a close on 2013-06-04; got %v, %v", price, err)
+	}
+	value := new(big.Rat).Mul(price, big.NewRat(10, 1))
+	if second.MarketValue.Value.Cmp(value) != 0 || second.Cash.String() != "650.00" || second.NetFlow.String() != "0.00" {
+		t.Fatalf("expected 10 shares worth %s and 650.00 cash on 2013-06-04; got %+v", value.FloatString(2), second)
+	}
+	// The 3500.00 buy takes the 650.00 left and 2850.00 more:
+	if third.Cash.String() != "0.00" || third.NetFlow.String() != "2850.00" || third.Invested.String() != "3850.00" {
+		t.Fatalf("expected 2850.00 put in on 2013-06-05; got %+v", third)
+	}
+
+	// A recorded date is never replaced:
+	again := testSnapshot("2013-06-05", "1.00", "1.00")
+	again.UserID, again.Date = user.UserID, third.Date
+	if err = store.AddSnapshots(ctx, []Snapshot{again}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stock owned since before the last snapshot is put in when it is first snapshotted:
+	owned := Stock{UserID: user.UserID, Symbol: "MSFT", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("30.00"), Shares: 5}
+	if err = a.AddStock(&owned); err != nil {
+		t.Fatal(err)
+	}
+	due, err := a.GetUserIDsToSnapshotContext(ctx)
+	if err != nil || len(due) != 1 || due[0] != user.UserID {
+		t.Fatalf("expected user %d due a snapshot; got %v, %v", user.UserID, due, err)
+	}
+	if err = a.recordSnapshots(ctx, user.UserID, day("2013-12-31")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := a.GetPerformance(user.UserID, AllPortfolios, testDateTime(dateFmt, "2013-06-01").Value, testDateTime(dateFmt, "2013-12-31").Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || len(p.Snapshots) != 4 || p.StartDate.DateString() != "2013-06-03" {
+		t.Fatalf("expected 4 snapshots from 2013-06-03; got %+v", p)
+	}
+	for i, s := range recorded {
+		if got := p.Snapshots[i]; got.Value().Cmp(s.Value()) != 0 || got.NetFlow.Value.Cmp(s.NetFlow.Value) != 0 {
+			t.Fatalf("expected the snapshot of %s left as %+v; got %+v", s.Date.DateString(), s, got)
+		}
+	}
+	// The stock's 150.00 less dividends of 0.23 and 0.28 on 110 shares paying back 56.10 of the 2850.00:
+	end := p.Snapshots[len(p.Snapshots)-1]
+	if end.Cash.String() != "0.00" || end.NetFlow.String() != "93.90" || end.Invested.String() != "3943.90" {
+		t.Fatalf("expected 93.90 put in by the end of 2013; got %+v", end)
+	}
+
+	if p.NetFlow.String() != "2943.90" {
+		t.Fatalf("expected 2943.90 put in after the start; got %v", p.NetFlow)
+	}
+	gain := new(big.Rat).Sub(new(big.Rat).Sub(end.Value(), big.NewRat(1000, 1)), big.NewRat(294390, 100))
+	if p.Gain.Value.Cmp(gain) != 0 || !p.TimeWeightedReturn.Valid || !p.MoneyWeightedReturn.Valid {
+		t.Fatalf("expected a %s gain with returns; got %+v", gain.FloatString(2), p)
+	}
+
+	// Only the portfolio asked for:
+	if p, err = a.GetPerformance(user.UserID, 1, testDateTime(dateFmt, "2013-06-01").Value, testDateTime(dateFmt, "2013-12-31").Value); err != nil || p != nil {
+		t.Fatalf("expected no snapshots of another portfolio; got %+v, %v", p, err)
+	}
+
+	// Nightly runs pick up from the last snapshot:
+	if err = a.RecordSnapshots(user.UserID); err != nil {
+		t.Fatal(err)
+	}
+	last, err := store.GetLastSnapshotDate(ctx, user.UserID)
+	if err != nil || !last.Valid || !last.Value.Equal(a.LastTradingDate()) {
+		t.Fatalf("expected a snapshot of %s; got %v, %v", a.LastTradingDate(), last, err)
+	}
+	if due, err = a.GetUserIDsToSnapshotContext(ctx); err != nil || len(due) != 0 {
+		t.Fatalf("expected no user due a snapshot; got %v, %v", due, err)
+	}
+}
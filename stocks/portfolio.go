@@ -0,0 +1,239 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type PortfolioID int64
+
+// Selects the holdings of every portfolio, including those in none, when filtering by portfolio:
+const AllPortfolios PortfolioID = -1
+
+// A user's named brokerage account or group of holdings, e.g. "IRA" or "Taxable". Stocks and transactions
+// with a zero PortfolioID are in no portfolio.
+type Portfolio struct {
+	PortfolioID PortfolioID
+	UserID      UserID
+	Name        string
+}
+
+// A portfolio's stocks, ledger positions and cash rolled up:
+type PortfolioDetail struct {
+	Portfolio Portfolio // zero PortfolioID for holdings in no portfolio
+
+	Owned     []StockDetail
+	Watched   []StockDetail
+	Positions []Position
+
+	Summary PortfolioSummary
+}
+
+// Adds a portfolio for `p.UserID` and sets `p.PortfolioID`. Fails with `ErrBadData` if the name is empty or
+// the user already has a portfolio by that name.
+func (api *API) AddPortfolio(p *Portfolio) (err error) {
+	if p == nil {
+		return fmt.Errorf("p cannot be nil for AddPortfolio")
+	}
+
+	ctx := context.Background()
+	p.Name = strings.TrimSpace(p.Name)
+	if err = api.checkPortfolioName(ctx, p.UserID, 0, p.Name); err != nil {
+		return wrapError("AddPortfolio", "", ErrBadData, err)
+	}
+
+	return storeError("AddPortfolio", "", api.store.AddPortfolio(ctx, p))
+}
+
+// Gets a portfolio by ID; nil if it does not exist.
+func (api *API) GetPortfolio(portfolioID PortfolioID) (p *Portfolio, err error) {
+	return api.GetPortfolioContext(context.Background(), portfolioID)
+}
+
+// Like `GetPortfolio`; `ctx` cancels the store query.
+func (api *API) GetPortfolioContext(ctx context.Context, portfolioID PortfolioID) (p *Portfolio, err error) {
+	p, err = api.store.GetPortfolio(ctx, portfolioID)
+	return p, storeError("GetPortfolio", "", err)
+}
+
+// Gets a user's portfolios ordered by name.
+func (api *API) GetPortfolios(userID UserID) (portfolios []Portfolio, err error) {
+	return api.GetPortfoliosContext(context.Background(), userID)
+}
+
+// Like `GetPortfolios`; `ctx` cancels the store query.
+func (api *API) GetPortfoliosContext(ctx context.Context, userID UserID) (portfolios []Portfolio, err error) {
+	portfolios, err = api.store.GetPortfolios(ctx, userID)
+	return portfolios, storeError("GetPortfolios", "", err)
+}
+
+// Renames a portfolio. Fails with `ErrBadData` like `AddPortfolio`.
+func (api *API) RenamePortfolio(portfolioID PortfolioID, name string) (err error) {
+	ctx := context.Background()
+	p, err := api.store.GetPortfolio(ctx, portfolioID)
+	if err != nil || p == nil {
+		return storeError("RenamePortfolio", "", err)
+	}
+
+	name = strings.TrimSpace(name)
+	if err = api.checkPortfolioName(ctx, p.UserID, portfolioID, name); err != nil {
+		return wrapError("RenamePortfolio", "", ErrBadData, err)
+	}
+
+	return storeError("RenamePortfolio", "", api.store.RenamePortfolio(ctx, portfolioID, name))
+}
+
+// Removes a portfolio and leaves its stocks in no portfolio. Fails with `ErrBadData` if ledger transactions
+// are recorded in it since moving them would merge their lots with others.
+func (api *API) RemovePortfolio(portfolioID PortfolioID) (err error) {
+	ctx := context.Background()
+	p, err := api.store.GetPortfolio(ctx, portfolioID)
+	if err != nil || p == nil {
+		return storeError("RemovePortfolio", "", err)
+	}
+
+	// The store checks for transactions in the same transaction that removes it:
+	removed, err := api.store.RemovePortfolio(ctx, portfolioID)
+	if err != nil {
+		return storeError("RemovePortfolio", "", err)
+	}
+	if !removed {
+		return badData("RemovePortfolio", "", fmt.Errorf("portfolio %q still has transactions", p.Name))
+	}
+	return nil
+}
+
+// Checks that a portfolio name is not empty and not used by another of the user's portfolios:
+func (api *API) checkPortfolioName(ctx context.Context, userID UserID, portfolioID PortfolioID, name string) (err error) {
+	if name == "" {
+		return fmt.Errorf("portfolio name required")
+	}
+
+	portfolios, err := api.store.GetPortfolios(ctx, userID)
+	if err != nil {
+		return
+	}
+	for _, p := range portfolios {
+		if p.PortfolioID != portfolioID && strings.EqualFold(p.Name, name) {
+			return fmt.Errorf("portfolio %q already exists", p.Name)
+		}
+	}
+	return nil
+}
+
+// Checks that a stock or transaction of `userID` may be put in a portfolio; 0 for none always may.
+func (api *API) checkPortfolio(ctx context.Context, userID UserID, portfolioID PortfolioID) (err error) {
+	if portfolioID == 0 {
+		return nil
+	}
+
+	p, err := api.store.GetPortfolio(ctx, portfolioID)
+	if err != nil {
+		return
+	}
+	// Don't tell users apart from missing portfolios:
+	if p == nil || p.UserID != userID {
+		return fmt.Errorf("portfolio %d not found", portfolioID)
+	}
+	return nil
+}
+
+// Keeps the transactions of one portfolio, or all of them for `AllPortfolios`:
+func inPortfolio(txns []Transaction, portfolioID PortfolioID) []Transaction {
+	if portfolioID == AllPortfolios {
+		return txns
+	}
+
+	kept := make([]Transaction, 0, len(txns))
+	for _, t := range txns {
+		if t.PortfolioID == portfolioID {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// Gets a user's stocks, positions and cash rolled up per portfolio, ordered by name after those in no
+// portfolio. Holdings in no portfolio are left out if there are none; empty portfolios are not.
+func (api *API) GetPortfolioDetails(userID UserID, m LotMatching) (portfolios []PortfolioDetail, err error) {
+	return api.GetPortfolioDetailsContext(context.Background(), userID, m)
+}
+
+// Like `GetPortfolioDetails`; `ctx` cancels the store queries.
+func (api *API) GetPortfolioDetailsContext(ctx context.Context, userID UserID, m LotMatching) (portfolios []PortfolioDetail, err error) {
+	ps, err := api.store.GetPortfolios(ctx, userID)
+	if err != nil {
+		return nil, storeError("GetPortfolioDetails", "", err)
+	}
+	details, err := api.GetStockDetailsForUserContext(ctx, userID)
+	if err != nil {
+		return
+	}
+	positions, err := api.GetPositionsContext(ctx, userID, m)
+	if err != nil {
+		return
+	}
+	txns, err := api.store.GetTransactions(ctx, userID, "")
+	if err != nil {
+		return nil, storeError("GetPortfolioDetails", "", err)
+	}
+
+	byID := make(map[PortfolioID]*PortfolioDetail, len(ps)+1)
+	byID[0] = &PortfolioDetail{Portfolio: Portfolio{UserID: userID}}
+	for _, p := range ps {
+		byID[p.PortfolioID] = &PortfolioDetail{Portfolio: p}
+	}
+
+	// Holdings of portfolios removed from under them are shown with those in none:
+	get := func(id PortfolioID) *PortfolioDetail {
+		if pd, ok := byID[id]; ok {
+			return pd
+		}
+		return byID[0]
+	}
+	for _, sd := range details {
+		pd := get(sd.Stock.PortfolioID)
+		if sd.Stock.IsWatched {
+			pd.Watched = append(pd.Watched, sd)
+		} else {
+			pd.Owned = append(pd.Owned, sd)
+		}
+	}
+	for _, p := range positions {
+		pd := get(p.PortfolioID)
+		pd.Positions = append(pd.Positions, p)
+	}
+	ledgers := make(map[*PortfolioDetail][]Transaction, len(byID))
+	for _, t := range txns {
+		pd := get(t.PortfolioID)
+		ledgers[pd] = append(ledgers[pd], t)
+	}
+
+	portfolios = make([]PortfolioDetail, 0, len(ps)+1)
+	if none := byID[0]; len(none.Owned)+len(none.Watched)+len(ledgers[none]) > 0 {
+		portfolios = append(portfolios, *none)
+	}
+	for _, p := range ps {
+		portfolios = append(portfolios, *byID[p.PortfolioID])
+	}
+	for i := range portfolios {
+		pd := &portfolios[i]
+		pd.Summary = Summarize(pd.Owned, pd.Positions, cashBalance(ledgers[byID[pd.Portfolio.PortfolioID]], pd.Positions))
+	}
+
+	total := TotalSummary(portfolios)
+	for i := range portfolios {
+		portfolios[i].Summary.AllocationPercent = percentOf(portfolios[i].Summary.TotalValue, total.TotalValue)
+	}
+	return portfolios, nil
+}
+
+// Orders portfolios by name:
+func sortPortfolios(portfolios []Portfolio) {
+	sort.Slice(portfolios, func(i, j int) bool {
+		return strings.ToLower(portfolios[i].Name) < strings.ToLower(portfolios[j].Name)
+	})
+}
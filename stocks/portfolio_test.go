@@ -0,0 +1,137 @@
+package stocks
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+const portfoliodb = "./tmp-portfolio.db"
+
+func TestPortfolios(t *testing.T) {
+	t.Run("memory", func(t *testing.T) { testPortfolios(t, NewMemoryStore()) })
+	t.Run("sqlite", func(t *testing.T) {
+		removeDB(portfoliodb)
+		defer removeDB(portfoliodb)
+
+		store, err := NewSQLiteStore(portfoliodb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPortfolios(t, store)
+	})
+}
+
+func testPortfolios(t *testing.T, store Store) {
+	a := setupStore(t, store)
+	defer a.Close()
+
+	user, err := a.GetUserByEmail("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taxable := &Portfolio{UserID: user.UserID, Name: "Taxable"}
+	ira := &Portfolio{UserID: user.UserID, Name: " IRA "}
+	for _, p := range []*Portfolio{taxable, ira} {
+		if err = a.AddPortfolio(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.AddPortfolio(&Portfolio{UserID: user.UserID, Name: "ira"}); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data for a duplicate name; got %v", err)
+	}
+	if err = a.AddPortfolio(&Portfolio{UserID: user.UserID, Name: ""}); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data for an empty name; got %v", err)
+	}
+	portfolios, err := a.GetPortfolios(user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(portfolios) != 2 || portfolios[0].Name != "IRA" || portfolios[1].Name != "Taxable" {
+		t.Fatalf("expected IRA and Taxable; got %+v", portfolios)
+	}
+
+	// Other users' portfolios are off limits:
+	other := &User{Name: "Other User", Emails: []UserEmail{UserEmail{Email: "other@example.org", IsPrimary: true}}}
+	if err = a.AddUser(other); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddStock(&Stock{UserID: other.UserID, PortfolioID: ira.PortfolioID, Symbol: "MSFT", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("30.00"), Shares: 1}); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data for another user's portfolio; got %v", err)
+	}
+
+	// Move the owned MSFT into the IRA:
+	msft, err := a.GetStock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msft.PortfolioID = ira.PortfolioID
+	if err = a.UpdateStock(msft); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lots don't close across portfolios:
+	buy := testTransaction(0, Buy, "2013-06-03", 10, "30.00")
+	buy.UserID, buy.PortfolioID = user.UserID, taxable.PortfolioID
+	if err = a.AddTransaction(&buy); err != nil {
+		t.Fatal(err)
+	}
+	sell := testTransaction(0, Sell, "2013-06-04", 4, "35.00")
+	sell.UserID, sell.PortfolioID = user.UserID, ira.PortfolioID
+	if err = a.AddTransaction(&sell); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data selling shares held in another portfolio; got %v", err)
+	}
+	sell.PortfolioID = taxable.PortfolioID
+	if err = a.AddTransaction(&sell); err != nil {
+		t.Fatal(err)
+	}
+
+	details, err := a.GetPortfolioDetails(user.UserID, FIFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(details) != 3 || details[0].Portfolio.PortfolioID != 0 || details[1].Portfolio.Name != "IRA" || details[2].Portfolio.Name != "Taxable" {
+		t.Fatalf("expected no portfolio, IRA and Taxable; got %+v", details)
+	}
+	none, iraDetail, taxableDetail := details[0], details[1], details[2]
+	if len(none.Owned) != 1 || len(none.Watched) != 1 || len(none.Positions) != 0 {
+		t.Fatalf("expected the AAPL short and watch in no portfolio; got %+v", none)
+	}
+	if len(iraDetail.Owned) != 1 || iraDetail.Owned[0].Stock.Symbol != "MSFT" || len(iraDetail.Positions) != 0 {
+		t.Fatalf("expected MSFT owned in the IRA; got %+v", iraDetail)
+	}
+	value := new(big.Rat).Mul(iraDetail.Owned[0].Detail.CurrPrice.Value, big.NewRat(10, 1))
+	summary := iraDetail.Summary
+	if !summary.MarketValue.Valid || summary.MarketValue.Value.Cmp(value) != 0 || summary.UnrealizedGain.Value.Cmp(iraDetail.Owned[0].Detail.GainLossDollar.Value) != 0 {
+		t.Fatalf("expected the IRA worth %s; got %+v", value.FloatString(2), iraDetail)
+	}
+	if len(taxableDetail.Positions) != 1 || taxableDetail.Positions[0].Shares != 6 || taxableDetail.Summary.RealizedGain.String() != "20.00" {
+		t.Fatalf("expected 6 shares with 20.00 realized in Taxable; got %+v", taxableDetail)
+	}
+	// Bought for 300.00 and sold for 140.00 with no cash deposited, then paid 0.23 and 0.28 on the 6 shares left:
+	if taxableDetail.Summary.Cash.String() != "-156.94" || taxableDetail.Summary.Dividends.String() != "3.06" {
+		t.Fatalf("expected -156.94 cash with 3.06 in dividends in Taxable; got %+v", taxableDetail.Summary)
+	}
+
+	// Portfolios with transactions can't be removed; stocks move out of removed ones:
+	if err = a.RemovePortfolio(taxable.PortfolioID); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data removing a portfolio with transactions; got %v", err)
+	}
+	if p, err := a.GetPortfolio(taxable.PortfolioID); err != nil || p == nil {
+		t.Fatalf("expected Taxable kept; got %+v, %v", p, err)
+	}
+	if err = a.RemovePortfolio(ira.PortfolioID); err != nil {
+		t.Fatal(err)
+	}
+	if msft, err = a.GetStock(1); err != nil || msft.PortfolioID != 0 {
+		t.Fatalf("expected MSFT in no portfolio; got %+v, %v", msft, err)
+	}
+
+	if err = a.RenamePortfolio(taxable.PortfolioID, "Brokerage"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := a.GetPortfolio(taxable.PortfolioID); err != nil || p == nil || p.Name != "Brokerage" {
+		t.Fatalf("expected Brokerage; got %+v, %v", p, err)
+	}
+}
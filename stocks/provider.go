@@ -0,0 +1,29 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"time"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/yql"
+)
+
+// A source of current stock quotes and daily trading history.
+// `*yql.Provider` is the default implementation. Requests should be abandoned with `ctx.Err()` once `ctx` is done.
+type QuoteProvider interface {
+	// Gets the current trading prices for a set of symbols.
+	// Symbols without a usable price may be left out and reported with a `yql.PriceErrors` error.
+	GetQuotesContext(ctx context.Context, symbols ...string) (quotes []yql.Quote, err error)
+
+	// Gets all historical data for a symbol between startDate and endDate, ordered by descending date.
+	GetHistoryContext(ctx context.Context, symbol string, startDate, endDate time.Time) (results []yql.History, err error)
+
+	// Gets all cash dividends for a symbol with ex-dates between startDate and endDate.
+	GetDividendsContext(ctx context.Context, symbol string, startDate, endDate time.Time) (dividends []yql.Dividend, err error)
+
+	// Gets all stock splits for a symbol between startDate and endDate.
+	GetSplitsContext(ctx context.Context, symbol string, startDate, endDate time.Time) (splits []yql.Split, err error)
+}
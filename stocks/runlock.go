@@ -0,0 +1,48 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// An advisory lock held through the store, e.g. so only one stocks-hourly run evaluates alerts at a time
+// even across processes.
+type RunLock struct {
+	api   *API
+	name  string
+	owner string
+}
+
+// Identifies this process and lock attempt as the owner of a run lock:
+func newRunLockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+// Takes the advisory lock `name`; fails with `ErrLocked` while another run holds it. The lock expires after
+// `ttl` in case the run dies without unlocking it.
+func (api *API) LockRun(name string, ttl time.Duration) (l *RunLock, err error) {
+	return api.LockRunContext(context.Background(), name, ttl)
+}
+
+// Like `LockRun`; `ctx` cancels waiting on the store.
+func (api *API) LockRunContext(ctx context.Context, name string, ttl time.Duration) (l *RunLock, err error) {
+	l = &RunLock{api: api, name: name, owner: newRunLockOwner()}
+
+	acquired, err := api.store.AcquireRunLock(ctx, name, l.owner, time.Now().Add(ttl))
+	if err != nil {
+		return nil, storeError("LockRun", "", err)
+	}
+	if !acquired {
+		return nil, wrapError("LockRun", "", ErrLocked, fmt.Errorf("run lock %q is held", name))
+	}
+	return l, nil
+}
+
+// Releases the lock; does nothing if it has expired and another run took it.
+func (l *RunLock) Unlock() error {
+	return storeError("Unlock", "", l.api.store.ReleaseRunLock(context.Background(), l.name, l.owner))
+}
@@ -0,0 +1,192 @@
+package stocks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/JamesDunne/StockWatcher/csvdir"
+)
+
+const hammerdb = "./tmp-hammer.db"
+
+func testRunLock(t *testing.T, store Store) {
+	a, err := NewAPI(store, csvdir.New(testdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	l, err := a.LockRun("hourly", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.LockRun("hourly", time.Hour); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected locked; got %v", err)
+	}
+	if err = l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired lock is taken over, and its old owner can't release the new one:
+	if _, err = a.LockRun("hourly", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = a.LockRun("hourly", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = (&RunLock{api: a, name: "hourly", owner: "someone else"}).Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.LockRun("hourly", time.Hour); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected locked; got %v", err)
+	}
+}
+
+func TestRunLock(t *testing.T) {
+	testRunLock(t, NewMemoryStore())
+
+	removeDB(hammerdb)
+	defer removeDB(hammerdb)
+	store, err := NewSQLiteStore(hammerdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRunLock(t, store)
+}
+
+// Runs stocks-web fetches and stocks-hourly evaluations at once, each through its own connection to the
+// same DB as if from separate processes:
+func TestHammerSQLite(t *testing.T) {
+	removeDB(hammerdb)
+	defer removeDB(hammerdb)
+
+	open := func() *API {
+		store, err := NewSQLiteStore(hammerdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := NewAPI(store, csvdir.New(testdata))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	web, hourly := open(), open()
+	defer web.Close()
+	defer hourly.Close()
+
+	user := &User{Name: "Test User", NotificationTimeout: time.Hour, Emails: []UserEmail{UserEmail{Email: "test@example.org", IsPrimary: true}}}
+	if err := web.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Stock{
+		&Stock{UserID: user.UserID, Symbol: "MSFT", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("30.00"), Shares: 10},
+		&Stock{UserID: user.UserID, Symbol: "AAPL", BuyDate: testDateTime(dateFmt, "2013-06-03"), BuyPrice: ToDecimal("450.00"), Shares: 5},
+	} {
+		if err := web.AddStock(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const rounds = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	var holders, maxHolders int32
+
+	// The /ui/fetch path:
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				symbols, err := web.GetAllTrackedSymbols()
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, symbol := range symbols {
+					if err = web.RecordHistory(symbol); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if _, err = web.GetCurrentHourlyPrices(true, symbols...); err != nil {
+					errs <- err
+					return
+				}
+				if _, err = web.GetStockDetailsForUser(user.UserID); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	// Overlapping stocks-hourly runs; only one at a time may evaluate:
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				l, err := hourly.LockRunContext(context.Background(), "stocks-hourly", time.Minute)
+				if errors.Is(err, ErrLocked) {
+					continue
+				} else if err != nil {
+					errs <- err
+					return
+				}
+
+				n := atomic.AddInt32(&holders, 1)
+				for {
+					max := atomic.LoadInt32(&maxHolders)
+					if n <= max || atomic.CompareAndSwapInt32(&maxHolders, max, n) {
+						break
+					}
+				}
+
+				err = func() (err error) {
+					for _, symbol := range []string{"MSFT", "AAPL"} {
+						if err = hourly.RecordHistory(symbol); err != nil {
+							return
+						}
+						details, err := hourly.GetStockDetailsForSymbol(symbol)
+						if err != nil {
+							return err
+						}
+						for _, sd := range details {
+							sd.Stock.LastTimeTStop = NullDateTime{Value: time.Now(), Valid: true}
+							if err = hourly.UpdateNotifyTimes(&sd.Stock); err != nil {
+								return err
+							}
+						}
+					}
+					return
+				}()
+
+				atomic.AddInt32(&holders, -1)
+				if uerr := l.Unlock(); err == nil {
+					err = uerr
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if maxHolders != 1 {
+		t.Fatalf("expected one run at a time; got %d at once", maxHolders)
+	}
+}
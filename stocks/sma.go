@@ -0,0 +1,161 @@
+package stocks
+
+// general stuff:
+import (
+	"math"
+	"strconv"
+)
+
+// Lengths of the moving-average windows recorded in StockStats, in trading days:
+const (
+	longWindow  = 200
+	shortWindow = 50
+)
+
+// Simple moving average over a trailing window of the last `size` values pushed.
+type movingAverage struct {
+	values []float64
+	next   int
+	count  int
+	sum    float64
+}
+
+func newMovingAverage(size int) *movingAverage {
+	return &movingAverage{values: make([]float64, size)}
+}
+
+// Adds a value to the window, dropping the oldest value once the window is full.
+func (m *movingAverage) Push(v float64) {
+	if m.count == len(m.values) {
+		m.sum -= m.values[m.next]
+	} else {
+		m.count++
+	}
+	m.values[m.next] = v
+	m.sum += v
+
+	m.next++
+	if m.next == len(m.values) {
+		m.next = 0
+
+		// Resum once per lap so floating-point error doesn't accumulate:
+		m.sum = 0
+		for _, x := range m.values[:m.count] {
+			m.sum += x
+		}
+	}
+}
+
+// Reports whether the window holds `size` values.
+func (m *movingAverage) Ready() bool { return m.count == len(m.values) }
+
+// Average of the values in the window.
+func (m *movingAverage) Value() float64 {
+	if m.count == 0 {
+		return 0
+	}
+	return m.sum / float64(m.count)
+}
+
+// Population standard deviation of the values in the window.
+func (m *movingAverage) StdDev() float64 {
+	if m.count == 0 {
+		return 0
+	}
+	mean, sumsq := m.Value(), 0.0
+	for _, x := range m.values[:m.count] {
+		sumsq += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(sumsq / float64(m.count))
+}
+
+// A trading day's adjusted prices:
+type dayClose struct {
+	Date          DateTime
+	TradeDayIndex int64
+	Close         float64
+	High          float64
+	Low           float64
+}
+
+// A trading day's moving averages and indicators:
+type DayStats struct {
+	Date          DateTime
+	TradeDayIndex int64
+	Avg200Day     float64
+	Avg50Day      float64
+	SMAPercent    float64
+
+	EMA12          float64
+	EMA26          float64
+	MACD           float64
+	MACDSignal     float64
+	RSI14          float64
+	AvgGain14      float64
+	AvgLoss14      float64
+	BollingerUpper float64
+	BollingerLower float64
+	ATR14          float64
+}
+
+// Computes trailing 200- and 50-day moving averages and the other indicators over `closes`, which must be
+// consecutive trading days in ascending order. Stats are produced only for days at or after TradeDayIndex
+// `from` that have a full 200-day window behind them.
+//
+// If `seed` is nil, `closes` must start at the first trading day so the exponential indicators see all
+// of history. Otherwise they continue from `seed`, the recorded stats of a day in `closes` before `from`.
+func trailingStats(closes []dayClose, from int64, seed *DayStats) (stats []DayStats) {
+	long, short := newMovingAverage(longWindow), newMovingAverage(shortWindow)
+	boll := newMovingAverage(bollingerPeriod)
+
+	var ind *indicators
+	if seed == nil {
+		ind = newIndicators()
+	}
+
+	stats = make([]DayStats, 0, len(closes))
+	for _, c := range closes {
+		long.Push(c.Close)
+		short.Push(c.Close)
+		boll.Push(c.Close)
+
+		if ind == nil {
+			if c.TradeDayIndex == seed.TradeDayIndex {
+				ind = resumeIndicators(seed, c)
+			}
+			continue
+		}
+		ind.Push(c)
+
+		if c.TradeDayIndex < from || !long.Ready() || !ind.Ready() {
+			continue
+		}
+
+		avg200, avg50 := long.Value(), short.Value()
+		mid, dev := boll.Value(), boll.StdDev()
+		stats = append(stats, DayStats{
+			Date:          c.Date,
+			TradeDayIndex: c.TradeDayIndex,
+			Avg200Day:     avg200,
+			Avg50Day:      avg50,
+			SMAPercent:    ((avg50 / avg200) - 1) * 100,
+
+			EMA12:          ind.emaFast.Value(),
+			EMA26:          ind.emaSlow.Value(),
+			MACD:           ind.MACD(),
+			MACDSignal:     ind.signal.Value(),
+			RSI14:          ind.RSI(),
+			AvgGain14:      ind.gain.Value(),
+			AvgLoss14:      ind.loss.Value(),
+			BollingerUpper: mid + bollingerWidth*dev,
+			BollingerLower: mid - bollingerWidth*dev,
+			ATR14:          ind.atr.Value(),
+		})
+	}
+
+	return
+}
+
+func formatStat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,108 @@
+package stocks
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMovingAverage(t *testing.T) {
+	tests := []struct {
+		size     int
+		values   []float64
+		expected []float64
+		full     []bool
+	}{
+		{1, []float64{3, 5, 7}, []float64{3, 5, 7}, []bool{true, true, true}},
+		{3, []float64{1, 2, 3, 4, 5, 6}, []float64{1, 1.5, 2, 3, 4, 5}, []bool{false, false, true, true, true, true}},
+		{2, []float64{10, 0, 10, 0}, []float64{10, 5, 5, 5}, []bool{false, true, true, true}},
+		{4, []float64{2, 4}, []float64{2, 3}, []bool{false, false}},
+	}
+
+	for _, test := range tests {
+		m := newMovingAverage(test.size)
+		for i, v := range test.values {
+			m.Push(v)
+			if got := m.Value(); math.Abs(got-test.expected[i]) > 1e-9 {
+				t.Errorf("size %d after %v: expected average %v; got %v", test.size, test.values[:i+1], test.expected[i], got)
+			}
+			if got := m.Ready(); got != test.full[i] {
+				t.Errorf("size %d after %v: expected ready %v; got %v", test.size, test.values[:i+1], test.full[i], got)
+			}
+		}
+	}
+}
+
+// Builds `n` consecutive trading days starting at TradeDayIndex 1 with closes from `f`:
+func series(n int, f func(i int64) float64) []dayClose {
+	closes := make([]dayClose, 0, n)
+	for i := int64(1); i <= int64(n); i++ {
+		c := f(i)
+		closes = append(closes, dayClose{TradeDayIndex: i, Close: c, High: c, Low: c})
+	}
+	return closes
+}
+
+func TestTrailingStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		closes []dayClose
+		from   int64
+		// Expected number of stats and the expected averages of a given TradeDayIndex:
+		count  int
+		index  int64
+		avg200 float64
+		avg50  float64
+	}{
+		// Not enough history for a 200-day average:
+		{"short", series(199, func(i int64) float64 { return 10 }), 1, 0, 0, 0, 0},
+		// Flat prices average to themselves:
+		{"flat", series(250, func(i int64) float64 { return 10 }), 1, 51, 250, 10, 10},
+		// Closes equal to the index average to the middle of each trailing window:
+		{"linear first", series(250, func(i int64) float64 { return float64(i) }), 1, 51, 200, 100.5, 175.5},
+		{"linear last", series(250, func(i int64) float64 { return float64(i) }), 1, 51, 250, 150.5, 225.5},
+		// Only days from `from` on are produced, but earlier closes still fill their windows:
+		{"from", series(250, func(i int64) float64 { return float64(i) }), 240, 11, 240, 140.5, 215.5},
+		// A jump only shows up in windows that include it:
+		{"step before", series(300, func(i int64) float64 { return stepAt(i, 260) }), 1, 101, 259, 1, 1},
+		// Days 101..259 close at 1 and days 260..300 at 201:
+		{"step after", series(300, func(i int64) float64 { return stepAt(i, 260) }), 1, 101, 300, (159 + 41*201) / 200.0, (9 + 41*201) / 50.0},
+	}
+
+	for _, test := range tests {
+		stats := trailingStats(test.closes, test.from, nil)
+		if len(stats) != test.count {
+			t.Errorf("%s: expected %d stats; got %d", test.name, test.count, len(stats))
+			continue
+		}
+		if test.count == 0 {
+			continue
+		}
+
+		var found bool
+		for _, s := range stats {
+			if s.TradeDayIndex != test.index {
+				continue
+			}
+			found = true
+			if math.Abs(s.Avg200Day-test.avg200) > 1e-9 {
+				t.Errorf("%s: expected 200-day average %v at day %d; got %v", test.name, test.avg200, test.index, s.Avg200Day)
+			}
+			if math.Abs(s.Avg50Day-test.avg50) > 1e-9 {
+				t.Errorf("%s: expected 50-day average %v at day %d; got %v", test.name, test.avg50, test.index, s.Avg50Day)
+			}
+			if expected := ((test.avg50 / test.avg200) - 1) * 100; math.Abs(s.SMAPercent-expected) > 1e-9 {
+				t.Errorf("%s: expected SMA percent %v at day %d; got %v", test.name, expected, test.index, s.SMAPercent)
+			}
+		}
+		if !found {
+			t.Errorf("%s: no stats for day %d", test.name, test.index)
+		}
+	}
+}
+
+func stepAt(i, at int64) float64 {
+	if i < at {
+		return 1
+	}
+	return 201
+}
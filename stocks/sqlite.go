@@ -0,0 +1,1564 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqlite related imports:
+import (
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/market"
+)
+
+// SQLite implementation of Store:
+type sqliteStore struct {
+	db *sqlx.DB
+}
+
+// Connection settings for a SQLite DB shared between processes, e.g. stocks-web and stocks-hourly:
+type SQLiteOptions struct {
+	// Write-ahead logging lets readers carry on while another connection writes:
+	WAL bool
+	// How long to wait for another connection's lock before failing with "database is locked"; 0 fails at once.
+	BusyTimeout time.Duration
+}
+
+var DefaultSQLiteOptions = SQLiteOptions{WAL: true, BusyTimeout: 30 * time.Second}
+
+// Opens the SQLite DB at `dbPath` with `DefaultSQLiteOptions` and creates or migrates the table schema to
+// `SchemaVersion()`.
+func NewSQLiteStore(dbPath string) (store Store, err error) {
+	return NewSQLiteStoreOptions(dbPath, DefaultSQLiteOptions)
+}
+
+// Like `NewSQLiteStore` with the given connection settings.
+func NewSQLiteStoreOptions(dbPath string, opts SQLiteOptions) (store Store, err error) {
+	// using sqlite 3.8.0 release
+	db, err := sqlx.Connect("sqlite3", opts.dsn(dbPath))
+	if err != nil {
+		return nil, err
+	}
+
+	st := &sqliteStore{db: db}
+
+	// Create or upgrade the table schema:
+	if err = st.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Create VIEWs:
+	if err = st.createViews(); err != nil {
+		db.Close()
+		return nil, storeError("NewSQLiteStore", "", err)
+	}
+
+	return st, nil
+}
+
+// Applies the options to every pooled connection through the go-sqlite3 DSN parameters:
+func (opts SQLiteOptions) dsn(dbPath string) string {
+	params := []string{
+		fmt.Sprintf("_busy_timeout=%d", opts.BusyTimeout/time.Millisecond),
+		// Take the write lock up front so a transaction waits for it instead of failing when it first writes:
+		"_txlock=immediate",
+	}
+	if opts.WAL {
+		params = append(params, "_journal_mode=WAL")
+	}
+
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + strings.Join(params, "&")
+}
+
+// Releases the DB connection:
+func (st *sqliteStore) Close() error {
+	return st.db.Close()
+}
+
+// ------------------------- users:
+
+type dbUser struct {
+	UserID              int64  `db:"UserID"`
+	Name                string `db:"Name"`
+	NotificationTimeout int    `db:"NotificationTimeout"`
+	CrossoverFast       int    `db:"CrossoverFast"`
+	CrossoverSlow       int    `db:"CrossoverSlow"`
+	CrossoverKind       string `db:"CrossoverKind"`
+	Benchmark           string `db:"Benchmark"`
+}
+
+type dbUserEmail struct {
+	Email     string `db:"Email"`
+	IsPrimary int64  `db:"IsPrimary"`
+}
+
+func (st *sqliteStore) AddUser(ctx context.Context, user *User) (err error) {
+	res, err := st.db.ExecContext(ctx, `insert into User (Name, NotificationTimeout, CrossoverFast, CrossoverSlow, CrossoverKind, Benchmark) values (?1,?2,?3,?4,?5,?6)`,
+		user.Name, user.NotificationTimeout/time.Second, user.Crossover.Fast, user.Crossover.Slow, string(user.Crossover.Kind), user.Benchmark)
+	if err != nil {
+		return err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.UserID = UserID(userID)
+
+	if len(user.Emails) > 0 {
+		emails := make([][]interface{}, 0, len(user.Emails))
+		for _, e := range user.Emails {
+			emails = append(emails, []interface{}{e.Email, user.UserID, e.IsPrimary})
+		}
+
+		err := st.bulkInsert(ctx, "UserEmail", []string{"Email", "UserID", "IsPrimary"}, emails)
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func (st *sqliteStore) projectUser(ctx context.Context, dbUser dbUser) (user *User, err error) {
+	// get emails:
+	emails := make([]dbUserEmail, 0, 2)
+	err = st.db.SelectContext(ctx, &emails, `select Email, IsPrimary from UserEmail where UserID = ?1`, dbUser.UserID)
+	if err == sql.ErrNoRows {
+		emails = make([]dbUserEmail, 0, 2)
+	} else if err != nil {
+		return
+	}
+
+	user = &User{
+		UserID:              UserID(dbUser.UserID),
+		Name:                dbUser.Name,
+		NotificationTimeout: time.Duration(dbUser.NotificationTimeout) * time.Second,
+		Emails:              make([]UserEmail, 0, len(emails)),
+		Crossover:           Crossover{Fast: dbUser.CrossoverFast, Slow: dbUser.CrossoverSlow, Kind: AverageKind(dbUser.CrossoverKind)},
+		Benchmark:           dbUser.Benchmark,
+	}
+
+	for _, e := range emails {
+		user.Emails = append(user.Emails, UserEmail{
+			Email:     e.Email,
+			UserID:    user.UserID,
+			IsPrimary: fromDbBool(e.IsPrimary),
+		})
+	}
+
+	return
+}
+
+func (st *sqliteStore) GetUser(ctx context.Context, userID UserID) (user *User, err error) {
+	dbUser := dbUser{}
+
+	// Get user by ID:
+	err = st.db.GetContext(ctx, &dbUser, `select UserID, Name, NotificationTimeout, CrossoverFast, CrossoverSlow, CrossoverKind, Benchmark from User where UserID = ?1`, int64(userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	return st.projectUser(ctx, dbUser)
+}
+
+func (st *sqliteStore) GetUserByEmail(ctx context.Context, email string) (user *User, err error) {
+	dbUser := dbUser{}
+
+	// Get user by email:
+	err = st.db.GetContext(ctx, &dbUser, `
+select u.UserID, u.Name, u.NotificationTimeout, u.CrossoverFast, u.CrossoverSlow, u.CrossoverKind, u.Benchmark
+from User as u
+join UserEmail as ue on u.UserID = ue.UserID
+where ue.Email = ?1`, email)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	return st.projectUser(ctx, dbUser)
+}
+
+func (st *sqliteStore) GetUserIDs(ctx context.Context) (ids []UserID, err error) {
+	rows := make([]int64, 0, 4)
+	err = st.db.SelectContext(ctx, &rows, `select UserID from User order by UserID ASC`)
+	if err != nil {
+		return
+	}
+
+	ids = make([]UserID, 0, len(rows))
+	for _, id := range rows {
+		ids = append(ids, UserID(id))
+	}
+	return
+}
+
+func (st *sqliteStore) UpdateUserCrossover(ctx context.Context, userID UserID, c Crossover) (err error) {
+	_, err = st.db.ExecContext(ctx, `update User set CrossoverFast = ?2, CrossoverSlow = ?3, CrossoverKind = ?4 where UserID = ?1`, int64(userID), c.Fast, c.Slow, string(c.Kind))
+	return
+}
+
+func (st *sqliteStore) UpdateUserBenchmark(ctx context.Context, userID UserID, symbol string) (err error) {
+	_, err = st.db.ExecContext(ctx, `update User set Benchmark = ?2 where UserID = ?1`, int64(userID), symbol)
+	return
+}
+
+// ------------------------- portfolios:
+
+type dbPortfolio struct {
+	PortfolioID int64  `db:"PortfolioID"`
+	UserID      int64  `db:"UserID"`
+	Name        string `db:"Name"`
+}
+
+func (r dbPortfolio) project() Portfolio {
+	return Portfolio{PortfolioID: PortfolioID(r.PortfolioID), UserID: UserID(r.UserID), Name: r.Name}
+}
+
+// Stocks and transactions in no portfolio have a NULL PortfolioID:
+func toDbPortfolioID(id PortfolioID) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+func (st *sqliteStore) AddPortfolio(ctx context.Context, p *Portfolio) (err error) {
+	res, err := st.db.ExecContext(ctx, `insert into Portfolio (UserID, Name) values (?1,?2)`, int64(p.UserID), p.Name)
+	if err != nil {
+		return
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	p.PortfolioID = PortfolioID(id)
+	return nil
+}
+
+func (st *sqliteStore) GetPortfolio(ctx context.Context, portfolioID PortfolioID) (p *Portfolio, err error) {
+	r := dbPortfolio{}
+	err = st.db.GetContext(ctx, &r, `select PortfolioID, UserID, Name from Portfolio where PortfolioID = ?1`, int64(portfolioID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	portfolio := r.project()
+	return &portfolio, nil
+}
+
+func (st *sqliteStore) GetPortfolios(ctx context.Context, userID UserID) (portfolios []Portfolio, err error) {
+	rows := make([]dbPortfolio, 0, 4)
+	err = st.db.SelectContext(ctx, &rows, `select PortfolioID, UserID, Name from Portfolio where UserID = ?1 order by Name ASC`, int64(userID))
+	if err != nil {
+		return
+	}
+
+	portfolios = make([]Portfolio, 0, len(rows))
+	for _, r := range rows {
+		portfolios = append(portfolios, r.project())
+	}
+	return
+}
+
+func (st *sqliteStore) RenamePortfolio(ctx context.Context, portfolioID PortfolioID, name string) (err error) {
+	_, err = st.db.ExecContext(ctx, `update Portfolio set Name = ?2 where PortfolioID = ?1`, int64(portfolioID), name)
+	return
+}
+
+func (st *sqliteStore) RemovePortfolio(ctx context.Context, portfolioID PortfolioID) (removed bool, err error) {
+	err = st.tx(ctx, func(tx *sqlx.Tx) (err error) {
+		res, err := tx.ExecContext(ctx, `
+delete from Portfolio
+where (PortfolioID = ?1) and not exists (select 1 from StockTransaction where PortfolioID = ?1)`, int64(portfolioID))
+		if err != nil {
+			return
+		}
+		n, err := res.RowsAffected()
+		if err != nil || n == 0 {
+			return
+		}
+		removed = true
+
+		_, err = tx.ExecContext(ctx, `update Stock set PortfolioID = null where PortfolioID = ?1`, int64(portfolioID))
+		return
+	})
+	return
+}
+
+// ------------------------- stocks:
+
+type dbStock struct {
+	StockID   int64  `db:"StockID"`
+	UserID    int64  `db:"UserID"`
+	Symbol    string `db:"Symbol"`
+	BuyDate   string `db:"BuyDate"`
+	BuyPrice  string `db:"BuyPrice"`
+	Shares    int64  `db:"Shares"`
+	IsWatched int64  `db:"IsWatched"`
+
+	TStopPercent     sql.NullString `db:"TStopPercent"`
+	BuyStopPrice     sql.NullString `db:"BuyStopPrice"`
+	SellStopPrice    sql.NullString `db:"SellStopPrice"`
+	RisePercent      sql.NullString `db:"RisePercent"`
+	FallPercent      sql.NullString `db:"FallPercent"`
+	NotifyTStop      int64          `db:"NotifyTStop"`
+	NotifyBuyStop    int64          `db:"NotifyBuyStop"`
+	NotifySellStop   int64          `db:"NotifySellStop"`
+	NotifyRise       int64          `db:"NotifyRise"`
+	NotifyFall       int64          `db:"NotifyFall"`
+	NotifyBullBear   int64          `db:"NotifyBullBear"`
+	LastTimeTStop    sql.NullString `db:"LastTimeTStop"`
+	LastTimeBuyStop  sql.NullString `db:"LastTimeBuyStop"`
+	LastTimeSellStop sql.NullString `db:"LastTimeSellStop"`
+	LastTimeRise     sql.NullString `db:"LastTimeRise"`
+	LastTimeFall     sql.NullString `db:"LastTimeFall"`
+	LastTimeBullBear sql.NullString `db:"LastTimeBullBear"`
+
+	TStopSessions    int64 `db:"TStopSessions"`
+	BuyStopSessions  int64 `db:"BuyStopSessions"`
+	SellStopSessions int64 `db:"SellStopSessions"`
+	RiseSessions     int64 `db:"RiseSessions"`
+	FallSessions     int64 `db:"FallSessions"`
+	BullBearSessions int64 `db:"BullBearSessions"`
+
+	CrossoverFast sql.NullInt64  `db:"CrossoverFast"`
+	CrossoverSlow sql.NullInt64  `db:"CrossoverSlow"`
+	CrossoverKind sql.NullString `db:"CrossoverKind"`
+
+	PortfolioID sql.NullInt64 `db:"PortfolioID"`
+}
+
+// DB representation of a stock with calculated stats:
+type dbDetail struct {
+	// Include all fields from dbStock:
+	dbStock
+
+	CurrPrice       sql.NullString `db:"CurrPrice"`
+	CurrHour        sql.NullString `db:"CurrHour"`
+	FetchedDateTime sql.NullString `db:"FetchedDateTime"`
+	CurrSession     sql.NullInt64  `db:"CurrSession"`
+
+	Bid           sql.NullString `db:"Bid"`
+	Ask           sql.NullString `db:"Ask"`
+	DayHigh       sql.NullString `db:"DayHigh"`
+	DayLow        sql.NullString `db:"DayLow"`
+	PrevClose     sql.NullString `db:"PrevClose"`
+	Volume        sql.NullInt64  `db:"Volume"`
+	ChangePercent sql.NullString `db:"ChangePercent"`
+
+	N1CloseDate  sql.NullString  `db:"N1CloseDate"`
+	N1ClosePrice sql.NullString  `db:"N1ClosePrice"`
+	N1SMAPercent sql.NullFloat64 `db:"N1SMAPercent"`
+	N1Avg200Day  sql.NullFloat64 `db:"N1Avg200Day"`
+	N1Avg50Day   sql.NullFloat64 `db:"N1Avg50Day"`
+
+	N1EMA12          sql.NullFloat64 `db:"N1EMA12"`
+	N1EMA26          sql.NullFloat64 `db:"N1EMA26"`
+	N1MACD           sql.NullFloat64 `db:"N1MACD"`
+	N1MACDSignal     sql.NullFloat64 `db:"N1MACDSignal"`
+	N1RSI14          sql.NullFloat64 `db:"N1RSI14"`
+	N1BollingerUpper sql.NullFloat64 `db:"N1BollingerUpper"`
+	N1BollingerLower sql.NullFloat64 `db:"N1BollingerLower"`
+	N1ATR14          sql.NullFloat64 `db:"N1ATR14"`
+
+	N2CloseDate  sql.NullString  `db:"N2CloseDate"`
+	N2ClosePrice sql.NullString  `db:"N2ClosePrice"`
+	N2SMAPercent sql.NullFloat64 `db:"N2SMAPercent"`
+
+	ActiveCrossoverFast sql.NullInt64   `db:"ActiveCrossoverFast"`
+	ActiveCrossoverSlow sql.NullInt64   `db:"ActiveCrossoverSlow"`
+	ActiveCrossoverKind sql.NullString  `db:"ActiveCrossoverKind"`
+	N1CrossoverPercent  sql.NullFloat64 `db:"N1CrossoverPercent"`
+	N2CrossoverPercent  sql.NullFloat64 `db:"N2CrossoverPercent"`
+
+	HighestClose sql.NullFloat64 `db:"HighestClose"`
+	LowestClose  sql.NullFloat64 `db:"LowestClose"`
+}
+
+// Nullable per-stock crossover columns; all NULL means the owner's crossover is used:
+func toDbCrossover(c *Crossover) (fast, slow sql.NullInt64, kind sql.NullString) {
+	if c == nil {
+		return
+	}
+	return sql.NullInt64{Int64: int64(c.Fast), Valid: true}, sql.NullInt64{Int64: int64(c.Slow), Valid: true}, sql.NullString{String: string(c.Kind), Valid: true}
+}
+
+func fromDbCrossover(fast, slow sql.NullInt64, kind sql.NullString) *Crossover {
+	if !fast.Valid || !slow.Valid || !kind.Valid {
+		return nil
+	}
+	return &Crossover{Fast: int(fast.Int64), Slow: int(slow.Int64), Kind: AverageKind(kind.String)}
+}
+
+func (r dbStock) project() (*Stock, error) {
+	f := fromDb{}
+	s := &Stock{
+		StockID:   StockID(r.StockID),
+		UserID:    UserID(r.UserID),
+		Symbol:    r.Symbol,
+		BuyDate:   f.DateTime(dateFmt, r.BuyDate),
+		BuyPrice:  f.Decimal(r.BuyPrice),
+		Shares:    r.Shares,
+		IsWatched: fromDbBool(r.IsWatched),
+
+		TStopPercent:     f.NullDecimal(r.TStopPercent),
+		BuyStopPrice:     f.NullDecimal(r.BuyStopPrice),
+		SellStopPrice:    f.NullDecimal(r.SellStopPrice),
+		RisePercent:      f.NullDecimal(r.RisePercent),
+		FallPercent:      f.NullDecimal(r.FallPercent),
+		NotifyTStop:      fromDbBool(r.NotifyTStop),
+		NotifyBuyStop:    fromDbBool(r.NotifyBuyStop),
+		NotifySellStop:   fromDbBool(r.NotifySellStop),
+		NotifyRise:       fromDbBool(r.NotifyRise),
+		NotifyFall:       fromDbBool(r.NotifyFall),
+		NotifyBullBear:   fromDbBool(r.NotifyBullBear),
+		LastTimeTStop:    f.NullDateTime(time.RFC3339, r.LastTimeTStop),
+		LastTimeBuyStop:  f.NullDateTime(time.RFC3339, r.LastTimeBuyStop),
+		LastTimeSellStop: f.NullDateTime(time.RFC3339, r.LastTimeSellStop),
+		LastTimeRise:     f.NullDateTime(time.RFC3339, r.LastTimeRise),
+		LastTimeFall:     f.NullDateTime(time.RFC3339, r.LastTimeFall),
+		LastTimeBullBear: f.NullDateTime(time.RFC3339, r.LastTimeBullBear),
+
+		TStopSessions:    market.Session(r.TStopSessions),
+		BuyStopSessions:  market.Session(r.BuyStopSessions),
+		SellStopSessions: market.Session(r.SellStopSessions),
+		RiseSessions:     market.Session(r.RiseSessions),
+		FallSessions:     market.Session(r.FallSessions),
+		BullBearSessions: market.Session(r.BullBearSessions),
+
+		Crossover: fromDbCrossover(r.CrossoverFast, r.CrossoverSlow, r.CrossoverKind),
+
+		PortfolioID: PortfolioID(r.PortfolioID.Int64),
+	}
+	return s, f.err
+}
+
+func (r dbDetail) project() (StoredDetail, error) {
+	f := fromDb{}
+	d := Detail{
+		CurrPrice:       f.NullDecimal(r.CurrPrice),
+		CurrHour:        f.NullDateTime(time.RFC3339, r.CurrHour),
+		FetchedDateTime: f.NullDateTime(time.RFC3339, r.FetchedDateTime),
+		CurrSession:     market.Session(r.CurrSession.Int64),
+
+		Bid:           f.NullDecimal(r.Bid),
+		Ask:           f.NullDecimal(r.Ask),
+		DayHigh:       f.NullDecimal(r.DayHigh),
+		DayLow:        f.NullDecimal(r.DayLow),
+		PrevClose:     f.NullDecimal(r.PrevClose),
+		Volume:        fromDbNullInt64(r.Volume),
+		ChangePercent: f.NullDecimal(r.ChangePercent),
+
+		N1CloseDate:  f.NullDateTime(time.RFC3339, r.N1CloseDate),
+		N1ClosePrice: f.NullDecimal(r.N1ClosePrice),
+		N1SMAPercent: fromDbNullFloat64(r.N1SMAPercent),
+		N1Avg200Day:  fromDbNullFloat64(r.N1Avg200Day),
+		N1Avg50Day:   fromDbNullFloat64(r.N1Avg50Day),
+
+		N1EMA12:          fromDbNullFloat64(r.N1EMA12),
+		N1EMA26:          fromDbNullFloat64(r.N1EMA26),
+		N1MACD:           fromDbNullFloat64(r.N1MACD),
+		N1MACDSignal:     fromDbNullFloat64(r.N1MACDSignal),
+		N1RSI14:          fromDbNullFloat64(r.N1RSI14),
+		N1BollingerUpper: fromDbNullFloat64(r.N1BollingerUpper),
+		N1BollingerLower: fromDbNullFloat64(r.N1BollingerLower),
+		N1ATR14:          fromDbNullFloat64(r.N1ATR14),
+
+		N2CloseDate:  f.NullDateTime(time.RFC3339, r.N2CloseDate),
+		N2ClosePrice: f.NullDecimal(r.N2ClosePrice),
+		N2SMAPercent: fromDbNullFloat64(r.N2SMAPercent),
+
+		Crossover:          DefaultCrossover,
+		N1CrossoverPercent: fromDbNullFloat64(r.N1CrossoverPercent),
+		N2CrossoverPercent: fromDbNullFloat64(r.N2CrossoverPercent),
+	}
+
+	if c := fromDbCrossover(r.ActiveCrossoverFast, r.ActiveCrossoverSlow, r.ActiveCrossoverKind); c != nil {
+		d.Crossover = *c
+	}
+
+	s, err := r.dbStock.project()
+	if err != nil {
+		return StoredDetail{}, err
+	}
+	return StoredDetail{
+		StockDetail:  StockDetail{Stock: *s, Detail: d},
+		LowestClose:  fromDbNullFloat64(r.LowestClose),
+		HighestClose: fromDbNullFloat64(r.HighestClose),
+	}, f.err
+}
+
+func (st *sqliteStore) AddStock(ctx context.Context, s *Stock) (err error) {
+	crossoverFast, crossoverSlow, crossoverKind := toDbCrossover(s.Crossover)
+
+	// Insert the Stock record:
+	res, err := st.db.ExecContext(ctx, `
+insert into Stock (`+stockCols+`)
+    values (?1,?2,?3,?4,?5,?6,?7,?8,?9,?10,?11,?12,?13,?14,?15,?16,?17,?18,?19,?20,?21,?22,?23,?24,?25,?26,?27,?28,?29,?30,?31,?32,?33)`,
+		int64(s.UserID),
+		s.Symbol,
+		toDbDateTime(s.BuyDate),
+		toDbDecimal(s.BuyPrice, 2),
+		s.Shares,
+		toDbBool(s.IsWatched),
+		toDbNullDecimal(s.TStopPercent, 2),
+		toDbNullDecimal(s.BuyStopPrice, 2),
+		toDbNullDecimal(s.SellStopPrice, 2),
+		toDbNullDecimal(s.RisePercent, 2),
+		toDbNullDecimal(s.FallPercent, 2),
+		toDbBool(s.NotifyTStop),
+		toDbBool(s.NotifyBuyStop),
+		toDbBool(s.NotifySellStop),
+		toDbBool(s.NotifyRise),
+		toDbBool(s.NotifyFall),
+		toDbBool(s.NotifyBullBear),
+		toDbNullDateTime(time.RFC3339, s.LastTimeTStop),
+		toDbNullDateTime(time.RFC3339, s.LastTimeBuyStop),
+		toDbNullDateTime(time.RFC3339, s.LastTimeSellStop),
+		toDbNullDateTime(time.RFC3339, s.LastTimeRise),
+		toDbNullDateTime(time.RFC3339, s.LastTimeFall),
+		toDbNullDateTime(time.RFC3339, s.LastTimeBullBear),
+		toDbSessions(s.TStopSessions),
+		toDbSessions(s.BuyStopSessions),
+		toDbSessions(s.SellStopSessions),
+		toDbSessions(s.RiseSessions),
+		toDbSessions(s.FallSessions),
+		toDbSessions(s.BullBearSessions),
+		crossoverFast,
+		crossoverSlow,
+		crossoverKind,
+		toDbPortfolioID(s.PortfolioID),
+	)
+	if err != nil {
+		s.StockID = StockID(0)
+		return err
+	}
+
+	// Get last inserted ID:
+	id, err := res.LastInsertId()
+	if err != nil {
+		s.StockID = StockID(0)
+		return err
+	}
+
+	// Set StockID:
+	s.StockID = StockID(id)
+	return nil
+}
+
+func (st *sqliteStore) GetStock(ctx context.Context, stockID StockID) (s *Stock, err error) {
+	r := dbStock{}
+	err = st.db.GetContext(ctx, &r, `select StockID,`+stockCols+` from Stock where StockID = ?1`, int64(stockID))
+	if err == sql.ErrNoRows {
+		return nil, stockNotFound(stockID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return r.project()
+}
+
+func (st *sqliteStore) GetStocksForUser(ctx context.Context, userID UserID) (list []Stock, err error) {
+	rows := make([]dbStock, 0, 16)
+	err = st.db.SelectContext(ctx, &rows, `select StockID,`+stockCols+` from Stock where UserID = ?1 order by Symbol ASC, datetime(BuyDate) ASC, StockID ASC`, int64(userID))
+	if err != nil {
+		return
+	}
+
+	list = make([]Stock, 0, len(rows))
+	for _, r := range rows {
+		s, err := r.project()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *s)
+	}
+	return list, nil
+}
+
+func (st *sqliteStore) UpdateStock(ctx context.Context, n *Stock) (err error) {
+	crossoverFast, crossoverSlow, crossoverKind := toDbCrossover(n.Crossover)
+
+	_, err = st.db.ExecContext(ctx, `
+update Stock
+set TStopPercent = ?2,
+    BuyStopPrice = ?3,
+    SellStopPrice = ?4,
+    RisePercent = ?5,
+    FallPercent = ?6,
+    NotifyTStop = ?7,
+    NotifyBuyStop = ?8,
+    NotifySellStop = ?9,
+    NotifyRise = ?10,
+    NotifyFall = ?11,
+    NotifyBullBear = ?12,
+    BuyDate = ?13,
+    BuyPrice = ?14,
+    Shares = ?15,
+    TStopSessions = ?16,
+    BuyStopSessions = ?17,
+    SellStopSessions = ?18,
+    RiseSessions = ?19,
+    FallSessions = ?20,
+    BullBearSessions = ?21,
+    CrossoverFast = ?22,
+    CrossoverSlow = ?23,
+    CrossoverKind = ?24,
+    PortfolioID = ?25
+where StockID = ?1`,
+		int64(n.StockID),
+		toDbNullDecimal(n.TStopPercent, 2),
+		toDbNullDecimal(n.BuyStopPrice, 2),
+		toDbNullDecimal(n.SellStopPrice, 2),
+		toDbNullDecimal(n.RisePercent, 2),
+		toDbNullDecimal(n.FallPercent, 2),
+		toDbBool(n.NotifyTStop),
+		toDbBool(n.NotifyBuyStop),
+		toDbBool(n.NotifySellStop),
+		toDbBool(n.NotifyRise),
+		toDbBool(n.NotifyFall),
+		toDbBool(n.NotifyBullBear),
+		toDbDateTime(n.BuyDate),
+		toDbDecimal(n.BuyPrice, 2),
+		n.Shares,
+		toDbSessions(n.TStopSessions),
+		toDbSessions(n.BuyStopSessions),
+		toDbSessions(n.SellStopSessions),
+		toDbSessions(n.RiseSessions),
+		toDbSessions(n.FallSessions),
+		toDbSessions(n.BullBearSessions),
+		crossoverFast,
+		crossoverSlow,
+		crossoverKind,
+		toDbPortfolioID(n.PortfolioID),
+	)
+	return
+}
+
+func (st *sqliteStore) UpdateNotifyTimes(ctx context.Context, n *Stock) (err error) {
+	_, err = st.db.ExecContext(ctx, `
+update Stock
+set LastTimeTStop = ?2,
+    LastTimeBuyStop = ?3,
+	LastTimeSellStop = ?4,
+	LastTimeRise = ?5,
+	LastTimeFall = ?6,
+	LastTimeBullBear = ?7
+where StockID = ?1`,
+		int64(n.StockID),
+		toDbNullDateTime(time.RFC3339, n.LastTimeTStop),
+		toDbNullDateTime(time.RFC3339, n.LastTimeBuyStop),
+		toDbNullDateTime(time.RFC3339, n.LastTimeSellStop),
+		toDbNullDateTime(time.RFC3339, n.LastTimeRise),
+		toDbNullDateTime(time.RFC3339, n.LastTimeFall),
+		toDbNullDateTime(time.RFC3339, n.LastTimeBullBear),
+	)
+	return
+}
+
+func (st *sqliteStore) RemoveStock(ctx context.Context, stockID StockID) (err error) {
+	_, err = st.db.ExecContext(ctx, `delete from Stock where StockID = ?1`, int64(stockID))
+	return
+}
+
+func (st *sqliteStore) GetAllTrackedSymbols(ctx context.Context) (symbols []string, err error) {
+	rows := make([]struct {
+		Symbol string `db:"Symbol"`
+	}, 0, 4)
+
+	err = st.db.SelectContext(ctx, &rows, `
+select Symbol from Stock
+union select Symbol from StockTransaction where Symbol <> ''
+union select Benchmark as Symbol from User where Benchmark <> ''`)
+	if err != nil {
+		return
+	}
+
+	symbols = make([]string, 0, len(rows))
+	for _, v := range rows {
+		symbols = append(symbols, v.Symbol)
+	}
+
+	return
+}
+
+func (st *sqliteStore) GetMinBuyDate(ctx context.Context, symbol string) (minDate NullDateTime, err error) {
+	row := struct {
+		Min sql.NullString `db:"Min"`
+	}{}
+	err = st.db.GetContext(ctx, &row, `
+select min(Date) as Min from (
+	select datetime(BuyDate) as Date from Stock where Symbol = ?1
+	union all
+	select datetime(Date) as Date from StockTransaction where Symbol = ?1
+	union all
+	-- Holdings of users comparing against the symbol:
+	select datetime(s.BuyDate) as Date from Stock s join User u on u.UserID = s.UserID where u.Benchmark = ?1
+	union all
+	select datetime(t.Date) as Date from StockTransaction t join User u on u.UserID = t.UserID where u.Benchmark = ?1
+)`, symbol)
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	return f.NullDateTime(sqliteFmt, row.Min), f.err
+}
+
+func (st *sqliteStore) GetCrossoversInUse(ctx context.Context, symbol string) (crossovers []Crossover, err error) {
+	rows := make([]struct {
+		Fast int    `db:"Fast"`
+		Slow int    `db:"Slow"`
+		Kind string `db:"Kind"`
+	}, 0, 2)
+	err = st.db.SelectContext(ctx, &rows, `
+select distinct coalesce(s.CrossoverFast, u.CrossoverFast) as Fast, coalesce(s.CrossoverSlow, u.CrossoverSlow) as Slow, coalesce(s.CrossoverKind, u.CrossoverKind) as Kind
+from Stock s
+join User u on u.UserID = s.UserID
+where s.Symbol = ?1`, symbol)
+	if err != nil {
+		return
+	}
+
+	crossovers = make([]Crossover, 0, len(rows))
+	for _, r := range rows {
+		crossovers = append(crossovers, Crossover{Fast: r.Fast, Slow: r.Slow, Kind: AverageKind(r.Kind)})
+	}
+	return
+}
+
+const detailCols = `StockID, ` + stockCols + `
+     , CurrPrice, CurrHour, FetchedDateTime, CurrSession
+     , Bid, Ask, DayHigh, DayLow, PrevClose, Volume, ChangePercent
+     , N1CloseDate, N1ClosePrice, N1SMAPercent, N1Avg200Day, N1Avg50Day
+     , N1EMA12, N1EMA26, N1MACD, N1MACDSignal, N1RSI14, N1BollingerUpper, N1BollingerLower, N1ATR14
+     , N2CloseDate, N2ClosePrice, N2SMAPercent
+     , ActiveCrossoverFast, ActiveCrossoverSlow, ActiveCrossoverKind, N1CrossoverPercent, N2CrossoverPercent
+     , LowestClose, HighestClose`
+
+func (st *sqliteStore) getStockDetails(ctx context.Context, where string, arg interface{}) (details []StoredDetail, err error) {
+	rows := make([]dbDetail, 0, 6)
+
+	err = st.db.SelectContext(ctx, &rows, `
+select `+detailCols+`
+from StockDetail s
+where (`+where+`)
+  and (datetime(s.CurrHour) = (select max(datetime(h.DateTime)) from StockHourly h where h.Symbol = s.Symbol))
+order by s.Symbol ASC, s.BuyDate ASC, s.Shares ASC`, arg)
+	if err != nil {
+		return
+	}
+
+	details = make([]StoredDetail, 0, len(rows))
+	for _, r := range rows {
+		d, err := r.project()
+		if err != nil {
+			return nil, err
+		}
+		details = append(details, d)
+	}
+	return
+}
+
+func (st *sqliteStore) GetStockDetailsForUser(ctx context.Context, userID UserID) (details []StoredDetail, err error) {
+	return st.getStockDetails(ctx, `s.UserID = ?1`, int64(userID))
+}
+
+func (st *sqliteStore) GetStockDetailsForSymbol(ctx context.Context, symbol string) (details []StoredDetail, err error) {
+	return st.getStockDetails(ctx, `s.Symbol = ?1`, symbol)
+}
+
+// ------------------------- transactions:
+
+const transactionCols = `UserID, Symbol, Kind, Date, Price, Shares, LotID, PortfolioID`
+
+type dbTransaction struct {
+	TransactionID int64         `db:"TransactionID"`
+	UserID        int64         `db:"UserID"`
+	PortfolioID   sql.NullInt64 `db:"PortfolioID"`
+	Symbol        string        `db:"Symbol"`
+	Kind          string        `db:"Kind"`
+	Date          string        `db:"Date"`
+	Price         string        `db:"Price"`
+	Shares        int64         `db:"Shares"`
+	LotID         sql.NullInt64 `db:"LotID"`
+}
+
+func (r *dbTransaction) project(f *fromDb) Transaction {
+	return Transaction{
+		TransactionID: TransactionID(r.TransactionID),
+		UserID:        UserID(r.UserID),
+		PortfolioID:   PortfolioID(r.PortfolioID.Int64),
+		Symbol:        r.Symbol,
+		Kind:          TransactionKind(r.Kind),
+		Date:          f.DateTime(time.RFC3339, r.Date),
+		Price:         f.Decimal(r.Price),
+		Shares:        r.Shares,
+		LotID:         TransactionID(r.LotID.Int64),
+	}
+}
+
+func (st *sqliteStore) AddTransaction(ctx context.Context, t *Transaction) (err error) {
+	lotID := sql.NullInt64{Int64: int64(t.LotID), Valid: t.LotID != 0}
+	res, err := st.db.ExecContext(ctx, `insert into StockTransaction (`+transactionCols+`) values (?1,?2,?3,?4,?5,?6,?7,?8)`,
+		int64(t.UserID), t.Symbol, string(t.Kind), toDbDateTime(t.Date), toDbDecimal(t.Price, 4), t.Shares, lotID, toDbPortfolioID(t.PortfolioID))
+	if err != nil {
+		return
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	t.TransactionID = TransactionID(id)
+	return nil
+}
+
+func (st *sqliteStore) GetTransaction(ctx context.Context, transactionID TransactionID) (t *Transaction, err error) {
+	r := dbTransaction{}
+	err = st.db.GetContext(ctx, &r, `select TransactionID, `+transactionCols+` from StockTransaction where TransactionID = ?1`, int64(transactionID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f := fromDb{}
+	tx := r.project(&f)
+	return &tx, f.err
+}
+
+func (st *sqliteStore) RemoveTransaction(ctx context.Context, transactionID TransactionID) (err error) {
+	_, err = st.db.ExecContext(ctx, `delete from StockTransaction where TransactionID = ?1`, int64(transactionID))
+	return
+}
+
+func (st *sqliteStore) GetTransactions(ctx context.Context, userID UserID, symbol string) (txns []Transaction, err error) {
+	rows := make([]dbTransaction, 0, 16)
+	err = st.db.SelectContext(ctx, &rows, `
+select TransactionID, `+transactionCols+`
+from StockTransaction
+where (UserID = ?1) and ((?2 = '') or (Symbol = ?2))
+order by datetime(Date) ASC, TransactionID ASC`, int64(userID), symbol)
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	txns = make([]Transaction, 0, len(rows))
+	for i := range rows {
+		txns = append(txns, rows[i].project(&f))
+	}
+	return txns, f.err
+}
+
+// ------------------------- portfolio snapshots:
+
+type dbSnapshot struct {
+	UserID      int64  `db:"UserID"`
+	PortfolioID int64  `db:"PortfolioID"`
+	Date        string `db:"Date"`
+	MarketValue string `db:"MarketValue"`
+	Cash        string `db:"Cash"`
+	NetFlow     string `db:"NetFlow"`
+	Invested    string `db:"Invested"`
+}
+
+func (st *sqliteStore) AddSnapshots(ctx context.Context, snapshots []Snapshot) (err error) {
+	if len(snapshots) == 0 {
+		return
+	}
+
+	rows := make([][]interface{}, 0, len(snapshots))
+	for _, s := range snapshots {
+		rows = append(rows, []interface{}{int64(s.UserID), int64(s.PortfolioID), toDbDateTime(s.Date),
+			toDbDecimal(s.MarketValue, 4), toDbDecimal(s.Cash, 4), toDbDecimal(s.NetFlow, 4), toDbDecimal(s.Invested, 4)})
+	}
+	return st.bulkInsert(ctx, "PortfolioSnapshot", []string{"UserID", "PortfolioID", "Date", "MarketValue", "Cash", "NetFlow", "Invested"}, rows)
+}
+
+func (st *sqliteStore) GetSnapshots(ctx context.Context, userID UserID, from, to time.Time) (snapshots []Snapshot, err error) {
+	rows := make([]dbSnapshot, 0, 260)
+	err = st.db.SelectContext(ctx, &rows, `
+select UserID, PortfolioID, Date, MarketValue, Cash, NetFlow, Invested
+from PortfolioSnapshot
+where (UserID = ?1)
+  and (datetime(Date) >= datetime(?2))
+  and (datetime(Date) <= datetime(?3))
+order by datetime(Date) ASC, PortfolioID ASC`, int64(userID), from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	snapshots = make([]Snapshot, 0, len(rows))
+	for _, r := range rows {
+		snapshots = append(snapshots, Snapshot{
+			UserID:      UserID(r.UserID),
+			PortfolioID: PortfolioID(r.PortfolioID),
+			Date:        f.DateTime(time.RFC3339, r.Date),
+			MarketValue: f.Decimal(r.MarketValue),
+			Cash:        f.Decimal(r.Cash),
+			NetFlow:     f.Decimal(r.NetFlow),
+			Invested:    f.Decimal(r.Invested),
+		})
+	}
+	return snapshots, f.err
+}
+
+func (st *sqliteStore) GetLastSnapshotDate(ctx context.Context, userID UserID) (date NullDateTime, err error) {
+	var last string
+	err = st.db.GetContext(ctx, &last, `select Date from PortfolioSnapshot where UserID = ?1 order by datetime(Date) DESC limit 1`, int64(userID))
+	if err == sql.ErrNoRows {
+		return NullDateTime{Valid: false}, nil
+	} else if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	return f.NullDateTime(time.RFC3339, sql.NullString{String: last, Valid: true}), f.err
+}
+
+func (st *sqliteStore) GetUserIDsToSnapshot(ctx context.Context, date time.Time) (ids []UserID, err error) {
+	rows := make([]int64, 0, 4)
+	err = st.db.SelectContext(ctx, &rows, `
+select u.UserID from User u
+where (exists (select 1 from Stock s where s.UserID = u.UserID and s.IsWatched = 0)
+    or exists (select 1 from StockTransaction t where t.UserID = u.UserID)
+    or exists (select 1 from PortfolioSnapshot p where p.UserID = u.UserID))
+  and not exists (select 1 from PortfolioSnapshot p where p.UserID = u.UserID and datetime(p.Date) >= datetime(?1))
+order by u.UserID ASC`, date.Format(time.RFC3339))
+	if err != nil {
+		return
+	}
+
+	ids = make([]UserID, 0, len(rows))
+	for _, id := range rows {
+		ids = append(ids, UserID(id))
+	}
+	return
+}
+
+// ------------------------- corporate actions:
+
+func (st *sqliteStore) AddDividends(ctx context.Context, dividends []Dividend) (err error) {
+	if len(dividends) == 0 {
+		return
+	}
+
+	rows := make([][]interface{}, 0, len(dividends))
+	for _, d := range dividends {
+		rows = append(rows, []interface{}{d.Symbol, toDbDateTime(d.Date), toDbDecimal(d.Amount, 4)})
+	}
+	return st.bulkInsert(ctx, "StockDividend", []string{"Symbol", "Date", "Amount"}, rows)
+}
+
+func (st *sqliteStore) AddSplits(ctx context.Context, splits []Split) (err error) {
+	if len(splits) == 0 {
+		return
+	}
+
+	rows := make([][]interface{}, 0, len(splits))
+	for _, s := range splits {
+		rows = append(rows, []interface{}{s.Symbol, toDbDateTime(s.Date), s.Numerator, s.Denominator})
+	}
+	return st.bulkInsert(ctx, "StockSplit", []string{"Symbol", "Date", "Numerator", "Denominator"}, rows)
+}
+
+func (st *sqliteStore) GetDividends(ctx context.Context, symbol string) (dividends []Dividend, err error) {
+	rows := make([]struct {
+		Symbol string `db:"Symbol"`
+		Date   string `db:"Date"`
+		Amount string `db:"Amount"`
+	}, 0, 16)
+	err = st.db.SelectContext(ctx, &rows, `select Symbol, Date, Amount from StockDividend where Symbol = ?1 order by Date ASC`, symbol)
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	dividends = make([]Dividend, 0, len(rows))
+	for _, r := range rows {
+		dividends = append(dividends, Dividend{
+			Symbol: r.Symbol,
+			Date:   f.DateTime(time.RFC3339, r.Date),
+			Amount: f.Decimal(r.Amount),
+		})
+	}
+	return dividends, f.err
+}
+
+type dbSplit struct {
+	Symbol      string `db:"Symbol"`
+	Date        string `db:"Date"`
+	Numerator   int64  `db:"Numerator"`
+	Denominator int64  `db:"Denominator"`
+}
+
+func (r dbSplit) project(f *fromDb) Split {
+	return Split{
+		Symbol:      r.Symbol,
+		Date:        f.DateTime(time.RFC3339, r.Date),
+		Numerator:   r.Numerator,
+		Denominator: r.Denominator,
+	}
+}
+
+func (st *sqliteStore) GetSplits(ctx context.Context, symbol string) (splits []Split, err error) {
+	rows := make([]dbSplit, 0, 4)
+	err = st.db.SelectContext(ctx, &rows, `select Symbol, Date, Numerator, Denominator from StockSplit where Symbol = ?1 order by Date ASC`, symbol)
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	splits = make([]Split, 0, len(rows))
+	for _, r := range rows {
+		splits = append(splits, r.project(&f))
+	}
+	return splits, f.err
+}
+
+func (st *sqliteStore) GetUnappliedSplits(ctx context.Context, symbol string) (splits []StockSplit, err error) {
+	rows := make([]struct {
+		StockID int64 `db:"StockID"`
+		dbSplit
+	}, 0, 4)
+	err = st.db.SelectContext(ctx, &rows, `
+select s.StockID, sp.Symbol, sp.Date, sp.Numerator, sp.Denominator
+from Stock s
+join StockSplit sp on sp.Symbol = s.Symbol
+where (s.Symbol = ?1)
+  and (datetime(s.BuyDate) < datetime(sp.Date))
+  and not exists (select 1 from StockSplitAdjustment a where a.StockID = s.StockID and a.SplitDate = sp.Date)
+order by s.StockID ASC, sp.Date ASC`, symbol)
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	splits = make([]StockSplit, 0, len(rows))
+	for _, r := range rows {
+		splits = append(splits, StockSplit{StockID: StockID(r.StockID), Split: r.dbSplit.project(&f)})
+	}
+	return splits, f.err
+}
+
+func (st *sqliteStore) ApplySplitAdjustment(ctx context.Context, adj SplitAdjustment) (err error) {
+	return st.tx(ctx, func(tx *sqlx.Tx) (err error) {
+		_, err = tx.ExecContext(ctx, `
+update Stock
+set Shares = ?2,
+    BuyPrice = ?3,
+    BuyStopPrice = ?4,
+    SellStopPrice = ?5
+where StockID = ?1`,
+			int64(adj.StockID),
+			adj.NewShares,
+			toDbDecimal(adj.NewBuyPrice, 4),
+			toDbNullDecimal(adj.NewBuyStopPrice, 4),
+			toDbNullDecimal(adj.NewSellStopPrice, 4),
+		)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.ExecContext(ctx, `
+insert into StockSplitAdjustment (StockID, SplitDate, Numerator, Denominator, AdjustedDateTime, OldShares, NewShares, OldBuyPrice, NewBuyPrice, OldBuyStopPrice, NewBuyStopPrice, OldSellStopPrice, NewSellStopPrice)
+values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13)`,
+			int64(adj.StockID),
+			toDbDateTime(adj.Split.Date),
+			adj.Split.Numerator,
+			adj.Split.Denominator,
+			toDbDateTime(adj.AdjustedDateTime),
+			adj.OldShares,
+			adj.NewShares,
+			toDbDecimal(adj.OldBuyPrice, 4),
+			toDbDecimal(adj.NewBuyPrice, 4),
+			toDbNullDecimal(adj.OldBuyStopPrice, 4),
+			toDbNullDecimal(adj.NewBuyStopPrice, 4),
+			toDbNullDecimal(adj.OldSellStopPrice, 4),
+			toDbNullDecimal(adj.NewSellStopPrice, 4),
+		)
+		return
+	})
+}
+
+// ------------------------- history:
+
+type dbHistoryDay struct {
+	Date          string         `db:"Date"`
+	TradeDayIndex int64          `db:"TradeDayIndex"`
+	Closing       string         `db:"Closing"`
+	Opening       string         `db:"Opening"`
+	High          string         `db:"High"`
+	Low           string         `db:"Low"`
+	Volume        int64          `db:"Volume"`
+	AdjClosing    sql.NullString `db:"AdjClosing"`
+}
+
+func (st *sqliteStore) GetLastTradeDay(ctx context.Context, symbol string) (date NullDateTime, tradeDay int64, err error) {
+	row := struct {
+		Date          string `db:"Date"`
+		TradeDayIndex int64  `db:"TradeDayIndex"`
+	}{}
+
+	err = st.db.GetContext(ctx, &row, `select h.Date, h.TradeDayIndex from StockHistory h where (h.Symbol = ?1) and (h.TradeDayIndex = (select max(TradeDayIndex) from StockHistory where Symbol = h.Symbol))`, symbol)
+	if err == sql.ErrNoRows {
+		return NullDateTime{Valid: false}, 0, nil
+	} else if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	return NullDateTime{Value: f.DateTime(time.RFC3339, row.Date).Value, Valid: true}, row.TradeDayIndex, f.err
+}
+
+func (st *sqliteStore) GetHistory(ctx context.Context, symbol string, from, to int64) (days []HistoryDay, err error) {
+	rows := make([]dbHistoryDay, 0, 260)
+	err = st.db.SelectContext(ctx, &rows, `
+select Date, TradeDayIndex, Closing, Opening, High, Low, Volume, AdjClosing
+from StockHistory
+where (Symbol = ?1)
+  and (TradeDayIndex >= ?2)
+  and (TradeDayIndex <= ?3)
+order by TradeDayIndex ASC`, symbol, from, to)
+	if err != nil {
+		return
+	}
+	return fromDbHistoryDays(rows)
+}
+
+func (st *sqliteStore) GetLastHistoryDay(ctx context.Context, symbol string, date time.Time) (h *HistoryDay, err error) {
+	rows := make([]dbHistoryDay, 0, 1)
+	err = st.db.SelectContext(ctx, &rows, `
+select Date, TradeDayIndex, Closing, Opening, High, Low, Volume, AdjClosing
+from StockHistory
+where (Symbol = ?1)
+  and (datetime(Date) <= datetime(?2))
+order by TradeDayIndex DESC
+limit 1`, symbol, date.Format(time.RFC3339))
+	if err != nil || len(rows) == 0 {
+		return
+	}
+
+	days, err := fromDbHistoryDays(rows)
+	if err != nil {
+		return
+	}
+	return &days[0], nil
+}
+
+func fromDbHistoryDays(rows []dbHistoryDay) (days []HistoryDay, err error) {
+	f := fromDb{}
+	days = make([]HistoryDay, 0, len(rows))
+	for _, r := range rows {
+		days = append(days, HistoryDay{
+			Date:          f.DateTime(time.RFC3339, r.Date),
+			TradeDayIndex: r.TradeDayIndex,
+			Open:          f.Decimal(r.Opening),
+			Close:         f.Decimal(r.Closing),
+			High:          f.Decimal(r.High),
+			Low:           f.Decimal(r.Low),
+			Volume:        r.Volume,
+			AdjClose:      f.NullDecimal(r.AdjClosing),
+		})
+	}
+	return days, f.err
+}
+
+func historyRow(symbol string, h HistoryDay) []interface{} {
+	return []interface{}{
+		symbol,
+		toDbDateTime(h.Date),
+		h.TradeDayIndex,
+		toDbDecimal(h.Close, 4),
+		toDbDecimal(h.Open, 4),
+		toDbDecimal(h.High, 4),
+		toDbDecimal(h.Low, 4),
+		h.Volume,
+	}
+}
+
+const historyCols = "Symbol, Date, TradeDayIndex, Closing, Opening, High, Low, Volume"
+
+func (st *sqliteStore) AddHistory(ctx context.Context, symbol string, days []HistoryDay) (err error) {
+	if len(days) == 0 {
+		return
+	}
+
+	rows := make([][]interface{}, 0, len(days))
+	for _, h := range days {
+		rows = append(rows, historyRow(symbol, h))
+	}
+	return st.bulkInsert(ctx, "StockHistory", []string{"Symbol", "Date", "TradeDayIndex", "Closing", "Opening", "High", "Low", "Volume"}, rows)
+}
+
+func (st *sqliteStore) BackfillHistory(ctx context.Context, symbol string, days []HistoryDay, startDate time.Time) (added int64, err error) {
+	err = st.tx(ctx, func(tx *sqlx.Tx) (err error) {
+		stmtInsert, err := tx.PreparexContext(ctx, `insert or ignore into StockHistory (`+historyCols+`) values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`)
+		if err != nil {
+			return
+		}
+
+		for _, h := range days {
+			res, err := stmtInsert.ExecContext(ctx, historyRow(symbol, h)...)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			added += n
+		}
+		if added == 0 {
+			return setHistoryStartDate(ctx, tx, symbol, startDate)
+		}
+
+		// Renumber trading days in date order:
+		_, err = tx.ExecContext(ctx, `
+update StockHistory
+set TradeDayIndex = (select count(*) from StockHistory h0 where (h0.Symbol = StockHistory.Symbol) and (h0.Date <= StockHistory.Date))
+where Symbol = ?1`, symbol)
+		if err != nil {
+			return
+		}
+		_, err = tx.ExecContext(ctx, `
+update StockStats
+set TradeDayIndex = (select h.TradeDayIndex from StockHistory h where (h.Symbol = StockStats.Symbol) and (h.Date = StockStats.Date))
+where Symbol = ?1`, symbol)
+		if err != nil {
+			return
+		}
+		_, err = tx.ExecContext(ctx, `
+update StockCrossover
+set TradeDayIndex = (select h.TradeDayIndex from StockHistory h where (h.Symbol = StockCrossover.Symbol) and (h.Date = StockCrossover.Date))
+where Symbol = ?1`, symbol)
+		if err != nil {
+			return
+		}
+
+		return setHistoryStartDate(ctx, tx, symbol, startDate)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return added, nil
+}
+
+func (st *sqliteStore) GetHistoryStartDate(ctx context.Context, symbol string) (startDate NullDateTime, err error) {
+	row := struct {
+		StartDate sql.NullString `db:"StartDate"`
+	}{}
+	err = st.db.GetContext(ctx, &row, `select StartDate from StockHistoryFetch where Symbol = ?1`, symbol)
+	if err == sql.ErrNoRows {
+		// Assume the earliest recorded date:
+		err = st.db.GetContext(ctx, &row, `select min(Date) as StartDate from StockHistory where Symbol = ?1`, symbol)
+	}
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	return f.NullDateTime(time.RFC3339, row.StartDate), f.err
+}
+
+func (st *sqliteStore) SetHistoryStartDate(ctx context.Context, symbol string, startDate time.Time) (err error) {
+	return setHistoryStartDate(ctx, st.db, symbol, startDate)
+}
+
+func setHistoryStartDate(ctx context.Context, db sqlx.ExecerContext, symbol string, startDate time.Time) (err error) {
+	_, err = db.ExecContext(ctx, `replace into StockHistoryFetch (Symbol, StartDate) values (?1, ?2)`, symbol, startDate.Format(time.RFC3339))
+	return
+}
+
+func (st *sqliteStore) GetFirstUnadjustedDate(ctx context.Context, symbol string) (date NullDateTime, err error) {
+	row := struct {
+		Min sql.NullString `db:"Min"`
+	}{}
+	err = st.db.GetContext(ctx, &row, `select min(Date) as Min from StockHistory where Symbol = ?1 and AdjClosing is null`, symbol)
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	return f.NullDateTime(time.RFC3339, row.Min), f.err
+}
+
+func (st *sqliteStore) SetAdjustedCloses(ctx context.Context, symbol string, days []HistoryDay) (err error) {
+	return st.tx(ctx, func(tx *sqlx.Tx) (err error) {
+		stmtUpdate, err := tx.PreparexContext(ctx, `update StockHistory set AdjClosing = ?3 where Symbol = ?1 and Date = ?2`)
+		if err != nil {
+			return
+		}
+
+		for _, h := range days {
+			if _, err = stmtUpdate.ExecContext(ctx, symbol, toDbDateTime(h.Date), toDbNullDecimal(h.AdjClose, 4)); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+func (st *sqliteStore) DeleteHistory(ctx context.Context, symbol string) (err error) {
+	return st.tx(ctx, func(tx *sqlx.Tx) (err error) {
+		for _, table := range []string{"StockHistory", "StockStats", "StockHistoryFetch", "StockCrossover"} {
+			if _, err = tx.ExecContext(ctx, `delete from `+table+` where Symbol = ?1`, symbol); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// ------------------------- stats:
+
+func (st *sqliteStore) SetStats(ctx context.Context, symbol string, stats []DayStats) (err error) {
+	return st.tx(ctx, func(tx *sqlx.Tx) (err error) {
+		stmtReplace, err := tx.PreparexContext(ctx, `
+replace into StockStats (Symbol, Date, TradeDayIndex, Avg200Day, Avg50Day, SMAPercent
+                       , EMA12, EMA26, MACD, MACDSignal, RSI14, AvgGain14, AvgLoss14, BollingerUpper, BollingerLower, ATR14)
+values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16)`)
+		if err != nil {
+			return
+		}
+
+		for _, s := range stats {
+			_, err = stmtReplace.ExecContext(ctx,
+				symbol, toDbDateTime(s.Date), s.TradeDayIndex,
+				formatStat(s.Avg200Day), formatStat(s.Avg50Day), formatStat(s.SMAPercent),
+				formatStat(s.EMA12), formatStat(s.EMA26), formatStat(s.MACD), formatStat(s.MACDSignal),
+				formatStat(s.RSI14), formatStat(s.AvgGain14), formatStat(s.AvgLoss14),
+				formatStat(s.BollingerUpper), formatStat(s.BollingerLower), formatStat(s.ATR14),
+			)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+func (st *sqliteStore) GetStats(ctx context.Context, symbol string, tradeDayIndex int64) (stats *DayStats, err error) {
+	rows := make([]struct {
+		Date           string          `db:"Date"`
+		TradeDayIndex  int64           `db:"TradeDayIndex"`
+		Avg200Day      float64         `db:"Avg200Day"`
+		Avg50Day       float64         `db:"Avg50Day"`
+		SMAPercent     float64         `db:"SMAPercent"`
+		EMA12          sql.NullFloat64 `db:"EMA12"`
+		EMA26          sql.NullFloat64 `db:"EMA26"`
+		MACD           sql.NullFloat64 `db:"MACD"`
+		MACDSignal     sql.NullFloat64 `db:"MACDSignal"`
+		RSI14          sql.NullFloat64 `db:"RSI14"`
+		AvgGain14      sql.NullFloat64 `db:"AvgGain14"`
+		AvgLoss14      sql.NullFloat64 `db:"AvgLoss14"`
+		BollingerUpper sql.NullFloat64 `db:"BollingerUpper"`
+		BollingerLower sql.NullFloat64 `db:"BollingerLower"`
+		ATR14          sql.NullFloat64 `db:"ATR14"`
+	}, 0, 1)
+	err = st.db.SelectContext(ctx, &rows, `
+select Date, TradeDayIndex
+     , cast(Avg200Day as real) as Avg200Day, cast(Avg50Day as real) as Avg50Day, cast(SMAPercent as real) as SMAPercent
+     , cast(EMA12 as real) as EMA12, cast(EMA26 as real) as EMA26, cast(MACD as real) as MACD, cast(MACDSignal as real) as MACDSignal
+     , cast(RSI14 as real) as RSI14, cast(AvgGain14 as real) as AvgGain14, cast(AvgLoss14 as real) as AvgLoss14
+     , cast(BollingerUpper as real) as BollingerUpper, cast(BollingerLower as real) as BollingerLower, cast(ATR14 as real) as ATR14
+from StockStats
+where (Symbol = ?1) and (TradeDayIndex = ?2)`, symbol, tradeDayIndex)
+	if err != nil || len(rows) == 0 {
+		return
+	}
+
+	// Stats recorded before the indicator columns were added can't be continued from:
+	r := rows[0]
+	if !r.EMA12.Valid || !r.EMA26.Valid || !r.MACDSignal.Valid || !r.AvgGain14.Valid || !r.AvgLoss14.Valid || !r.ATR14.Valid {
+		return nil, nil
+	}
+
+	f := fromDb{}
+	stats = &DayStats{
+		Date:           f.DateTime(time.RFC3339, r.Date),
+		TradeDayIndex:  r.TradeDayIndex,
+		Avg200Day:      r.Avg200Day,
+		Avg50Day:       r.Avg50Day,
+		SMAPercent:     r.SMAPercent,
+		EMA12:          r.EMA12.Float64,
+		EMA26:          r.EMA26.Float64,
+		MACD:           r.MACD.Float64,
+		MACDSignal:     r.MACDSignal.Float64,
+		RSI14:          r.RSI14.Float64,
+		AvgGain14:      r.AvgGain14.Float64,
+		AvgLoss14:      r.AvgLoss14.Float64,
+		BollingerUpper: r.BollingerUpper.Float64,
+		BollingerLower: r.BollingerLower.Float64,
+		ATR14:          r.ATR14.Float64,
+	}
+	return stats, f.err
+}
+
+func (st *sqliteStore) SetCrossoverDays(ctx context.Context, symbol string, c Crossover, days []CrossoverDay) (err error) {
+	return st.tx(ctx, func(tx *sqlx.Tx) (err error) {
+		stmtReplace, err := tx.PreparexContext(ctx, `
+replace into StockCrossover (Symbol, Kind, Fast, Slow, Date, TradeDayIndex, FastAvg, SlowAvg, Percent)
+values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`)
+		if err != nil {
+			return
+		}
+
+		for _, d := range days {
+			_, err = stmtReplace.ExecContext(ctx, symbol, string(c.Kind), c.Fast, c.Slow, toDbDateTime(d.Date), d.TradeDayIndex, formatStat(d.Fast), formatStat(d.Slow), formatStat(d.Percent))
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+func (st *sqliteStore) GetCrossoverDay(ctx context.Context, symbol string, c Crossover, tradeDayIndex int64) (day *CrossoverDay, err error) {
+	rows := make([]struct {
+		Date          string  `db:"Date"`
+		TradeDayIndex int64   `db:"TradeDayIndex"`
+		FastAvg       float64 `db:"FastAvg"`
+		SlowAvg       float64 `db:"SlowAvg"`
+		Percent       float64 `db:"Percent"`
+	}, 0, 1)
+	err = st.db.SelectContext(ctx, &rows, `
+select Date, TradeDayIndex, cast(FastAvg as real) as FastAvg, cast(SlowAvg as real) as SlowAvg, cast(Percent as real) as Percent
+from StockCrossover
+where (Symbol = ?1) and (Kind = ?2) and (Fast = ?3) and (Slow = ?4) and (TradeDayIndex = ?5)`, symbol, string(c.Kind), c.Fast, c.Slow, tradeDayIndex)
+	if err != nil || len(rows) == 0 {
+		return
+	}
+
+	r := rows[0]
+	f := fromDb{}
+	return &CrossoverDay{Date: f.DateTime(time.RFC3339, r.Date), TradeDayIndex: r.TradeDayIndex, Fast: r.FastAvg, Slow: r.SlowAvg, Percent: r.Percent}, f.err
+}
+
+func (st *sqliteStore) GetLastCrossoverDay(ctx context.Context, symbol string, c Crossover) (tradeDay int64, err error) {
+	last := sql.NullInt64{}
+	err = st.db.GetContext(ctx, &last, `select max(TradeDayIndex) from StockCrossover where (Symbol = ?1) and (Kind = ?2) and (Fast = ?3) and (Slow = ?4)`, symbol, string(c.Kind), c.Fast, c.Slow)
+	return last.Int64, err
+}
+
+// ------------------------- hourly prices:
+
+func (st *sqliteStore) SetHourlyPrice(ctx context.Context, p HourlyPrice) (err error) {
+	_, err = st.db.ExecContext(ctx, `replace into StockHourly (Symbol, DateTime, Current, FetchedDateTime, Bid, Ask, DayHigh, DayLow, PrevClose, Volume, ChangePercent, Session) values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12)`,
+		p.Symbol,
+		toDbDateTime(p.DateTime),
+		toDbDecimal(p.Current, 2),
+		toDbDateTime(p.FetchedDateTime),
+		toDbNullDecimal(p.Bid, 2),
+		toDbNullDecimal(p.Ask, 2),
+		toDbNullDecimal(p.DayHigh, 2),
+		toDbNullDecimal(p.DayLow, 2),
+		toDbNullDecimal(p.PrevClose, 2),
+		sql.NullInt64{Int64: p.Volume.Value, Valid: p.Volume.Valid},
+		toDbNullDecimal(p.ChangePercent, 4),
+		int64(p.Session),
+	)
+	return
+}
+
+func (st *sqliteStore) GetHourlyPrice(ctx context.Context, symbol string, hour time.Time) (p *HourlyPrice, err error) {
+	rows := make([]struct {
+		DateTime        string         `db:"DateTime"`
+		Current         string         `db:"Current"`
+		FetchedDateTime string         `db:"FetchedDateTime"`
+		Session         sql.NullInt64  `db:"Session"`
+		Bid             sql.NullString `db:"Bid"`
+		Ask             sql.NullString `db:"Ask"`
+		DayHigh         sql.NullString `db:"DayHigh"`
+		DayLow          sql.NullString `db:"DayLow"`
+		PrevClose       sql.NullString `db:"PrevClose"`
+		Volume          sql.NullInt64  `db:"Volume"`
+		ChangePercent   sql.NullString `db:"ChangePercent"`
+	}, 0, 1)
+	err = st.db.SelectContext(ctx, &rows, `
+select DateTime, Current, FetchedDateTime, Session, Bid, Ask, DayHigh, DayLow, PrevClose, Volume, ChangePercent
+from StockHourly
+where Symbol = ?1 and DateTime = ?2`, symbol, hour.Format(time.RFC3339))
+	if err != nil || len(rows) == 0 {
+		return
+	}
+
+	r := rows[0]
+	f := fromDb{}
+	p = &HourlyPrice{
+		Symbol:          symbol,
+		DateTime:        f.DateTime(time.RFC3339, r.DateTime),
+		Current:         f.Decimal(r.Current),
+		FetchedDateTime: f.DateTime(time.RFC3339, r.FetchedDateTime),
+		Session:         market.Session(r.Session.Int64),
+		Bid:             f.NullDecimal(r.Bid),
+		Ask:             f.NullDecimal(r.Ask),
+		DayHigh:         f.NullDecimal(r.DayHigh),
+		DayLow:          f.NullDecimal(r.DayLow),
+		PrevClose:       f.NullDecimal(r.PrevClose),
+		Volume:          fromDbNullInt64(r.Volume),
+		ChangePercent:   f.NullDecimal(r.ChangePercent),
+	}
+	return p, f.err
+}
+
+func (st *sqliteStore) GetLastHourlyTime(ctx context.Context, symbol string) (lastTime NullDateTime, err error) {
+	row := struct {
+		Max sql.NullString `db:"Max"`
+	}{}
+	err = st.db.GetContext(ctx, &row, `select max(datetime(DateTime)) as Max from StockHourly where Symbol = ?1`, symbol)
+	if err != nil {
+		return
+	}
+
+	f := fromDb{}
+	return f.NullDateTime(sqliteFmt, row.Max), f.err
+}
+
+// ------------------------- run locks:
+
+func (st *sqliteStore) AcquireRunLock(ctx context.Context, name, owner string, expires time.Time) (acquired bool, err error) {
+	err = st.tx(ctx, func(tx *sqlx.Tx) (err error) {
+		// Take over our own lock or one left by a run that died:
+		_, err = tx.ExecContext(ctx, `delete from RunLock where (Name = ?1) and ((Owner = ?2) or (datetime(ExpiresDateTime) <= datetime(?3)))`,
+			name, owner, toDbDateTime(DateTime{Value: time.Now()}))
+		if err != nil {
+			return
+		}
+
+		res, err := tx.ExecContext(ctx, `insert or ignore into RunLock (Name, Owner, ExpiresDateTime) values (?1, ?2, ?3)`,
+			name, owner, toDbDateTime(DateTime{Value: expires}))
+		if err != nil {
+			return
+		}
+		n, err := res.RowsAffected()
+		acquired = n == 1
+		return
+	})
+	return
+}
+
+func (st *sqliteStore) ReleaseRunLock(ctx context.Context, name, owner string) (err error) {
+	_, err = st.db.ExecContext(ctx, `delete from RunLock where (Name = ?1) and (Owner = ?2)`, name, owner)
+	return
+}
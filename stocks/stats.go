@@ -2,125 +2,267 @@ package stocks
 
 // general stuff:
 import (
+	"context"
+	"fmt"
+	"strconv"
 	"time"
 )
 
 // Our own packages:
 import (
-	"database/sql"
 	"github.com/JamesDunne/StockWatcher/yql"
-	"github.com/jmoiron/sqlx"
 )
 
 // Get the earliest buy date for a symbol.
-func (api *API) GetMinBuyDate(symbol string) NullDateTime {
+func (api *API) GetMinBuyDate(symbol string) (minDate NullDateTime, err error) {
 	// Find earliest date of interest for history:
-	row := struct {
-		Min sql.NullString `db:"Min"`
-	}{}
-	err := api.db.Get(&row, `select min(datetime(BuyDate)) as Min from Stock where Symbol = ?1`, symbol)
+	minDate, err = api.store.GetMinBuyDate(context.Background(), symbol)
+	return minDate, storeError("GetMinBuyDate", symbol, err)
+}
+
+// Deletes all historical and statistical data for a symbol.
+func (api *API) DeleteHistory(symbol string) (err error) {
+	return storeError("DeleteHistory", symbol, api.store.DeleteHistory(context.Background(), symbol))
+}
+
+// Fetches historical data from the quote provider into the store and brings adjusted closes, stats and
+// crossovers up to date. Fails with `ErrNotFound` if the quote provider has no history for the symbol,
+// `ErrProviderUnavailable` if it could not be reached and `ErrBadData` if its data could not be parsed.
+func (api *API) RecordHistory(symbol string) (err error) {
+	return api.RecordHistoryContext(context.Background(), symbol)
+}
+
+// Like `RecordHistory`; cancelling `ctx` aborts pending quote provider requests and store queries and keeps
+// whatever history was recorded before.
+func (api *API) RecordHistoryContext(ctx context.Context, symbol string) (err error) {
+	// Concurrent calls for the same symbol would fetch and insert the same days:
+	l := api.recordingLock(symbol)
+	l.Lock()
+	defer l.Unlock()
+
+	return storeError("RecordHistory", symbol, api.recordAll(ctx, symbol))
+}
+
+func (api *API) recordAll(ctx context.Context, symbol string) (err error) {
+	// Find earliest date of interest for symbol:
+	lastTradingDate := api.LastTradingDate()
+	startDate := lastTradingDate
+	minDate, err := api.store.GetMinBuyDate(ctx, symbol)
 	if err != nil {
-		panic(err)
+		return
+	}
+	if minDate.Valid {
+		startDate = minDate.Value
 	}
 
-	return fromDbNullDateTime(sqliteFmt, row.Min)
-}
+	// Take it back at least 200 trading days to get the 200-day moving average:
+	startDate = api.calendar.AddTradingDays(startDate, -210)
 
-// Deletes all historical and statistical data for a symbol.
-func (api *API) DeleteHistory(symbol string) {
-	err := api.tx(func(tx *sqlx.Tx) (err error) {
-		_, err = api.db.Exec(`delete from StockHistory where Symbol = ?1`, symbol)
+	lastDateTime, lastTradeDay, err := api.store.GetLastTradeDay(ctx, symbol)
+	if err != nil {
+		return
+	}
+	if !lastDateTime.Valid {
+		// No history yet:
+		n, err := api.recordHistory(ctx, symbol, startDate, 0)
 		if err != nil {
 			return err
 		}
-		_, err = api.db.Exec(`delete from StockStats where Symbol = ?1`, symbol)
+		if n == 0 {
+			return wrapError("GetHistory", symbol, ErrNotFound, fmt.Errorf("no trading history since %s", startDate.Format(dateFmt)))
+		}
+		if err = api.store.SetHistoryStartDate(ctx, symbol, startDate); err != nil {
+			return err
+		}
+	} else {
+		// Backfill history before the earliest date fetched so far, e.g. for a stock added with an earlier buy date:
+		fetchedDate, err := api.store.GetHistoryStartDate(ctx, symbol)
 		if err != nil {
 			return err
 		}
+		if startDate.Before(fetchedDate.Value) {
+			n, err := api.backfillHistory(ctx, symbol, startDate, fetchedDate.Value)
+			if err != nil {
+				return err
+			}
+			lastTradeDay += n
+		}
+
+		// Do we need to fetch newer history?
+		if lastDateTime.Value.Before(lastTradingDate) {
+			if _, err = api.recordHistory(ctx, symbol, lastDateTime.Value, lastTradeDay); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Adjust positions bought before any recorded splits:
+	if err = api.applySplits(ctx, symbol); err != nil {
 		return
-	})
+	}
+
+	// Find the earliest close not yet adjusted for dividends and splits:
+	minUnadjusted, err := api.store.GetFirstUnadjustedDate(ctx, symbol)
 	if err != nil {
-		panic(err)
+		return
 	}
+
+	var minChanged, maxChanged int64
+	if minUnadjusted.Valid {
+		// Fetch dividends and splits since then and recompute adjusted closes:
+		if err = api.recordActions(ctx, symbol, minUnadjusted.Value); err != nil {
+			return
+		}
+		if minChanged, maxChanged, err = api.adjustHistory(ctx, symbol); err != nil {
+			return
+		}
+		if err = api.applySplits(ctx, symbol); err != nil {
+			return
+		}
+	}
+
+	if maxChanged > 0 {
+		// Only days whose 200-day window includes a changed close need recalculating:
+		if err = api.recordStats(ctx, symbol, minChanged, maxChanged+longWindow-1); err != nil {
+			return
+		}
+	}
+
+	// Bring the series of every crossover in use up to date, including newly chosen ones:
+	return api.recordCrossovers(ctx, symbol, minChanged)
 }
 
-// Fetches historical data from Yahoo Finance into the database.
-func (api *API) RecordHistory(symbol string) {
-	var startDate time.Time
+// Converts historical data from the quote provider, which is in descending date order, into trading days
+// after `startDate`. Days are numbered from `lastTradeDay` + 1 in ascending date order.
+// Fails with `ErrBadData` if a day's date, prices or volume cannot be parsed.
+func toHistoryDays(symbol string, hist []yql.History, startDate time.Time, lastTradeDay int64) (days []HistoryDay, err error) {
+	days = make([]HistoryDay, 0, len(hist))
+	for _, h := range hist {
+		// Dates are in the NYC timezone:
+		date, err := time.ParseInLocation(dateFmt, h.Date, LocNY)
+		if err != nil {
+			return nil, badData("GetHistory", symbol, err)
+		}
 
-	// Fetch earliest date of interest for symbol:
-	lastDateTime, lastTradeDay, err := api.GetLastTradeDay(symbol)
-	if err != nil {
-		minDate := api.GetMinBuyDate(symbol)
-		if !minDate.Valid {
-			startDate = api.lastTradingDate
-		} else {
-			startDate = minDate.Value
+		// Only record dates after last-fetched dates:
+		if !date.After(startDate) {
+			continue
 		}
 
-		// Take it back at least 42 weeks to get the 200-day moving average:
-		startDate = startDate.Add(time.Duration(-42*7*24) * time.Hour)
-		lastTradeDay = 0
-	} else {
-		startDate = lastDateTime.Value
+		day := HistoryDay{Date: DateTime{Value: date}}
+		for _, p := range []struct {
+			field string
+			value string
+			dest  *Decimal
+		}{
+			{"Open", h.Open, &day.Open},
+			{"Close", h.Close, &day.Close},
+			{"High", h.High, &day.High},
+			{"Low", h.Low, &day.Low},
+		} {
+			r, err := yql.ParsePrice(symbol, p.field, p.value)
+			if err != nil {
+				return nil, badData("GetHistory", symbol, err)
+			}
+			p.dest.Value = r
+		}
+
+		if day.Volume, err = strconv.ParseInt(h.Volume, 10, 64); err != nil {
+			return nil, badData("GetHistory", symbol, err)
+		}
+
+		days = append(days, day)
 	}
 
-	// Do we need to fetch history?
-	if !startDate.Before(api.lastTradingDate) {
-		return
+	// Number only the days kept; ranges are inclusive so `startDate` itself is usually skipped:
+	for i := range days {
+		days[i].TradeDayIndex = lastTradeDay + int64(len(days)-i)
 	}
+	return
+}
 
+// Fetches historical data since startDate from the quote provider into the store.
+// Returns the number of days recorded.
+func (api *API) recordHistory(ctx context.Context, symbol string, startDate time.Time, lastTradeDay int64) (n int, err error) {
 	// Fetch the historical data:
-	hist, err := yql.GetHistory(symbol, startDate, api.lastTradingDate)
+	hist, err := api.provider.GetHistoryContext(ctx, symbol, startDate, api.LastTradingDate())
 	if err != nil {
-		panic(err)
+		return 0, providerError("GetHistory", symbol, err)
 	}
 
-	// Bulk insert the historical data into the StockHistory table:
-	rows := make([][]interface{}, 0, len(hist))
-	for i, h := range hist {
-		// Store dates as RFC3339 in the NYC timezone:
-		date, err := time.ParseInLocation(dateFmt, h.Date, LocNY)
-		if err != nil {
-			panic(err)
-		}
+	days, err := toHistoryDays(symbol, hist, startDate, lastTradeDay)
+	if err != nil {
+		return
+	}
 
-		// Only record dates after last-fetched dates:
-		if date.After(time.Time(startDate)) {
-			rows = append(rows, []interface{}{
-				symbol,
-				date.Format(time.RFC3339),
-				lastTradeDay + int64(len(hist)-i),
-				h.Close,
-				h.Open,
-				h.High,
-				h.Low,
-				h.Volume,
-			})
-		}
+	return len(days), api.store.AddHistory(ctx, symbol, days)
+}
+
+// Fetches historical data between startDate and endDate that precedes all recorded history and renumbers
+// TradeDayIndex for the whole symbol. Returns the number of days added.
+func (api *API) backfillHistory(ctx context.Context, symbol string, startDate, endDate time.Time) (added int64, err error) {
+	hist, err := api.provider.GetHistoryContext(ctx, symbol, startDate, endDate)
+	if err != nil {
+		return 0, providerError("GetHistory", symbol, err)
 	}
 
-	if len(rows) > 0 {
-		err = api.bulkInsert("StockHistory", []string{"Symbol", "Date", "TradeDayIndex", "Closing", "Opening", "High", "Low", "Volume"}, rows)
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	// Calculates per-day trends and records them to the database.
-	_, err = api.db.Exec(`
-replace into StockStats (Symbol, Date, TradeDayIndex, Avg200Day, Avg50Day, SMAPercent)
-select Symbol, Date, TradeDayIndex, Avg200, Avg50, ((Avg50 / Avg200) - 1) * 100 as SMAPercent
-from (
-	select h.Symbol, h.Date, h.TradeDayIndex
-	     , (select avg(cast(Closing as real)) from StockHistory h0 where (h0.Symbol = h.Symbol) and (h0.TradeDayIndex >= (h.TradeDayIndex - 200))) as Avg200
-	     , (select avg(cast(Closing as real)) from StockHistory h0 where (h0.Symbol = h.Symbol) and (h0.TradeDayIndex >= (h.TradeDayIndex - 50))) as Avg50
-	from StockHistory h
-	where (h.Symbol = ?1)
-	  and (h.TradeDayIndex > 200)
-)`, symbol)
+	// Same range as the initial fetch records; the store renumbers the days:
+	days, err := toHistoryDays(symbol, hist, startDate, 0)
 	if err != nil {
-		panic(err)
+		return
+	}
+
+	return api.store.BackfillHistory(ctx, symbol, days, startDate)
+}
+
+// Calculates trailing moving averages and indicators from adjusted prices for the days between TradeDayIndex
+// `from` and `to` and records them to the store. Only the closes in those days' windows are read when the
+// indicators can continue from the stats recorded for the day before `from`; otherwise all history is read.
+func (api *API) recordStats(ctx context.Context, symbol string, from, to int64) (err error) {
+	seed, err := api.store.GetStats(ctx, symbol, from-1)
+	if err != nil {
+		return
+	}
+	start := from - longWindow + 1
+	if seed == nil {
+		start = 1
+	}
+
+	closes, err := api.getCloses(ctx, symbol, start, to)
+	if err != nil {
+		return
+	}
+
+	stats := trailingStats(closes, from, seed)
+	if len(stats) == 0 {
+		return
+	}
+
+	return api.store.SetStats(ctx, symbol, stats)
+}
+
+// Gets the adjusted prices of the trading days between TradeDayIndex `from` and `to` in ascending order.
+// High and low are scaled by the same factor as the close.
+func (api *API) getCloses(ctx context.Context, symbol string, from, to int64) (closes []dayClose, err error) {
+	hist, err := api.store.GetHistory(ctx, symbol, from, to)
+	if err != nil {
+		return
+	}
+
+	closes = make([]dayClose, 0, len(hist))
+	for _, h := range hist {
+		closing := RatToFloat(h.Close.Value)
+		adj := closing
+		if h.AdjClose.Valid {
+			adj = RatToFloat(h.AdjClose.Value)
+		}
+
+		c := dayClose{Date: h.Date, TradeDayIndex: h.TradeDayIndex, Close: adj, High: adj, Low: adj}
+		if closing != 0 {
+			c.High = RatToFloat(h.High.Value) * adj / closing
+			c.Low = RatToFloat(h.Low.Value) * adj / closing
+		}
+		closes = append(closes, c)
 	}
 	return
 }
@@ -129,29 +271,32 @@ from (
 func truncTime(t time.Time) time.Time   { return t.Truncate(time.Minute * time.Duration(15)) }
 func (api *API) CurrentHour() time.Time { return truncTime(time.Now()) }
 
-// Checks if the current hourly price has been fetched from Yahoo or not and fetches it into the StockHourly table if needed.
-func (api *API) GetCurrentHourlyPrices(force bool, symbols ...string) (prices map[string]Decimal) {
+// Checks if the current hourly price has been fetched from the quote provider or not and fetches it into the store if needed.
+// Symbols without a usable price are left out of `prices` and reported with an `ErrBadData` error wrapping
+// `yql.PriceErrors`; the prices of the other symbols are still returned and recorded.
+func (api *API) GetCurrentHourlyPrices(force bool, symbols ...string) (prices map[string]Decimal, err error) {
+	return api.GetCurrentHourlyPricesContext(context.Background(), force, symbols...)
+}
+
+// Like `GetCurrentHourlyPrices`; cancelling `ctx` aborts the quote request and store queries.
+func (api *API) GetCurrentHourlyPricesContext(ctx context.Context, force bool, symbols ...string) (prices map[string]Decimal, err error) {
 	currHour := api.CurrentHour()
 
 	toFetch := make([]string, 0, len(symbols))
 	prices = make(map[string]Decimal)
 	if force {
-		// Forcefully fetch all symbols from Yahoo Finance:
+		// Forcefully fetch all symbols from the quote provider:
 		for _, symbol := range symbols {
 			toFetch = append(toFetch, symbol)
 		}
 	} else {
 		for _, symbol := range symbols {
-			row := struct {
-				Max sql.NullString `db:"Max"`
-			}{}
-			err := api.db.Get(&row, `select max(datetime(DateTime)) as Max from StockHourly where Symbol = ?1`, symbol)
+			lastTime, err := api.store.GetLastHourlyTime(ctx, symbol)
 			if err != nil {
-				panic(err)
+				return nil, storeError("GetCurrentHourlyPrices", symbol, err)
 			}
-			lastTime := fromDbNullDateTime(sqliteFmt, row.Max)
 
-			// Determine if we need to fetch from Yahoo or not:
+			// Determine if we need to fetch from the quote provider or not:
 			needFetch := false
 			if !lastTime.Valid {
 				needFetch = true
@@ -164,42 +309,54 @@ func (api *API) GetCurrentHourlyPrices(force bool, symbols ...string) (prices ma
 
 			// TODO(jsd): could break this out to separate single query with IN clause
 			if !needFetch {
-				row := struct {
-					Current sql.NullString `db:"Current"`
-				}{}
-				err := api.db.Get(&row, `select Current from StockHourly where Symbol = ?1 and DateTime = ?2`, symbol, currHour.Format(time.RFC3339))
+				p, err := api.store.GetHourlyPrice(ctx, symbol, currHour)
 				if err != nil {
-					panic(err)
+					return nil, storeError("GetCurrentHourlyPrices", symbol, err)
 				}
 
-				if row.Current.Valid {
-					prices[symbol] = ToDecimal(row.Current.String)
+				if p != nil {
+					prices[symbol] = p.Current
 					continue
 				}
 			}
 
-			// Add it to the list of symbols to be fetched from Yahoo:
+			// Add it to the list of symbols to be fetched from the quote provider:
 			toFetch = append(toFetch, symbol)
 		}
 	}
 
-	// Get current prices from Yahoo:
+	// Get current prices from the quote provider:
 	if len(toFetch) > 0 {
-		quotes, err := yql.GetQuotes(toFetch...)
-		if err != nil {
-			panic(err)
+		// Tag prices with the trading session they were fetched in:
+		session := api.calendar.SessionAt(time.Now())
+
+		quotes, qerr := api.provider.GetQuotesContext(ctx, toFetch...)
+		if _, ok := qerr.(yql.PriceErrors); ok {
+			// Still record the prices we did get:
+			err = providerError("GetQuotes", "", qerr)
+		} else if qerr != nil {
+			return nil, providerError("GetQuotes", "", qerr)
 		}
 
 		for _, quote := range quotes {
 			// Record the current hourly price:
-			_, err = api.db.Exec(`replace into StockHourly (Symbol, DateTime, Current, FetchedDateTime) values (?1, ?2, ?3, ?4)`,
-				quote.Symbol,
-				currHour.Format(time.RFC3339),
-				quote.Price.FloatString(2),
-				time.Now().In(LocNY).Format(time.RFC3339),
-			)
-			if err != nil {
-				panic(err)
+			serr := api.store.SetHourlyPrice(ctx, HourlyPrice{
+				Symbol:          quote.Symbol,
+				DateTime:        DateTime{Value: currHour},
+				Current:         Decimal{Value: quote.Price},
+				FetchedDateTime: DateTime{Value: time.Now().In(LocNY)},
+				Session:         session,
+
+				Bid:           toNullDecimal(quote.Bid),
+				Ask:           toNullDecimal(quote.Ask),
+				DayHigh:       toNullDecimal(quote.DayHigh),
+				DayLow:        toNullDecimal(quote.DayLow),
+				PrevClose:     toNullDecimal(quote.PreviousClose),
+				Volume:        toNullInt64(quote.Volume),
+				ChangePercent: toNullDecimal(quote.ChangePercent),
+			})
+			if serr != nil {
+				return nil, storeError("GetCurrentHourlyPrices", quote.Symbol, serr)
 			}
 
 			// Fill in the price map:
@@ -2,27 +2,26 @@ package stocks
 
 // general stuff:
 import (
+	"context"
 	"fmt"
 	"math/big"
-	"time"
 )
 
-// sqlite related imports:
+// Our own packages:
 import (
-	"database/sql"
-	//"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/JamesDunne/StockWatcher/market"
 )
 
 // A stock owned/watched by UserID.
 type Stock struct {
-	StockID   StockID
-	UserID    UserID
-	Symbol    string
-	BuyDate   DateTime
-	BuyPrice  Decimal
-	Shares    int64
-	IsWatched bool // false = owned, true = watched
+	StockID     StockID
+	UserID      UserID
+	PortfolioID PortfolioID // 0 for none
+	Symbol      string
+	BuyDate     DateTime
+	BuyPrice    Decimal
+	Shares      int64
+	IsWatched   bool // false = owned, true = watched
 
 	TStopPercent     NullDecimal
 	BuyStopPrice     NullDecimal
@@ -41,12 +40,32 @@ type Stock struct {
 	LastTimeRise     NullDateTime
 	LastTimeFall     NullDateTime
 	LastTimeBullBear NullDateTime
+
+	// Trading sessions each notification may fire in; `market.Regular` when not set:
+	TStopSessions    market.Session
+	BuyStopSessions  market.Session
+	SellStopSessions market.Session
+	RiseSessions     market.Session
+	FallSessions     market.Session
+	BullBearSessions market.Session
+
+	// Moving averages whose crossover signals bull/bear; nil to use the owner's:
+	Crossover *Crossover
 }
 
 type Detail struct {
 	CurrPrice       NullDecimal
 	CurrHour        NullDateTime
 	FetchedDateTime NullDateTime
+	CurrSession     market.Session
+
+	Bid           NullDecimal
+	Ask           NullDecimal
+	DayHigh       NullDecimal
+	DayLow        NullDecimal
+	PrevClose     NullDecimal
+	Volume        NullInt64
+	ChangePercent NullDecimal
 
 	N1CloseDate  NullDateTime
 	N1ClosePrice NullDecimal
@@ -54,13 +73,35 @@ type Detail struct {
 	N1Avg200Day  NullFloat64
 	N1Avg50Day   NullFloat64
 
+	N1EMA12          NullFloat64
+	N1EMA26          NullFloat64
+	N1MACD           NullFloat64
+	N1MACDSignal     NullFloat64
+	N1RSI14          NullFloat64
+	N1BollingerUpper NullFloat64
+	N1BollingerLower NullFloat64
+	N1ATR14          NullFloat64
+
 	N2CloseDate  NullDateTime
 	N2ClosePrice NullDecimal
 	N2SMAPercent NullFloat64
 
+	// Crossover in effect for the stock and its percent for the last two trading days:
+	Crossover          Crossover
+	N1CrossoverPercent NullFloat64
+	N2CrossoverPercent NullFloat64
+
 	TStopPrice      NullDecimal
 	GainLossPercent NullFloat64
 	GainLossDollar  NullDecimal
+
+	// The owner's benchmark over the same window since BuyDate: what the cost would be worth had it bought the
+	// benchmark instead, the benchmark's return and GainLossPercent less it. Only set by `GetStockDetailsForUser`;
+	// not valid without a benchmark or its history back to BuyDate:
+	BenchmarkSymbol  string
+	BenchmarkValue   NullDecimal
+	BenchmarkPercent NullFloat64
+	AlphaPercent     NullFloat64
 }
 
 // A stock with calculated stats:
@@ -69,268 +110,72 @@ type StockDetail struct {
 	Detail Detail
 }
 
-type dbStock struct {
-	StockID   int64  `db:"StockID"`
-	UserID    int64  `db:"UserID"`
-	Symbol    string `db:"Symbol"`
-	BuyDate   string `db:"BuyDate"`
-	BuyPrice  string `db:"BuyPrice"`
-	Shares    int64  `db:"Shares"`
-	IsWatched int64  `db:"IsWatched"`
-
-	TStopPercent     sql.NullString `db:"TStopPercent"`
-	BuyStopPrice     sql.NullString `db:"BuyStopPrice"`
-	SellStopPrice    sql.NullString `db:"SellStopPrice"`
-	RisePercent      sql.NullString `db:"RisePercent"`
-	FallPercent      sql.NullString `db:"FallPercent"`
-	NotifyTStop      int64          `db:"NotifyTStop"`
-	NotifyBuyStop    int64          `db:"NotifyBuyStop"`
-	NotifySellStop   int64          `db:"NotifySellStop"`
-	NotifyRise       int64          `db:"NotifyRise"`
-	NotifyFall       int64          `db:"NotifyFall"`
-	NotifyBullBear   int64          `db:"NotifyBullBear"`
-	LastTimeTStop    sql.NullString `db:"LastTimeTStop"`
-	LastTimeBuyStop  sql.NullString `db:"LastTimeBuyStop"`
-	LastTimeSellStop sql.NullString `db:"LastTimeSellStop"`
-	LastTimeRise     sql.NullString `db:"LastTimeRise"`
-	LastTimeFall     sql.NullString `db:"LastTimeFall"`
-	LastTimeBullBear sql.NullString `db:"LastTimeBullBear"`
-}
-
-// DB representation of a stock with calculated stats:
-type dbDetail struct {
-	// Include all fields from dbStock:
-	dbStock
-
-	CurrPrice       sql.NullString `db:"CurrPrice"`
-	CurrHour        sql.NullString `db:"CurrHour"`
-	FetchedDateTime sql.NullString `db:"FetchedDateTime"`
-
-	N1CloseDate  sql.NullString  `db:"N1CloseDate"`
-	N1ClosePrice sql.NullString  `db:"N1ClosePrice"`
-	N1SMAPercent sql.NullFloat64 `db:"N1SMAPercent"`
-	N1Avg200Day  sql.NullFloat64 `db:"N1Avg200Day"`
-	N1Avg50Day   sql.NullFloat64 `db:"N1Avg50Day"`
-
-	N2CloseDate  sql.NullString  `db:"N2CloseDate"`
-	N2ClosePrice sql.NullString  `db:"N2ClosePrice"`
-	N2SMAPercent sql.NullFloat64 `db:"N2SMAPercent"`
-
-	HighestClose sql.NullFloat64 `db:"HighestClose"`
-	LowestClose  sql.NullFloat64 `db:"LowestClose"`
-}
-
 // Add a stock for UserID:
 func (api *API) AddStock(s *Stock) (err error) {
 	if s == nil {
 		return fmt.Errorf("s cannot be nil for AddStock")
 	}
-
-	// Insert the Stock record:
-	res, err := api.db.Exec(`
-insert into Stock (`+stockCols+`)
-    values (?1,?2,?3,?4,?5,?6,?7,?8,?9,?10,?11,?12,?13,?14,?15,?16,?17,?18,?19,?20,?21,?22,?23)`,
-		int64(s.UserID),
-		s.Symbol,
-		toDbDateTime(s.BuyDate),
-		toDbDecimal(s.BuyPrice, 2),
-		s.Shares,
-		toDbBool(s.IsWatched),
-		toDbNullDecimal(s.TStopPercent, 2),
-		toDbNullDecimal(s.BuyStopPrice, 2),
-		toDbNullDecimal(s.SellStopPrice, 2),
-		toDbNullDecimal(s.RisePercent, 2),
-		toDbNullDecimal(s.FallPercent, 2),
-		toDbBool(s.NotifyTStop),
-		toDbBool(s.NotifyBuyStop),
-		toDbBool(s.NotifySellStop),
-		toDbBool(s.NotifyRise),
-		toDbBool(s.NotifyFall),
-		toDbBool(s.NotifyBullBear),
-		toDbNullDateTime(time.RFC3339, s.LastTimeTStop),
-		toDbNullDateTime(time.RFC3339, s.LastTimeBuyStop),
-		toDbNullDateTime(time.RFC3339, s.LastTimeSellStop),
-		toDbNullDateTime(time.RFC3339, s.LastTimeRise),
-		toDbNullDateTime(time.RFC3339, s.LastTimeFall),
-		toDbNullDateTime(time.RFC3339, s.LastTimeBullBear),
-	)
-	if err != nil {
-		s.StockID = StockID(0)
-		return err
+	if s.Crossover != nil {
+		if err = s.Crossover.Validate(); err != nil {
+			return badData("AddStock", s.Symbol, err)
+		}
 	}
 
-	// Get last inserted ID:
-	id, err := res.LastInsertId()
-	if err != nil {
-		s.StockID = StockID(0)
-		return err
+	ctx := context.Background()
+	if err = api.checkPortfolio(ctx, s.UserID, s.PortfolioID); err != nil {
+		return wrapError("AddStock", s.Symbol, ErrBadData, err)
 	}
-
-	// Set StockID:
-	s.StockID = StockID(id)
-	return nil
+	return api.store.AddStock(ctx, s)
 }
 
-// Gets a stock by ID:
+// Gets a stock by ID. Fails with `ErrNotFound` if there is no such stock.
 func (api *API) GetStock(stockID StockID) (s *Stock, err error) {
-	r := dbStock{}
-	err = api.db.Get(&r, `select StockID,`+stockCols+` from Stock where StockID = ?1`, int64(stockID))
-	if err == sql.ErrNoRows {
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-
-	s = &Stock{
-		StockID:   StockID(r.StockID),
-		UserID:    UserID(r.UserID),
-		Symbol:    r.Symbol,
-		BuyDate:   fromDbDateTime(dateFmt, r.BuyDate),
-		BuyPrice:  fromDbDecimal(r.BuyPrice),
-		Shares:    r.Shares,
-		IsWatched: fromDbBool(r.IsWatched),
-
-		TStopPercent:     fromDbNullDecimal(r.TStopPercent),
-		BuyStopPrice:     fromDbNullDecimal(r.BuyStopPrice),
-		SellStopPrice:    fromDbNullDecimal(r.SellStopPrice),
-		RisePercent:      fromDbNullDecimal(r.RisePercent),
-		FallPercent:      fromDbNullDecimal(r.FallPercent),
-		NotifyTStop:      fromDbBool(r.NotifyTStop),
-		NotifyBuyStop:    fromDbBool(r.NotifyBuyStop),
-		NotifySellStop:   fromDbBool(r.NotifySellStop),
-		NotifyRise:       fromDbBool(r.NotifyRise),
-		NotifyFall:       fromDbBool(r.NotifyFall),
-		NotifyBullBear:   fromDbBool(r.NotifyBullBear),
-		LastTimeTStop:    fromDbNullDateTime(time.RFC3339, r.LastTimeTStop),
-		LastTimeBuyStop:  fromDbNullDateTime(time.RFC3339, r.LastTimeBuyStop),
-		LastTimeSellStop: fromDbNullDateTime(time.RFC3339, r.LastTimeSellStop),
-		LastTimeRise:     fromDbNullDateTime(time.RFC3339, r.LastTimeRise),
-		LastTimeFall:     fromDbNullDateTime(time.RFC3339, r.LastTimeFall),
-		LastTimeBullBear: fromDbNullDateTime(time.RFC3339, r.LastTimeBullBear),
-	}
+	return api.GetStockContext(context.Background(), stockID)
+}
 
-	return
+// Like `GetStock`; `ctx` cancels the store query.
+func (api *API) GetStockContext(ctx context.Context, stockID StockID) (s *Stock, err error) {
+	s, err = api.store.GetStock(ctx, stockID)
+	return s, storeError("GetStock", "", err)
 }
 
-// Only updates notify flag columns:
+// Only updates notify flag columns and the portfolio:
 func (api *API) UpdateStock(n *Stock) (err error) {
-	_, err = api.db.Exec(`
-update Stock
-set TStopPercent = ?2,
-    BuyStopPrice = ?3,
-    SellStopPrice = ?4,
-    RisePercent = ?5,
-    FallPercent = ?6,
-    NotifyTStop = ?7,
-    NotifyBuyStop = ?8,
-    NotifySellStop = ?9,
-    NotifyRise = ?10,
-    NotifyFall = ?11,
-    NotifyBullBear = ?12,
-    BuyDate = ?13,
-    BuyPrice = ?14,
-    Shares = ?15
-where StockID = ?1`,
-		int64(n.StockID),
-		toDbNullDecimal(n.TStopPercent, 2),
-		toDbNullDecimal(n.BuyStopPrice, 2),
-		toDbNullDecimal(n.SellStopPrice, 2),
-		toDbNullDecimal(n.RisePercent, 2),
-		toDbNullDecimal(n.FallPercent, 2),
-		toDbBool(n.NotifyTStop),
-		toDbBool(n.NotifyBuyStop),
-		toDbBool(n.NotifySellStop),
-		toDbBool(n.NotifyRise),
-		toDbBool(n.NotifyFall),
-		toDbBool(n.NotifyBullBear),
-		toDbDateTime(n.BuyDate),
-		toDbDecimal(n.BuyPrice, 2),
-		n.Shares,
-	)
-	return
+	if n.Crossover != nil {
+		if err = n.Crossover.Validate(); err != nil {
+			return badData("UpdateStock", n.Symbol, err)
+		}
+	}
+
+	ctx := context.Background()
+	if err = api.checkPortfolio(ctx, n.UserID, n.PortfolioID); err != nil {
+		return wrapError("UpdateStock", n.Symbol, ErrBadData, err)
+	}
+	return api.store.UpdateStock(ctx, n)
 }
 
 // Only updates last notification times:
 func (api *API) UpdateNotifyTimes(n *Stock) (err error) {
-	_, err = api.db.Exec(`
-update Stock
-set LastTimeTStop = ?2,
-    LastTimeBuyStop = ?3,
-	LastTimeSellStop = ?4,
-	LastTimeRise = ?5,
-	LastTimeFall = ?6,
-	LastTimeBullBear = ?7
-where StockID = ?1`,
-		int64(n.StockID),
-		toDbNullDateTime(time.RFC3339, n.LastTimeTStop),
-		toDbNullDateTime(time.RFC3339, n.LastTimeBuyStop),
-		toDbNullDateTime(time.RFC3339, n.LastTimeSellStop),
-		toDbNullDateTime(time.RFC3339, n.LastTimeRise),
-		toDbNullDateTime(time.RFC3339, n.LastTimeFall),
-		toDbNullDateTime(time.RFC3339, n.LastTimeBullBear),
-	)
-	return
+	return api.UpdateNotifyTimesContext(context.Background(), n)
+}
+
+// Like `UpdateNotifyTimes`; `ctx` cancels the store query.
+func (api *API) UpdateNotifyTimesContext(ctx context.Context, n *Stock) (err error) {
+	return api.store.UpdateNotifyTimes(ctx, n)
 }
 
 // Removes a stock:
 func (api *API) RemoveStock(stockID StockID) (err error) {
-	_, err = api.db.Exec(`delete from Stock where StockID = ?1`, int64(stockID))
-	return
+	return api.store.RemoveStock(context.Background(), stockID)
 }
 
-func projectDetails(rows []dbDetail) (details []StockDetail, err error) {
-	// Copy raw DB rows into OwnedDetails records:
+// Calculates the trailing stop price and gains of stored details:
+func calcDetails(rows []StoredDetail) (details []StockDetail) {
 	details = make([]StockDetail, 0, len(rows))
 	for _, r := range rows {
-		s := &Stock{
-			StockID:   StockID(r.StockID),
-			UserID:    UserID(r.UserID),
-			Symbol:    r.Symbol,
-			BuyDate:   fromDbDateTime(dateFmt, r.BuyDate),
-			BuyPrice:  fromDbDecimal(r.BuyPrice),
-			Shares:    r.Shares,
-			IsWatched: fromDbBool(r.IsWatched),
-
-			TStopPercent:     fromDbNullDecimal(r.TStopPercent),
-			BuyStopPrice:     fromDbNullDecimal(r.BuyStopPrice),
-			SellStopPrice:    fromDbNullDecimal(r.SellStopPrice),
-			RisePercent:      fromDbNullDecimal(r.RisePercent),
-			FallPercent:      fromDbNullDecimal(r.FallPercent),
-			NotifyTStop:      fromDbBool(r.NotifyTStop),
-			NotifyBuyStop:    fromDbBool(r.NotifyBuyStop),
-			NotifySellStop:   fromDbBool(r.NotifySellStop),
-			NotifyRise:       fromDbBool(r.NotifyRise),
-			NotifyFall:       fromDbBool(r.NotifyFall),
-			NotifyBullBear:   fromDbBool(r.NotifyBullBear),
-			LastTimeTStop:    fromDbNullDateTime(time.RFC3339, r.LastTimeTStop),
-			LastTimeBuyStop:  fromDbNullDateTime(time.RFC3339, r.LastTimeBuyStop),
-			LastTimeSellStop: fromDbNullDateTime(time.RFC3339, r.LastTimeSellStop),
-			LastTimeRise:     fromDbNullDateTime(time.RFC3339, r.LastTimeRise),
-			LastTimeFall:     fromDbNullDateTime(time.RFC3339, r.LastTimeFall),
-			LastTimeBullBear: fromDbNullDateTime(time.RFC3339, r.LastTimeBullBear),
-		}
-
-		d := &Detail{
-			CurrPrice:       fromDbNullDecimal(r.CurrPrice),
-			CurrHour:        fromDbNullDateTime(time.RFC3339, r.CurrHour),
-			FetchedDateTime: fromDbNullDateTime(time.RFC3339, r.FetchedDateTime),
-
-			N1CloseDate:  fromDbNullDateTime(time.RFC3339, r.N1CloseDate),
-			N1ClosePrice: fromDbNullDecimal(r.N1ClosePrice),
-			N1SMAPercent: fromDbNullFloat64(r.N1SMAPercent),
-			N1Avg200Day:  fromDbNullFloat64(r.N1Avg200Day),
-			N1Avg50Day:   fromDbNullFloat64(r.N1Avg50Day),
+		s, d := &r.Stock, &r.Detail
 
-			N2CloseDate:  fromDbNullDateTime(time.RFC3339, r.N2CloseDate),
-			N2ClosePrice: fromDbNullDecimal(r.N2ClosePrice),
-			N2SMAPercent: fromDbNullFloat64(r.N2SMAPercent),
-
-			// TStopPrice
-			// GainLossPercent
-			// GainLossDollar
-		}
-
-		currPrice := fromDbNullDecimal(r.CurrPrice)
+		currPrice := d.CurrPrice
 		buyPriceFlt := RatToFloat(s.BuyPrice.Value)
 
 		if s.Shares >= 0 {
@@ -338,7 +183,7 @@ func projectDetails(rows []dbDetail) (details []StockDetail, err error) {
 
 			if s.TStopPercent.Valid && r.HighestClose.Valid {
 				// ((100 - stopPercent) * 0.01) * highestClose
-				d.TStopPrice = NullDecimal{Value: new(big.Rat).Mul((new(big.Rat).Mul(new(big.Rat).Sub(ToRat("100"), s.TStopPercent.Value), ToRat("0.01"))), FloatToRat(r.HighestClose.Float64)), Valid: true}
+				d.TStopPrice = NullDecimal{Value: new(big.Rat).Mul((new(big.Rat).Mul(new(big.Rat).Sub(ToRat("100"), s.TStopPercent.Value), ToRat("0.01"))), FloatToRat(r.HighestClose.Value)), Valid: true}
 			}
 
 			if currPrice.Valid {
@@ -356,7 +201,7 @@ func projectDetails(rows []dbDetail) (details []StockDetail, err error) {
 
 			if s.TStopPercent.Valid && r.LowestClose.Valid {
 				// ((100 + stopPercent) * 0.01) * lowestClose
-				d.TStopPrice = NullDecimal{Value: new(big.Rat).Mul((new(big.Rat).Mul(new(big.Rat).Add(ToRat("100"), s.TStopPercent.Value), ToRat("0.01"))), FloatToRat(r.LowestClose.Float64)), Valid: true}
+				d.TStopPrice = NullDecimal{Value: new(big.Rat).Mul((new(big.Rat).Mul(new(big.Rat).Add(ToRat("100"), s.TStopPercent.Value), ToRat("0.01"))), FloatToRat(r.LowestClose.Value)), Valid: true}
 			}
 
 			if currPrice.Valid {
@@ -371,56 +216,41 @@ func projectDetails(rows []dbDetail) (details []StockDetail, err error) {
 			}
 		}
 
-		sd := StockDetail{
-			Stock:  *s,
-			Detail: *d,
-		}
-
 		// Add to list:
-		details = append(details, sd)
+		details = append(details, r.StockDetail)
 	}
 
 	return
 }
 
 func (api *API) GetStockDetailsForUser(userID UserID) (details []StockDetail, err error) {
-	rows := make([]dbDetail, 0, 6)
-
-	err = api.db.Select(&rows, `
-select StockID, `+stockCols+`
-     , CurrPrice, CurrHour, FetchedDateTime
-     , N1CloseDate, N1ClosePrice, N1SMAPercent, N1Avg200Day, N1Avg50Day
-     , N2CloseDate, N2ClosePrice, N2SMAPercent
-     , LowestClose, HighestClose
-from StockDetail s
-where (s.UserID = ?1)
-  and (datetime(s.CurrHour) = (select max(datetime(h.DateTime)) from StockHourly h where h.Symbol = s.Symbol))
-order by s.Symbol ASC, s.BuyDate ASC, s.Shares ASC`, int64(userID))
+	return api.GetStockDetailsForUserContext(context.Background(), userID)
+}
+
+// Like `GetStockDetailsForUser`; `ctx` cancels the store query.
+func (api *API) GetStockDetailsForUserContext(ctx context.Context, userID UserID) (details []StockDetail, err error) {
+	rows, err := api.store.GetStockDetailsForUser(ctx, userID)
 	if err != nil {
-		return
+		return nil, storeError("GetStockDetailsForUser", "", err)
 	}
 
-	details, err = projectDetails(rows)
-	return
+	details = calcDetails(rows)
+	if err = api.compareDetails(ctx, details); err != nil {
+		return nil, storeError("GetStockDetailsForUser", "", err)
+	}
+	return details, nil
 }
 
 func (api *API) GetStockDetailsForSymbol(symbol string) (details []StockDetail, err error) {
-	rows := make([]dbDetail, 0, 6)
-
-	err = api.db.Select(&rows, `
-select StockID, `+stockCols+`
-     , CurrPrice, CurrHour, FetchedDateTime
-     , N1CloseDate, N1ClosePrice, N1SMAPercent, N1Avg200Day, N1Avg50Day
-     , N2CloseDate, N2ClosePrice, N2SMAPercent
-     , LowestClose, HighestClose
-from StockDetail s
-where (s.Symbol = ?1)
-  and (datetime(s.CurrHour) = (select max(datetime(h.DateTime)) from StockHourly h where h.Symbol = s.Symbol))
-order by s.Symbol ASC, s.BuyDate ASC, s.Shares ASC`, symbol)
+	return api.GetStockDetailsForSymbolContext(context.Background(), symbol)
+}
+
+// Like `GetStockDetailsForSymbol`; `ctx` cancels the store query.
+func (api *API) GetStockDetailsForSymbolContext(ctx context.Context, symbol string) (details []StockDetail, err error) {
+	rows, err := api.store.GetStockDetailsForSymbol(ctx, symbol)
 	if err != nil {
-		return
+		return nil, storeError("GetStockDetailsForSymbol", symbol, err)
 	}
 
-	details, err = projectDetails(rows)
-	return
+	return calcDetails(rows), nil
 }
@@ -0,0 +1,222 @@
+package stocks
+
+// general stuff:
+import (
+	"context"
+	"time"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/market"
+)
+
+// Persistent storage for users, stocks, trading history, hourly prices and stats.
+// `NewSQLiteStore` is the on-disk implementation; `NewMemoryStore` keeps everything in memory for tests.
+// Methods that get a single record return nil without an error if it does not exist. `ctx` bounds each query
+// or transaction; the in-memory store never blocks and ignores it.
+type Store interface {
+	// Releases all store resources.
+	Close() error
+
+	// ---- Users:
+
+	// Adds a user with its emails and sets `user.UserID`.
+	AddUser(ctx context.Context, user *User) error
+	GetUser(ctx context.Context, userID UserID) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	// Gets the IDs of all users in ascending order.
+	GetUserIDs(ctx context.Context) ([]UserID, error)
+	UpdateUserCrossover(ctx context.Context, userID UserID, c Crossover) error
+	UpdateUserBenchmark(ctx context.Context, userID UserID, symbol string) error
+
+	// ---- Portfolios:
+
+	// Adds a portfolio and sets `p.PortfolioID`.
+	AddPortfolio(ctx context.Context, p *Portfolio) error
+	GetPortfolio(ctx context.Context, portfolioID PortfolioID) (*Portfolio, error)
+	// Gets a user's portfolios ordered by name.
+	GetPortfolios(ctx context.Context, userID UserID) ([]Portfolio, error)
+	RenamePortfolio(ctx context.Context, portfolioID PortfolioID, name string) error
+	// Removes a portfolio and moves its stocks to no portfolio, atomically, unless transactions are recorded
+	// in it. Returns whether it was removed.
+	RemovePortfolio(ctx context.Context, portfolioID PortfolioID) (removed bool, err error)
+
+	// ---- Stocks:
+
+	// Adds a stock and sets `s.StockID`.
+	AddStock(ctx context.Context, s *Stock) error
+	// Fails with `ErrNotFound` if there is no such stock.
+	GetStock(ctx context.Context, stockID StockID) (*Stock, error)
+	// Gets all of a user's stocks, priced or not, ordered by symbol, buy date and StockID.
+	GetStocksForUser(ctx context.Context, userID UserID) ([]Stock, error)
+	// Updates everything but the symbol, owner and last notification times, including the portfolio.
+	UpdateStock(ctx context.Context, s *Stock) error
+	// Updates only the last notification times.
+	UpdateNotifyTimes(ctx context.Context, s *Stock) error
+	RemoveStock(ctx context.Context, stockID StockID) error
+
+	// Gets the distinct symbols of all stocks, trades and users' benchmarks; deposits and withdrawals have none.
+	GetAllTrackedSymbols(ctx context.Context) ([]string, error)
+	// Gets the earliest buy date of the stocks of a symbol, or transaction date if earlier. For a benchmark
+	// symbol, the stocks and transactions of the users comparing against it count too.
+	GetMinBuyDate(ctx context.Context, symbol string) (NullDateTime, error)
+	// Gets the distinct crossovers chosen by the stocks of a symbol or else their owners.
+	GetCrossoversInUse(ctx context.Context, symbol string) ([]Crossover, error)
+
+	// Gets the stocks of a user, or of a symbol, that have hourly prices along with their latest price and stats.
+	// Details are ordered by symbol, buy date and shares; TStopPrice and gains are left for the caller.
+	GetStockDetailsForUser(ctx context.Context, userID UserID) ([]StoredDetail, error)
+	GetStockDetailsForSymbol(ctx context.Context, symbol string) ([]StoredDetail, error)
+
+	// ---- Transactions:
+
+	// Adds a ledger transaction and sets `t.TransactionID`.
+	AddTransaction(ctx context.Context, t *Transaction) error
+	GetTransaction(ctx context.Context, transactionID TransactionID) (*Transaction, error)
+	RemoveTransaction(ctx context.Context, transactionID TransactionID) error
+	// Gets a user's transactions, of only `symbol` if it is not empty, ordered by date and TransactionID.
+	GetTransactions(ctx context.Context, userID UserID, symbol string) ([]Transaction, error)
+
+	// ---- Portfolio snapshots:
+
+	// Adds snapshots, ignoring those of a user, portfolio and date already recorded.
+	AddSnapshots(ctx context.Context, snapshots []Snapshot) error
+	// Gets a user's snapshots dated from `from` through `to`, ordered by date and PortfolioID.
+	GetSnapshots(ctx context.Context, userID UserID, from, to time.Time) ([]Snapshot, error)
+	// Gets the date of a user's latest snapshot; not valid if there are none.
+	GetLastSnapshotDate(ctx context.Context, userID UserID) (NullDateTime, error)
+	// Gets the IDs of users, in ascending order, who own stocks, have transactions or have snapshots but have
+	// none dated `date` or later.
+	GetUserIDsToSnapshot(ctx context.Context, date time.Time) ([]UserID, error)
+
+	// ---- Corporate actions:
+
+	// Adds dividends and splits, ignoring those already recorded.
+	AddDividends(ctx context.Context, dividends []Dividend) error
+	AddSplits(ctx context.Context, splits []Split) error
+	// Get the recorded dividends and splits of a symbol in ascending date order.
+	GetDividends(ctx context.Context, symbol string) ([]Dividend, error)
+	GetSplits(ctx context.Context, symbol string) ([]Split, error)
+	// Gets the splits of a symbol after each stock's buy date that have not been applied to the stock yet,
+	// ordered by StockID and date.
+	GetUnappliedSplits(ctx context.Context, symbol string) ([]StockSplit, error)
+	// Updates a stock's position to its post-split values and records the adjustment, atomically.
+	ApplySplitAdjustment(ctx context.Context, adj SplitAdjustment) error
+
+	// ---- History:
+
+	// Gets the last recorded trading day of a symbol; `date` is not valid if there is no history.
+	GetLastTradeDay(ctx context.Context, symbol string) (date NullDateTime, tradeDay int64, err error)
+	// Gets the trading days between TradeDayIndex `from` and `to` in ascending order.
+	GetHistory(ctx context.Context, symbol string, from, to int64) ([]HistoryDay, error)
+	// Gets the last recorded trading day of a symbol on or before `date`; nil if there is none.
+	GetLastHistoryDay(ctx context.Context, symbol string, date time.Time) (*HistoryDay, error)
+	// Adds trading days, ignoring dates already recorded.
+	AddHistory(ctx context.Context, symbol string, days []HistoryDay) error
+	// Adds trading days that precede recorded history, renumbers TradeDayIndex of the symbol's history, stats
+	// and crossovers in date order and records `startDate` as the history start date, atomically.
+	// Returns the number of days added.
+	BackfillHistory(ctx context.Context, symbol string, days []HistoryDay, startDate time.Time) (added int64, err error)
+	// Gets the earliest date history has been requested from the quote provider for; defaults to the
+	// earliest recorded date.
+	GetHistoryStartDate(ctx context.Context, symbol string) (NullDateTime, error)
+	SetHistoryStartDate(ctx context.Context, symbol string, startDate time.Time) error
+	// Gets the earliest date whose close has not been adjusted for dividends and splits.
+	GetFirstUnadjustedDate(ctx context.Context, symbol string) (NullDateTime, error)
+	// Sets AdjClose of the given trading days by date.
+	SetAdjustedCloses(ctx context.Context, symbol string, days []HistoryDay) error
+	// Deletes all history, stats and crossovers of a symbol.
+	DeleteHistory(ctx context.Context, symbol string) error
+
+	// ---- Stats:
+
+	// Adds or replaces stats by date.
+	SetStats(ctx context.Context, symbol string, stats []DayStats) error
+	// Gets the stats of a trading day, or nil if it has none or lacks the indicators to continue from.
+	GetStats(ctx context.Context, symbol string, tradeDayIndex int64) (*DayStats, error)
+	// Adds or replaces a crossover's averages by date.
+	SetCrossoverDays(ctx context.Context, symbol string, c Crossover, days []CrossoverDay) error
+	// Gets a crossover's averages for a trading day, or nil if none are recorded.
+	GetCrossoverDay(ctx context.Context, symbol string, c Crossover, tradeDayIndex int64) (*CrossoverDay, error)
+	// Gets the last TradeDayIndex with recorded averages for a crossover; 0 if none.
+	GetLastCrossoverDay(ctx context.Context, symbol string, c Crossover) (int64, error)
+
+	// ---- Hourly prices:
+
+	// Adds or replaces a symbol's price for an hour.
+	SetHourlyPrice(ctx context.Context, p HourlyPrice) error
+	// Gets a symbol's price for an hour, or nil if none is recorded.
+	GetHourlyPrice(ctx context.Context, symbol string, hour time.Time) (*HourlyPrice, error)
+	// Gets the latest hour a symbol has a price for.
+	GetLastHourlyTime(ctx context.Context, symbol string) (NullDateTime, error)
+
+	// ---- Run locks:
+
+	// Takes the advisory lock `name` for `owner` until `expires` unless another owner holds it unexpired;
+	// the owner may take it again to extend it. Returns whether it was taken.
+	AcquireRunLock(ctx context.Context, name, owner string, expires time.Time) (acquired bool, err error)
+	// Releases the lock `name` if `owner` holds it.
+	ReleaseRunLock(ctx context.Context, name, owner string) error
+}
+
+// A trading day of a symbol's history:
+type HistoryDay struct {
+	Date          DateTime
+	TradeDayIndex int64
+	Open          Decimal
+	Close         Decimal
+	High          Decimal
+	Low           Decimal
+	Volume        int64
+
+	// Close adjusted for later dividends and splits; not valid until adjusted:
+	AdjClose NullDecimal
+}
+
+// A symbol's current price recorded for an hour:
+type HourlyPrice struct {
+	Symbol          string
+	DateTime        DateTime
+	Current         Decimal
+	FetchedDateTime DateTime
+	Session         market.Session
+
+	Bid           NullDecimal
+	Ask           NullDecimal
+	DayHigh       NullDecimal
+	DayLow        NullDecimal
+	PrevClose     NullDecimal
+	Volume        NullInt64
+	ChangePercent NullDecimal
+}
+
+// A split of a stock's symbol after its buy date:
+type StockSplit struct {
+	StockID StockID
+	Split   Split
+}
+
+// A stock's position before and after adjusting it for a split:
+type SplitAdjustment struct {
+	StockID          StockID
+	Split            Split
+	AdjustedDateTime DateTime
+
+	OldShares        int64
+	NewShares        int64
+	OldBuyPrice      Decimal
+	NewBuyPrice      Decimal
+	OldBuyStopPrice  NullDecimal
+	NewBuyStopPrice  NullDecimal
+	OldSellStopPrice NullDecimal
+	NewSellStopPrice NullDecimal
+}
+
+// A stock with its stored details and the lowest and highest adjusted closes since its buy date:
+type StoredDetail struct {
+	StockDetail
+
+	LowestClose  NullFloat64
+	HighestClose NullFloat64
+}
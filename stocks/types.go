@@ -192,6 +192,43 @@ func ToNullFloat64(v string) NullFloat64 {
 
 // --------------
 
+type NullInt64 struct {
+	Value int64
+	Valid bool
+}
+
+func (d NullInt64) String() string {
+	if d.Valid {
+		return strconv.FormatInt(d.Value, 10)
+	} else {
+		return ""
+	}
+}
+
+func (d NullInt64) MarshalJSON() ([]byte, error) {
+	if !d.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.Value)
+}
+
+func (d *NullInt64) UnmarshalJSON(data []byte) error {
+	v := new(int64)
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		d.Valid = false
+		return nil
+	}
+	d.Value = *v
+	d.Valid = true
+	return nil
+}
+
+// --------------
+
 type DateTime struct {
 	Value time.Time
 	// TODO: store format here too.
@@ -277,21 +314,23 @@ func (d *NullDateTime) UnmarshalJSON(data []byte) error {
 
 var DateTimeNull = NullDateTime{Valid: false}
 
-func ToDateTime(format, s string) DateTime {
+// Parses a date/time; fails with `ErrBadData`.
+func ToDateTime(format, s string) (DateTime, error) {
 	t, err := time.Parse(format, s)
 	if err != nil {
-		panic(err)
+		return DateTime{}, badData("ToDateTime", "", err)
 	}
-	return DateTime{Value: t}
+	return DateTime{Value: t}, nil
 }
 
-func ToNullDateTime(format, s string) NullDateTime {
+// Parses an optional date/time; the empty string is not valid.
+func ToNullDateTime(format, s string) (NullDateTime, error) {
 	if s == "" {
-		return NullDateTime{Valid: false}
+		return NullDateTime{Valid: false}, nil
 	}
 	t, err := time.Parse(format, s)
 	if err != nil {
-		panic(err)
+		return NullDateTime{}, badData("ToNullDateTime", "", err)
 	}
-	return NullDateTime{Value: t, Valid: true}
+	return NullDateTime{Value: t, Valid: true}, nil
 }
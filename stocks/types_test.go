@@ -2,18 +2,55 @@ package stocks
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 )
 
+import (
+	"github.com/JamesDunne/StockWatcher/market"
+)
+
+// Parses date/time literals for test data:
+func testDateTime(format, s string) DateTime {
+	d, err := ToDateTime(format, s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func testNullDateTime(format, s string) NullDateTime {
+	d, err := ToNullDateTime(format, s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestToDateTime(t *testing.T) {
+	if d, err := ToDateTime(dateFmt, "2013-09-04"); err != nil || d.DateString() != "2013-09-04" {
+		t.Fatalf("expected 2013-09-04; got %v, %v", d, err)
+	}
+	if _, err := ToDateTime(dateFmt, "09/04/2013"); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data; got %v", err)
+	}
+	if d, err := ToNullDateTime(dateFmt, ""); err != nil || d.Valid {
+		t.Fatalf("expected null; got %v, %v", d, err)
+	}
+	if _, err := ToNullDateTime(dateFmt, "tomorrow"); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected bad data; got %v", err)
+	}
+}
+
 func TestJSONMarshal(t *testing.T) {
 	v := StockDetail{
 		Stock: Stock{
 			StockID:          1,
 			UserID:           1,
 			Symbol:           "MSFT",
-			BuyDate:          ToDateTime(time.RFC3339, "2013-09-04T00:00:00Z"),
+			BuyDate:          testDateTime(time.RFC3339, "2013-09-04T00:00:00Z"),
 			BuyPrice:         ToDecimal("30.00"),
 			Shares:           20,
 			IsWatched:        false,
@@ -28,24 +65,46 @@ func TestJSONMarshal(t *testing.T) {
 			NotifyRise:       false,
 			NotifyFall:       false,
 			NotifyBullBear:   false,
-			LastTimeTStop:    ToNullDateTime(time.RFC3339, "2013-12-30T14:16:32-06:00"),
+			LastTimeTStop:    testNullDateTime(time.RFC3339, "2013-12-30T14:16:32-06:00"),
 			LastTimeBuyStop:  DateTimeNull,
 			LastTimeSellStop: DateTimeNull,
 			LastTimeRise:     DateTimeNull,
 			LastTimeFall:     DateTimeNull,
 			LastTimeBullBear: DateTimeNull,
+			TStopSessions:    market.Regular | market.AfterHours,
+			BuyStopSessions:  market.Regular,
+			SellStopSessions: market.Regular,
+			RiseSessions:     market.Regular,
+			FallSessions:     market.Regular,
+			BullBearSessions: market.Regular,
+			Crossover:        &Crossover{Fast: 20, Slow: 50, Kind: EMA},
 		},
 		Detail: Detail{
-			LastCloseDate:   ToNullDateTime(time.RFC3339, "2013-12-27T00:00:00-05:00"),
-			TStopPrice:      ToNullDecimal("29.20"),
-			Avg200Day:       ToNullFloat64("33.644428"),
-			Avg50Day:        ToNullFloat64("36.832549"),
-			SMAPercent:      ToNullFloat64("9.475926"),
-			GainLossPercent: ToNullFloat64("24.433333"),
-			GainLossDollar:  ToNullDecimal("146.60"),
+			CurrPrice:          ToNullDecimal("37.33"),
+			CurrHour:           testNullDateTime(time.RFC3339, "2013-12-30T14:00:00-06:00"),
+			CurrSession:        market.Regular,
+			DayHigh:            ToNullDecimal("37.40"),
+			DayLow:             ToNullDecimal("37.07"),
+			PrevClose:          ToNullDecimal("37.29"),
+			Volume:             NullInt64{Value: 25000000, Valid: true},
+			ChangePercent:      ToNullDecimal("0.1073"),
+			N1CloseDate:        testNullDateTime(time.RFC3339, "2013-12-27T00:00:00-05:00"),
+			N1ClosePrice:       ToNullDecimal("37.29"),
+			N1SMAPercent:       ToNullFloat64("9.475926"),
+			N1Avg200Day:        ToNullFloat64("33.644428"),
+			N1Avg50Day:         ToNullFloat64("36.832549"),
+			N1MACD:             ToNullFloat64("0.412345"),
+			N1RSI14:            ToNullFloat64("61.250000"),
+			Crossover:          Crossover{Fast: 20, Slow: 50, Kind: EMA},
+			N1CrossoverPercent: ToNullFloat64("1.250000"),
+			TStopPrice:         ToNullDecimal("29.20"),
+			GainLossPercent:    ToNullFloat64("24.433333"),
+			GainLossDollar:     ToNullDecimal("146.60"),
+			BenchmarkSymbol:    "SPY",
+			BenchmarkValue:     ToNullDecimal("690.00"),
+			BenchmarkPercent:   ToNullFloat64("15.000000"),
+			AlphaPercent:       ToNullFloat64("9.433333"),
 		},
-		CurrHour:  ToNullDateTime(time.RFC3339, "2013-12-30T14:00:00-06:00"),
-		CurrPrice: ToNullDecimal("37.33"),
 	}
 
 	j, err := json.Marshal(&v)
@@ -53,7 +112,7 @@ func TestJSONMarshal(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if string(j) != `{"Stock":{"StockID":1,"UserID":1,"Symbol":"MSFT","BuyDate":"2013-09-04T00:00:00Z","BuyPrice":"30.00","Shares":20,"IsWatched":false,"TStopPercent":"25.00","BuyStopPrice":null,"SellStopPrice":null,"RisePercent":null,"FallPercent":null,"NotifyTStop":true,"NotifyBuyStop":false,"NotifySellStop":false,"NotifyRise":false,"NotifyFall":false,"NotifyBullBear":false,"LastTimeTStop":"2013-12-30T14:16:32-06:00","LastTimeBuyStop":null,"LastTimeSellStop":null,"LastTimeRise":null,"LastTimeFall":null,"LastTimeBullBear":null},"Detail":{"LastCloseDate":"2013-12-27T00:00:00-05:00","TStopPrice":"29.20","Avg200Day":"33.644428","Avg50Day":"36.832549","SMAPercent":"9.475926","GainLossPercent":"24.433333","GainLossDollar":"146.60"},"CurrHour":"2013-12-30T14:00:00-06:00","CurrPrice":"37.33"}` {
+	if string(j) != `{"Stock":{"StockID":1,"UserID":1,"PortfolioID":0,"Symbol":"MSFT","BuyDate":"2013-09-04T00:00:00Z","BuyPrice":"30.00","Shares":20,"IsWatched":false,"TStopPercent":"25.00","BuyStopPrice":null,"SellStopPrice":null,"RisePercent":null,"FallPercent":null,"NotifyTStop":true,"NotifyBuyStop":false,"NotifySellStop":false,"NotifyRise":false,"NotifyFall":false,"NotifyBullBear":false,"LastTimeTStop":"2013-12-30T14:16:32-06:00","LastTimeBuyStop":null,"LastTimeSellStop":null,"LastTimeRise":null,"LastTimeFall":null,"LastTimeBullBear":null,"TStopSessions":"regular,after","BuyStopSessions":"regular","SellStopSessions":"regular","RiseSessions":"regular","FallSessions":"regular","BullBearSessions":"regular","Crossover":{"Fast":20,"Slow":50,"Kind":"EMA"}},"Detail":{"CurrPrice":"37.33","CurrHour":"2013-12-30T14:00:00-06:00","FetchedDateTime":null,"CurrSession":"regular","Bid":null,"Ask":null,"DayHigh":"37.40","DayLow":"37.07","PrevClose":"37.29","Volume":25000000,"ChangePercent":"0.11","N1CloseDate":"2013-12-27T00:00:00-05:00","N1ClosePrice":"37.29","N1SMAPercent":"9.475926","N1Avg200Day":"33.644428","N1Avg50Day":"36.832549","N1EMA12":null,"N1EMA26":null,"N1MACD":"0.412345","N1MACDSignal":null,"N1RSI14":"61.250000","N1BollingerUpper":null,"N1BollingerLower":null,"N1ATR14":null,"N2CloseDate":null,"N2ClosePrice":null,"N2SMAPercent":null,"Crossover":{"Fast":20,"Slow":50,"Kind":"EMA"},"N1CrossoverPercent":"1.250000","N2CrossoverPercent":null,"TStopPrice":"29.20","GainLossPercent":"24.433333","GainLossDollar":"146.60","BenchmarkSymbol":"SPY","BenchmarkValue":"690.00","BenchmarkPercent":"15.000000","AlphaPercent":"9.433333"}}` {
 		fmt.Printf("%s\n", j)
 		t.Fatal(fmt.Errorf("JSON does not match expected"))
 	}
@@ -88,16 +147,21 @@ func TestJSONUnmarshal(t *testing.T) {
         "LastTimeBullBear": null
     },
     "Detail": {
-        "LastCloseDate": "2013-12-27T00:00:00-05:00",
+        "CurrPrice": "37.33",
+        "CurrHour": "2013-12-30T14:00:00-06:00",
+        "Bid": null,
+        "DayHigh": "37.40",
+        "Volume": 25000000,
+        "ChangePercent": "0.11",
+        "N1CloseDate": "2013-12-27T00:00:00-05:00",
+        "N1ClosePrice": "37.29",
+        "N1SMAPercent": "9.475926",
+        "N1Avg200Day": "33.644428",
+        "N1Avg50Day": "36.832549",
         "TStopPrice": "29.20",
-        "Avg200Day": "33.644428",
-        "Avg50Day": "36.832549",
-        "SMAPercent": "9.475926",
         "GainLossPercent": "24.433333",
         "GainLossDollar": "146.60"
-    },
-    "CurrHour": "2013-12-30T14:00:00-06:00",
-    "CurrPrice": "37.33"
+    }
 }`
 
 	v := StockDetail{}
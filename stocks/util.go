@@ -1,6 +1,7 @@
 package stocks
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 	"strings"
@@ -13,21 +14,22 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/market"
+)
+
 // ------------------------------- private API utility functions:
 
-func (api *API) ddl(cmds ...string) {
-	for _, cmd := range cmds {
-		if _, err := api.db.Exec(cmd); err != nil {
-			api.db.Close()
-			panic(fmt.Errorf("%s\n%s", cmd, err))
-		}
-	}
+// Executes DDL commands in one transaction so other connections never see e.g. a view dropped but not yet recreated:
+func (st *sqliteStore) ddl(cmds ...string) error {
+	return st.tx(context.Background(), func(tx *sqlx.Tx) error { return execAll(tx, cmds...) })
 }
 
 // Gets a single scalar value from a DB query:
-func (api *API) getScalar(query string, args ...interface{}) (value interface{}, err error) {
+func (st *sqliteStore) getScalar(ctx context.Context, query string, args ...interface{}) (value interface{}, err error) {
 	// Call QueryRowx to get a raw Row result:
-	row := api.db.QueryRowx(query, args...)
+	row := st.db.QueryRowxContext(ctx, query, args...)
 	if err = row.Err(); err != nil {
 		return
 	}
@@ -46,9 +48,9 @@ func (api *API) getScalar(query string, args ...interface{}) (value interface{},
 }
 
 // Gets a slice of scalar values from a DB query:
-func (api *API) getScalars(query string, args ...interface{}) (slice []interface{}, err error) {
+func (st *sqliteStore) getScalars(ctx context.Context, query string, args ...interface{}) (slice []interface{}, err error) {
 	// Call QueryRowx to get a raw Row result:
-	row := api.db.QueryRowx(query, args...)
+	row := st.db.QueryRowxContext(ctx, query, args...)
 	if err = row.Err(); err != nil {
 		return
 	}
@@ -58,16 +60,16 @@ func (api *API) getScalars(query string, args ...interface{}) (slice []interface
 	return
 }
 
-// Execute a database action in a transaction:
-func (api *API) tx(action func(tx *sqlx.Tx) error) (err error) {
-	tx, err := api.db.Beginx()
+// Execute a database action in a transaction; the transaction is rolled back if `ctx` is done before it commits:
+func (st *sqliteStore) tx(ctx context.Context, action func(tx *sqlx.Tx) error) (err error) {
+	tx, err := st.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return
 	}
 
 	err = action(tx)
 	if err != nil {
-		//tx.Tx.Abort()
+		tx.Rollback()
 		return
 	}
 
@@ -77,9 +79,9 @@ func (api *API) tx(action func(tx *sqlx.Tx) error) (err error) {
 }
 
 // Does a bulk insert of data into a single table using a transaction to make it quick:
-func (api *API) bulkInsert(tableName string, columns []string, rows [][]interface{}) (err error) {
+func (st *sqliteStore) bulkInsert(ctx context.Context, tableName string, columns []string, rows [][]interface{}) (err error) {
 	// Run in a transaction:
-	return api.tx(func(tx *sqlx.Tx) (err error) {
+	return st.tx(ctx, func(tx *sqlx.Tx) (err error) {
 		// Prepare insert statement:
 		// e.g. `insert into StockHistory (Symbol, Date, Closing, Opening, High, Low, Volume) values (?1,?2,?3,?4,?5,?6,?7)`
 
@@ -88,14 +90,16 @@ func (api *API) bulkInsert(tableName string, columns []string, rows [][]interfac
 			paramIdents = append(paramIdents, fmt.Sprintf("?%d", i+1))
 		}
 
-		stmtInsert, err := tx.Preparex(`insert or ignore into ` + tableName + ` (` + strings.Join(columns, ",") + `) values (` + strings.Join(paramIdents, ",") + `)`)
+		stmtInsert, err := tx.PreparexContext(ctx, `insert or ignore into `+tableName+` (`+strings.Join(columns, ",")+`) values (`+strings.Join(paramIdents, ",")+`)`)
 		if err != nil {
 			return
 		}
 
 		// Insert each row:
 		for _, row := range rows {
-			stmtInsert.Execl(row...)
+			if _, err = stmtInsert.ExecContext(ctx, row...); err != nil {
+				return
+			}
 		}
 		return
 	})
@@ -125,6 +129,30 @@ func toDbDecimal(v Decimal, prec int) string {
 	}
 }
 
+func toNullDecimal(v *big.Rat) NullDecimal {
+	if v == nil {
+		return NullDecimal{Value: nil, Valid: false}
+	} else {
+		return NullDecimal{Value: v, Valid: true}
+	}
+}
+
+func toNullInt64(v *big.Int) NullInt64 {
+	if v == nil || !v.IsInt64() {
+		return NullInt64{Valid: false}
+	} else {
+		return NullInt64{Value: v.Int64(), Valid: true}
+	}
+}
+
+// Notifications fire in the regular session unless told otherwise:
+func toDbSessions(v market.Session) int64 {
+	if v == market.Closed {
+		return int64(market.Regular)
+	}
+	return int64(v)
+}
+
 func toDbDateTime(v DateTime) string {
 	return v.Value.Format(time.RFC3339)
 }
@@ -137,24 +165,31 @@ func toDbNullDateTime(format string, v NullDateTime) sql.NullString {
 	return sql.NullString{String: v.Value.Format(format), Valid: true}
 }
 
-func fromDbNullDecimal(v sql.NullString) NullDecimal {
+// Converts DB column values that may fail to parse; keeps the first failure as an `ErrBadData` error
+// for the caller to check after converting a whole row:
+type fromDb struct {
+	err error
+}
+
+func (f *fromDb) fail(err error) {
+	if f.err == nil {
+		f.err = badData("", "", err)
+	}
+}
+
+func (f *fromDb) NullDecimal(v sql.NullString) NullDecimal {
 	if !v.Valid {
 		return NullDecimal{Value: nil, Valid: false}
 	}
-	d := NullDecimal{
-		Value: new(big.Rat),
-		Valid: true,
-	}
-	d.Value.SetString(v.String)
-	return d
+	return NullDecimal{Value: f.Decimal(v.String).Value, Valid: true}
 }
 
-func fromDbDecimal(v string) Decimal {
-	if v == "" {
-		panic("Unexpected empty string value in fromDbDecimal!")
+func (f *fromDb) Decimal(v string) Decimal {
+	d, ok := new(big.Rat).SetString(v)
+	if !ok {
+		f.fail(fmt.Errorf("invalid decimal in database: '%s'", v))
+		return Decimal{Value: new(big.Rat)}
 	}
-	d := new(big.Rat)
-	d.SetString(v)
 	return Decimal{Value: d}
 }
 
@@ -166,6 +201,14 @@ func fromDbNullFloat64(v sql.NullFloat64) NullFloat64 {
 	return NullFloat64{Value: v.Float64, Valid: true}
 }
 
+func fromDbNullInt64(v sql.NullInt64) NullInt64 {
+	if !v.Valid {
+		return NullInt64{Valid: false}
+	}
+
+	return NullInt64{Value: v.Int64, Valid: true}
+}
+
 func fromDbBool(i int64) bool {
 	if i == 0 {
 		return false
@@ -174,23 +217,24 @@ func fromDbBool(i int64) bool {
 	}
 }
 
-func fromDbNullDateTime(format string, v sql.NullString) NullDateTime {
+func (f *fromDb) NullDateTime(format string, v sql.NullString) NullDateTime {
 	if !v.Valid {
 		return NullDateTime{Valid: false}
 	}
 
 	t, err := time.Parse(format, v.String)
 	if err != nil {
-		panic(err)
+		f.fail(err)
+		return NullDateTime{Valid: false}
 	}
 	return NullDateTime{Value: t, Valid: true}
 }
 
 // parses the date/time, assuming NY timezone:
-func fromDbDateTime(format string, str string) DateTime {
+func (f *fromDb) DateTime(format string, str string) DateTime {
 	t, err := time.ParseInLocation(time.RFC3339, str, LocNY)
 	if err != nil {
-		panic(err)
+		f.fail(err)
 	}
 	return DateTime{Value: t}
 }
@@ -277,7 +321,7 @@ func RatToFloat(v *big.Rat) float64 {
 	return f
 }
 
-// Check if the date is on a weekend:
+// Check if the date is on a weekend; see `market.TradingCalendar.IsTradingDay` to also skip holidays:
 func IsWeekend(date time.Time) bool {
 	return date.Weekday() == 0 || date.Weekday() == 6
 }
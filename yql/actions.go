@@ -0,0 +1,171 @@
+package yql
+
+// general stuff:
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cash dividend paid per share.
+type Dividend struct {
+	Symbol string
+	Date   string // ex-dividend date
+	Amount string
+}
+
+// A stock split of `Numerator` new shares for every `Denominator` old shares, e.g. 2:1.
+type Split struct {
+	Symbol      string
+	Date        string
+	Numerator   int64
+	Denominator int64
+}
+
+// Parses a split ratio of the form "2:1" or "2/1":
+func ParseSplitRatio(ratio string) (numerator, denominator int64, err error) {
+	parts := strings.FieldsFunc(ratio, func(r rune) bool { return r == ':' || r == '/' })
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid split ratio '%s'", ratio)
+	}
+	numerator, err = strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid split ratio '%s'", ratio)
+	}
+	denominator, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid split ratio '%s'", ratio)
+	}
+	if numerator <= 0 || denominator <= 0 {
+		return 0, 0, fmt.Errorf("invalid split ratio '%s'", ratio)
+	}
+	return
+}
+
+// Rows of Yahoo's dividends and splits CSV, e.g. "DIVIDEND, 20131119,0.280000" or "SPLIT, 20030218,2:1":
+type actionRow struct {
+	Col0 string `json:"col0"`
+	Col1 string `json:"col1"`
+	Col2 string `json:"col2"`
+}
+
+// Gets the raw dividend and split rows for a symbol between startDate and endDate.
+func (p *Provider) getActions(ctx context.Context, symbol string, startDate, endDate time.Time) (rows []actionRow, err error) {
+	// NOTE(jsd): Yahoo's months are zero-based.
+	u := fmt.Sprintf(
+		`http://ichart.finance.yahoo.com/x?s=%s&a=%d&b=%d&c=%d&d=%d&e=%d&f=%d&g=v&y=0&z=30000`,
+		symbol,
+		int(startDate.Month())-1, startDate.Day(), startDate.Year(),
+		int(endDate.Month())-1, endDate.Day(), endDate.Year(),
+	)
+
+	rows = make([]actionRow, 0, 8)
+	err = p.GetContext(ctx, &rows, fmt.Sprintf(`select * from csv where url = "%s"`, u))
+	return
+}
+
+// Converts Yahoo's "20131119" date format:
+func actionDate(s string) (string, error) {
+	t, err := time.Parse("20060102", strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	}
+	return t.Format(dateFmt), nil
+}
+
+// Gets all dividends for a symbol with ex-dates between startDate and endDate.
+func GetDividends(symbol string, startDate, endDate time.Time) (dividends []Dividend, err error) {
+	return DefaultProvider.GetDividends(symbol, startDate, endDate)
+}
+
+// Gets all dividends for a symbol with ex-dates between startDate and endDate.
+func GetDividendsContext(ctx context.Context, symbol string, startDate, endDate time.Time) (dividends []Dividend, err error) {
+	return DefaultProvider.GetDividendsContext(ctx, symbol, startDate, endDate)
+}
+
+// Gets all dividends for a symbol with ex-dates between startDate and endDate.
+func (p *Provider) GetDividends(symbol string, startDate, endDate time.Time) (dividends []Dividend, err error) {
+	return p.GetDividendsContext(context.Background(), symbol, startDate, endDate)
+}
+
+// Gets all dividends for a symbol with ex-dates between startDate and endDate.
+func (p *Provider) GetDividendsContext(ctx context.Context, symbol string, startDate, endDate time.Time) (dividends []Dividend, err error) {
+	rows, err := p.getActions(ctx, symbol, startDate, endDate)
+	if err != nil {
+		return
+	}
+
+	dividends = make([]Dividend, 0, len(rows))
+	for _, r := range rows {
+		if strings.TrimSpace(r.Col0) != "DIVIDEND" {
+			continue
+		}
+
+		date, err := actionDate(r.Col1)
+		if err != nil {
+			return nil, &ResponseError{Msg: "invalid dividend date", Err: err}
+		}
+		amount, err := ParsePrice(symbol, "Dividend", r.Col2)
+		if err != nil {
+			return nil, err
+		}
+
+		dividends = append(dividends, Dividend{
+			Symbol: symbol,
+			Date:   date,
+			Amount: amount.FloatString(6),
+		})
+	}
+
+	return dividends, nil
+}
+
+// Gets all stock splits for a symbol between startDate and endDate.
+func GetSplits(symbol string, startDate, endDate time.Time) (splits []Split, err error) {
+	return DefaultProvider.GetSplits(symbol, startDate, endDate)
+}
+
+// Gets all stock splits for a symbol between startDate and endDate.
+func GetSplitsContext(ctx context.Context, symbol string, startDate, endDate time.Time) (splits []Split, err error) {
+	return DefaultProvider.GetSplitsContext(ctx, symbol, startDate, endDate)
+}
+
+// Gets all stock splits for a symbol between startDate and endDate.
+func (p *Provider) GetSplits(symbol string, startDate, endDate time.Time) (splits []Split, err error) {
+	return p.GetSplitsContext(context.Background(), symbol, startDate, endDate)
+}
+
+// Gets all stock splits for a symbol between startDate and endDate.
+func (p *Provider) GetSplitsContext(ctx context.Context, symbol string, startDate, endDate time.Time) (splits []Split, err error) {
+	rows, err := p.getActions(ctx, symbol, startDate, endDate)
+	if err != nil {
+		return
+	}
+
+	splits = make([]Split, 0, 1)
+	for _, r := range rows {
+		if strings.TrimSpace(r.Col0) != "SPLIT" {
+			continue
+		}
+
+		date, err := actionDate(r.Col1)
+		if err != nil {
+			return nil, &ResponseError{Msg: "invalid split date", Err: err}
+		}
+		num, den, err := ParseSplitRatio(r.Col2)
+		if err != nil {
+			return nil, &ResponseError{Msg: "invalid split", Err: err}
+		}
+
+		splits = append(splits, Split{
+			Symbol:      symbol,
+			Date:        date,
+			Numerator:   num,
+			Denominator: den,
+		})
+	}
+
+	return splits, nil
+}
@@ -0,0 +1,104 @@
+package yql
+
+// general stuff:
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// A YQL response body that could not be decoded.
+type ResponseError struct {
+	Msg string
+	Err error // underlying JSON error, if any
+}
+
+func (e *ResponseError) Error() string {
+	if e.Err == nil {
+		return "yql: " + e.Msg
+	}
+	return fmt.Sprintf("yql: %s: %s", e.Msg, e.Err)
+}
+
+// A quote field that does not hold a usable number, e.g. "N/A" for a halted or unknown symbol.
+type PriceError struct {
+	Symbol string
+	Field  string
+	Value  string
+}
+
+func (e *PriceError) Error() string {
+	return fmt.Sprintf("yql: %s: %s is not a price: '%s'", e.Symbol, e.Field, e.Value)
+}
+
+// Quotes rejected from a batch; the other quotes in the batch are still returned alongside this error.
+type PriceErrors []*PriceError
+
+func (e PriceErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, pe := range e {
+		msgs = append(msgs, pe.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Parses a plain decimal number such as "36.80" or "-0.5" into a `*big.Rat`.
+// Anything else, including "N/A", the empty string and fractions like "1/2", is rejected with a `*PriceError`.
+func ParsePrice(symbol, field, value string) (*big.Rat, error) {
+	s := strings.TrimSpace(value)
+
+	// Validate the format ourselves since `big.Rat.SetString` also accepts fractions and exponents:
+	if !isDecimal(s) {
+		return nil, &PriceError{Symbol: symbol, Field: field, Value: value}
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, &PriceError{Symbol: symbol, Field: field, Value: value}
+	}
+	return r, nil
+}
+
+// Parses an optional price; "N/A", blanks and other non-numbers yield nil.
+func parseOptionalPrice(value string) *big.Rat {
+	r, err := ParsePrice("", "", value)
+	if err != nil {
+		return nil
+	}
+	return r
+}
+
+// Parses an optional share volume; "N/A", blanks and other non-integers yield nil.
+func parseOptionalVolume(value string) *big.Int {
+	s := strings.TrimSpace(value)
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return nil
+		}
+	}
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil
+	}
+	return v
+}
+
+// Checks for an optionally signed string of digits with at most one decimal point:
+func isDecimal(s string) bool {
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+
+	digits, dot := 0, false
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.' && !dot:
+			dot = true
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
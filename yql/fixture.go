@@ -0,0 +1,99 @@
+package yql
+
+// general stuff:
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// networking:
+import "io/ioutil"
+import "net/http"
+
+// Gets the path of the recorded response file for YQL query `q` within `dir`.
+func FixturePath(dir, q string) string {
+	h := sha1.Sum([]byte(q))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".json")
+}
+
+// Extracts the YQL query from a request URL:
+func requestQuery(req *http.Request) string {
+	return req.URL.Query().Get("q")
+}
+
+// ------------- recording:
+
+// Recorder is an `http.RoundTripper` that passes YQL requests through to `Transport` and saves
+// each successful response body to `Dir`, keyed by query. Use it as `Client.Transport`.
+type Recorder struct {
+	Dir       string
+	Transport http.RoundTripper // defaults to http.DefaultTransport
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	t := r.Transport
+	if t == nil {
+		t = http.DefaultTransport
+	}
+
+	resp, err = t.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		return
+	}
+
+	// Read the whole body so we can save it and hand a copy back to the caller:
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err = os.MkdirAll(r.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(FixturePath(r.Dir, requestQuery(req)), body, 0644); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// ------------- replaying:
+
+// Replayer is an `http.RoundTripper` that serves YQL response bodies previously saved by a `Recorder`
+// from `Dir`. It never touches the network; queries without a recorded response fail.
+type Replayer struct {
+	Dir string
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	q := requestQuery(req)
+	body, err := ioutil.ReadFile(FixturePath(r.Dir, q))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recorded YQL response for query: %s", q)
+	} else if err != nil {
+		return nil, err
+	}
+
+	resp = &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	resp.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return resp, nil
+}
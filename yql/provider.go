@@ -0,0 +1,217 @@
+package yql
+
+// general stuff:
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Our own packages:
+import (
+	"github.com/JamesDunne/StockWatcher/market"
+)
+
+// networking:
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/url"
+
+// Public YQL endpoint:
+const DefaultBaseURL = "http://query.yahooapis.com/v1/public/yql"
+
+// Provider fetches current quotes and daily trading history from YQL.
+//
+// The zero value is usable and uses the package `Client` and `DefaultBaseURL` with no timeout,
+// no retries and no rate limiting; `NewProvider` returns a provider with sensible defaults.
+type Provider struct {
+	// HTTP client to use; defaults to the package `Client`.
+	Client *http.Client
+	// YQL endpoint URL; defaults to `DefaultBaseURL`.
+	BaseURL string
+
+	// Time limit for each HTTP request, including reading the body; 0 means no limit.
+	Timeout time.Duration
+	// Number of times to retry a request that failed with a network error or 5xx status.
+	MaxRetries int
+	// Delay before the first retry; doubled for each retry after that.
+	Backoff time.Duration
+	// Minimum time between the starts of consecutive requests; 0 means no limit.
+	RateLimit time.Duration
+	// Maximum number of concurrent queries issued by `GetHistory`; 0 means 1.
+	MaxParallel int
+	// Exchange calendar used to skip history queries with no trading days; defaults to `market.NYSE`.
+	Calendar *market.TradingCalendar
+
+	limiterOnce sync.Once
+	limiter     *rateLimiter
+}
+
+// Creates a provider with a request timeout, retries with exponential backoff and a client-side rate limit.
+func NewProvider() *Provider {
+	return &Provider{
+		Timeout:     time.Second * time.Duration(30),
+		MaxRetries:  3,
+		Backoff:     time.Second,
+		RateLimit:   time.Millisecond * time.Duration(250),
+		MaxParallel: 4,
+	}
+}
+
+func (p *Provider) client() *http.Client {
+	c := p.Client
+	if c == nil {
+		c = Client
+	}
+	if p.Timeout <= 0 {
+		return c
+	}
+
+	// Shallow copy so we don't alter the shared client's timeout:
+	tc := *c
+	tc.Timeout = p.Timeout
+	return &tc
+}
+
+func (p *Provider) baseURL() string {
+	if p.BaseURL == "" {
+		return DefaultBaseURL
+	}
+	return p.BaseURL
+}
+
+func (p *Provider) maxParallel() int {
+	if p.MaxParallel <= 0 {
+		return 1
+	}
+	return p.MaxParallel
+}
+
+func (p *Provider) calendar() *market.TradingCalendar {
+	if p.Calendar == nil {
+		return market.NYSE
+	}
+	return p.Calendar
+}
+
+// Waits until the rate limiter allows another request or `ctx` is done:
+func (p *Provider) wait(ctx context.Context) error {
+	p.limiterOnce.Do(func() {
+		p.limiter = &rateLimiter{interval: p.RateLimit}
+	})
+	return p.limiter.wait(ctx)
+}
+
+// Fetches the body of a successful JSON response from `u`, retrying on network errors and 5xx statuses
+// until `ctx` is done:
+func (p *Provider) fetch(ctx context.Context, u string) (body []byte, err error) {
+	delay := p.Backoff
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		body, retry, err = p.fetchOnce(ctx, u)
+		if err == nil || !retry || attempt >= p.MaxRetries || ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("yql: %s; retrying in %s\n", err, delay)
+		if err = sleep(ctx, delay); err != nil {
+			return
+		}
+		delay *= 2
+	}
+}
+
+// Makes a single request; `retry` reports whether the failure is worth retrying.
+func (p *Provider) fetchOnce(ctx context.Context, u string) (body []byte, retry bool, err error) {
+	if err = p.wait(ctx); err != nil {
+		return nil, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, isTransient(err), err
+	}
+
+	// read body:
+	defer resp.Body.Close()
+
+	// Need a 200 response:
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("%s", resp.Status)
+		return nil, resp.StatusCode >= 500, err
+	}
+	if hp, ok := resp.Header["Content-Type"]; ok && len(hp) > 0 {
+		if strings.Split(hp[0], ";")[0] != "application/json" {
+			err = fmt.Errorf("Expected JSON content-type: %s", hp[0])
+			return nil, false, err
+		}
+	}
+
+	// Read the whole response body into memory:
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return body, false, nil
+}
+
+// Determines if a request error came from the network (including timeouts) rather than e.g. a bad URL:
+func isTransient(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// ------------- rate limiting:
+
+// Spaces out requests so that no two start within `interval` of each other.
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l.interval <= 0 {
+		return ctx.Err()
+	}
+
+	// Reserve the next slot:
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.lock.Unlock()
+
+	return sleep(ctx, delay)
+}
+
+// Sleeps for `d` unless `ctx` is done first:
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
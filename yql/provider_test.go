@@ -0,0 +1,286 @@
+package yql
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const quoteBody = `{"query":{"count":1,"created":"2013-12-26T04:12:41Z","lang":"en-US","results":{"quote":{"Symbol":"MSFT","LastTradePriceOnly":"36.80"}}}}`
+
+// Creates a provider pointed at a test server with fast retries:
+func testProvider(srv *httptest.Server) *Provider {
+	return &Provider{
+		Client:      srv.Client(),
+		BaseURL:     srv.URL,
+		MaxRetries:  3,
+		Backoff:     time.Millisecond,
+		MaxParallel: 2,
+	}
+}
+
+func TestProviderRetriesServerErrors(t *testing.T) {
+	lock := sync.Mutex{}
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls++
+		n := calls
+		lock.Unlock()
+
+		// Fail the first two requests:
+		if n <= 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(quoteBody))
+	}))
+	defer srv.Close()
+
+	quote, err := testProvider(srv).GetQuote("MSFT")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if quote == nil || quote.Price.FloatString(2) != "36.80" {
+		t.Fatalf("unexpected quote: %+v", quote)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 requests; got %d", calls)
+	}
+}
+
+func TestProviderGivesUpAfterMaxRetries(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	_, err := testProvider(srv).GetQuote("MSFT")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 4 {
+		t.Fatalf("expected 1 request + 3 retries; got %d", calls)
+	}
+}
+
+func TestProviderDoesNotRetryClientErrors(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "bad query", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	_, err := testProvider(srv).GetQuote("MSFT")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 request; got %d", calls)
+	}
+}
+
+func TestProviderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the test is over:
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p := testProvider(srv)
+	p.Timeout = time.Millisecond * time.Duration(50)
+	p.MaxRetries = 1
+
+	start := time.Now()
+	_, err := p.GetQuote("MSFT")
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		t.Fatalf("request took too long to time out: %s", elapsed)
+	}
+}
+
+func TestProviderRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(quoteBody))
+	}))
+	defer srv.Close()
+
+	p := testProvider(srv)
+	p.RateLimit = time.Millisecond * time.Duration(20)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := p.GetQuote("MSFT"); err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+
+	// 4 requests need at least 3 intervals between them:
+	if elapsed := time.Now().Sub(start); elapsed < time.Millisecond*time.Duration(60) {
+		t.Fatalf("requests were not rate limited: %s", elapsed)
+	}
+}
+
+func TestProviderRejectsUnavailablePrices(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"query":{"count":2,"created":"2013-12-26T04:12:41Z","lang":"en-US","results":{"quote":[{"Symbol":"MSFT","LastTradePriceOnly":"36.80"},{"Symbol":"HALT","LastTradePriceOnly":"N/A"}]}}}`))
+	}))
+	defer srv.Close()
+
+	quotes, err := testProvider(srv).GetQuotes("MSFT", "HALT")
+	rejected, ok := err.(PriceErrors)
+	if !ok {
+		t.Fatalf("expected PriceErrors; got %#v", err)
+		return
+	}
+	if len(rejected) != 1 || rejected[0].Symbol != "HALT" {
+		t.Fatalf("unexpected rejections: %s", rejected)
+	}
+
+	// The good quote is still returned:
+	if len(quotes) != 1 || quotes[0].Symbol != "MSFT" {
+		t.Fatalf("unexpected quotes: %+v", quotes)
+	}
+}
+
+func TestProviderHistoryParallelism(t *testing.T) {
+	lock := sync.Mutex{}
+	active, maxActive := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond * time.Duration(10))
+
+		lock.Lock()
+		active--
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"query":{"count":0,"created":"2013-12-26T04:12:41Z","lang":"en-US","results":null}}`))
+	}))
+	defer srv.Close()
+
+	// Five yearly queries:
+	startDate, _ := time.Parse(dateFmt, "2009-01-01")
+	endDate, _ := time.Parse(dateFmt, "2013-12-25")
+	if _, err := testProvider(srv).GetHistory("MSFT", startDate, endDate); err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	if maxActive > 2 {
+		t.Fatalf("expected at most 2 concurrent queries; saw %d", maxActive)
+	}
+}
+
+func TestProviderHistoryCancellation(t *testing.T) {
+	lock := sync.Mutex{}
+	started := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		started++
+		lock.Unlock()
+
+		// Slower than the caller is willing to wait:
+		select {
+		case <-time.After(time.Second * time.Duration(10)):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(50))
+	defer cancel()
+
+	// Five yearly queries, two at a time:
+	startDate, _ := time.Parse(dateFmt, "2009-01-01")
+	endDate, _ := time.Parse(dateFmt, "2013-12-25")
+	begin := time.Now()
+	_, err := testProvider(srv).GetHistoryContext(ctx, "MSFT", startDate, endDate)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded; got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("expected cancellation to stop the queries; took %s", elapsed)
+	}
+
+	// Queries waiting for a free slot never start:
+	lock.Lock()
+	defer lock.Unlock()
+	if started > 2 {
+		t.Fatalf("expected at most 2 queries started; saw %d", started)
+	}
+}
+
+func TestProviderRetryCancellation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	// Backoff far longer than the deadline:
+	p := testProvider(srv)
+	p.Backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(50))
+	defer cancel()
+
+	begin := time.Now()
+	if _, err := p.GetQuoteContext(ctx, "MSFT"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded; got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("expected cancellation to stop retrying; took %s", elapsed)
+	}
+}
+
+func TestProviderDividendsAndSplits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"query":{"count":3,"created":"2013-12-26T04:12:41Z","lang":"en-US","results":{"row":[{"col0":"DIVIDEND","col1":" 20131119","col2":"0.280000"},{"col0":"SPLIT","col1":" 20030218","col2":"2:1"},{"col0":"STARTDATE","col1":" 20000101","col2":null}]}}}`))
+	}))
+	defer srv.Close()
+
+	p := testProvider(srv)
+	startDate, _ := time.Parse(dateFmt, "2000-01-01")
+	endDate, _ := time.Parse(dateFmt, "2013-12-25")
+
+	dividends, err := p.GetDividends("MSFT", startDate, endDate)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(dividends) != 1 || dividends[0].Date != "2013-11-19" || dividends[0].Amount != "0.280000" {
+		t.Fatalf("unexpected dividends: %+v", dividends)
+	}
+
+	splits, err := p.GetSplits("MSFT", startDate, endDate)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(splits) != 1 || splits[0].Date != "2003-02-18" || splits[0].Numerator != 2 || splits[0].Denominator != 1 {
+		t.Fatalf("unexpected splits: %+v", splits)
+	}
+}
@@ -2,19 +2,18 @@ package yql
 
 // general stuff:
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"math/big"
-	"reflect"
 	"sort"
 	"strings"
 	"time"
 )
 
 // networking:
-import "io/ioutil"
 import "net/http"
 import "net/url"
 
@@ -22,6 +21,15 @@ import "net/url"
 
 const dateFmt = "2006-01-02"
 
+// ------------- public configuration:
+
+// Default HTTP client used for YQL requests by providers that don't set their own. Set its Transport
+// to a `Recorder` or `Replayer` to capture live responses to disk or serve them back without touching the network.
+var Client = &http.Client{}
+
+// Provider used by the package-level query functions:
+var DefaultProvider = NewProvider()
+
 // Head to http://developer.yahoo.com/yql/console/?q=select%20*%20from%20yahoo.finance.quote%20where%20symbol%20in%20(%22YHOO%22%2C%22AAPL%22%2C%22GOOG%22%2C%22MSFT%22)&env=store%3A%2F%2Fdatatables.org%2Falltableswithkeys
 // to understand this JSON structure.
 
@@ -29,9 +37,17 @@ type yqlResponse struct {
 	Query struct {
 		Count       int    `json:"count"`
 		CreatedDate string `json:"created"`
-		// TODO(jsd): Use `*json.RawMessage` type instead.
-		Results map[string]interface{} `json:"results"`
+		Results     *struct {
+			// Either a single object or an array of objects:
+			Quote json.RawMessage `json:"quote"`
+			// Same as `quote` but from the `csv` table:
+			Row json.RawMessage `json:"row"`
+		} `json:"results"`
 	} `json:"query"`
+	// Reported instead of `query` for bad queries:
+	Error *struct {
+		Description string `json:"description"`
+	} `json:"error"`
 }
 
 type History struct {
@@ -44,118 +60,80 @@ type History struct {
 	Volume string
 }
 
-func validateResultsType(results interface{}) (structType reflect.Type) {
-	if results == nil {
-		panic(errors.New("results cannot be nil"))
-	}
-	rt := reflect.TypeOf(results)
-	if rt.Kind() != reflect.Ptr {
-		panic(errors.New("results must be a pointer"))
-	}
-	rtp := rt.Elem()
-	if rtp.Kind() != reflect.Slice {
-		panic(errors.New("results must be a pointer to a slice"))
-	}
-	structType = rtp.Elem()
-	if structType.Kind() != reflect.Struct {
-		panic(errors.New("results must be a pointer to a slice of structs"))
-	}
-	return
-}
-
-func extractResponse(body []byte, results interface{}, structType reflect.Type) (err error) {
-	if structType == nil {
-		structType = validateResultsType(results)
-	}
-
-	// results is now guaranteed to be a pointer to a slice of structs.
-	sliceValue := reflect.ValueOf(results).Elem()
-
+// Decodes the `quote` results of a YQL response body into `results`, which must be a pointer to a slice of structs
+// whose string fields are named after the YQL columns selected. The slice is left alone if there are no results.
+func extractResponse(body []byte, results interface{}) (err error) {
 	// decode JSON response body:
 	yrsp := new(yqlResponse)
 	err = json.Unmarshal(body, yrsp)
 	if err != nil {
 		// debugging info:
 		log.Printf("response: %s\n", body)
-		return
+		return &ResponseError{Msg: "invalid response body", Err: err}
 	}
 
-	// Decode the Results map as either an array of objects or a single object:
-	quote := yrsp.Query.Results["quote"]
-	if quote == nil {
-		// TODO(jsd): clear the sliceValue pointer to nil?
-		return
+	if yrsp.Error != nil {
+		return &ResponseError{Msg: yrsp.Error.Description}
 	}
 
-	switch t := quote.(type) {
+	// No results?
+	if yrsp.Query.Results == nil {
+		return nil
+	}
+	quote := bytes.TrimSpace(yrsp.Query.Results.Quote)
+	if len(quote) == 0 {
+		quote = bytes.TrimSpace(yrsp.Query.Results.Row)
+	}
+	if len(quote) == 0 || bytes.Equal(quote, []byte("null")) {
+		return nil
+	}
+
+	// Decode the quote as either an array of objects or a single object:
+	switch quote[0] {
+	case '[':
+		// Decode straight into the slice.
+	case '{':
+		// Wrap the single object in an array:
+		quote = append(append([]byte{'['}, quote...), ']')
 	default:
-		panic(errors.New("unexpected JSON result type for 'quote'"))
-	case []interface{}:
-		sl := sliceValue
-		for j, n := range t {
-			// Append to the slice for each array element:
-			m := n.(map[string]interface{})
-			sl = reflect.Append(sl, reflect.Zero(structType))
-			el := sl.Index(j)
-			for i := 0; i < structType.NumField(); i++ {
-				f := structType.Field(i)
-				if v, ok := m[f.Name]; ok {
-					el.Field(i).Set(reflect.ValueOf(v))
-				}
-			}
-		}
-		sliceValue.Set(sl)
-	case map[string]interface{}:
-		// Insert the only element of the slice:
-		sl := reflect.Append(sliceValue, reflect.Zero(structType))
-		el0 := sl.Index(0)
-		for i := 0; i < structType.NumField(); i++ {
-			f := structType.Field(i)
-			if v, ok := t[f.Name]; ok {
-				el0.Field(i).Set(reflect.ValueOf(v))
-			}
-		}
-		sliceValue.Set(sl)
+		return &ResponseError{Msg: fmt.Sprintf("unexpected JSON result type for 'quote': %.40s", quote)}
 	}
 
-	return
+	if err = json.Unmarshal(quote, results); err != nil {
+		return &ResponseError{Msg: "invalid 'quote' results", Err: err}
+	}
+
+	return nil
 }
 
 // `q` is the YQL query
 func Get(results interface{}, q string) (err error) {
-	// Validate type of `results`:
-	structType := validateResultsType(results)
+	return DefaultProvider.Get(results, q)
+}
 
-	// form the YQL URL:
-	u := `http://query.yahooapis.com/v1/public/yql?q=` + url.QueryEscape(q) + `&format=json&env=store%3A%2F%2Fdatatables.org%2Falltableswithkeys`
-	resp, err := http.Get(u)
-	if err != nil {
-		return
-	}
+// `q` is the YQL query
+func GetContext(ctx context.Context, results interface{}, q string) (err error) {
+	return DefaultProvider.GetContext(ctx, results, q)
+}
 
-	// read body:
-	defer resp.Body.Close()
+// `q` is the YQL query
+func (p *Provider) Get(results interface{}, q string) (err error) {
+	return p.GetContext(context.Background(), results, q)
+}
 
-	// Need a 200 response:
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf("%s", resp.Status)
-		return
-	}
-	if hp, ok := resp.Header["Content-Type"]; ok && len(hp) > 0 {
-		if strings.Split(hp[0], ";")[0] != "application/json" {
-			err = fmt.Errorf("Expected JSON content-type: %s", hp[0])
-			return
-		}
-	}
+// `q` is the YQL query; the request is abandoned when `ctx` is done.
+func (p *Provider) GetContext(ctx context.Context, results interface{}, q string) (err error) {
+	// form the YQL URL:
+	u := p.baseURL() + `?q=` + url.QueryEscape(q) + `&format=json&env=store%3A%2F%2Fdatatables.org%2Falltableswithkeys`
 
-	// Read the whole response body into memory:
-	body, err := ioutil.ReadAll(resp.Body)
+	// Fetch the response body, retrying on transient failures:
+	body, err := p.fetch(ctx, u)
 	if err != nil {
 		return
 	}
 
 	// Extract the unstable JSON structure's results field as an array:
-	err = extractResponse(body, results, structType)
+	err = extractResponse(body, results)
 	if err != nil {
 		// debugging info:
 		log.Printf("query:    %s\n", q)
@@ -195,16 +173,70 @@ func (l *yearQueryResultList) Swap(i, j int) {
 type Quote struct {
 	Symbol string
 	Price  *big.Rat
+
+	// Optional details; nil when not reported:
+	Bid           *big.Rat
+	Ask           *big.Rat
+	DayHigh       *big.Rat
+	DayLow        *big.Rat
+	PreviousClose *big.Rat
+	Volume        *big.Int
+	ChangePercent *big.Rat
+}
+
+// Columns selected from yahoo.finance.quotes:
+const quoteCols = `Symbol, LastTradePriceOnly, Bid, Ask, DaysHigh, DaysLow, PreviousClose, Volume, ChangeinPercent`
+
+type quoteRow struct {
+	Symbol             string
+	LastTradePriceOnly string
+	Bid                string
+	Ask                string
+	DaysHigh           string
+	DaysLow            string
+	PreviousClose      string
+	Volume             string
+	ChangeinPercent    string
+}
+
+// Converts a raw quote row; only the last trade price is required to be a number.
+func (q quoteRow) toQuote() (quote Quote, err error) {
+	// Reject "N/A" and other non-numeric prices:
+	price, err := ParsePrice(q.Symbol, "LastTradePriceOnly", q.LastTradePriceOnly)
+	if err != nil {
+		return
+	}
+
+	quote = Quote{
+		Symbol:        q.Symbol,
+		Price:         price,
+		Bid:           parseOptionalPrice(q.Bid),
+		Ask:           parseOptionalPrice(q.Ask),
+		DayHigh:       parseOptionalPrice(q.DaysHigh),
+		DayLow:        parseOptionalPrice(q.DaysLow),
+		PreviousClose: parseOptionalPrice(q.PreviousClose),
+		Volume:        parseOptionalVolume(q.Volume),
+		// e.g. "+0.68%":
+		ChangePercent: parseOptionalPrice(strings.TrimSuffix(strings.TrimSpace(q.ChangeinPercent), "%")),
+	}
+	return
 }
 
 // Gets the current trading price for a symbol.
 func GetQuote(symbol string) (quote *Quote, err error) {
-	quot := make([]struct {
-		Symbol             string
-		LastTradePriceOnly string
-	}, 0, 1)
-	query := fmt.Sprintf(`select Symbol, LastTradePriceOnly from yahoo.finance.quote where symbol = "%s"`, symbol)
-	err = Get(&quot, query)
+	return DefaultProvider.GetQuote(symbol)
+}
+
+// Gets the current trading price for a symbol.
+func (p *Provider) GetQuote(symbol string) (quote *Quote, err error) {
+	return p.GetQuoteContext(context.Background(), symbol)
+}
+
+// Gets the current trading price for a symbol.
+func (p *Provider) GetQuoteContext(ctx context.Context, symbol string) (quote *Quote, err error) {
+	quot := make([]quoteRow, 0, 1)
+	query := fmt.Sprintf(`select %s from yahoo.finance.quotes where symbol = "%s"`, quoteCols, symbol)
+	err = p.GetContext(ctx, &quot, query)
 	if err != nil {
 		return
 	}
@@ -214,27 +246,39 @@ func GetQuote(symbol string) (quote *Quote, err error) {
 		return nil, nil
 	}
 
-	quote = &Quote{
-		Symbol: quot[0].Symbol,
-		Price:  new(big.Rat),
+	q, err := quot[0].toQuote()
+	if err != nil {
+		return nil, err
 	}
-	quote.Price.SetString(quot[0].LastTradePriceOnly)
-	return quote, nil
+	return &q, nil
 }
 
 // Gets the current trading prices for a set of symbols.
 func GetQuotes(symbols ...string) (quotes []Quote, err error) {
+	return DefaultProvider.GetQuotes(symbols...)
+}
+
+// Gets the current trading prices for a set of symbols.
+func GetQuotesContext(ctx context.Context, symbols ...string) (quotes []Quote, err error) {
+	return DefaultProvider.GetQuotesContext(ctx, symbols...)
+}
+
+// Gets the current trading prices for a set of symbols.
+func (p *Provider) GetQuotes(symbols ...string) (quotes []Quote, err error) {
+	return p.GetQuotesContext(context.Background(), symbols...)
+}
+
+// Gets the current trading prices for a set of symbols.
+// Symbols with "N/A" or otherwise non-numeric prices are left out of `quotes` and reported in a `PriceErrors` error.
+func (p *Provider) GetQuotesContext(ctx context.Context, symbols ...string) (quotes []Quote, err error) {
 	if len(symbols) == 0 {
 		return []Quote{}, nil
 	}
 
-	quot := make([]struct {
-		Symbol             string
-		LastTradePriceOnly string
-	}, 0, len(symbols))
+	quot := make([]quoteRow, 0, len(symbols))
 
 	// Build query:
-	query := `select Symbol, LastTradePriceOnly from yahoo.finance.quote where symbol in (`
+	query := `select ` + quoteCols + ` from yahoo.finance.quotes where symbol in (`
 	for i, symbol := range symbols {
 		if i > 0 {
 			query += `,`
@@ -244,7 +288,7 @@ func GetQuotes(symbols ...string) (quotes []Quote, err error) {
 	query += `)`
 
 	// Execute query:
-	err = Get(&quot, query)
+	err = p.GetContext(ctx, &quot, query)
 	if err != nil {
 		return
 	}
@@ -255,25 +299,47 @@ func GetQuotes(symbols ...string) (quotes []Quote, err error) {
 
 	// Project into results:
 	quotes = make([]Quote, 0, len(quot))
+	rejected := PriceErrors(nil)
 	for _, q := range quot {
-		quote := Quote{
-			Symbol: q.Symbol,
-			Price:  new(big.Rat),
+		quote, err := q.toQuote()
+		if err != nil {
+			rejected = append(rejected, err.(*PriceError))
+			continue
 		}
-		quote.Price.SetString(q.LastTradePriceOnly)
+
 		quotes = append(quotes, quote)
 	}
 
+	if len(rejected) > 0 {
+		return quotes, rejected
+	}
 	return quotes, nil
 }
 
 // Gets all historical data for a symbol between startDate and endDate.
 func GetHistory(symbol string, startDate, endDate time.Time) (results []History, err error) {
+	return DefaultProvider.GetHistory(symbol, startDate, endDate)
+}
+
+// Gets all historical data for a symbol between startDate and endDate.
+func GetHistoryContext(ctx context.Context, symbol string, startDate, endDate time.Time) (results []History, err error) {
+	return DefaultProvider.GetHistoryContext(ctx, symbol, startDate, endDate)
+}
+
+// Gets all historical data for a symbol between startDate and endDate.
+func (p *Provider) GetHistory(symbol string, startDate, endDate time.Time) (results []History, err error) {
+	return p.GetHistoryContext(context.Background(), symbol, startDate, endDate)
+}
+
+// Gets all historical data for a symbol between startDate and endDate.
+// When `ctx` is done, queries not yet started are skipped and those in flight are abandoned.
+func (p *Provider) GetHistoryContext(ctx context.Context, symbol string, startDate, endDate time.Time) (results []History, err error) {
 	// NOTE(jsd): YQL queries over stocks only respond to queries requesting up to 365 date records; results is nil otherwise.
 	days := int(endDate.Sub(startDate) / (time.Duration(24) * time.Hour))
 
-	// TODO(jsd): Subtract weekend dates (and holidays).
-	results = make([]History, 0, days)
+	// Skip weekends and holidays:
+	cal := p.calendar()
+	results = make([]History, 0, cal.TradingDays(startDate, endDate))
 
 	count := days / 365
 	if (days % 365) > 0 {
@@ -289,6 +355,13 @@ func GetHistory(symbol string, startDate, endDate time.Time) (results []History,
 			qendDate = endDate
 		}
 
+		date = date.Add(time.Duration(365*24) * time.Hour)
+
+		// No need to ask for a range with no trading days in it:
+		if cal.TradingDays(qstartDate, qendDate) == 0 {
+			continue
+		}
+
 		// TODO(jsd): YQL parameter escaping!
 		queries = append(
 			queries,
@@ -298,17 +371,24 @@ func GetHistory(symbol string, startDate, endDate time.Time) (results []History,
 				qendDate.Format(dateFmt),
 			),
 		)
-
-		date = date.Add(time.Duration(365*24) * time.Hour)
 	}
 
-	// Run the queries in parallel:
-	queryResults := make(chan yearQueryResult)
+	// Run the queries in parallel, at most `MaxParallel` at a time; buffered so no query blocks on sending its result:
+	queryResults := make(chan yearQueryResult, len(queries))
+	sem := make(chan struct{}, p.maxParallel())
 	for i, q := range queries {
 		go func(i int, q string) {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				queryResults <- yearQueryResult{Year: i, Error: ctx.Err()}
+				return
+			}
+			defer func() { <-sem }()
+
 			res := make([]History, 0, 364)
 
-			err := Get(&res, q)
+			err := p.GetContext(ctx, &res, q)
 			if err != nil {
 				queryResults <- yearQueryResult{
 					Year:    i,
@@ -326,8 +406,8 @@ func GetHistory(symbol string, startDate, endDate time.Time) (results []History,
 	}
 
 	// Collect the query results:
-	list := &yearQueryResultList{items: make([]yearQueryResult, 0, count)}
-	for i := 0; i < count; i++ {
+	list := &yearQueryResultList{items: make([]yearQueryResult, 0, len(queries))}
+	for i := 0; i < len(queries); i++ {
 		r := <-queryResults
 		list.items = append(list.items, r)
 	}
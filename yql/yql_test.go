@@ -1,11 +1,37 @@
 package yql
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
-	//	"time"
+	"time"
 )
 
+// Recorded YQL responses live here:
+const fixtureDir = "./testdata"
+
+var record = flag.Bool("record", false, "record live YQL responses into "+fixtureDir+" instead of replaying them")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	// No need to be polite to the replayer:
+	DefaultProvider.RateLimit = 0
+
+	// Replay recorded responses by default so tests run deterministically without network:
+	if *record {
+		Client.Transport = &Recorder{Dir: fixtureDir}
+	} else {
+		Client.Transport = &Replayer{Dir: fixtureDir}
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestYqlExtractResponseArray(t *testing.T) {
 	hist := make([]History, 0, 1)
 
@@ -13,7 +39,7 @@ func TestYqlExtractResponseArray(t *testing.T) {
 	body := `{"query":{"count":1,"created":"2013-12-22T05:22:05Z","lang":"en-US","results":{"quote":[{"Symbol":"MSFT","Close":"36.80","Volume":"62649100","Date":"2013-12-20","Open":"36.20","High":"36.93","Low":"36.19"}]}}}`
 
 	// Test decoding the JSON:
-	if err := extractResponse([]byte(body), &hist, nil); err != nil {
+	if err := extractResponse([]byte(body), &hist); err != nil {
 		t.Fatal(err)
 		return
 	}
@@ -28,7 +54,7 @@ func TestYqlExtractResponseObject(t *testing.T) {
 	body := `{"query":{"count":1,"created":"2013-12-22T05:22:05Z","lang":"en-US","results":{"quote":{"Symbol":"MSFT","Close":"36.80","Volume":"62649100","Date":"2013-12-20","Open":"36.20","High":"36.93","Low":"36.19"}}}}`
 
 	// Test decoding the JSON:
-	if err := extractResponse([]byte(body), &hist, nil); err != nil {
+	if err := extractResponse([]byte(body), &hist); err != nil {
 		t.Fatal(err)
 		return
 	}
@@ -36,12 +62,86 @@ func TestYqlExtractResponseObject(t *testing.T) {
 	fmt.Println(hist)
 }
 
+// Feeds previously captured response bodies through extractResponse; "bad-*" files must be rejected with a
+// *ResponseError and "ok-*" files must decode cleanly:
+func TestYqlExtractResponseRegressions(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(fixtureDir, "regress", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+
+		hist := make([]History, 0, 1)
+		err = extractResponse(body, &hist)
+		if strings.HasPrefix(filepath.Base(file), "bad-") {
+			if _, ok := err.(*ResponseError); !ok {
+				t.Fatalf("%s: expected *ResponseError; got %#v", file, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+	}
+}
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		Value string
+		Valid bool
+		Price string
+	}{
+		{"36.80", true, "36.80"},
+		{" 549.02 ", true, "549.02"},
+		{"-0.5", true, "-0.50"},
+		{"+12", true, "12.00"},
+		{"N/A", false, ""},
+		{"", false, ""},
+		{".", false, ""},
+		{"1/2", false, ""},
+		{"1e3", false, ""},
+		{"1.2.3", false, ""},
+	}
+
+	for _, test := range tests {
+		price, err := ParsePrice("MSFT", "LastTradePriceOnly", test.Value)
+		if !test.Valid {
+			if _, ok := err.(*PriceError); !ok {
+				t.Fatalf("'%s': expected *PriceError; got %#v", test.Value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("'%s': %s", test.Value, err)
+		}
+		if price.FloatString(2) != test.Price {
+			t.Fatalf("'%s': expected %s; got %s", test.Value, test.Price, price.FloatString(2))
+		}
+	}
+}
+
 func TestGetQuote(t *testing.T) {
 	quote, err := GetQuote("MSFT")
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
+	if quote == nil || quote.Symbol != "MSFT" {
+		t.Fatalf("unexpected quote: %+v", quote)
+		return
+	}
+	if quote.Bid.FloatString(2) != "36.79" || quote.Ask.FloatString(2) != "36.81" ||
+		quote.DayHigh.FloatString(2) != "36.93" || quote.DayLow.FloatString(2) != "36.19" ||
+		quote.PreviousClose.FloatString(2) != "36.25" || quote.Volume.String() != "62649100" ||
+		quote.ChangePercent.FloatString(2) != "1.52" {
+		t.Fatalf("unexpected quote details: %+v", quote)
+		return
+	}
 
 	fmt.Printf("quote: %+v\n", quote)
 }
@@ -72,21 +172,42 @@ func TestGetQuotesMulti(t *testing.T) {
 		t.Fatal(err)
 		return
 	}
+	if len(quotes) != 2 {
+		t.Fatalf("expected 2 quotes; got %d", len(quotes))
+		return
+	}
+
+	// Missing bid/ask are left nil rather than zero:
+	if quotes[1].Bid != nil || quotes[1].Ask != nil {
+		t.Fatalf("expected no bid/ask: %+v", quotes[1])
+		return
+	}
 
 	fmt.Printf("quotes: %+v\n", quotes)
 }
 
-//func TestGetHistory(t *testing.T) {
-//	startDate, err := time.Parse(dateFmt, "2011-11-26")
-//	endDate, err := time.Parse(dateFmt, "2013-12-25")
-//	res, err := GetHistory("MSFT", startDate, endDate)
-//	if err != nil {
-//		t.Fatal(err)
-//		return
-//	}
-
-//	//_ = res
-//	for _, r := range res {
-//		fmt.Println(r.Date)
-//	}
-//}
+func TestGetHistory(t *testing.T) {
+	// Spans two yearly queries:
+	startDate, _ := time.Parse(dateFmt, "2012-12-20")
+	endDate, _ := time.Parse(dateFmt, "2013-12-25")
+	res, err := GetHistory("MSFT", startDate, endDate)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(res) == 0 {
+		t.Fatal("expected history")
+		return
+	}
+
+	// Results from all queries must be in descending date order:
+	for i := 1; i < len(res); i++ {
+		if res[i-1].Date <= res[i].Date {
+			t.Fatalf("dates out of order: %s before %s", res[i-1].Date, res[i].Date)
+		}
+	}
+
+	for _, r := range res {
+		fmt.Println(r.Date)
+	}
+}